@@ -0,0 +1,251 @@
+// Package converge waits for a myco cluster to agree: every node knows every
+// deployed service and, where 'myco status' reports peer health, reaches
+// every other node. It polls with backoff until a deadline and says which
+// nodes lag and by how much when the cluster does not get there; Diff then
+// shows which service records and peers the nodes disagree on.
+package converge
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Node is one daemon to poll.
+type Node struct {
+	Name string
+	// Dir is the node's state dir, where status runs.
+	Dir    string
+	Socket string
+	// PID, when set, is checked on every poll so a crashed daemon fails the
+	// wait at once instead of at the deadline.
+	PID int
+}
+
+// Waiter polls Nodes through Bin until they converge or ctx ends.
+type Waiter struct {
+	Bin   string
+	Nodes []Node
+	// Services is how many services every node must know.
+	Services int
+	// RequirePeerHealth makes a node whose status has no peer lines lag,
+	// so connectivity cannot pass unchecked. Without it peer health is
+	// checked only once some node reports it.
+	RequirePeerHealth bool
+	// StatusTimeout bounds each status call.
+	StatusTimeout time.Duration
+	// The wait between polls starts at MinInterval and doubles up to
+	// MaxInterval.
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// Log, when set, gets one line per poll.
+	Log io.Writer
+}
+
+// NodeState is what one node reported on the last poll.
+type NodeState struct {
+	Name string `json:"name"`
+	// Known is services_known, or -1 when status did not answer.
+	Known    int `json:"services_known"`
+	Expected int `json:"services_expected"`
+	Behind   int `json:"services_behind"`
+	// Reachable is the reachable peers, or -1 when status does not report
+	// per-peer health.
+	Reachable int `json:"peers_reachable"`
+	Peers     int `json:"peers_expected"`
+	// NoPeerHealth is set when peer health is required and status did not
+	// report it.
+	NoPeerHealth bool `json:"no_peer_health,omitempty"`
+	Dead         bool `json:"dead,omitempty"`
+	// Error is why status did not answer.
+	Error string `json:"error,omitempty"`
+}
+
+// Converged says whether the node has caught up.
+func (s NodeState) Converged() bool {
+	return !s.Dead && !s.NoPeerHealth && s.Known >= 0 && s.Behind == 0 && (s.Reachable < 0 || s.Reachable == s.Peers)
+}
+
+func (s NodeState) String() string {
+	switch {
+	case s.Dead:
+		return s.Name + ": daemon died"
+	case s.Known < 0:
+		return fmt.Sprintf("%s: no status (%s)", s.Name, s.Error)
+	}
+	msg := fmt.Sprintf("%s: %d/%d services", s.Name, s.Known, s.Expected)
+	if s.Behind > 0 {
+		msg += fmt.Sprintf(" (%d behind)", s.Behind)
+	}
+	if s.Reachable >= 0 {
+		msg += fmt.Sprintf(", %d/%d peers reachable", s.Reachable, s.Peers)
+	}
+	if s.NoPeerHealth {
+		msg += ", no peer health reported"
+	}
+	return msg
+}
+
+// Report is the outcome of a wait, as of its last poll.
+type Report struct {
+	Converged bool    `json:"converged"`
+	Polls     int     `json:"polls"`
+	Seconds   float64 `json:"elapsed_sec"`
+	// PeerHealth is whether any node reported per-peer health; until one
+	// does, connectivity is not checked.
+	PeerHealth bool        `json:"peer_health"`
+	Nodes      []NodeState `json:"nodes"`
+	// Divergence is where the nodes' persisted service records disagree,
+	// filled in by the caller when the wait fails.
+	Divergence []Divergence `json:"divergence,omitempty"`
+}
+
+// Lagging lists the nodes that have not caught up.
+func (r Report) Lagging() []NodeState {
+	var lagging []NodeState
+	for _, n := range r.Nodes {
+		if !n.Converged() {
+			lagging = append(lagging, n)
+		}
+	}
+	return lagging
+}
+
+// Summary is the lagging nodes on one line, e.g. for an error message.
+func (r Report) Summary() string {
+	var parts []string
+	for _, n := range r.Lagging() {
+		parts = append(parts, n.String())
+	}
+	return strings.Join(parts, "; ")
+}
+
+// ErrDied is returned when a daemon exits during the wait.
+var ErrDied = errors.New("daemon died")
+
+// Wait polls until every node has converged, a daemon dies or ctx ends. The
+// report is filled in either way; the error says why the wait gave up.
+func (w Waiter) Wait(ctx context.Context) (Report, error) {
+	start := time.Now()
+	interval := w.MinInterval
+	var report Report
+	for {
+		report.Polls++
+		report.Nodes = report.Nodes[:0]
+		converged := true
+		for _, n := range w.Nodes {
+			state := w.poll(ctx, n, &report.PeerHealth)
+			if state.Dead {
+				report.Nodes = append(report.Nodes, state)
+				report.Seconds = time.Since(start).Seconds()
+				return report, fmt.Errorf("%s (pid %d): %w", n.Name, n.PID, ErrDied)
+			}
+			report.Nodes = append(report.Nodes, state)
+			converged = converged && state.Converged()
+		}
+		// A node can look converged before any peer health appeared.
+		if converged && report.PeerHealth {
+			for _, s := range report.Nodes {
+				converged = converged && s.Reachable >= 0
+			}
+		}
+		report.Seconds = time.Since(start).Seconds()
+		if converged {
+			report.Converged = true
+			return report, nil
+		}
+		if w.Log != nil {
+			fmt.Fprintf(w.Log, "poll %d (%.0fs): %s\n", report.Polls, report.Seconds, report.Summary())
+		}
+		select {
+		case <-ctx.Done():
+			return report, fmt.Errorf("not converged after %.0fs: %w", report.Seconds, ctx.Err())
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > w.MaxInterval {
+			interval = w.MaxInterval
+		}
+	}
+}
+
+// poll asks n for its status. peerHealth is set, for good, once a node
+// reports per-peer health.
+func (w Waiter) poll(ctx context.Context, n Node, peerHealth *bool) NodeState {
+	state := NodeState{Name: n.Name, Known: -1, Expected: w.Services, Behind: w.Services, Reachable: -1, Peers: len(w.Nodes) - 1}
+	if n.PID > 0 && !alive(n.PID) {
+		state.Dead = true
+		return state
+	}
+	out, err := w.status(ctx, n)
+	known, reachable, reported := parseStatus(out)
+	if known < 0 {
+		state.Error = "services_known missing"
+		if err != nil {
+			state.Error = err.Error()
+		}
+		return state
+	}
+	state.Known = known
+	if state.Behind = w.Services - known; state.Behind < 0 {
+		state.Behind = 0
+	}
+	if reported {
+		*peerHealth = true
+	}
+	state.NoPeerHealth = w.RequirePeerHealth && !reported
+	if *peerHealth {
+		state.Reachable = reachable
+	}
+	return state
+}
+
+// alive says whether process pid still exists.
+func alive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	return err == nil && p.Signal(syscall.Signal(0)) == nil
+}
+
+// status runs 'myco status' against n.
+func (w Waiter) status(ctx context.Context, n Node) (string, error) {
+	if w.StatusTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.StatusTimeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, w.Bin, "status")
+	cmd.Dir = n.Dir
+	cmd.Env = append(os.Environ(), "MYCO_STATE_DIR="+n.Dir, "MYCO_UDS_PATH="+n.Socket)
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// parseStatus reads services_known and the reachable peers from status
+// output; known is -1 when absent and reported says whether any peer lines
+// were there.
+func parseStatus(out string) (known, reachable int, reported bool) {
+	known = -1
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) >= 2 && fields[0] == "services_known" && known < 0:
+			if n, err := strconv.Atoi(fields[1]); err == nil {
+				known = n
+			}
+		case len(fields) >= 1 && fields[0] == "peer":
+			reported = true
+			if len(fields) >= 3 && fields[2] == "reachable" {
+				reachable++
+			}
+		}
+	}
+	return known, reachable, reported
+}
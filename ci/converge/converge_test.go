@@ -0,0 +1,176 @@
+package converge
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		name          string
+		out           string
+		wantKnown     int
+		wantReachable int
+		wantReported  bool
+	}{
+		{"services and peers", "services_known 3\npeer n2 reachable\npeer n3 unreachable\n", 3, 1, true},
+		{"no peer lines", "services_known 5\nservices_pending 0\n", 5, 0, false},
+		{"peer line without a state", "services_known 1\npeer n2\n", 1, 0, true},
+		{"first services_known wins", "services_known 2\nservices_known 9\n", 2, 0, false},
+		{"count not a number", "services_known many\n", -1, 0, false},
+		{"no services_known", "error: connection refused\n", -1, 0, false},
+		{"empty", "", -1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			known, reachable, reported := parseStatus(tt.out)
+			if known != tt.wantKnown || reachable != tt.wantReachable || reported != tt.wantReported {
+				t.Errorf("parseStatus = (%d, %d, %v), want (%d, %d, %v)",
+					known, reachable, reported, tt.wantKnown, tt.wantReachable, tt.wantReported)
+			}
+		})
+	}
+}
+
+// fakeMyco writes script as a stand-in for the myco binary. Status runs it
+// in the node's dir; most tests have it print the file at MYCO_UDS_PATH, so
+// each node's output is set by writing its socket.
+func fakeMyco(t *testing.T, script string) string {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), "myco")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return bin
+}
+
+// statusNodes makes one node per output, each answering status with it.
+func statusNodes(t *testing.T, outputs ...string) []Node {
+	t.Helper()
+	var nodes []Node
+	for i, out := range outputs {
+		dir := t.TempDir()
+		socket := filepath.Join(dir, "status.txt")
+		if err := os.WriteFile(socket, []byte(out), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, Node{Name: "n" + string(rune('1'+i)), Dir: dir, Socket: socket})
+	}
+	return nodes
+}
+
+func testWaiter(bin string, nodes []Node, services int) Waiter {
+	return Waiter{Bin: bin, Nodes: nodes, Services: services, MinInterval: time.Millisecond, MaxInterval: 5 * time.Millisecond}
+}
+
+// cancelOnLog cancels the wait when the first poll that did not converge is
+// logged, so the report holds that poll however slow status is.
+type cancelOnLog context.CancelFunc
+
+func (c cancelOnLog) Write(p []byte) (int, error) {
+	c()
+	return len(p), nil
+}
+
+// waitOnePoll runs w until its first poll that does not converge.
+func waitOnePoll(w Waiter) (Report, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.Log = cancelOnLog(cancel)
+	return w.Wait(ctx)
+}
+
+func TestWaitConvergesOnceEveryNodeCatchesUp(t *testing.T) {
+	// Each status call knows one more service than the last.
+	bin := fakeMyco(t, `n=$(cat count 2>/dev/null || echo 0)
+n=$((n + 1))
+echo "$n" >count
+echo "services_known $n"
+`)
+	nodes := statusNodes(t, "", "")
+	report, err := testWaiter(bin, nodes, 3).Wait(context.Background())
+	if err != nil {
+		t.Fatalf("Wait: %v (%s)", err, report.Summary())
+	}
+	if !report.Converged || report.Polls != 3 {
+		t.Errorf("report = converged %v after %d polls, want converged after 3", report.Converged, report.Polls)
+	}
+	if report.PeerHealth {
+		t.Error("PeerHealth set without any peer lines")
+	}
+}
+
+func TestWaitGivesUpOnLaggingNodes(t *testing.T) {
+	bin := fakeMyco(t, `cat "$MYCO_UDS_PATH"`)
+	tests := []struct {
+		name        string
+		outputs     []string
+		requirePeer bool
+		want        string
+	}{
+		{"behind", []string{"services_known 3\n", "services_known 1\n"}, false, "n2: 1/3 services (2 behind)"},
+		{"no status", []string{"services_known 3\n", "connection refused\n"}, false, "n2: no status (services_known missing)"},
+		{"peer unreachable", []string{
+			"services_known 3\npeer n2 reachable\n",
+			"services_known 3\npeer n1 unreachable\n",
+		}, false, "n2: 3/3 services, 0/1 peers reachable"},
+		{"peer health required", []string{"services_known 3\n", "services_known 3\n"}, true,
+			"n1: 3/3 services, no peer health reported; n2: 3/3 services, no peer health reported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := testWaiter(bin, statusNodes(t, tt.outputs...), 3)
+			w.RequirePeerHealth = tt.requirePeer
+			report, err := waitOnePoll(w)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("err = %v, want the wait cancelled", err)
+			}
+			if report.Converged {
+				t.Error("report says converged")
+			}
+			if got := report.Summary(); got != tt.want {
+				t.Errorf("Summary = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestWaitNeedsPeerHealthFromEveryNode checks a node that stays silent on
+// peers holds the wait once another node has reported them.
+func TestWaitNeedsPeerHealthFromEveryNode(t *testing.T) {
+	bin := fakeMyco(t, `cat "$MYCO_UDS_PATH"`)
+	nodes := statusNodes(t, "services_known 1\npeer n2 reachable\n", "services_known 1\n")
+	report, err := waitOnePoll(testWaiter(bin, nodes, 1))
+	if err == nil || report.Converged {
+		t.Fatalf("converged with n2 reporting no peers: %+v", report)
+	}
+	if !report.PeerHealth {
+		t.Error("PeerHealth not set after n1 reported peers")
+	}
+}
+
+func TestWaitStopsWhenADaemonDies(t *testing.T) {
+	bin := fakeMyco(t, `cat "$MYCO_UDS_PATH"`)
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	nodes := statusNodes(t, "services_known 0\n", "services_known 0\n")
+	nodes[1].PID = exited.Process.Pid
+
+	report, err := testWaiter(bin, nodes, 1).Wait(context.Background())
+	if !errors.Is(err, ErrDied) {
+		t.Fatalf("err = %v, want ErrDied", err)
+	}
+	if report.Polls != 1 {
+		t.Errorf("Polls = %d, want the wait to stop on the first poll", report.Polls)
+	}
+	if got, want := report.Summary(), "n1: 0/1 services (1 behind); n2: daemon died"; got != want {
+		t.Errorf("Summary = %q, want %q", got, want)
+	}
+}
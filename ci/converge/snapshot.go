@@ -0,0 +1,262 @@
+package converge
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Snapshot is the service records one node has persisted, as read from
+// DIR/services/NAME.json in its state dir, and its peers.list.
+type Snapshot struct {
+	Node string
+	// Services maps each service name to its record's fields, compacted so
+	// equal values compare equal however the node indented them.
+	Services map[string]map[string]string
+	// Peers maps each peer's public key to its address, as 'myco peer add'
+	// wrote them.
+	Peers map[string]string
+	// Error is why the state dir could not be read.
+	Error string
+}
+
+// TakeSnapshot reads n's service records and peers. A node with no
+// services dir or peers.list yet has none, which is not an error.
+func TakeSnapshot(n Node) Snapshot {
+	snap := Snapshot{Node: n.Name, Services: map[string]map[string]string{}, Peers: map[string]string{}}
+	peers, err := readPeers(filepath.Join(n.Dir, "peers.list"))
+	if err != nil {
+		snap.Error = err.Error()
+		return snap
+	}
+	snap.Peers = peers
+	dir := filepath.Join(n.Dir, "services")
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return snap
+	}
+	if err != nil {
+		snap.Error = err.Error()
+		return snap
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		fields, err := readRecord(filepath.Join(dir, e.Name()))
+		if err != nil {
+			snap.Error = err.Error()
+			return snap
+		}
+		snap.Services[name] = fields
+	}
+	return snap
+}
+
+// readPeers reads peers.list, one "KEY ADDRESS" line per peer.
+func readPeers(path string) (map[string]string, error) {
+	peers := map[string]string{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return peers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if key, addr, ok := strings.Cut(strings.TrimSpace(line), " "); ok {
+			peers[key] = addr
+		}
+	}
+	return peers, nil
+}
+
+func readRecord(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	fields := make(map[string]string, len(raw))
+	for k, v := range raw {
+		var buf bytes.Buffer
+		if json.Compact(&buf, v) != nil {
+			buf.Reset()
+			buf.Write(v)
+		}
+		fields[k] = buf.String()
+	}
+	return fields, nil
+}
+
+// Divergence is one place where nodes disagree: a field of a service record,
+// or, with Field empty, whether the node has the record at all. With Peer
+// set it is the address the nodes list for that peer instead.
+type Divergence struct {
+	Service string `json:"service,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Peer    string `json:"peer,omitempty"`
+	// Values maps each node to what it holds: "present" or "(missing)" for
+	// a record, the field's JSON or "(unset)" for a field, the address or
+	// "(missing)" for a peer.
+	Values map[string]string `json:"values"`
+}
+
+const (
+	missingRecord = "(missing)"
+	unsetField    = "(unset)"
+)
+
+// String groups the nodes by value, the most common first, e.g.
+// "web-3.version: 2 on n1,n2; 1 on n3".
+func (d Divergence) String() string {
+	byValue := map[string][]string{}
+	for node, v := range d.Values {
+		byValue[v] = append(byValue[v], node)
+	}
+	values := make([]string, 0, len(byValue))
+	for v, nodes := range byValue {
+		sort.Strings(nodes)
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		a, b := byValue[values[i]], byValue[values[j]]
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a[0] < b[0]
+	})
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%s on %s", v, strings.Join(byValue[values[i]], ","))
+	}
+	what := d.Service
+	if d.Field != "" {
+		what += "." + d.Field
+	}
+	if d.Peer != "" {
+		what = "peer " + d.Peer
+	}
+	return what + ": " + strings.Join(parts, "; ")
+}
+
+// Diff compares the snapshots field by field and lists where they disagree,
+// by service then field, then the peers. Snapshots with an Error are left
+// out.
+func Diff(snaps []Snapshot) []Divergence {
+	var ok []Snapshot
+	services := map[string]bool{}
+	for _, s := range snaps {
+		if s.Error != "" {
+			continue
+		}
+		ok = append(ok, s)
+		for name := range s.Services {
+			services[name] = true
+		}
+	}
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var diffs []Divergence
+	for _, name := range names {
+		present := Divergence{Service: name, Values: map[string]string{}}
+		fields := map[string]bool{}
+		holders := 0
+		for _, s := range ok {
+			rec, has := s.Services[name]
+			present.Values[s.Node] = missingRecord
+			if !has {
+				continue
+			}
+			present.Values[s.Node] = "present"
+			holders++
+			for f := range rec {
+				fields[f] = true
+			}
+		}
+		if holders < len(ok) {
+			diffs = append(diffs, present)
+		}
+		diffs = append(diffs, fieldDiffs(ok, name, fields)...)
+	}
+	return append(diffs, peerDiffs(ok)...)
+}
+
+// peerDiffs lists the peers the nodes list at different addresses, and
+// those fewer than all nodes but one list: a node does not list itself.
+func peerDiffs(snaps []Snapshot) []Divergence {
+	keys := map[string]bool{}
+	for _, s := range snaps {
+		for key := range s.Peers {
+			keys[key] = true
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	var diffs []Divergence
+	for _, key := range sorted {
+		d := Divergence{Peer: key, Values: map[string]string{}}
+		addrs := map[string]bool{}
+		listed := 0
+		for _, s := range snaps {
+			addr, has := s.Peers[key]
+			if !has {
+				d.Values[s.Node] = missingRecord
+				continue
+			}
+			d.Values[s.Node] = addr
+			addrs[addr] = true
+			listed++
+		}
+		if len(addrs) > 1 || listed < len(snaps)-1 {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs
+}
+
+// fieldDiffs compares service name's fields across the nodes that hold it.
+func fieldDiffs(snaps []Snapshot, name string, fields map[string]bool) []Divergence {
+	keys := make([]string, 0, len(fields))
+	for f := range fields {
+		keys = append(keys, f)
+	}
+	sort.Strings(keys)
+	var diffs []Divergence
+	for _, f := range keys {
+		d := Divergence{Service: name, Field: f, Values: map[string]string{}}
+		distinct := map[string]bool{}
+		for _, s := range snaps {
+			rec, has := s.Services[name]
+			if !has {
+				continue
+			}
+			v, set := rec[f]
+			if !set {
+				v = unsetField
+			}
+			d.Values[s.Node] = v
+			distinct[v] = true
+		}
+		if len(distinct) > 1 {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs
+}
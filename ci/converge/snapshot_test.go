@@ -0,0 +1,113 @@
+package converge
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func snap(node string, services map[string]map[string]string, peers map[string]string) Snapshot {
+	return Snapshot{Node: node, Services: services, Peers: peers}
+}
+
+func TestDiff(t *testing.T) {
+	web1 := map[string]string{"id": "1", "version": "2"}
+	// n1 lists n2 and n3, n2 lists n1 and n3, n3 lists n1 and n2.
+	mesh := []map[string]string{
+		{"k2": "10.0.0.2:7000", "k3": "10.0.0.3:7000"},
+		{"k1": "10.0.0.1:7000", "k3": "10.0.0.3:7000"},
+		{"k1": "10.0.0.1:7000", "k2": "10.0.0.2:7000"},
+	}
+	tests := []struct {
+		name  string
+		snaps []Snapshot
+		want  []string
+	}{
+		{"agree", []Snapshot{
+			snap("n1", map[string]map[string]string{"web": web1}, mesh[0]),
+			snap("n2", map[string]map[string]string{"web": web1}, mesh[1]),
+			snap("n3", map[string]map[string]string{"web": web1}, mesh[2]),
+		}, nil},
+		{"service added on one node", []Snapshot{
+			snap("n1", map[string]map[string]string{"web": web1, "db": {"id": "2"}}, nil),
+			snap("n2", map[string]map[string]string{"web": web1}, nil),
+		}, []string{"db: present on n1; (missing) on n2"}},
+		{"service removed from one node", []Snapshot{
+			snap("n1", map[string]map[string]string{"web": web1}, nil),
+			snap("n2", map[string]map[string]string{"web": web1}, nil),
+			snap("n3", map[string]map[string]string{}, nil),
+		}, []string{"web: present on n1,n2; (missing) on n3"}},
+		{"service field changed", []Snapshot{
+			snap("n1", map[string]map[string]string{"web": web1}, nil),
+			snap("n2", map[string]map[string]string{"web": web1}, nil),
+			snap("n3", map[string]map[string]string{"web": {"id": "1", "version": "1"}}, nil),
+		}, []string{"web.version: 2 on n1,n2; 1 on n3"}},
+		{"service field unset", []Snapshot{
+			snap("n1", map[string]map[string]string{"web": web1}, nil),
+			snap("n2", map[string]map[string]string{"web": {"id": "1"}}, nil),
+		}, []string{"web.version: 2 on n1; (unset) on n2"}},
+		{"peer added on one node", []Snapshot{
+			snap("n1", nil, map[string]string{"k2": "10.0.0.2:7000", "k3": "10.0.0.3:7000", "k9": "10.0.0.9:7000"}),
+			snap("n2", nil, mesh[1]),
+			snap("n3", nil, mesh[2]),
+		}, []string{"peer k9: (missing) on n2,n3; 10.0.0.9:7000 on n1"}},
+		{"peer removed from one node", []Snapshot{
+			snap("n1", nil, map[string]string{"k2": "10.0.0.2:7000"}),
+			snap("n2", nil, mesh[1]),
+			snap("n3", nil, mesh[2]),
+		}, []string{"peer k3: (missing) on n1,n3; 10.0.0.3:7000 on n2"}},
+		{"peer address changed", []Snapshot{
+			snap("n1", nil, mesh[0]),
+			snap("n2", nil, map[string]string{"k1": "10.0.0.1:7001", "k3": "10.0.0.3:7000"}),
+			snap("n3", nil, mesh[2]),
+		}, []string{"peer k1: (missing) on n1; 10.0.0.1:7001 on n2; 10.0.0.1:7000 on n3"}},
+		{"unreadable node left out", []Snapshot{
+			snap("n1", map[string]map[string]string{"web": web1}, nil),
+			snap("n2", map[string]map[string]string{"web": web1}, nil),
+			{Node: "n3", Error: "permission denied"},
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, d := range Diff(tt.snaps) {
+				got = append(got, d.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff =\n  %q\nwant\n  %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "services"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"services/web.json":  "{\n  \"id\": 1,\n  \"tags\": [ \"a\", \"b\" ]\n}\n",
+		"services/notes.txt": "not a record",
+		"peers.list":         "k2 10.0.0.2:7000\nk3 10.0.0.3:7000\n\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := TakeSnapshot(Node{Name: "n1", Dir: dir})
+	want := Snapshot{
+		Node:     "n1",
+		Services: map[string]map[string]string{"web": {"id": "1", "tags": `["a","b"]`}},
+		Peers:    map[string]string{"k2": "10.0.0.2:7000", "k3": "10.0.0.3:7000"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TakeSnapshot = %+v, want %+v", got, want)
+	}
+
+	empty := TakeSnapshot(Node{Name: "n2", Dir: t.TempDir()})
+	if empty.Error != "" || len(empty.Services) != 0 || len(empty.Peers) != 0 {
+		t.Errorf("fresh state dir: %+v, want an empty snapshot", empty)
+	}
+}
@@ -0,0 +1,289 @@
+// Command myco-evil-peer is a hostile UDP peer used by the CI scenarios. It
+// sits between two daemons to capture real frames and plays them back later.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// packetSize matches the fixed 1024-byte Packet in src/packet.zig.
+const packetSize = 1024
+
+// msgTypeOffset is the byte offset of Packet.msg_type (after magic and version).
+const msgTypeOffset = 3
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "proxy":
+		err = runProxy(os.Args[2:])
+	case "replay":
+		err = runReplay(os.Args[2:])
+	case "fuzz":
+		err = runFuzz(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "myco-evil-peer %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: myco-evil-peer <command> [flags]
+
+Commands:
+  proxy   Forward frames to a daemon and capture the first matching one
+  replay  Send a captured frame to a daemon repeatedly
+  fuzz    Send random and mutated frames until a daemon dies or time runs out`)
+}
+
+func runProxy(args []string) error {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:19999", "address to receive frames on")
+	to := fs.String("to", "", "daemon address to forward frames to")
+	out := fs.String("out", "frame.bin", "file the captured frame is written to (empty disables capture)")
+	msgType := fs.Int("type", -1, "only capture frames with this msg_type (-1 for any)")
+	timeout := fs.Duration("timeout", 60*time.Second, "give up if nothing is captured in time")
+	countFile := fs.String("count-file", "", "file kept updated with the number of frames forwarded")
+	fs.Parse(args)
+
+	if *to == "" {
+		return errors.New("-to is required")
+	}
+	dst, err := net.ResolveUDPAddr("udp", *to)
+	if err != nil {
+		return err
+	}
+	conn, err := listenUDP(*listen)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Forwarding keeps the cluster converging while we wait for a frame, and
+	// continues after the capture so the proxied link stays healthy.
+	// Without a capture target the proxy is only a relay or traffic meter.
+	captured := *out == ""
+	forwarded := 0
+	deadline := time.Now().Add(*timeout)
+	buf := make([]byte, 2*packetSize)
+	for {
+		if !captured && time.Now().After(deadline) {
+			return fmt.Errorf("no frame captured within %s", *timeout)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		frame := buf[:n]
+		if _, err := conn.WriteToUDP(frame, dst); err != nil {
+			return err
+		}
+		forwarded++
+		if *countFile != "" {
+			if err := os.WriteFile(*countFile, []byte(fmt.Sprintf("%d\n", forwarded)), 0o644); err != nil {
+				return err
+			}
+		}
+		if captured || n != packetSize {
+			continue
+		}
+		if *msgType >= 0 && int(frame[msgTypeOffset]) != *msgType {
+			continue
+		}
+		if err := os.WriteFile(*out, frame, 0o600); err != nil {
+			return err
+		}
+		captured = true
+		fmt.Printf("captured msg_type=%d frame to %s\n", frame[msgTypeOffset], *out)
+	}
+}
+
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	in := fs.String("in", "frame.bin", "captured frame to replay")
+	to := fs.String("to", "", "daemon address to send the frame to")
+	count := fs.Int("count", 5, "number of times to send the frame")
+	interval := fs.Duration("interval", 100*time.Millisecond, "delay between sends")
+	fs.Parse(args)
+
+	if *to == "" {
+		return errors.New("-to is required")
+	}
+	frame, err := os.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+	dst, err := net.ResolveUDPAddr("udp", *to)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, dst)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for i := 0; i < *count; i++ {
+		if _, err := conn.Write(frame); err != nil {
+			return err
+		}
+		time.Sleep(*interval)
+	}
+	fmt.Printf("replayed %d bytes %d times to %s\n", len(frame), *count, *to)
+	return nil
+}
+
+// errDaemonDied is returned by fuzz once the monitored daemon has exited.
+var errDaemonDied = errors.New("daemon died")
+
+func runFuzz(args []string) error {
+	fs := flag.NewFlagSet("fuzz", flag.ExitOnError)
+	to := fs.String("to", "", "daemon address to send frames to")
+	pid := fs.Int("pid", 0, "daemon pid to monitor for crashes")
+	duration := fs.Duration("duration", 60*time.Second, "how long to fuzz")
+	out := fs.String("out", "crashes", "directory reproducers are written to")
+	corpus := fs.String("corpus", "", "optional captured frame to mutate")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "random seed")
+	keep := fs.Int("keep", 64, "recent inputs kept as reproducer candidates")
+	batch := fs.Int("batch", 16, "frames sent between liveness checks")
+	fs.Parse(args)
+
+	if *to == "" || *pid <= 0 {
+		return errors.New("-to and -pid are required")
+	}
+	var base []byte
+	if *corpus != "" {
+		frame, err := os.ReadFile(*corpus)
+		if err != nil {
+			return err
+		}
+		base = frame
+	}
+	dst, err := net.ResolveUDPAddr("udp", *to)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, dst)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	fmt.Printf("fuzzing %s for %s (seed=%d)\n", *to, *duration, *seed)
+	rng := rand.New(rand.NewSource(*seed))
+	recent := make([][]byte, 0, *keep)
+	sent := 0
+	deadline := time.Now().Add(*duration)
+	for time.Now().Before(deadline) {
+		for i := 0; i < *batch; i++ {
+			frame := fuzzFrame(rng, base)
+			if len(recent) == *keep {
+				recent = recent[1:]
+			}
+			recent = append(recent, frame)
+			// Send errors are expected (e.g. ECONNREFUSED after a crash).
+			conn.Write(frame)
+			sent++
+		}
+		// Give the daemon a poll interval to chew on the batch.
+		time.Sleep(20 * time.Millisecond)
+		if !processAlive(*pid) {
+			if err := writeReproducers(*out, recent, *seed); err != nil {
+				return err
+			}
+			fmt.Printf("daemon pid %d died after %d frames; %d reproducers in %s\n", *pid, sent, len(recent), *out)
+			return errDaemonDied
+		}
+	}
+	fmt.Printf("sent %d frames; daemon pid %d survived\n", sent, *pid)
+	return nil
+}
+
+// fuzzFrame returns either a mutation of base or a frame with a plausible
+// header and random body, so the parser past the magic check gets exercised.
+func fuzzFrame(rng *rand.Rand, base []byte) []byte {
+	if len(base) > 0 && rng.Intn(2) == 0 {
+		frame := append([]byte(nil), base...)
+		for i := rng.Intn(16) + 1; i > 0; i-- {
+			frame[rng.Intn(len(frame))] = byte(rng.Intn(256))
+		}
+		return frame
+	}
+
+	size := packetSize
+	if rng.Intn(10) == 0 {
+		size = rng.Intn(2 * packetSize)
+	}
+	frame := make([]byte, size)
+	rng.Read(frame)
+	if size >= 14 {
+		binary.LittleEndian.PutUint16(frame[0:2], 0x4d59)
+		frame[2] = 1
+		frame[msgTypeOffset] = byte(rng.Intn(6))
+		// payload_len sits at offset 12; bias it toward the interesting edges.
+		lens := []uint16{0, 8, 936, 937, 0xffff, uint16(rng.Intn(1024))}
+		binary.LittleEndian.PutUint16(frame[12:14], lens[rng.Intn(len(lens))])
+	}
+	return frame
+}
+
+func writeReproducers(dir string, frames [][]byte, seed int64) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for i, frame := range frames {
+		// Newest first: the last frame sent is the most likely culprit.
+		name := filepath.Join(dir, fmt.Sprintf("repro-%03d.bin", len(frames)-1-i))
+		if err := os.WriteFile(name, frame, 0o644); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(dir, "seed.txt"), []byte(fmt.Sprintf("%d\n", seed)), 0o644)
+}
+
+// processAlive reports whether pid is running. A crashed daemon stays a
+// zombie until the scenario shell reaps it, so a signal probe is not enough.
+func processAlive(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state follows the parenthesised command name: "pid (comm) S ...".
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 || end+2 >= len(stat) {
+		return false
+	}
+	state := stat[end+2]
+	return state != 'Z' && state != 'X'
+}
+
+func listenUDP(addr string) (*net.UDPConn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", laddr)
+}
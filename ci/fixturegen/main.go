@@ -0,0 +1,134 @@
+// Command myco-fixture writes myco.json service definitions for the CI
+// scenarios from the fixtures package, so shell scripts deploy the same
+// shapes the Go stages do.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"orchestrator-ci/ci/fixtures"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "services":
+		err = runServices(os.Args[2:])
+	case "service":
+		err = runService(os.Args[2:])
+	case "node-env":
+		err = runNodeEnv(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "myco-fixture %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: myco-fixture <command> [flags]
+
+Commands:
+  services FIRST_ID COUNT PREFIX  Print an array of COUNT services PREFIX-1..COUNT
+  service -id N -name NAME ...    Print one service object
+  node-env [-role R] IDX          Print scenario node IDX's environment`)
+}
+
+func runServices(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("want FIRST_ID COUNT PREFIX, got %d arguments", len(args))
+	}
+	first, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("FIRST_ID %q: %w", args[0], err)
+	}
+	count, err := strconv.Atoi(args[1])
+	if err != nil || count < 0 {
+		return fmt.Errorf("COUNT %q: want a non-negative number", args[1])
+	}
+	data, err := fixtures.Marshal(fixtures.Services(first, count, args[2]))
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func runService(args []string) error {
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	id := fs.Uint64("id", 0, "service id")
+	name := fs.String("name", "", "service name")
+	flake := fs.String("flake", "", "flake URI (default github:example/NAME)")
+	memoryMax := fs.String("memory-max", "", "MemoryMax for the unit, e.g. 64M")
+	cpuQuota := fs.String("cpu-quota", "", "CPUQuota for the unit, e.g. 50%")
+	dependsOn := fs.String("depends-on", "", "comma-separated services it depends on")
+	fs.Parse(args)
+
+	if *name == "" {
+		return fmt.Errorf("-name is required")
+	}
+	service := fixtures.Service(*id, *name)
+	if *flake != "" {
+		service.FlakeURI = *flake
+	}
+	service.MemoryMax = *memoryMax
+	service.CPUQuota = *cpuQuota
+	if *dependsOn != "" {
+		service.DependsOn = strings.Split(*dependsOn, ",")
+	}
+	data, err := fixtures.MarshalOne(service)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func runNodeEnv(args []string) error {
+	fs := flag.NewFlagSet("node-env", flag.ExitOnError)
+	role := fs.String("role", "daemon", "what the variables are for: daemon, cli or pubkey")
+	plaintext := fs.String("plaintext", "", "plaintext mode for a daemon: allow or force")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("want IDX, got %d arguments", fs.NArg())
+	}
+	idx, err := strconv.Atoi(fs.Arg(0))
+	if err != nil || idx < 0 {
+		return fmt.Errorf("IDX %q: want a non-negative number", fs.Arg(0))
+	}
+	node := fixtures.ScenarioNode(idx)
+	if *plaintext != "" && *role != "daemon" {
+		return fmt.Errorf("-plaintext applies to the daemon, not %s", *role)
+	}
+	switch *role {
+	case "daemon":
+		node.Plaintext = fixtures.Plaintext(*plaintext)
+	case "cli":
+		node = node.Client()
+	case "pubkey":
+		node = node.Identity()
+	default:
+		return fmt.Errorf("no role %q", *role)
+	}
+	env, err := node.Env()
+	if err != nil {
+		return err
+	}
+	for _, line := range fixtures.EnvLines(env) {
+		fmt.Println(line)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package fixtures
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// Where the scenario harness puts its nodes: node IDX keeps its state in
+// ScenarioStateRoot/nIDX+1 and listens on ScenarioPortBase+IDX.
+const (
+	ScenarioStateRoot = "/tmp/myco-scenario"
+	ScenarioPortBase  = 18777
+)
+
+// maxSocketPath is the longest path a unix socket can bind: sun_path is 108
+// bytes including the terminating NUL.
+const maxSocketPath = 107
+
+// Plaintext is how a node treats unencrypted packets.
+type Plaintext string
+
+const (
+	// PlaintextOff is the default: secure transport only.
+	PlaintextOff Plaintext = ""
+	// PlaintextAllow accepts plaintext peers next to secure ones.
+	PlaintextAllow Plaintext = "allow"
+	// PlaintextForce sends plaintext, and so also accepts it.
+	PlaintextForce Plaintext = "force"
+)
+
+// NodeConfig is the environment a myco process runs with, as src/main.zig
+// reads it. Zero fields are left unset, so the process falls back to its
+// own default:
+//
+//   - StateDir (MYCO_STATE_DIR): /var/lib/myco.
+//   - Port (MYCO_PORT): 7777.
+//   - NodeID (MYCO_NODE_ID): random, so peers cannot know the node's key;
+//     'pubkey' then reads the persistent node.key instead.
+//   - UDSPath (MYCO_UDS_PATH): /tmp/myco.sock, shared by every node.
+//   - Plaintext (MYCO_PACKET_ALLOW_PLAINTEXT, MYCO_PACKET_PLAINTEXT): off.
+type NodeConfig struct {
+	StateDir  string
+	Port      int
+	NodeID    int
+	UDSPath   string
+	Plaintext Plaintext
+}
+
+// ScenarioNode is the daemon config for scenario node idx (n1 is idx 0),
+// matching node_dir, node_port and node_sock in the scenario prelude.
+func ScenarioNode(idx int) NodeConfig {
+	dir := path.Join(ScenarioStateRoot, fmt.Sprintf("n%d", idx+1))
+	return NodeConfig{
+		StateDir: dir,
+		Port:     ScenarioPortBase + idx,
+		NodeID:   idx + 1,
+		UDSPath:  path.Join(dir, "myco.sock"),
+	}
+}
+
+// Validate rejects values the process would silently replace with its
+// default, and combinations that make nodes collide or unreachable.
+func (c NodeConfig) Validate() error {
+	switch {
+	case c.StateDir != "" && !path.IsAbs(c.StateDir):
+		return fmt.Errorf("state dir %q is relative; the CLI runs from other directories", c.StateDir)
+	case c.UDSPath != "" && !path.IsAbs(c.UDSPath):
+		return fmt.Errorf("socket %q is relative", c.UDSPath)
+	case len(c.UDSPath) > maxSocketPath:
+		return fmt.Errorf("socket %q is %d bytes; unix sockets take at most %d", c.UDSPath, len(c.UDSPath), maxSocketPath)
+	case c.Port < 0 || c.Port > 65535:
+		return fmt.Errorf("port %d is out of range", c.Port)
+	case c.NodeID < 0 || c.NodeID > 65535:
+		return fmt.Errorf("node id %d does not fit in 16 bits", c.NodeID)
+	case c.Port != 0 && c.UDSPath == "":
+		return fmt.Errorf("port %d without a socket would share /tmp/myco.sock with every other node", c.Port)
+	case c.Port != 0 && c.NodeID == 0:
+		return fmt.Errorf("port %d without a node id: peers cannot compute the node's key", c.Port)
+	}
+	switch c.Plaintext {
+	case PlaintextOff, PlaintextAllow, PlaintextForce:
+	default:
+		return fmt.Errorf("no plaintext mode %q", c.Plaintext)
+	}
+	return nil
+}
+
+// Env renders c as variables for a daemon.
+func (c NodeConfig) Env() (map[string]string, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	env := map[string]string{}
+	set := func(name, value string) {
+		if value != "" {
+			env[name] = value
+		}
+	}
+	set("MYCO_STATE_DIR", c.StateDir)
+	set("MYCO_UDS_PATH", c.UDSPath)
+	if c.Port != 0 {
+		env["MYCO_PORT"] = strconv.Itoa(c.Port)
+	}
+	if c.NodeID != 0 {
+		env["MYCO_NODE_ID"] = strconv.Itoa(c.NodeID)
+	}
+	switch c.Plaintext {
+	case PlaintextAllow:
+		env["MYCO_PACKET_ALLOW_PLAINTEXT"] = "1"
+	case PlaintextForce:
+		env["MYCO_PACKET_PLAINTEXT"] = "1"
+	}
+	return env, nil
+}
+
+// Client is c as the CLI needs it to reach the daemon: the state dir and
+// socket only, so commands like 'peer add' never pick up the node's id.
+func (c NodeConfig) Client() NodeConfig {
+	return NodeConfig{StateDir: c.StateDir, UDSPath: c.UDSPath}
+}
+
+// Identity is c as 'pubkey' needs it: the state dir and node id, which
+// together pick the key the daemon will use.
+func (c NodeConfig) Identity() NodeConfig {
+	return NodeConfig{StateDir: c.StateDir, NodeID: c.NodeID}
+}
+
+// EnvLines renders env as sorted NAME=VALUE lines, ready for env(1).
+func EnvLines(env map[string]string) []string {
+	lines := make([]string, 0, len(env))
+	for name, value := range env {
+		lines = append(lines, name+"="+value)
+	}
+	sort.Strings(lines)
+	return lines
+}
@@ -0,0 +1,97 @@
+package fixtures
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNodeConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		node NodeConfig
+		want string // substring of the error; empty for valid
+	}{
+		{"zero value", NodeConfig{}, ""},
+		{"scenario node", ScenarioNode(2), ""},
+		{"forced plaintext", NodeConfig{Plaintext: PlaintextForce}, ""},
+		{"relative state dir", NodeConfig{StateDir: "n1"}, "is relative; the CLI"},
+		{"relative socket", NodeConfig{UDSPath: "n1/myco.sock"}, `socket "n1/myco.sock" is relative`},
+		{"socket too long", NodeConfig{UDSPath: "/" + strings.Repeat("s", maxSocketPath)}, "unix sockets take at most 107"},
+		{"negative port", NodeConfig{Port: -1}, "port -1 is out of range"},
+		{"port too high", NodeConfig{Port: 65536}, "port 65536 is out of range"},
+		{"node id too high", NodeConfig{NodeID: 65536}, "does not fit in 16 bits"},
+		{"port without socket", NodeConfig{Port: 7777, NodeID: 1}, "share /tmp/myco.sock"},
+		{"port without node id", NodeConfig{Port: 7777, UDSPath: "/tmp/n1.sock"}, "peers cannot compute"},
+		{"unknown plaintext mode", NodeConfig{Plaintext: "sometimes"}, `no plaintext mode "sometimes"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.node.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("Validate() = %v, want nil", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("Validate() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodeConfigEnv(t *testing.T) {
+	node := ScenarioNode(1)
+	allow := node
+	allow.Plaintext = PlaintextAllow
+	force := node
+	force.Plaintext = PlaintextForce
+	tests := []struct {
+		name string
+		node NodeConfig
+		want []string
+	}{
+		{"zero value", NodeConfig{}, []string{}},
+		{"daemon", node, []string{
+			"MYCO_NODE_ID=2",
+			"MYCO_PORT=18778",
+			"MYCO_STATE_DIR=/tmp/myco-scenario/n2",
+			"MYCO_UDS_PATH=/tmp/myco-scenario/n2/myco.sock",
+		}},
+		{"allow plaintext", allow, []string{
+			"MYCO_NODE_ID=2",
+			"MYCO_PACKET_ALLOW_PLAINTEXT=1",
+			"MYCO_PORT=18778",
+			"MYCO_STATE_DIR=/tmp/myco-scenario/n2",
+			"MYCO_UDS_PATH=/tmp/myco-scenario/n2/myco.sock",
+		}},
+		{"force plaintext", force, []string{
+			"MYCO_NODE_ID=2",
+			"MYCO_PACKET_PLAINTEXT=1",
+			"MYCO_PORT=18778",
+			"MYCO_STATE_DIR=/tmp/myco-scenario/n2",
+			"MYCO_UDS_PATH=/tmp/myco-scenario/n2/myco.sock",
+		}},
+		{"client", node.Client(), []string{
+			"MYCO_STATE_DIR=/tmp/myco-scenario/n2",
+			"MYCO_UDS_PATH=/tmp/myco-scenario/n2/myco.sock",
+		}},
+		{"identity", node.Identity(), []string{
+			"MYCO_NODE_ID=2",
+			"MYCO_STATE_DIR=/tmp/myco-scenario/n2",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, err := tt.node.Env()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := EnvLines(env); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("EnvLines(Env()) = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := (NodeConfig{Port: 7777}).Env(); err == nil {
+		t.Error("Env() of an invalid config succeeded")
+	}
+}
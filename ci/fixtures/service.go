@@ -0,0 +1,66 @@
+// Package fixtures builds the myco.json service definitions the CI stages
+// deploy, so the integration test, the cluster smoke and the scenarios agree
+// on one shape instead of each writing JSON by hand. The historical files
+// under ci/fixtures/myco-json stay hand-written: they pin exactly what older
+// releases accepted.
+package fixtures
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ServiceDefinition is one service in myco.json, as 'myco deploy' reads it
+// (src/cli/deploy.zig). Fields left empty are omitted, leaving the daemon's
+// defaults: exec_name run, no limits.
+type ServiceDefinition struct {
+	ID   uint64 `json:"id,omitempty"`
+	Name string `json:"name"`
+	// FlakeURI or, in older files, Package names what to build.
+	FlakeURI string `json:"flake_uri,omitempty"`
+	Package  string `json:"package,omitempty"`
+	ExecName string `json:"exec_name,omitempty"`
+	// MemoryMax and CPUQuota are meant to become MemoryMax= and CPUQuota=
+	// in the unit; deploy does not read them yet.
+	MemoryMax string `json:"memory_max,omitempty"`
+	CPUQuota  string `json:"cpu_quota,omitempty"`
+	// DependsOn is not supported by deploy; scenarios use it to check what
+	// deploy does with the field.
+	DependsOn []string `json:"depends_on,omitempty"`
+}
+
+// Service is the usual test service: github:example/NAME, run by "run".
+func Service(id uint64, name string) ServiceDefinition {
+	return ServiceDefinition{ID: id, Name: name, FlakeURI: "github:example/" + name, ExecName: "run"}
+}
+
+// Services is count services PREFIX-1 … PREFIX-count with consecutive ids
+// from first.
+func Services(first uint64, count int, prefix string) []ServiceDefinition {
+	services := make([]ServiceDefinition, 0, count)
+	for i := 1; i <= count; i++ {
+		services = append(services, Service(first+uint64(i-1), fmt.Sprintf("%s-%d", prefix, i)))
+	}
+	return services
+}
+
+// Marshal renders services as a myco.json array.
+func Marshal(services []ServiceDefinition) ([]byte, error) {
+	if services == nil {
+		services = []ServiceDefinition{}
+	}
+	data, err := json.MarshalIndent(services, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// MarshalOne renders a single service as a myco.json object.
+func MarshalOne(service ServiceDefinition) ([]byte, error) {
+	data, err := json.MarshalIndent(service, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,66 @@
+package fixtures
+
+import "testing"
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []ServiceDefinition
+		want     string
+	}{
+		{"nil is an empty array", nil, "[]\n"},
+		{"empty fields omitted", []ServiceDefinition{{Name: "bare"}}, `[
+  {
+    "name": "bare"
+  }
+]
+`},
+		{"usual service", Services(4, 1, "web"), `[
+  {
+    "id": 4,
+    "name": "web-1",
+    "flake_uri": "github:example/web-1",
+    "exec_name": "run"
+  }
+]
+`},
+		{"unsupported fields", []ServiceDefinition{{ID: 2, Name: "web", MemoryMax: "64M", CPUQuota: "50%", DependsOn: []string{"db"}}}, `[
+  {
+    "id": 2,
+    "name": "web",
+    "memory_max": "64M",
+    "cpu_quota": "50%",
+    "depends_on": [
+      "db"
+    ]
+  }
+]
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Marshal(tt.services)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("Marshal() =\n%s\nwant\n%s", data, tt.want)
+			}
+		})
+	}
+
+	one, err := MarshalOne(Service(1, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "id": 1,
+  "name": "db",
+  "flake_uri": "github:example/db",
+  "exec_name": "run"
+}
+`
+	if string(one) != want {
+		t.Errorf("MarshalOne() =\n%s\nwant\n%s", one, want)
+	}
+}
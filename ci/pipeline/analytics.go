@@ -0,0 +1,214 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// stageHistoryPath is the JSON-lines history of stage outcomes. Like the
+// size history it is shared by all runs and carried between CI jobs by the
+// workflow cache; MYCO_STAGE_HISTORY points at a copy to start from when it
+// does not exist yet.
+var stageHistoryPath = filepath.Join("build", "stage-history.jsonl")
+
+// defaultReportRuns is how many recent runs the stage report covers.
+const defaultReportRuns = 50
+
+const (
+	outcomePassed  = "passed"
+	outcomeFailed  = "failed"
+	outcomeWarned  = "warned"
+	outcomeSkipped = "skipped"
+)
+
+type stageRecord struct {
+	RunID   string    `json:"run_id"`
+	Commit  string    `json:"commit"`
+	At      time.Time `json:"at"`
+	Stage   string    `json:"stage"`
+	Outcome string    `json:"outcome"`
+	Seconds float64   `json:"seconds"`
+	// Attempts is set when a retry policy ran the stage more than once.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// recordStageHistory appends this run's stage outcomes to the history and
+// writes the report over the last defaultReportRuns runs to the run
+// directory and the GitHub job summary.
+func recordStageHistory(run runDir, p *perfRecorder) error {
+	outcomes := p.stageOutcomes()
+	if len(outcomes) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	for i := range outcomes {
+		outcomes[i].RunID = run.ID
+		outcomes[i].At = now
+	}
+	sort.Slice(outcomes, func(i, j int) bool { return outcomes[i].Stage < outcomes[j].Stage })
+	if err := appendHistory(stageHistoryPath, os.Getenv("MYCO_STAGE_HISTORY"), outcomes); err != nil {
+		return err
+	}
+	history, err := readStageHistory(stageHistoryPath)
+	if err != nil {
+		return err
+	}
+
+	report := renderStageReport(history, defaultReportRuns)
+	reportPath := run.path("stage-report.md")
+	if err := os.WriteFile(reportPath, []byte(report), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Stage history: %d records in %s, report in %s\n", len(history), stageHistoryPath, reportPath)
+	return appendStepSummary(report)
+}
+
+// RunReportCommand implements "ci report": it renders the stage report from
+// the history without running the pipeline, for the scheduled workflow.
+func RunReportCommand(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	history := fs.String("history", stageHistoryPath, "stage history file")
+	runs := fs.Int("runs", defaultReportRuns, "number of most recent runs to cover")
+	out := fs.String("o", "", "write the report here instead of stdout")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	records, err := readStageHistory(*history)
+	if err != nil {
+		return err
+	}
+	report := renderStageReport(records, *runs)
+	if *out != "" {
+		return os.WriteFile(*out, []byte(report), 0o644)
+	}
+	fmt.Print(report)
+	return appendStepSummary(report)
+}
+
+// readStageHistory loads a history file; a missing file is an empty history.
+func readStageHistory(path string) ([]stageRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var history []stageRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var r stageRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		history = append(history, r)
+	}
+	return history, scanner.Err()
+}
+
+// stageStats summarises one stage over the report window. A failure counts
+// as a flake when the same stage also passed on the same commit, since
+// nothing in the code under test changed between the two.
+type stageStats struct {
+	Stage    string
+	Runs     int
+	Failures int
+	Flakes   int
+	Warnings int
+	Skipped  int
+	Seconds  float64
+}
+
+// renderStageReport covers the last runs runs in history, most failing
+// stages first.
+func renderStageReport(history []stageRecord, runs int) string {
+	var order []string
+	seen := map[string]bool{}
+	for i := len(history) - 1; i >= 0 && len(order) < runs; i-- {
+		if id := history[i].RunID; !seen[id] {
+			seen[id] = true
+			order = append(order, id)
+		}
+	}
+
+	passedOn := map[string]bool{}
+	for _, r := range history {
+		if seen[r.RunID] && (r.Outcome == outcomePassed || r.Outcome == outcomeWarned) {
+			passedOn[r.Stage+"@"+r.Commit] = true
+		}
+	}
+	stats := map[string]*stageStats{}
+	for _, r := range history {
+		if !seen[r.RunID] {
+			continue
+		}
+		s := stats[r.Stage]
+		if s == nil {
+			s = &stageStats{Stage: r.Stage}
+			stats[r.Stage] = s
+		}
+		switch r.Outcome {
+		case outcomeSkipped:
+			s.Skipped++
+			continue
+		case outcomeFailed:
+			s.Failures++
+			if passedOn[r.Stage+"@"+r.Commit] {
+				s.Flakes++
+			}
+		case outcomeWarned:
+			s.Warnings++
+		}
+		s.Runs++
+		s.Seconds += r.Seconds
+	}
+
+	rows := make([]*stageStats, 0, len(stats))
+	for _, s := range stats {
+		rows = append(rows, s)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Failures != rows[j].Failures {
+			return rows[i].Failures > rows[j].Failures
+		}
+		return rows[i].Stage < rows[j].Stage
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "## Stage reliability (last %d runs)\n\n", len(order))
+	if len(rows) == 0 {
+		b.WriteString("No stage history recorded yet.\n")
+		return b.String()
+	}
+	b.WriteString("| stage | runs | failures | failure rate | flake rate | warnings | mean duration | skipped |\n|---|---:|---:|---:|---:|---:|---:|---:|\n")
+	for _, s := range rows {
+		mean := "-"
+		if s.Runs > 0 {
+			mean = fmt.Sprintf("%.1fs", s.Seconds/float64(s.Runs))
+		}
+		fmt.Fprintf(&b, "| %s | %d | %d | %s | %s | %d | %s | %d |\n",
+			s.Stage, s.Runs, s.Failures, percent(s.Failures, s.Runs), percent(s.Flakes, s.Runs), s.Warnings, mean, s.Skipped)
+	}
+	return b.String()
+}
+
+func percent(n, of int) string {
+	if of == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", 100*float64(n)/float64(of))
+}
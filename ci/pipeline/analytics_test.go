@@ -0,0 +1,79 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStageReportCountsFlakes(t *testing.T) {
+	history := []stageRecord{
+		{RunID: "old", Commit: "c0", Stage: "Cluster Smoke", Outcome: outcomeFailed, Seconds: 99},
+		{RunID: "a", Commit: "c1", Stage: "Cluster Smoke", Outcome: outcomeFailed, Seconds: 40},
+		{RunID: "b", Commit: "c1", Stage: "Cluster Smoke", Outcome: outcomePassed, Seconds: 20},
+		{RunID: "b", Commit: "c1", Stage: "Flamegraph", Outcome: outcomeSkipped},
+		{RunID: "b", Commit: "c1", Stage: "Release Comparison", Outcome: outcomeWarned, Seconds: 60},
+		{RunID: "c", Commit: "c2", Stage: "Cluster Smoke", Outcome: outcomeFailed, Seconds: 30},
+	}
+	report := renderStageReport(history, 3)
+	for _, want := range []string{
+		"last 3 runs",
+		"| Cluster Smoke | 3 | 2 | 67% | 33% | 0 | 30.0s | 0 |",
+		"| Flamegraph | 0 | 0 | - | - | 0 | - | 1 |",
+		"| Release Comparison | 1 | 0 | 0% | 0% | 1 | 60.0s | 0 |",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report is missing %q:\n%s", want, report)
+		}
+	}
+}
+
+func TestStageReportEmpty(t *testing.T) {
+	if report := renderStageReport(nil, 10); !strings.Contains(report, "No stage history") {
+		t.Errorf("unexpected empty report:\n%s", report)
+	}
+}
+
+func TestConcurrentRunsKeepEachOthersHistory(t *testing.T) {
+	t.Chdir(t.TempDir())
+	seed := filepath.Join(t.TempDir(), "seed.jsonl")
+	if err := os.WriteFile(seed, []byte(`{"run_id":"cached","stage":"Format","outcome":"passed"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MYCO_STAGE_HISTORY", seed)
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run := runDir{ID: fmt.Sprintf("r%d", i)}
+			if err := os.MkdirAll(run.path(), 0o755); err != nil {
+				t.Error(err)
+				return
+			}
+			p := newPerfRecorder("c1")
+			p.stage("Format", 0, nil)
+			p.stage("Unit Tests", 0, nil)
+			if err := recordStageHistory(run, p); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	history, err := readStageHistory(stageHistoryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := map[string]int{}
+	for _, r := range history {
+		runs[r.RunID]++
+	}
+	if len(history) != 41 || runs["cached"] != 1 || len(runs) != 21 {
+		t.Errorf("%d records from %d runs, want the seed's and two from each of 20 runs", len(history), len(runs))
+	}
+}
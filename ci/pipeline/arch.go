@@ -0,0 +1,59 @@
+package pipeline
+
+import (
+	"context"
+	"runtime"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// The engine's own platform is the native one: what the pipeline builds for
+// it can also run there. Every other platform is only cross-compiled, since
+// running its binaries takes qemu, which only the x86_64 runners register;
+// Graviton and Raspberry Pi hosts run the same ci binary without it.
+
+// defaultNativePlatform is assumed when the ci binary runs on an
+// architecture no release is built for.
+const defaultNativePlatform dagger.Platform = "linux/amd64"
+
+// hostPlatform guesses the native platform from the ci binary's own
+// architecture, for New and dry runs, which have no engine to ask.
+func hostPlatform() dagger.Platform {
+	p := dagger.Platform("linux/" + runtime.GOARCH)
+	if _, err := platformToZigTarget(p); err != nil {
+		return defaultNativePlatform
+	}
+	return p
+}
+
+// enginePlatform asks the engine for its platform, without a CPU variant
+// such as arm64's "/v8".
+func enginePlatform(ctx context.Context, client *dagger.Client) (dagger.Platform, error) {
+	platform, err := client.DefaultPlatform(ctx)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(string(platform), "/", 3)
+	if len(parts) < 2 {
+		return platform, nil
+	}
+	return dagger.Platform(parts[0] + "/" + parts[1]), nil
+}
+
+// emulates says whether an engine on native runs other platforms' binaries
+// under qemu.
+func emulates(native dagger.Platform) bool {
+	return native == "linux/amd64"
+}
+
+// crossPlatforms lists the platforms other than native.
+func crossPlatforms(platforms []dagger.Platform, native dagger.Platform) []string {
+	var cross []string
+	for _, p := range platforms {
+		if p != native {
+			cross = append(cross, string(p))
+		}
+	}
+	return cross
+}
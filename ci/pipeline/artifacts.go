@@ -0,0 +1,117 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// artifactManifestName is the file in the run directory that maps each
+// exported artifact to what it is. Release and packaging steps read it
+// instead of re-deriving artifact paths.
+const artifactManifestName = "manifest.json"
+
+var zonVersion = regexp.MustCompile(`\.version\s*=\s*"([^"]+)"`)
+
+// artifact describes one exported build output. Name is the file name in the
+// run directory and the manifest key.
+type artifact struct {
+	Name   string `json:"-"`
+	Target string `json:"target"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Commit string `json:"commit"`
+	// Channel is the release channel the artifact was built for, if any.
+	Channel string `json:"channel,omitempty"`
+}
+
+// artifactManifest maps artifact file name to its description.
+type artifactManifest map[string]artifact
+
+// projectVersion reads .version from build.zig.zon, or "0.0.0" if it has none.
+func projectVersion(zonPath string) (string, error) {
+	zon, err := os.ReadFile(zonPath)
+	if err != nil {
+		return "", err
+	}
+	if m := zonVersion.FindStringSubmatch(stripZonComments(string(zon))); m != nil {
+		return m[1], nil
+	}
+	return "0.0.0", nil
+}
+
+// artifactName is the exported file name for a release binary.
+func artifactName(version, target string) string {
+	return fmt.Sprintf("myco-%s-%s", version, target)
+}
+
+// describeArtifact hashes the exported file at path.
+func describeArtifact(path, target, commit string) (artifact, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return artifact{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return artifact{}, err
+	}
+	return artifact{
+		Name:   filepath.Base(path),
+		Target: target,
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+		Commit: commit,
+	}, nil
+}
+
+func writeArtifactManifest(run runDir, built []artifact) error {
+	m := artifactManifest{}
+	for _, a := range built {
+		m[a.Name] = a
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := run.path(artifactManifestName)
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Artifact manifest written to %s\n", path)
+	return nil
+}
+
+// readArtifactManifest loads a manifest written by writeArtifactManifest.
+func readArtifactManifest(path string) (artifactManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m artifactManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for name, a := range m {
+		a.Name = name
+		m[name] = a
+	}
+	return m, nil
+}
+
+// sizeRecords lists the manifest's artifacts for the size history.
+func (m artifactManifest) sizeRecords() []sizeRecord {
+	var records []sizeRecord
+	for _, a := range m {
+		records = append(records, sizeRecord{Commit: a.Commit, Target: a.Target, Bytes: a.Size})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Target < records[j].Target })
+	return records
+}
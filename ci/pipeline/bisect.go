@@ -0,0 +1,190 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// stageSlug turns a stage name into its command-line form ("Cluster Smoke"
+// becomes "cluster-smoke").
+func stageSlug(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), " ", "-")
+}
+
+// bisectStages indexes every stage the pipeline can run by slug.
+func bisectStages() map[string]Stage {
+	stages := map[string]Stage{}
+	for _, s := range New(Options{Coverage: true, CompareRelease: true}).Stages {
+		stages[stageSlug(s.Name)] = s
+	}
+	return stages
+}
+
+// RunBisectCommand implements
+// "ci bisect --stage STAGE --good SHA --bad SHA".
+//
+// git bisect runs with --no-checkout, so the working tree (and this CI code)
+// stays put. Each candidate is exported with git archive and the stage runs
+// against it using the current pipeline. Any stage failure counts as bad,
+// including revisions that do not build; infrastructure errors skip the
+// revision.
+func RunBisectCommand(args []string) error {
+	fs := flag.NewFlagSet("bisect", flag.ContinueOnError)
+	stage := fs.String("stage", "cluster-smoke", "stage to run for each revision")
+	good := fs.String("good", "", "known good revision")
+	bad := fs.String("bad", "HEAD", "known bad revision")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *good == "" {
+		return &UsageError{Err: errors.New("--good is required")}
+	}
+
+	// Pending and opt-in scenarios are run when named explicitly.
+	os.Setenv("MYCO_CI_RUN_PENDING", "1")
+	for _, s := range scenarios {
+		if s.OptIn != "" && stageSlug(s.Name) == *stage {
+			os.Setenv(s.OptIn, "1")
+		}
+	}
+
+	ctx := context.Background()
+	client, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stdout))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	stages := bisectStages()
+	run, ok := stages[*stage]
+	if !ok {
+		var names []string
+		for name := range stages {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown stage %q; choose one of: %s", *stage, strings.Join(names, ", "))
+	}
+	session := newRunDir()
+	base, err := buildEnvironment(ctx, client, http.DefaultClient, session, nil)
+	if err != nil {
+		return err
+	}
+	current := client.Host().Directory(".", dagger.HostDirectoryOpts{Include: []string{"go.mod", "go.sum", "ci/"}})
+	tools := scenarioToolsDir(client, session, current)
+
+	if _, err := git("bisect", "start", "--no-checkout", *bad, *good); err != nil {
+		return err
+	}
+	defer git("bisect", "reset")
+
+	for {
+		rev, err := git("rev-parse", "BISECT_HEAD")
+		if err != nil {
+			return err
+		}
+		subject, _ := git("log", "-1", "--format=%h %s", rev)
+		fmt.Printf("==> Testing %s\n", subject)
+
+		verdict, err := bisectRevision(ctx, client, session, base, tools, rev, run)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("==> %s is %s\n", rev[:12], verdict)
+		out, err := git("bisect", verdict)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(out, "is the first bad commit") {
+			fmt.Println(out)
+			return nil
+		}
+	}
+}
+
+// bisectRevision exports rev into a temporary directory and runs the stage
+// against it under the usual MYCO_CI_TIMEOUT_MIN deadline, returning "good",
+// "bad", or "skip" when infrastructure kept the stage from running.
+func bisectRevision(ctx context.Context, client *dagger.Client, session runDir, base *dagger.Container, tools *dagger.Directory, rev string, stage Stage) (string, error) {
+	dir, err := os.MkdirTemp("", "myco-bisect-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	if err := exportRevision(rev, dir); err != nil {
+		return "", fmt.Errorf("export %s: %w", rev, err)
+	}
+
+	src := client.Host().Directory(dir)
+	zigCache := client.CacheVolume(session.cacheKey(zigCacheKey(filepath.Join(dir, "build.zig.zon"))))
+	stepCtx, cancel := WithDeadline(ctx, Timeout())
+	defer cancel()
+	runner := stageRunner(base, src, zigCache)
+	env := &Env{
+		Client: client,
+		Src:    src,
+		Runner: runner,
+		Exec:   daggerExecutor{runner},
+		run:    session,
+		perf:   newPerfRecorder(rev),
+		tools:  tools,
+	}
+	start := time.Now()
+	err = stage.Run(stepCtx, env)
+	err = classify(stepCtx, stage.Name, time.Since(start), err)
+	switch ExitCode(err) {
+	case ExitOK:
+		return "good", nil
+	case ExitInfra:
+		// Says nothing about the revision; let git pick another.
+		fmt.Printf("stage could not run: %v\n", err)
+		return "skip", nil
+	default:
+		fmt.Printf("stage failed: %v\n", err)
+		return "bad", nil
+	}
+}
+
+// exportRevision writes the tree of rev into dir, reading git archive's tar
+// itself so no shell or tar is needed on the host.
+func exportRevision(rev, dir string) error {
+	archive := exec.Command("git", "archive", "--format=tar", rev)
+	archive.Stderr = os.Stderr
+	out, err := archive.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := archive.Start(); err != nil {
+		return err
+	}
+	extractErr := extractTar(out, dir, "git archive "+rev)
+	if extractErr != nil {
+		// Drain the rest so git is not left blocked on the pipe.
+		io.Copy(io.Discard, out)
+	}
+	if err := archive.Wait(); err != nil {
+		return err
+	}
+	return extractErr
+}
+
+// git runs a git command in the working tree and returns its trimmed output.
+func git(args ...string) (string, error) {
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,325 @@
+package pipeline
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"dagger.io/dagger"
+)
+
+// defaultBundleDir is where --offline looks for the cache bundle.
+var defaultBundleDir = filepath.Join("build", "cache-bundle")
+
+// cacheBundle is a directory holding everything the pipeline would otherwise
+// download:
+//
+//	images/base.tar     provisioned base container (OCI tarball)
+//	toolchain/          zig tarball and .minisig, as in build/toolchain
+//	zig-deps/           zig global cache packages (the p/ directory)
+type cacheBundle struct {
+	Dir string
+}
+
+func (b cacheBundle) imagePath() string    { return filepath.Join(b.Dir, "images", "base.tar") }
+func (b cacheBundle) toolchainDir() string { return filepath.Join(b.Dir, "toolchain") }
+func (b cacheBundle) zigDepsDir() string   { return filepath.Join(b.Dir, "zig-deps") }
+func (b cacheBundle) zigTarball(arch, version string) string {
+	return filepath.Join(b.toolchainDir(), zigTarballName(arch, version))
+}
+
+// check fails unless every bundle component for this toolchain is present.
+func (b cacheBundle) check(arch, version string) error {
+	required := []string{
+		b.imagePath(),
+		b.zigTarball(arch, version),
+		b.zigTarball(arch, version) + ".minisig",
+		b.zigDepsDir(),
+	}
+	var missing []error
+	for _, path := range required {
+		if _, err := os.Stat(path); err != nil {
+			missing = append(missing, err)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("cache bundle %s is incomplete: %w", b.Dir, errors.Join(missing...))
+	}
+	return nil
+}
+
+// offlineProxy points HTTP clients in the containers at a closed port so
+// any attempted download fails fast instead of silently succeeding.
+const offlineProxy = "http://127.0.0.1:9"
+
+// refusingTransport fails every HTTP request made from the Go side.
+type refusingTransport struct{}
+
+func (refusingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("offline mode: refusing request to %s", req.URL)
+}
+
+// httpClient is what the run fetches and posts with: with Offline, one that
+// refuses every request, so a download the bundle misses fails fast.
+func (o Options) httpClient() *http.Client {
+	if o.Offline {
+		return &http.Client{Transport: refusingTransport{}}
+	}
+	return http.DefaultClient
+}
+
+// hostScenarioTools builds the scenario tools with the host Go toolchain,
+// which needs no network since they only use the standard library, and
+// returns the directory holding them, tools/ in run's directory.
+func hostScenarioTools(run runDir, goarch string) (string, error) {
+	dir := run.path("tools")
+	for _, tool := range scenarioTools {
+		cmd := exec.Command("go", "build", "-o", filepath.Join(dir, tool.Name), tool.Package)
+		cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS=linux", "GOARCH="+goarch, "GOPROXY=off")
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("go build %s: %w", tool.Package, err)
+		}
+	}
+	return dir, nil
+}
+
+// RunCacheCommand implements "ci cache export|import BUNDLE.tar" and
+// "ci cache prune".
+func RunCacheCommand(args []string) error {
+	if len(args) > 0 && args[0] == "prune" {
+		return runCachePrune(args[1:])
+	}
+	fs := flag.NewFlagSet("cache", flag.ContinueOnError)
+	dir := fs.String("bundle", defaultBundleDir, "cache bundle directory")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: go run ./ci cache [-bundle DIR] export|import BUNDLE.tar")
+		fmt.Fprintln(os.Stderr, "       go run ./ci cache prune [-keep 10GB] [-max-age 168h]")
+		fs.PrintDefaults()
+	}
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return &UsageError{Err: fmt.Errorf("want export or import and a bundle tar, got %d argument(s)", fs.NArg())}
+	}
+	bundle := cacheBundle{Dir: *dir}
+	switch fs.Arg(0) {
+	case "export":
+		return exportCacheBundle(bundle, fs.Arg(1))
+	case "import":
+		return importCacheBundle(bundle, fs.Arg(1))
+	default:
+		fs.Usage()
+		return &UsageError{Err: fmt.Errorf("unknown cache command %q", fs.Arg(0))}
+	}
+}
+
+// exportCacheBundle populates the bundle directory (base image, verified
+// zig tarball, zig dependencies) and packs it into a single tar.
+func exportCacheBundle(bundle cacheBundle, out string) error {
+	ctx := context.Background()
+	client, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stdout))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	version := zigVersion()
+	platform, err := client.DefaultPlatform(ctx)
+	if err != nil {
+		return err
+	}
+	arch, err := zigArch(platform)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(bundle.Dir); err != nil {
+		return err
+	}
+
+	fmt.Println("==> Exporting provisioned base image...")
+	if _, err := provisionedBase(client).Export(ctx, bundle.imagePath()); err != nil {
+		return err
+	}
+
+	// Fetched into the regular toolchain dir so buildEnvironment below
+	// reuses it, then copied into the bundle.
+	fmt.Println("==> Fetching zig toolchain...")
+	tarball, err := fetchZigToolchain(ctx, http.DefaultClient, filepath.Join("build", "toolchain"), version, arch)
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{tarball, tarball + ".minisig"} {
+		if err := copyFile(path, filepath.Join(bundle.toolchainDir(), filepath.Base(path))); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("==> Fetching zig dependencies...")
+	base, err := buildEnvironment(ctx, client, http.DefaultClient, newRunDir(), nil)
+	if err != nil {
+		return err
+	}
+	src := client.Host().Directory(".", dagger.HostDirectoryOpts{Include: []string{"build.zig", "build.zig.zon", "src/"}})
+	deps := base.
+		WithMountedDirectory("/src", src).
+		WithWorkdir("/src").
+		WithEnvVariable("ZIG_GLOBAL_CACHE_DIR", "/deps").
+		WithExec([]string{"sh", "-c", "zig build --fetch && mkdir -p /deps/p"}).
+		Directory("/deps/p")
+	if _, err := deps.Export(ctx, bundle.zigDepsDir()); err != nil {
+		return err
+	}
+	if err := bundle.check(arch, version); err != nil {
+		return err
+	}
+
+	if err := writeTar(out, bundle.Dir); err != nil {
+		return err
+	}
+	fmt.Printf("Cache bundle written to %s\n", out)
+	return nil
+}
+
+func copyFile(from, to string) error {
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(to, data, 0o644)
+}
+
+// importCacheBundle unpacks a bundle tar into the bundle directory, where
+// --offline picks it up.
+func importCacheBundle(bundle cacheBundle, in string) error {
+	if err := os.RemoveAll(bundle.Dir); err != nil {
+		return err
+	}
+	if err := readTar(in, bundle.Dir); err != nil {
+		return err
+	}
+	fmt.Printf("Cache bundle restored to %s; run with --offline -bundle %s\n", bundle.Dir, bundle.Dir)
+	return nil
+}
+
+// writeTar archives the regular files and directories under root.
+func writeTar(out, root string) error {
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(hdr); err != nil || info.IsDir() {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readTar extracts a tar written by writeTar, rejecting entries that would
+// land outside root.
+func readTar(in, root string) error {
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return extractTar(f, root, in)
+}
+
+// extractTar extracts the tar read from r under root, rejecting entries,
+// and link targets, that would land outside it; name is r in errors.
+func extractTar(r io.Reader, root, name string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("%s: unsafe path %q", name, hdr.Name)
+		}
+		path := filepath.Join(root, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(file, tr); err != nil {
+				file.Close()
+				return err
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if !filepath.IsLocal(filepath.Join(filepath.Dir(hdr.Name), hdr.Linkname)) {
+				return fmt.Errorf("%s: link %q points outside the tree", name, hdr.Name)
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: unsupported entry %q", name, hdr.Name)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// sharedZigCacheKey is used when build.zig.zon cannot be read, so runs still
+// share one warm cache.
+const sharedZigCacheKey = "myco-zig-cache-shared"
+
+// zigCacheKey names the zig cache volume after the content hash of
+// build.zig.zon. Bumping a dependency starts from a fresh cache while other
+// changes keep reusing the warm one.
+func zigCacheKey(zonPath string) string {
+	zon, err := os.ReadFile(zonPath)
+	if err != nil {
+		fmt.Printf("Zig cache key: %s (build.zig.zon unreadable: %v)\n", sharedZigCacheKey, err)
+		return sharedZigCacheKey
+	}
+	sum := sha256.Sum256(zon)
+	key := "myco-zig-cache-" + hex.EncodeToString(sum[:8])
+	fmt.Printf("Zig cache key: %s (sha256 of build.zig.zon)\n", key)
+	return key
+}
@@ -0,0 +1,123 @@
+package pipeline
+
+// restartStormScenario restarts a random node of three every
+// MYCO_CHAOS_INTERVAL_SEC for MYCO_CHAOS_CHURN_SEC while the other two keep
+// deploying. Once the churn stops every node must hold every service within
+// MYCO_CHAOS_CONVERGE_SEC; the restarted daemons rejoin from peers.list.
+var restartStormScenario = scenario{
+	Name:      "Restart Storm",
+	OptIn:     "MYCO_CI_CHAOS",
+	Resources: Resources{CPUs: 2, MemoryMB: 1024},
+	Env:       []string{"MYCO_CHAOS_CHURN_SEC", "MYCO_CHAOS_INTERVAL_SEC", "MYCO_CHAOS_CONVERGE_SEC"},
+	Script: `
+build_myco
+
+CHURN_SEC="${MYCO_CHAOS_CHURN_SEC:-180}"
+INTERVAL_SEC="${MYCO_CHAOS_INTERVAL_SEC:-10}"
+CONVERGE_SEC="${MYCO_CHAOS_CONVERGE_SEC:-120}"
+PER_DEPLOY=2
+
+for idx in 0 1 2; do
+  start_node "$idx"
+done
+sleep 2
+check_daemons
+wire_full_mesh 0 1 2
+
+echo "==> Restarting a random node every ${INTERVAL_SEC}s for ${CHURN_SEC}s..."
+end=$(( $(date +%s) + CHURN_SEC ))
+next_id=1
+wave=0
+while [ "$(date +%s)" -lt "$end" ]; do
+  wave=$((wave + 1))
+  victim=$((RANDOM % 3))
+  echo "--- wave ${wave}: restarting $(node_name "$victim")"
+  stop_node "$victim"
+  start_node "$victim"
+  for idx in 0 1 2; do
+    [ "$idx" -eq "$victim" ] && continue
+    deploy_services "$idx" "$next_id" "${PER_DEPLOY}" "storm${wave}-$(node_name "$idx")"
+    next_id=$((next_id + PER_DEPLOY))
+  done
+  sleep "${INTERVAL_SEC}"
+  check_daemons
+done
+total=$((next_id - 1))
+ok "${wave} restarts, ${total} services deployed during the storm"
+
+for idx in 0 1 2; do
+  wait_until "${CONVERGE_SEC}" "$(node_name "$idx") holds all ${total} services" services_known_at_least "$idx" "$total"
+done
+`,
+}
+
+// slowConsumerScenario freezes n3 with SIGSTOP for MYCO_CHAOS_PAUSE_SEC while
+// n1 and n2 deploy in waves, then resumes it. n3 must catch up on every
+// service, and the senders' RSS must stay within MYCO_CHAOS_RSS_GROWTH_KIB of
+// where it started instead of buffering without bound for the stalled peer.
+var slowConsumerScenario = scenario{
+	Name:      "Slow Consumer",
+	OptIn:     "MYCO_CI_CHAOS",
+	Resources: Resources{CPUs: 2, MemoryMB: 1024},
+	Env:       []string{"MYCO_CHAOS_PAUSE_SEC", "MYCO_CHAOS_CONVERGE_SEC", "MYCO_CHAOS_RSS_GROWTH_KIB"},
+	Script: `
+build_myco
+
+PAUSE_SEC="${MYCO_CHAOS_PAUSE_SEC:-60}"
+CONVERGE_SEC="${MYCO_CHAOS_CONVERGE_SEC:-120}"
+RSS_GROWTH_KIB="${MYCO_CHAOS_RSS_GROWTH_KIB:-32768}"
+WAVES=12
+PER_DEPLOY=10
+
+for idx in 0 1 2; do
+  start_node "$idx"
+done
+sleep 2
+check_daemons
+wire_full_mesh 0 1 2
+
+rss_kib() {
+  awk '/^VmRSS:/ {print $2}' "/proc/${PIDS[$1]}/status"
+}
+declare -A base_rss peak_rss
+for idx in 0 1; do
+  base_rss[$idx]=$(rss_kib "$idx")
+  peak_rss[$idx]=${base_rss[$idx]}
+done
+
+echo "==> Pausing n3 for ${PAUSE_SEC}s while n1 and n2 deploy..."
+kill -STOP "${PIDS[2]}"
+resume_at=$(( $(date +%s) + PAUSE_SEC ))
+next_id=1
+for wave in $(seq 1 "${WAVES}"); do
+  for idx in 0 1; do
+    deploy_services "$idx" "$next_id" "${PER_DEPLOY}" "slow${wave}-$(node_name "$idx")"
+    next_id=$((next_id + PER_DEPLOY))
+  done
+done
+total=$((next_id - 1))
+while [ "$(date +%s)" -lt "$resume_at" ]; do
+  check_daemons
+  for idx in 0 1; do
+    rss=$(rss_kib "$idx")
+    [ "$rss" -gt "${peak_rss[$idx]}" ] && peak_rss[$idx]=$rss
+  done
+  sleep 1
+done
+for idx in 0 1; do
+  wait_until 30 "$(node_name "$idx") holds all ${total} services" services_known_at_least "$idx" "$total"
+done
+
+echo "==> Resuming n3..."
+kill -CONT "${PIDS[2]}"
+wait_until "${CONVERGE_SEC}" "n3 caught up on ${total} services" services_known_at_least 2 "$total"
+
+for idx in 0 1; do
+  growth=$(( peak_rss[$idx] - base_rss[$idx] ))
+  echo "$(node_name "$idx") RSS ${base_rss[$idx]}KiB -> peak ${peak_rss[$idx]}KiB"
+  [ "$growth" -le "${RSS_GROWTH_KIB}" ] ||
+    fail "$(node_name "$idx") grew ${growth}KiB while n3 was stalled (limit ${RSS_GROWTH_KIB}KiB)"
+done
+ok "senders stayed bounded while n3 was stalled"
+`,
+}
@@ -0,0 +1,209 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// releaseDownloadURL is where the latest GitHub release's assets are, named
+// like the build stage's output.
+const releaseDownloadURL = "https://github.com/LBjerke/myco/releases/latest/download/"
+
+// defaultReleaseURL is the latest release's asset for the native platform,
+// which the engine can run. MYCO_RELEASE_URL overrides it.
+func defaultReleaseURL(native dagger.Platform) (string, error) {
+	target, err := platformToZigTarget(native)
+	if err != nil {
+		return "", err
+	}
+	return releaseDownloadURL + "myco-" + target, nil
+}
+
+// releaseSkippedCode is the exit code the comparison script uses when no
+// release binary can be downloaded.
+const releaseSkippedCode = 3
+
+// releaseComparisonScript benchmarks the previous release and the current
+// tree with the same 3-node workload, printing "bench LABEL METRIC MS" lines.
+const releaseComparisonScript = `
+RUNS="${MYCO_COMPARE_RUNS:-3}"
+OLD_BIN=/tmp/myco-release
+NEW_BIN="${BIN}"
+
+echo "==> Downloading previous release from ${MYCO_RELEASE_URL}..."
+if ! curl -fsSL -o "${OLD_BIN}" "${MYCO_RELEASE_URL}"; then
+  echo "no release binary available"
+  exit 3
+fi
+chmod +x "${OLD_BIN}"
+build_myco
+
+# poll_ms DESC CMD... polls CMD every 100ms for up to 60s.
+poll_ms() {
+  local desc="$1"
+  shift
+  local i
+  for i in $(seq 1 600); do
+    if "$@"; then
+      return 0
+    fi
+    sleep 0.1
+  done
+  fail "${desc}: not reached within 60s"
+}
+
+sockets_up() {
+  local idx
+  for idx in "$@"; do
+    [ -S "$(node_sock "$idx")" ] || return 1
+  done
+}
+
+all_know() {
+  local idx
+  for idx in 0 1 2; do
+    services_known_at_least "$idx" "$1" || return 1
+  done
+}
+
+bench_once() {
+  local label="$1" t0
+  stop_all
+  rm -rf "${STATE:?}"/n*
+
+  t0=$(now_ms)
+  start_node 0
+  start_node 1
+  start_node 2
+  poll_ms "${label} sockets up" sockets_up 0 1 2
+  echo "bench ${label} startup $(( $(now_ms) - t0 ))"
+  wire_full_mesh 0 1 2
+
+  t0=$(now_ms)
+  deploy_services 0 1 1 bench
+  poll_ms "${label} deploy accepted" services_known_at_least 0 1
+  echo "bench ${label} deploy $(( $(now_ms) - t0 ))"
+
+  t0=$(now_ms)
+  deploy_services 1 10 3 burst
+  poll_ms "${label} cluster converged" all_know 4
+  echo "bench ${label} convergence $(( $(now_ms) - t0 ))"
+}
+
+for run in $(seq 1 "${RUNS}"); do
+  echo "==> Run ${run}/${RUNS}"
+  BIN="${OLD_BIN}" bench_once release
+  BIN="${NEW_BIN}" bench_once current
+done
+stop_all
+`
+
+// releaseComparisonResources covers two 3-node clusters run back to back.
+var releaseComparisonResources = Resources{CPUs: 2, MemoryMB: 1024}
+
+// releaseMetrics lists the benchmark metrics in table order.
+var releaseMetrics = []string{"startup", "deploy", "convergence"}
+
+// runReleaseComparison benchmarks the previous release against the current
+// tree and prints a median comparison table. Regressions beyond
+// MYCO_COMPARE_THRESHOLD_PCT (default 20) are flagged but do not fail the
+// stage, since shared CI runners are too noisy to gate on.
+func runReleaseComparison(ctx context.Context, runner *dagger.Container, native dagger.Platform) error {
+	url := os.Getenv("MYCO_RELEASE_URL")
+	if url == "" {
+		var err error
+		if url, err = defaultReleaseURL(native); err != nil {
+			return &StageError{Stage: "Release Comparison", Err: err}
+		}
+	}
+	threshold := 20.0
+	if value := os.Getenv("MYCO_COMPARE_THRESHOLD_PCT"); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil && parsed > 0 {
+			threshold = parsed
+		}
+	}
+
+	ran := runner.
+		WithEnvVariable("ZIG_LOCAL_CACHE_DIR", "/src/zig-cache").
+		WithEnvVariable("ZIG_GLOBAL_CACHE_DIR", "/src/zig-cache").
+		WithEnvVariable("MYCO_RELEASE_URL", url).
+		WithExec([]string{"bash", "-c", scenarioPrelude + memoryGuard(releaseComparisonResources.MemoryMB) + releaseComparisonScript}, dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		})
+	var code int
+	err := runBounded(ctx, "comparison script", func(ctx context.Context) (err error) {
+		code, err = ran.ExitCode(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if code == releaseSkippedCode {
+		logf(ctx, "skipped: no release binary at %s", url)
+		return nil
+	}
+	if code != 0 {
+		return fmt.Errorf("comparison script exited with code %d", code)
+	}
+	out, err := ran.Stdout(ctx)
+	if err != nil {
+		return err
+	}
+
+	samples := map[string]map[string][]float64{"release": {}, "current": {}}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 || fields[0] != "bench" || samples[fields[1]] == nil {
+			continue
+		}
+		ms, err := strconv.ParseFloat(fields[3], 64)
+		if err != nil {
+			return fmt.Errorf("bad benchmark line %q: %w", scanner.Text(), err)
+		}
+		samples[fields[1]][fields[2]] = append(samples[fields[1]][fields[2]], ms)
+	}
+
+	var table strings.Builder
+	table.WriteString("median of runs, milliseconds:\n")
+	fmt.Fprintf(&table, "%-12s %10s %10s %8s\n", "metric", "release", "current", "change")
+	var regressions []string
+	for _, metric := range releaseMetrics {
+		old, cur := median(samples["release"][metric]), median(samples["current"][metric])
+		if old <= 0 || cur <= 0 {
+			return fmt.Errorf("missing %s samples", metric)
+		}
+		change := 100 * (cur - old) / old
+		flag := ""
+		if change > threshold {
+			flag = "  REGRESSION"
+			regressions = append(regressions, metric)
+		}
+		fmt.Fprintf(&table, "%-12s %10.0f %10.0f %+7.1f%%%s\n", metric, old, cur, change, flag)
+	}
+	logf(ctx, "%s", table.String())
+	if len(regressions) > 0 {
+		return &WarningError{Warnings: []string{fmt.Sprintf("%s regressed more than %.0f%% against the last release", strings.Join(regressions, ", "), threshold)}}
+	}
+	return nil
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
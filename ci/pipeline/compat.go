@@ -0,0 +1,208 @@
+package pipeline
+
+// mycoJSONCompatScenario feeds every historical myco.json in
+// ci/fixtures/myco-json to 'myco deploy' against a live daemon and checks the
+// outcome recorded in expectations.txt.
+var mycoJSONCompatScenario = scenario{
+	Name: "myco.json Compatibility",
+	Script: `
+build_myco
+
+FIXTURES=/src/ci/fixtures/myco-json
+EXPECT="${FIXTURES}/expectations.txt"
+
+start_node 0
+sleep 2
+check_daemons
+
+for fixture in "${FIXTURES}"/*.json; do
+  name=$(basename "$fixture")
+  grep -q "^${name} " "${EXPECT}" || fail "${name} has no entry in expectations.txt"
+done
+
+failures=0
+while read -r name outcome detail; do
+  case "$name" in ''|'#'*) continue ;; esac
+  [ -f "${FIXTURES}/${name}" ] || fail "expectations.txt lists missing fixture ${name}"
+  cp "${FIXTURES}/${name}" "$(node_dir 0)/myco.json"
+  set +e
+  out=$(myco_cli 0 deploy 2>&1)
+  code=$?
+  set -e
+  result=ok
+  case "$outcome" in
+    accept)
+      if [ "$code" -ne 0 ] || ! grep -Eq "Deployed ID|Already up to date" <<<"$out"; then
+        result="expected deploy to succeed (exit ${code})"
+      fi
+      ;;
+    reject)
+      if [ "$code" -eq 0 ]; then
+        result="expected rejection, deploy exited 0"
+      elif ! grep -qF "$detail" <<<"$out"; then
+        result="rejected without mentioning '${detail}'"
+      fi
+      ;;
+    empty)
+      if [ "$code" -ne 0 ] || grep -q "Deployed ID" <<<"$out"; then
+        result="expected a no-op deploy (exit ${code})"
+      fi
+      ;;
+    *)
+      fail "unknown outcome '${outcome}' for ${name}"
+      ;;
+  esac
+  if [ "$result" = ok ]; then
+    ok "${name}: ${outcome}"
+  else
+    echo "[FAIL] ${name}: ${result}"
+    echo "$out" | sed 's/^/    /'
+    failures=$((failures + 1))
+  fi
+done <"${EXPECT}"
+
+[ "$failures" -eq 0 ] || fail "${failures} myco.json fixture(s) changed behavior"
+`,
+}
+
+// unusualNamesScenario deploys awkward service names with the real executor
+// (nix and systemctl are mocked) and checks each unit file is written under
+// the service id with the full name, or that a name longer than a service
+// holds is rejected with a clear error. Names are not validated otherwise,
+// so escapes that decode to newlines are not tried. It also runs a node out
+// of a state dir with spaces and one whose socket path exceeds the sun_path
+// limit.
+var unusualNamesScenario = scenario{
+	Name: "Unusual Names",
+	Script: `
+build_myco
+
+UNIT_DIR=/run/systemd/system
+mkdir -p "${UNIT_DIR}" /var/lib/myco
+LONG_NAME=$(printf 'a%.0s' $(seq 40))
+
+dir=$(node_dir 0)
+mkdir -p "$dir"
+node_vars 0
+env "${NODE_ENV[@]}" "${BIN}" daemon >>"${dir}/myco.log" 2>&1 &
+PIDS[0]=$!
+sleep 2
+check_daemons
+
+failures=0
+# try_name ID NAME accept|reject
+try_name() {
+  local id="$1" name="$2" want="$3" out code unit
+  printf '{"id": %s, "name": "%s", "flake_uri": "github:example/odd", "exec_name": "run"}\n' "$id" "$name" >"${dir}/myco.json"
+  set +e
+  out=$(myco_cli 0 deploy 2>&1)
+  code=$?
+  set -e
+  unit="${UNIT_DIR}/myco-${id}.service"
+  if [ "$want" = accept ]; then
+    if [ "$code" -ne 0 ] || [ ! -f "$unit" ]; then
+      echo "[FAIL] '${name}': expected a unit file (exit ${code})"
+      failures=$((failures + 1))
+    elif ! grep -qxF "Description=Myco Managed Service: ${name}" "$unit"; then
+      echo "[FAIL] '${name}': unit Description does not carry the full name"
+      sed 's/^/    /' "$unit"
+      failures=$((failures + 1))
+    else
+      ok "'${name}' accepted"
+    fi
+  else
+    if [ "$code" -eq 0 ] || [ -f "$unit" ]; then
+      echo "[FAIL] '${name}': expected rejection, got exit ${code}"
+      failures=$((failures + 1))
+    elif ! grep -Eqi "name|too ?long" <<<"$out"; then
+      echo "[FAIL] '${name}': rejected without a clear error: ${out}"
+      failures=$((failures + 1))
+    else
+      ok "'${name}' rejected: $(head -n1 <<<"$out")"
+    fi
+  fi
+}
+
+try_name 1 "web.api-v2" accept
+try_name 2 "a-b-c.d-e" accept
+try_name 3 "サービス" accept
+try_name 4 "../../etc/passwd" accept
+try_name 5 "with space" accept
+try_name 6 "${LONG_NAME}" reject
+
+echo "==> Node with spaces in its state dir..."
+SPACED="${STATE}/state with spaces"
+mkdir -p "${SPACED}"
+env MYCO_STATE_DIR="${SPACED}" MYCO_PORT="$(node_port 1)" MYCO_NODE_ID=2 MYCO_UDS_PATH="${SPACED}/myco.sock" \
+  MYCO_SMOKE_SKIP_EXEC=1 "${BIN}" daemon >>"${STATE}/spaced.log" 2>&1 &
+PIDS[1]=$!
+sleep 2
+check_daemons
+MYCO_UDS_PATH="${SPACED}/myco.sock" "${BIN}" status 2>&1 | grep -q services_known \
+  || { echo "[FAIL] status failed for a state dir with spaces"; failures=$((failures + 1)); }
+MYCO_STATE_DIR="${SPACED}" "${BIN}" peer add "$(node_pubkey 0)" "$(node_addr 0)" >/dev/null 2>&1
+grep -q "$(node_pubkey 0)" "${SPACED}/peers.list" \
+  || { echo "[FAIL] peer add failed for a state dir with spaces"; failures=$((failures + 1)); }
+
+echo "==> Socket path longer than sun_path..."
+LONG_SOCK="${STATE}/$(printf 's%.0s' $(seq 120)).sock"
+# A daemon that accepts the path runs on until the command timeout fails
+# the stage.
+set +e
+out=$(MYCO_STATE_DIR="${STATE}/longsock" MYCO_PORT="$(node_port 2)" MYCO_UDS_PATH="${LONG_SOCK}" \
+  "${BIN}" daemon 2>&1)
+code=$?
+set -e
+if [ "$code" -eq 0 ] || ! grep -Eqi "too ?long" <<<"$out"; then
+  echo "[FAIL] overlong socket path: exit ${code}, want a clear 'too long' error"
+  echo "$out" | tail -n 5 | sed 's/^/    /'
+  failures=$((failures + 1))
+else
+  ok "overlong socket path rejected"
+fi
+
+[ "$failures" -eq 0 ] || fail "${failures} unusual name/path case(s) failed"
+`,
+}
+
+// examplesScenario deploys every bundle under examples/ through the real
+// executor, with nix and systemctl mocked, so shipped examples cannot rot.
+// There is no 'myco up' yet, so the flow is daemon plus 'myco deploy' from
+// the bundle directory, checking a unit file appears for every service id.
+var examplesScenario = scenario{
+	Name: "Example Configs",
+	Script: `
+build_myco
+
+UNIT_DIR=/run/systemd/system
+mkdir -p "${UNIT_DIR}"
+
+dir=$(node_dir 0)
+mkdir -p "$dir"
+node_vars 0
+env "${NODE_ENV[@]}" "${BIN}" daemon >>"${dir}/myco.log" 2>&1 &
+PIDS[0]=$!
+sleep 2
+check_daemons
+
+examples=0
+expected=0
+for bundle in /src/examples/*/; do
+  [ -f "${bundle}myco.json" ] || continue
+  name=$(basename "$bundle")
+  examples=$((examples + 1))
+  ids=$(grep -oE '"id"[[:space:]]*:[[:space:]]*[0-9]+' "${bundle}myco.json" | grep -oE '[0-9]+$')
+  [ -n "$ids" ] || fail "${name}: myco.json declares no service ids"
+
+  out=$(node_vars 0 cli && cd "$bundle" && env "${NODE_ENV[@]}" "${BIN}" deploy 2>&1) ||
+    { echo "$out"; fail "${name}: deploy exited non-zero"; }
+  for id in $ids; do
+    expected=$((expected + 1))
+    wait_until 10 "${name}: unit for service ${id}" test -f "${UNIT_DIR}/myco-${id}.service"
+  done
+done
+[ "$examples" -gt 0 ] || fail "no example bundles found under examples/"
+wait_until 10 "daemon knows all ${expected} example services" services_known_at_least 0 "$expected"
+ok "${examples} example bundles deployed"
+`,
+}
@@ -0,0 +1,397 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultConfigPath is the pipeline configuration read when it exists.
+const DefaultConfigPath = "ci.yaml"
+
+// defaultStageTimeout bounds each command a stage runs unless ci.yaml sets
+// the stage's timeout.
+const defaultStageTimeout = 900 * time.Second
+
+// Config is ci.yaml: the settings a fork tunes without editing Go. Anything
+// left out keeps its default, and MYCO_CI_* variables set in the environment
+// win over it.
+type Config struct {
+	// Timeout is the overall deadline; none runs without one, leaving the
+	// stage timeouts to bound the run.
+	Timeout Duration `yaml:"timeout"`
+	// Platforms are the release build's targets.
+	Platforms []string `yaml:"platforms"`
+	// Env is applied to the pipeline's environment, under variables that are
+	// already set, before anything reads it.
+	Env map[string]string `yaml:"env"`
+	// Stages holds per-stage settings keyed by stage name.
+	Stages map[string]StageConfig `yaml:"stages"`
+	// MinFree is the engine disk space the preflight wants before the stages
+	// start; below it the engine cache is pruned to CacheKeep.
+	MinFree   ByteSize `yaml:"min_free"`
+	CacheKeep ByteSize `yaml:"cache_keep"`
+	// Matrix expands into Matrix Build stages; see Matrix.
+	Matrix Matrix `yaml:"matrix"`
+	// ArtifactStore is where each run's artifacts are mirrored:
+	// s3://BUCKET/PREFIX, gs://BUCKET/PREFIX or a directory.
+	ArtifactStore string `yaml:"artifact_store"`
+	// ArtifactLinkTTL is how long failure notification links work.
+	ArtifactLinkTTL Duration `yaml:"artifact_link_ttl"`
+	// Plugins are executables adding stages; see LoadPlugins.
+	Plugins []string `yaml:"plugins"`
+}
+
+// StageConfig tunes one stage.
+type StageConfig struct {
+	// Timeout bounds each command the stage runs; none leaves them
+	// unbounded.
+	Timeout Duration `yaml:"timeout"`
+	// Disabled skips the stage.
+	Disabled bool `yaml:"disabled"`
+	// Before and After are hooks run around the stage; see Hook.
+	Before []Hook `yaml:"before"`
+	After  []Hook `yaml:"after"`
+	// Retry reruns the stage after infrastructure errors; see RetryPolicy.
+	Retry RetryPolicy `yaml:"retry"`
+}
+
+// Duration is a time.Duration written as in Go, e.g. 7m or 90s, or none
+// for no limit.
+type Duration time.Duration
+
+// noLimit is the Duration written as none.
+const noLimit = Duration(-1)
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := parseLimit(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*d = parsed
+	return nil
+}
+
+// parseLimit reads a positive duration or none.
+func parseLimit(s string) (Duration, error) {
+	if s == "none" {
+		return noLimit, nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("duration %q: want a positive value such as 7m or 90s, or none", s)
+	}
+	return Duration(parsed), nil
+}
+
+// ByteSize is a size in bytes written as e.g. 10GB or 512MiB.
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	n, err := parseBytes(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*b = ByteSize(n)
+	return nil
+}
+
+// LoadConfig reads the configuration at path. A missing file is an empty
+// configuration; unknown keys are errors so typos do not go unnoticed.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, p := range cfg.Platforms {
+		if _, err := platformToZigTarget(dagger.Platform(p)); err != nil {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := cfg.Matrix.validate(); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.validateStages(); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.ArtifactStore != "" {
+		if _, err := parseArtifactStore(cfg.ArtifactStore); err != nil {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if cfg.ArtifactLinkTTL == noLimit {
+		return cfg, fmt.Errorf("%s: artifact_link_ttl cannot be none; signed links always expire", path)
+	}
+	if time.Duration(cfg.ArtifactLinkTTL) > maxArtifactLinkTTL {
+		return cfg, fmt.Errorf("%s: artifact_link_ttl %s is longer than the %s object stores allow", path, time.Duration(cfg.ArtifactLinkTTL), maxArtifactLinkTTL)
+	}
+	return cfg, nil
+}
+
+// validateStages checks every stage's hooks and retry policy, in stage name
+// order.
+func (c Config) validateStages() error {
+	names := make([]string, 0, len(c.Stages))
+	for name := range c.Stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sc := c.Stages[name]
+		for _, h := range []struct {
+			when  string
+			hooks []Hook
+		}{{"before", sc.Before}, {"after", sc.After}} {
+			for i, hook := range h.hooks {
+				if err := hook.validate(); err != nil {
+					return fmt.Errorf("stage %q %s hook %d: %w", name, h.when, i+1, err)
+				}
+			}
+		}
+		if err := sc.Retry.validate(); err != nil {
+			return fmt.Errorf("stage %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ApplyEnv sets the configured variables that the environment does not
+// already set.
+func (c Config) ApplyEnv() error {
+	names := make([]string, 0, len(c.Env))
+	for name := range c.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, set := os.LookupEnv(name); set {
+			continue
+		}
+		if err := os.Setenv(name, c.Env[name]); err != nil {
+			return fmt.Errorf("env %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// PlatformList is the configured release platforms, or nil for the default.
+func (c Config) PlatformList() []dagger.Platform {
+	var platforms []dagger.Platform
+	for _, p := range c.Platforms {
+		platforms = append(platforms, dagger.Platform(p))
+	}
+	return platforms
+}
+
+// Deadline is the overall deadline: MYCO_CI_TIMEOUT_MIN minutes, else the
+// configured timeout, else 7 minutes. Zero means none, from
+// MYCO_CI_TIMEOUT_MIN=0 or timeout: none.
+func (c Config) Deadline() time.Duration {
+	if value := os.Getenv("MYCO_CI_TIMEOUT_MIN"); value != "" {
+		if minutes, err := strconv.Atoi(value); err == nil && minutes >= 0 {
+			return time.Duration(minutes) * time.Minute
+		}
+	}
+	if c.Timeout == noLimit {
+		return 0
+	}
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout)
+	}
+	return 7 * time.Minute
+}
+
+// WithDeadline bounds ctx by d unless d is zero, for no deadline.
+func WithDeadline(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// SetStageTimeouts overrides stage timeouts from a comma-separated list of
+// NAME=DURATION, as given to --stage-timeout or MYCO_CI_STAGE_TIMEOUTS,
+// e.g. "Cluster Smoke=30m,Coverage=none". A malformed entry is a UsageError.
+func (c *Config) SetStageTimeouts(spec string) error {
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return &UsageError{Err: fmt.Errorf("stage timeout %q: want NAME=DURATION", entry)}
+		}
+		d, err := parseLimit(strings.TrimSpace(value))
+		if err != nil {
+			return &UsageError{Err: fmt.Errorf("stage timeout %q: %w", entry, err)}
+		}
+		if c.Stages == nil {
+			c.Stages = map[string]StageConfig{}
+		}
+		name = strings.TrimSpace(name)
+		sc := c.Stages[name]
+		sc.Timeout = d
+		c.Stages[name] = sc
+	}
+	return nil
+}
+
+// ArtifactStoreLocation is MYCO_CI_ARTIFACT_STORE, else the configured
+// artifact store; empty means artifacts stay in the run directory.
+func (c Config) ArtifactStoreLocation() string {
+	if value := os.Getenv("MYCO_CI_ARTIFACT_STORE"); value != "" {
+		return value
+	}
+	return c.ArtifactStore
+}
+
+// PluginPaths is the configured plugins followed by those listed in
+// MYCO_CI_PLUGINS, separated like PATH.
+func (c Config) PluginPaths() []string {
+	paths := append([]string(nil), c.Plugins...)
+	for _, path := range filepath.SplitList(os.Getenv("MYCO_CI_PLUGINS")) {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// Configure applies the per-stage settings of cfg. Naming a stage the
+// pipeline does not have is an error.
+func (p *Pipeline) Configure(cfg Config) error {
+	byName := map[string]*Stage{}
+	for i := range p.Stages {
+		byName[p.Stages[i].Name] = &p.Stages[i]
+	}
+	names := make([]string, 0, len(cfg.Stages))
+	for name := range cfg.Stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("%s: no stage %q; stages are: %s", DefaultConfigPath, name, p.stageNames())
+		}
+		sc := cfg.Stages[name]
+		if sc.Timeout != 0 {
+			s.Timeout = time.Duration(sc.Timeout)
+		}
+		if sc.Retry != (RetryPolicy{}) {
+			s.Retry = sc.Retry
+		}
+		s.Before = append(s.Before, sc.Before...)
+		s.After = append(s.After, sc.After...)
+		if sc.Disabled && s.Skip == "" {
+			s.Skip = "disabled in " + DefaultConfigPath
+		}
+	}
+	return nil
+}
+
+type stageTimeoutKey struct{}
+
+// withStageTimeout records the running stage's command timeout in ctx; zero
+// is defaultStageTimeout and negative is none.
+func withStageTimeout(ctx context.Context, d time.Duration) context.Context {
+	if d == 0 {
+		d = defaultStageTimeout
+	}
+	return context.WithValue(ctx, stageTimeoutKey{}, d)
+}
+
+// capCommandTimeout lowers the command timeout in ctx to d, keeping the
+// stage's own when it is shorter.
+func capCommandTimeout(ctx context.Context, d time.Duration) context.Context {
+	if current := commandTimeout(ctx); current >= 0 && current <= d {
+		return ctx
+	}
+	return withStageTimeout(ctx, d)
+}
+
+// commandTimeout is the running stage's command timeout; negative is none.
+func commandTimeout(ctx context.Context) time.Duration {
+	d, ok := ctx.Value(stageTimeoutKey{}).(time.Duration)
+	if !ok {
+		d = defaultStageTimeout
+	}
+	return d
+}
+
+// commandContext bounds one command by the running stage's timeout. The
+// engine cancels a command whose request is cancelled, and the host kills
+// one, so no image needs timeout(1) and it behaves the same on every distro.
+func commandContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d := commandTimeout(ctx); d >= 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
+
+// runBounded runs fn, which has the engine run one command, under the
+// running stage's command timeout.
+func runBounded(ctx context.Context, what string, fn func(ctx context.Context) error) error {
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+	return commandTimedOut(ctx, cmdCtx, what, fn(cmdCtx))
+}
+
+// commandTimedOut turns err into a TimeoutError when it is cmdCtx's own
+// timeout, rather than the run ending, that stopped the command.
+func commandTimedOut(ctx, cmdCtx context.Context, what string, err error) error {
+	if err == nil || ctx.Err() != nil || !errors.Is(cmdCtx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	d := commandTimeout(ctx)
+	return &TimeoutError{After: d, Err: fmt.Errorf("%s ran longer than the %s command timeout", what, d)}
+}
+
+// DeadlineConflicts names the stages configured to run longer than
+// deadline allows, which the overall deadline would cut off before their
+// own timeout. A zero deadline conflicts with nothing.
+func (p *Pipeline) DeadlineConflicts(deadline time.Duration) []string {
+	if deadline <= 0 {
+		return nil
+	}
+	var conflicts []string
+	for _, s := range p.Stages {
+		switch {
+		case s.Skip != "" || s.Timeout == 0:
+		case s.Timeout < 0:
+			conflicts = append(conflicts, s.Name+" (no timeout)")
+		case s.Timeout > deadline:
+			conflicts = append(conflicts, fmt.Sprintf("%s (%s timeout)", s.Name, s.Timeout))
+		}
+	}
+	return conflicts
+}
+
+// stageNames lists the pipeline's stages, for error messages.
+func (p *Pipeline) stageNames() string {
+	names := make([]string, 0, len(p.Stages))
+	for _, s := range p.Stages {
+		names = append(names, s.Name)
+	}
+	return strings.Join(names, ", ")
+}
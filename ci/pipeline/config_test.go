@@ -0,0 +1,188 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ci.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, `
+timeout: 20m
+min_free: 20GB
+platforms: [linux/arm64]
+env:
+  MYCO_SMOKE_PRESET: stress
+stages:
+  Cluster Smoke:
+    timeout: 30m
+  Coverage:
+    disabled: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MYCO_CI_TIMEOUT_MIN", "")
+	if got := cfg.Deadline(); got != 20*time.Minute {
+		t.Errorf("Deadline = %s, want 20m", got)
+	}
+	t.Setenv("MYCO_CI_TIMEOUT_MIN", "3")
+	if got := cfg.Deadline(); got != 3*time.Minute {
+		t.Errorf("Deadline with MYCO_CI_TIMEOUT_MIN = %s, want 3m", got)
+	}
+	if cfg.MinFree != 20e9 {
+		t.Errorf("MinFree = %d, want 20GB", cfg.MinFree)
+	}
+	if got := cfg.PlatformList(); len(got) != 1 || got[0] != "linux/arm64" {
+		t.Errorf("PlatformList = %v", got)
+	}
+
+	p := New(Options{Coverage: true})
+	if err := p.Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range p.Stages {
+		switch s.Name {
+		case "Cluster Smoke":
+			if s.Timeout != 30*time.Minute {
+				t.Errorf("Cluster Smoke timeout = %s", s.Timeout)
+			}
+			if got := commandTimeout(withStageTimeout(context.Background(), s.Timeout)); got != 30*time.Minute {
+				t.Errorf("command timeout = %s, want 30m", got)
+			}
+		case "Coverage":
+			if s.Skip != "disabled in ci.yaml" {
+				t.Errorf("Coverage skip = %q", s.Skip)
+			}
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	if cfg, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err != nil || cfg.Deadline() <= 0 {
+		t.Errorf("missing file: %+v, %v", cfg, err)
+	}
+	for contents, want := range map[string]string{
+		"timout: 7m\n":                           "field timout not found",
+		"timeout: soon\n":                        `duration "soon"`,
+		"artifact_link_ttl: none\n":              "cannot be none",
+		"platforms: [linux/riscv64]\n":           "unsupported platform",
+		"min_free: lots\n":                       `size "lots"`,
+		"stages:\n  Nope:\n    disabled: true\n": "",
+	} {
+		cfg, err := LoadConfig(writeConfig(t, contents))
+		if want == "" {
+			err = New(Options{}).Configure(cfg)
+			want = `no stage "Nope"`
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: err = %v, want %q", contents, err, want)
+		}
+	}
+}
+
+func TestApplyEnvKeepsExistingVariables(t *testing.T) {
+	t.Setenv("MYCO_SMOKE_PRESET", "small")
+	t.Setenv("MYCO_SMOKE_NODES", "")
+	os.Unsetenv("MYCO_SMOKE_NODES")
+	cfg := Config{Env: map[string]string{"MYCO_SMOKE_PRESET": "stress", "MYCO_SMOKE_NODES": "7"}}
+	if err := cfg.ApplyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("MYCO_SMOKE_PRESET"); got != "small" {
+		t.Errorf("MYCO_SMOKE_PRESET = %q, want the environment's value", got)
+	}
+	if got := os.Getenv("MYCO_SMOKE_NODES"); got != "7" {
+		t.Errorf("MYCO_SMOKE_NODES = %q, want 7", got)
+	}
+}
+
+func TestOptionalDeadlineAndStageTimeoutOverrides(t *testing.T) {
+	t.Setenv("MYCO_CI_TIMEOUT_MIN", "")
+	cfg, err := LoadConfig(writeConfig(t, `
+timeout: 10m
+stages:
+  Cluster Smoke:
+    timeout: 5m
+  Coverage:
+    timeout: none
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.SetStageTimeouts("Cluster Smoke=30m, Unit Tests=2m"); err != nil {
+		t.Fatal(err)
+	}
+	p := New(Options{Coverage: true})
+	if err := p.Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got := p.DeadlineConflicts(cfg.Deadline())
+	if strings.Join(got, "; ") != "Coverage (no timeout); Cluster Smoke (30m0s timeout)" {
+		t.Errorf("conflicts = %q", got)
+	}
+	for _, s := range p.Stages {
+		if s.Name == "Coverage" {
+			if got := commandTimeout(withStageTimeout(context.Background(), s.Timeout)); got >= 0 {
+				t.Errorf("Coverage with timeout none has a %s command timeout", got)
+			}
+		}
+	}
+
+	t.Setenv("MYCO_CI_TIMEOUT_MIN", "0")
+	if d := cfg.Deadline(); d != 0 {
+		t.Errorf("MYCO_CI_TIMEOUT_MIN=0: Deadline = %s, want none", d)
+	}
+	if conflicts := p.DeadlineConflicts(0); conflicts != nil {
+		t.Errorf("no deadline conflicts with %v", conflicts)
+	}
+	t.Setenv("MYCO_CI_TIMEOUT_MIN", "")
+	none, err := LoadConfig(writeConfig(t, "timeout: none\n"))
+	if err != nil || none.Deadline() != 0 {
+		t.Errorf("timeout: none: Deadline = %s, err %v", none.Deadline(), err)
+	}
+	ctx, cancel := WithDeadline(context.Background(), 0)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("WithDeadline(0) set a deadline")
+	}
+
+	for _, bad := range []string{"Cluster Smoke", "Cluster Smoke=soon", "Cluster Smoke=0s"} {
+		if err := (&Config{}).SetStageTimeouts(bad); err == nil {
+			t.Errorf("SetStageTimeouts(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestCapCommandTimeoutKeepsTheShorter(t *testing.T) {
+	tests := []struct {
+		name  string
+		stage time.Duration
+		want  time.Duration
+	}{
+		{"default stage timeout", 0, 5 * time.Minute},
+		{"shorter stage timeout", time.Minute, time.Minute},
+		{"longer stage timeout", time.Hour, 5 * time.Minute},
+		{"no stage timeout", -1, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := capCommandTimeout(withStageTimeout(context.Background(), tt.stage), 5*time.Minute)
+			if got := commandTimeout(ctx); got != tt.want {
+				t.Errorf("command timeout = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
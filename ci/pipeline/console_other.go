@@ -0,0 +1,8 @@
+//go:build !windows
+
+package pipeline
+
+import "os"
+
+// enableANSI is a no-op: other terminals handle escape sequences already.
+func enableANSI(*os.File) {}
@@ -0,0 +1,22 @@
+package pipeline
+
+import (
+	"os"
+	"syscall"
+)
+
+// enableVirtualTerminal is ENABLE_VIRTUAL_TERMINAL_PROCESSING.
+const enableVirtualTerminal = 0x0004
+
+var setConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+// enableANSI turns on escape sequence handling in a Windows console, which
+// older consoles leave off, so the --tui table can redraw in place.
+func enableANSI(f *os.File) {
+	h := syscall.Handle(f.Fd())
+	var mode uint32
+	if syscall.GetConsoleMode(h, &mode) != nil {
+		return
+	}
+	setConsoleMode.Call(uintptr(h), uintptr(mode|enableVirtualTerminal))
+}
@@ -0,0 +1,105 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"dagger.io/dagger"
+)
+
+// coverageDir is where kcov writes its report; it merges the runs into
+// kcov-merged/.
+const coverageDir = "/tmp/coverage"
+
+// withCoverageRuns builds each suite without running it and executes the
+// binary under kcov, one exec per step so the runner needs no shell.
+func withCoverageRuns(runner *dagger.Container) *dagger.Container {
+	ran := runner.
+		WithEnvVariable("ZIG_GLOBAL_CACHE_DIR", zigCacheEnv["ZIG_GLOBAL_CACHE_DIR"]).
+		WithEnvVariable("ZIG_LOCAL_CACHE_DIR", zigCacheEnv["ZIG_LOCAL_CACHE_DIR"]).
+		WithExec([]string{"mkdir", "-p", "/tmp/coverage-bin", coverageDir})
+	for i, t := range unitTestFiles {
+		bin := fmt.Sprintf("/tmp/coverage-bin/test-%d", i+1)
+		ran = ran.
+			WithExec(t.zigTestArgs("--test-no-exec", "-femit-bin="+bin)).
+			WithExec([]string{"kcov", "--include-path=/src/src", coverageDir, bin})
+	}
+	return ran
+}
+
+// coverageReport is the subset of kcov's coverage.json the badge needs.
+type coverageReport struct {
+	PercentCovered string `json:"percent_covered"`
+	CoveredLines   int    `json:"covered_lines"`
+	TotalLines     int    `json:"total_lines"`
+}
+
+// coverageBadge is a shields.io endpoint document:
+// https://shields.io/badges/endpoint-badge
+type coverageBadge struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Label         string `json:"label"`
+	Message       string `json:"message"`
+	Color         string `json:"color"`
+}
+
+// runCoverage runs the unit test suites under kcov, exports the HTML report
+// to coverage/html in the run directory and writes coverage/badge.json next
+// to it for the README badge. Publishing the badge is left to the workflow.
+func runCoverage(ctx context.Context, run runDir, runner *dagger.Container) error {
+	ran := runner.
+		WithExec([]string{"apk", "add", "--no-cache", "kcov", "--repository=https://dl-cdn.alpinelinux.org/alpine/edge/testing"}).
+		With(withCoverageRuns)
+
+	var raw string
+	err := runBounded(ctx, "kcov", func(ctx context.Context) (err error) {
+		raw, err = ran.File(coverageDir + "/kcov-merged/coverage.json").Contents(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var report coverageReport
+	if err := json.Unmarshal([]byte(raw), &report); err != nil {
+		return fmt.Errorf("parse kcov report: %w", err)
+	}
+	percent, err := strconv.ParseFloat(report.PercentCovered, 64)
+	if err != nil {
+		return fmt.Errorf("parse kcov percent %q: %w", report.PercentCovered, err)
+	}
+
+	if _, err := ran.Directory(coverageDir).Export(ctx, run.path("coverage", "html")); err != nil {
+		return err
+	}
+	badge, err := json.MarshalIndent(coverageBadge{
+		SchemaVersion: 1,
+		Label:         "coverage",
+		Message:       fmt.Sprintf("%.1f%%", percent),
+		Color:         coverageColor(percent),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := run.path("coverage", "badge.json")
+	if err := os.WriteFile(path, append(badge, '\n'), 0o644); err != nil {
+		return err
+	}
+	logf(ctx, "%.1f%% (%d/%d lines); badge written to %s", percent, report.CoveredLines, report.TotalLines, path)
+	return nil
+}
+
+func coverageColor(percent float64) string {
+	switch {
+	case percent >= 80:
+		return "brightgreen"
+	case percent >= 60:
+		return "yellow"
+	case percent >= 40:
+		return "orange"
+	default:
+		return "red"
+	}
+}
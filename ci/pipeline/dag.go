@@ -0,0 +1,184 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// stageStatus is how a stage ended, as far as the stages after it care.
+type stageStatus int
+
+const (
+	stagePassed stageStatus = iota
+	stageFailed
+	stageSkipped
+)
+
+func (s stageStatus) String() string {
+	switch s {
+	case stageFailed:
+		return "failed"
+	case stageSkipped:
+		return "was skipped"
+	}
+	return "passed"
+}
+
+// stageGraph orders a run's stages: each waits for the producers of its
+// Inputs and for its Deps.
+type stageGraph struct {
+	stages []Stage
+	// deps[i] are the stages i waits for, dependents[i] those waiting for i.
+	deps       [][]int
+	dependents [][]int
+}
+
+// newStageGraph builds the graph for stages, rejecting duplicate names,
+// dependencies on stages not in the run and cycles, so no stage can wait
+// forever. Inputs nobody produces are the output registry's to report.
+func newStageGraph(stages []Stage) (*stageGraph, error) {
+	index := map[string]int{}
+	producer := map[string]int{}
+	for i, s := range stages {
+		if _, ok := index[s.Name]; ok {
+			return nil, fmt.Errorf("stage %q declared twice", s.Name)
+		}
+		index[s.Name] = i
+		for _, o := range s.Outputs {
+			producer[o.Name] = i
+		}
+	}
+	g := &stageGraph{stages: stages, deps: make([][]int, len(stages)), dependents: make([][]int, len(stages))}
+	names := map[string][]string{}
+	for i, s := range stages {
+		seen := map[int]bool{}
+		add := func(j int) {
+			if !seen[j] {
+				seen[j] = true
+				g.deps[i] = append(g.deps[i], j)
+				g.dependents[j] = append(g.dependents[j], i)
+				names[s.Name] = append(names[s.Name], stages[j].Name)
+			}
+		}
+		for _, input := range s.Inputs {
+			if j, ok := producer[input]; ok {
+				add(j)
+			}
+		}
+		for _, dep := range s.Deps {
+			j, ok := index[dep]
+			if !ok {
+				return nil, fmt.Errorf("%s depends on stage %q, which is not in this run", s.Name, dep)
+			}
+			add(j)
+		}
+	}
+	if cycle := dependencyCycle(names); cycle != nil {
+		return nil, fmt.Errorf("stage dependencies form a cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return g, nil
+}
+
+// run starts every stage as soon as all it waits for has finished, so
+// independent stages fan out and a stage with several dependencies fans in;
+// the resource scheduler then decides how many actually run at once. run
+// calls start exactly once per stage, concurrently, with blocked naming the
+// first dependency that did not pass, in which case start should skip the
+// stage. It returns once every stage has finished.
+func (g *stageGraph) run(start func(s Stage, blocked string) stageStatus) {
+	type finished struct {
+		stage  int
+		status stageStatus
+	}
+	done := make(chan finished, len(g.stages))
+	waiting := make([]int, len(g.stages))
+	blocked := make([]string, len(g.stages))
+	launch := func(i int) {
+		go func() {
+			done <- finished{i, start(g.stages[i], blocked[i])}
+		}()
+	}
+	for i := range g.stages {
+		waiting[i] = len(g.deps[i])
+		if waiting[i] == 0 {
+			launch(i)
+		}
+	}
+	for range g.stages {
+		f := <-done
+		for _, j := range g.dependents[f.stage] {
+			if f.status != stagePassed && blocked[j] == "" {
+				blocked[j] = g.stages[f.stage].Name + " " + f.status.String()
+			}
+			if waiting[j]--; waiting[j] == 0 {
+				launch(j)
+			}
+		}
+	}
+}
+
+// order lists the stages so each comes after everything it waits for,
+// keeping declaration order among stages that could start together.
+func (g *stageGraph) order() []int {
+	placed := make([]bool, len(g.stages))
+	order := make([]int, 0, len(g.stages))
+	for len(order) < len(g.stages) {
+		for i := range g.stages {
+			ready := !placed[i]
+			for _, j := range g.deps[i] {
+				ready = ready && placed[j]
+			}
+			if ready {
+				placed[i] = true
+				order = append(order, i)
+				break
+			}
+		}
+	}
+	return order
+}
+
+// dependencyCycle returns a cycle in the stage -> dependency graph, if any.
+func dependencyCycle(deps map[string][]string) []string {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var path []string
+	var visit func(stage string) []string
+	visit = func(stage string) []string {
+		switch state[stage] {
+		case visiting:
+			for i, s := range path {
+				if s == stage {
+					return append(append([]string(nil), path[i:]...), stage)
+				}
+			}
+		case done:
+			return nil
+		}
+		state[stage] = visiting
+		path = append(path, stage)
+		for _, dep := range deps[stage] {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[stage] = done
+		return nil
+	}
+	stages := make([]string, 0, len(deps))
+	for stage := range deps {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		if cycle := visit(stage); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
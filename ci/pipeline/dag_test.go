@@ -0,0 +1,155 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStageGraphRejectsBadDependencies(t *testing.T) {
+	tests := []struct {
+		name   string
+		stages []Stage
+		want   string
+	}{
+		{"unknown dependency", []Stage{{Name: "A", Deps: []string{"Nope"}}}, `A depends on stage "Nope", which is not in this run`},
+		{"duplicate stage", []Stage{{Name: "A"}, {Name: "A"}}, `stage "A" declared twice`},
+		{"dependency cycle", []Stage{{Name: "A", Deps: []string{"B"}}, {Name: "B", Deps: []string{"A"}}}, "cycle: A -> B -> A"},
+		{"output cycle", []Stage{
+			{Name: "A", Outputs: []Output{{"a", OutputJSON}}, Inputs: []string{"b"}},
+			{Name: "B", Outputs: []Output{{"b", OutputJSON}}, Inputs: []string{"a"}},
+		}, "cycle: A -> B -> A"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newStageGraph(tt.stages)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestStageGraphFansOutAndIn runs one producer feeding two consumers that
+// a final stage waits for, checking each starts only after what it needs
+// and that the consumers overlap.
+func TestStageGraphFansOutAndIn(t *testing.T) {
+	g, err := newStageGraph([]Stage{
+		{Name: "Report", Deps: []string{"Integration", "Smoke"}},
+		{Name: "Smoke", Inputs: []string{"binary"}},
+		{Name: "Integration", Inputs: []string{"binary"}},
+		{Name: "Binary", Outputs: []Output{{"binary", OutputFile}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	finished := map[string]bool{}
+	running, overlap := 0, false
+	g.run(func(s Stage, blocked string) stageStatus {
+		mu.Lock()
+		for _, need := range map[string][]string{"Smoke": {"Binary"}, "Integration": {"Binary"}, "Report": {"Integration", "Smoke"}}[s.Name] {
+			if !finished[need] {
+				t.Errorf("%s started before %s finished", s.Name, need)
+			}
+		}
+		if blocked != "" {
+			t.Errorf("%s blocked by %q", s.Name, blocked)
+		}
+		running++
+		overlap = overlap || running > 1
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		finished[s.Name] = true
+		mu.Unlock()
+		return stagePassed
+	})
+	if len(finished) != 4 {
+		t.Errorf("ran %v, want all four stages", finished)
+	}
+	if !overlap {
+		t.Error("Integration and Smoke did not run concurrently")
+	}
+}
+
+func TestStageGraphBlocksDependentsOfFailedStages(t *testing.T) {
+	g, err := newStageGraph([]Stage{
+		{Name: "Binary", Outputs: []Output{{"binary", OutputFile}}},
+		{Name: "Smoke", Inputs: []string{"binary"}},
+		{Name: "Report", Deps: []string{"Smoke"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	blockedBy := map[string]string{}
+	g.run(func(s Stage, blocked string) stageStatus {
+		mu.Lock()
+		defer mu.Unlock()
+		blockedBy[s.Name] = blocked
+		switch {
+		case s.Name == "Binary":
+			return stageFailed
+		case blocked != "":
+			return stageSkipped
+		}
+		return stagePassed
+	})
+	if blockedBy["Smoke"] != "Binary failed" || blockedBy["Report"] != "Smoke was skipped" {
+		t.Errorf("blocked = %v", blockedBy)
+	}
+}
+
+func TestIntegrationAndSmokeShareOneBinary(t *testing.T) {
+	stages := map[string]Stage{}
+	for _, s := range New(Options{}).Stages {
+		stages[s.Name] = s
+	}
+	producers := 0
+	for _, s := range stages {
+		for _, o := range s.Outputs {
+			if o.Name == mycoBinaryOutput {
+				producers++
+			}
+		}
+	}
+	if producers != 1 {
+		t.Fatalf("%d stages produce %s, want 1", producers, mycoBinaryOutput)
+	}
+	for _, name := range []string{"Integration Test", "Cluster Smoke"} {
+		if inputs := stages[name].Inputs; len(inputs) != 1 || inputs[0] != mycoBinaryOutput {
+			t.Errorf("%s inputs = %v, want the shared binary", name, inputs)
+		}
+	}
+
+	exec := &fakeExecutor{}
+	if err := stages["Integration Test"].Run(context.Background(), &Env{Exec: exec, outputs: publishedBinary(t)}); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.commands()[0]
+	if _, ok := cmd.Mounts[mycoBinaryMount]; !ok || cmd.Env["MYCO_BIN"] != mycoBinaryMount {
+		t.Errorf("integration command mounts %v with MYCO_BIN %q", cmd.Mounts, cmd.Env["MYCO_BIN"])
+	}
+	if strings.Contains(cmd.Args[len(cmd.Args)-1], "zig build") {
+		t.Error("integration script still builds its own binary")
+	}
+}
+
+// publishedBinary is a registry with the myco binary output published.
+func publishedBinary(t *testing.T) *outputRegistry {
+	t.Helper()
+	r, err := newOutputRegistry([]Stage{{Name: "Myco Binary", Outputs: []Output{{mycoBinaryOutput, OutputFile}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.publish(mycoBinaryOutput, stageOutput{Kind: OutputFile}); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
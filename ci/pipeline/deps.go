@@ -0,0 +1,265 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// zonDependency is a url-pinned entry from build.zig.zon. Path dependencies
+// are local and have nothing to go stale against.
+type zonDependency struct {
+	Name string
+	URL  string
+}
+
+var (
+	zonDepURL = regexp.MustCompile(`\.(\w+|@"[^"]+")\s*=\s*\.\{[^{}]*?\.url\s*=\s*"([^"]+)"`)
+	// Archive URLs pin a tag: .../archive/refs/tags/v1.2.3.tar.gz
+	archiveTag = regexp.MustCompile(`^(https://github\.com/[^/]+/[^/]+)/archive/(?:refs/tags/)?(.+?)\.(?:tar\.gz|tgz|zip)$`)
+	// git+ URLs pin a commit: git+https://host/repo.git#<sha>
+	gitCommit = regexp.MustCompile(`^git\+(\S+?)#([0-9a-f]{7,40})$`)
+)
+
+// parseZonDependencies extracts url dependencies from build.zig.zon source.
+func parseZonDependencies(zon string) []zonDependency {
+	var deps []zonDependency
+	for _, m := range zonDepURL.FindAllStringSubmatch(stripZonComments(zon), -1) {
+		name := strings.TrimSuffix(strings.TrimPrefix(m[1], `@"`), `"`)
+		deps = append(deps, zonDependency{Name: name, URL: m[2]})
+	}
+	return deps
+}
+
+// stripZonComments drops // comments while leaving "//" inside strings,
+// such as URLs, alone.
+func stripZonComments(zon string) string {
+	var b strings.Builder
+	inString, inComment := false, false
+	for i := 0; i < len(zon); i++ {
+		c := zon[i]
+		switch {
+		case inComment:
+			if c != '\n' {
+				continue
+			}
+			inComment = false
+		case inString:
+			if c == '\\' && i+1 < len(zon) {
+				b.WriteByte(c)
+				i++
+				c = zon[i]
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '/' && i+1 < len(zon) && zon[i+1] == '/':
+			inComment = true
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// dependencyStatus is one row of the freshness report.
+type dependencyStatus struct {
+	Name     string
+	Pinned   string
+	Latest   string
+	Note     string
+	Outdated bool
+}
+
+// runDependencyReport compares each build.zig.zon dependency with its
+// upstream and writes deps-report.md to the run directory. It never edits build.zig.zon and
+// only fails when the report itself cannot be produced. With
+// MYCO_DEPS_PR_COMMENT=1 and a GITHUB_TOKEN the report is also posted on the
+// pull request being built, through hc.
+func runDependencyReport(ctx context.Context, run runDir, client *dagger.Client, hc *http.Client) error {
+	zon, err := os.ReadFile("build.zig.zon")
+	if err != nil {
+		return err
+	}
+	deps := parseZonDependencies(string(zon))
+
+	var rows []dependencyStatus
+	if len(deps) > 0 {
+		git := client.Container().From("alpine/git:latest")
+		for _, dep := range deps {
+			rows = append(rows, checkDependency(ctx, git, dep))
+		}
+	}
+
+	report := renderDependencyReport(rows)
+	path := run.path("deps-report.md")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(report), 0o644); err != nil {
+		return err
+	}
+	logf(ctx, "%s", report)
+
+	if os.Getenv("MYCO_DEPS_PR_COMMENT") == "1" {
+		if err := commentOnPullRequest(ctx, hc, report); err != nil {
+			logf(ctx, "warning: PR comment not posted: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkDependency asks the upstream for its refs with git ls-remote. Lookup
+// failures become notes in the report rather than stage failures.
+func checkDependency(ctx context.Context, git *dagger.Container, dep zonDependency) dependencyStatus {
+	status := dependencyStatus{Name: dep.Name, Pinned: dep.URL}
+	lsRemote := func(args ...string) (out string, err error) {
+		err = runBounded(ctx, "git ls-remote", func(ctx context.Context) (err error) {
+			out, err = git.WithExec(append([]string{"git", "ls-remote"}, args...)).Stdout(ctx)
+			return err
+		})
+		return out, err
+	}
+
+	if m := archiveTag.FindStringSubmatch(dep.URL); m != nil {
+		status.Pinned = m[2]
+		out, err := lsRemote("--tags", m[1]+".git")
+		if err != nil {
+			status.Note = "upstream lookup failed"
+			return status
+		}
+		latest := latestTag(out)
+		status.Latest = latest
+		status.Outdated = latest != "" && compareVersions(latest, m[2]) > 0
+		return status
+	}
+	if m := gitCommit.FindStringSubmatch(dep.URL); m != nil {
+		status.Pinned = m[2][:min(len(m[2]), 12)]
+		out, err := lsRemote(m[1], "HEAD")
+		if err != nil || len(out) < 12 {
+			status.Note = "upstream lookup failed"
+			return status
+		}
+		head := strings.Fields(out)[0]
+		status.Latest = head[:12]
+		status.Outdated = !strings.HasPrefix(head, m[2])
+		return status
+	}
+	status.Note = "unrecognised URL form; check manually"
+	return status
+}
+
+// latestTag picks the highest version-looking tag from ls-remote output.
+func latestTag(lsRemote string) string {
+	var tags []string
+	for _, line := range strings.Split(lsRemote, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.HasSuffix(fields[1], "^{}") {
+			continue
+		}
+		tag := strings.TrimPrefix(fields[1], "refs/tags/")
+		if versionParts(tag) != nil {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return compareVersions(tags[i], tags[j]) > 0 })
+	if len(tags) == 0 {
+		return ""
+	}
+	return tags[0]
+}
+
+// versionParts splits "v1.2.3" into [1 2 3]; pre-release tags return nil.
+func versionParts(tag string) []int {
+	var parts []int
+	for _, p := range strings.Split(strings.TrimPrefix(tag, "v"), ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+func compareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < max(len(pa), len(pb)); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			return x - y
+		}
+	}
+	return 0
+}
+
+func renderDependencyReport(rows []dependencyStatus) string {
+	var b strings.Builder
+	b.WriteString("## Dependency freshness\n\n")
+	if len(rows) == 0 {
+		b.WriteString("build.zig.zon has no url dependencies.\n")
+		return b.String()
+	}
+	outdated := 0
+	b.WriteString("| dependency | pinned | latest | status |\n|---|---|---|---|\n")
+	for _, r := range rows {
+		state := "up to date"
+		switch {
+		case r.Note != "":
+			state = r.Note
+		case r.Outdated:
+			state = "outdated"
+			outdated++
+		}
+		fmt.Fprintf(&b, "| %s | `%s` | `%s` | %s |\n", r.Name, r.Pinned, r.Latest, state)
+	}
+	fmt.Fprintf(&b, "\n%d of %d dependencies are outdated.\n", outdated, len(rows))
+	return b.String()
+}
+
+// commentOnPullRequest posts body on the PR named by GITHUB_REF
+// (refs/pull/<n>/merge) in GITHUB_REPOSITORY.
+func commentOnPullRequest(ctx context.Context, hc *http.Client, body string) error {
+	token, repo := os.Getenv("GITHUB_TOKEN"), os.Getenv("GITHUB_REPOSITORY")
+	var pr int
+	if _, err := fmt.Sscanf(os.Getenv("GITHUB_REF"), "refs/pull/%d/merge", &pr); err != nil || token == "" || repo == "" {
+		return fmt.Errorf("not a pull request build with GITHUB_TOKEN set")
+	}
+	payload, err := json.Marshal(map[string]string{"body": body})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("https://api.github.com/repos/%s/issues/%d/comments", repo, pr)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("GitHub API returned %s", resp.Status)
+	}
+	return nil
+}
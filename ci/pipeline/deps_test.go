@@ -0,0 +1,36 @@
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseZonDependencies(t *testing.T) {
+	zon := `.{
+    .name = .myco,
+    .version = "0.1.0",
+    // .old = .{ .url = "https://example.com/old.tar.gz" },
+    .dependencies = .{
+        .zap = .{
+            .url = "https://github.com/zigzap/zap/archive/refs/tags/v0.9.1.tar.gz", // pinned
+            .hash = "zap-0.9.1",
+        },
+        .@"lib-x" = .{ .url = "git+https://codeberg.org/x/lib.git#0123456789abcdef" },
+        .local = .{ .path = "vendor/local" },
+    },
+}`
+	want := []zonDependency{
+		{Name: "zap", URL: "https://github.com/zigzap/zap/archive/refs/tags/v0.9.1.tar.gz"},
+		{Name: "lib-x", URL: "git+https://codeberg.org/x/lib.git#0123456789abcdef"},
+	}
+	if got := parseZonDependencies(zon); !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseZonDependencies() = %+v, want %+v", got, want)
+	}
+}
+
+func TestLatestTag(t *testing.T) {
+	out := "aaa\trefs/tags/v0.9.1\nbbb\trefs/tags/v0.10.0\nccc\trefs/tags/v0.10.0^{}\nddd\trefs/tags/v1.0.0-rc1\n"
+	if got := latestTag(out); got != "v0.10.0" {
+		t.Fatalf("latestTag() = %q, want v0.10.0", got)
+	}
+}
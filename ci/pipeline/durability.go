@@ -0,0 +1,156 @@
+package pipeline
+
+// walCompactionScenario rewrites the same services many times so the WAL
+// grows past MYCO_WAL_COMPACT_BYTES, then checks that a checkpoint was taken,
+// the log shrank back under the threshold, and a restart recovers the same
+// state from checkpoint + log.
+var walCompactionScenario = scenario{
+	Name:    "WAL Compaction",
+	Pending: "the WAL is an in-memory buffer without checkpoints or compaction (src/db/wal.zig)",
+	Script: `
+build_myco
+
+COMPACT_BYTES=65536
+WAVES=40
+SERVICES=20
+
+start_node 0 MYCO_WAL_COMPACT_BYTES="${COMPACT_BYTES}"
+sleep 2
+check_daemons
+
+echo "==> Rewriting ${SERVICES} services ${WAVES} times..."
+for wave in $(seq 1 "${WAVES}"); do
+  deploy_services 0 1 "${SERVICES}" "wave${wave}"
+done
+wait_until 30 "n1 holds ${SERVICES} services" services_known_at_least 0 "${SERVICES}"
+
+dir=$(node_dir 0)
+ls -la "$dir"
+wal_bytes() {
+  find "$dir" -maxdepth 1 -name 'wal*' -type f -exec cat {} + | wc -c
+}
+checkpoint_taken() {
+  [ -n "$(find "$dir" -maxdepth 1 \( -name 'checkpoint*' -o -name 'snapshot*' \) -type f)" ]
+}
+wal_compacted() {
+  [ "$(wal_bytes)" -le "${COMPACT_BYTES}" ]
+}
+wait_until 30 "checkpoint written" checkpoint_taken
+wait_until 30 "WAL compacted below ${COMPACT_BYTES} bytes (now $(wal_bytes))" wal_compacted
+
+before_status=$(node_status 0)
+before_known=$(status_field 0 services_known)
+before_height=$(status_field 0 knowledge_height)
+
+echo "==> Restarting n1 from checkpoint + WAL..."
+stop_node 0
+start_node 0 MYCO_WAL_COMPACT_BYTES="${COMPACT_BYTES}"
+sleep 2
+check_daemons
+
+after_known=$(status_field 0 services_known)
+after_height=$(status_field 0 knowledge_height)
+if [ "${after_known}" != "${before_known}" ] || [ "${after_height}" -lt "${before_height}" ]; then
+  echo "before restart:"
+  echo "${before_status}"
+  echo "after restart:"
+  node_status 0
+  fail "recovered state differs (services ${before_known} -> ${after_known}, height ${before_height} -> ${after_height})"
+fi
+ok "recovered ${after_known} services at height ${after_height} after compaction"
+`,
+}
+
+// killDurabilityScenario SIGKILLs the daemon right after it acknowledges
+// deploys. Every acknowledged service must survive the restart, which only
+// holds if the WAL is fsynced before the API replies.
+var killDurabilityScenario = scenario{
+	Name:    "Kill -9 Durability",
+	Pending: "the WAL lives in memory and is not fsynced to MYCO_STATE_DIR (src/db/wal.zig)",
+	Script: `
+build_myco
+
+ROUNDS=5
+PER_ROUND=4
+acked=0
+
+start_node 0
+sleep 2
+check_daemons
+
+for round in $(seq 1 "${ROUNDS}"); do
+  for i in $(seq 1 "${PER_ROUND}"); do
+    id=$((acked + 1))
+    write_services "$(node_dir 0)/myco.json" "$id" 1 "durable-${id}"
+    out=$(myco_cli 0 deploy 2>&1 || true)
+    grep -q "Deployed ID ${id}" <<<"$out" || fail "deploy of id ${id} was not acknowledged: ${out}"
+    acked=$id
+  done
+
+  echo "==> Round ${round}: SIGKILL after ${acked} acknowledged deploys"
+  kill -9 "${PIDS[0]}"
+  wait "${PIDS[0]}" 2>/dev/null || true
+  start_node 0
+  sleep 2
+  check_daemons
+
+  known=$(status_field 0 services_known)
+  if [ -z "$known" ] || [ "$known" -lt "$acked" ]; then
+    node_status 0
+    fail "round ${round}: only ${known:-0} of ${acked} acknowledged services survived kill -9"
+  fi
+  ok "round ${round}: ${known} services after restart"
+done
+`,
+}
+
+// stateMigrationScenario starts the current binary on a state directory
+// written by the previous release (ci/fixtures, or a tarball from
+// MYCO_STATE_FIXTURE_URL) and checks identity, peers and deploys still work.
+var stateMigrationScenario = scenario{
+	Name: "State Migration",
+	Env:  []string{"MYCO_STATE_FIXTURE_URL"},
+	Script: `
+build_myco
+
+STATE_FIXTURE=/src/ci/fixtures/state-0.0.0
+if [ -n "${MYCO_STATE_FIXTURE_URL:-}" ]; then
+  echo "==> Downloading state fixture from ${MYCO_STATE_FIXTURE_URL}..."
+  mkdir -p "${STATE}/fixture"
+  curl -fsSL "${MYCO_STATE_FIXTURE_URL}" | tar -xz -C "${STATE}/fixture"
+  STATE_FIXTURE="${STATE}/fixture"
+fi
+[ -d "${STATE_FIXTURE}/state" ] || fail "fixture ${STATE_FIXTURE} has no state/ directory"
+
+dir=$(node_dir 0)
+mkdir -p "$dir"
+cp -a "${STATE_FIXTURE}/state/." "$dir/"
+peers_before=$(grep -c . "$dir/peers.list")
+
+migration_broken() {
+  echo "[FAIL] state dir from $(basename "${STATE_FIXTURE}") no longer loads: $*"
+  echo "[FAIL] the on-disk format changed without a migration path"
+  exit 1
+}
+
+start_node 0
+sleep 2
+node_alive 0 || migration_broken "daemon exited on startup"
+[ -n "$(status_field 0 node_id)" ] || migration_broken "status does not answer"
+
+pub=$(MYCO_STATE_DIR="$dir" "${BIN}" pubkey)
+[ "$pub" = "$(cat "${STATE_FIXTURE}/pubkey")" ] || migration_broken "node.key yields ${pub}, want $(cat "${STATE_FIXTURE}/pubkey")"
+ok "persistent identity preserved"
+
+peer_add 0 1
+peers_after=$(grep -c . "$dir/peers.list")
+[ "$peers_after" -eq $((peers_before + 1)) ] || migration_broken "peers.list has ${peers_after} peers after add, want $((peers_before + 1))"
+while read -r line; do
+  grep -qxF "$line" "$dir/peers.list" || migration_broken "peer '${line}' lost from peers.list"
+done <"${STATE_FIXTURE}/state/peers.list"
+ok "existing peers preserved"
+
+deploy_services 0 1 2 migrated
+wait_until 30 "deploys work on the migrated state dir" services_known_at_least 0 2
+`,
+}
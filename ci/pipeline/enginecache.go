@@ -0,0 +1,258 @@
+package pipeline
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// Defaults for 'ci cache prune'. Long-lived self-hosted runners keep one
+// engine for weeks, and without a bound its cache fills the disk.
+const (
+	defaultCacheKeep   = "10GB"
+	defaultCacheMaxAge = 7 * 24 * time.Hour
+)
+
+// defaultMinFree is the free engine disk space the preflight asks for
+// before the stages start.
+const defaultMinFree = 5e9
+
+// cachePolicy bounds the engine's local cache: at most Keep bytes, and no
+// idle entry older than MaxAge (zero disables the age check).
+type cachePolicy struct {
+	Keep   int64
+	MaxAge time.Duration
+}
+
+// cacheEntry is what the policy needs to know about one engine cache entry.
+type cacheEntry struct {
+	Bytes    int64
+	LastUsed time.Time
+	Active   bool
+}
+
+// byteUnits are the suffixes parseBytes accepts, longest first so "GiB"
+// is not read as "B".
+var byteUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseBytes reads a size such as 10GB, 512MiB or 1.5GB; a bare number is
+// bytes.
+func parseBytes(s string) (int64, error) {
+	value, scale := strings.TrimSpace(s), 1.0
+	for _, u := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(value), strings.ToUpper(u.suffix)) {
+			value, scale = strings.TrimSpace(value[:len(value)-len(u.suffix)]), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("size %q: want a number with an optional unit such as 10GB", s)
+	}
+	return int64(n * scale), nil
+}
+
+// formatBytes renders n in decimal units, matching what parseBytes reads.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1e12:
+		return fmt.Sprintf("%.1fTB", float64(n)/1e12)
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fGB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fMB", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.1fKB", float64(n)/1e3)
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// violations says how entries break the policy at now; none means the
+// cache can be left alone.
+func (p cachePolicy) violations(entries []cacheEntry, now time.Time) []string {
+	var total, stale int64
+	staleCount := 0
+	for _, e := range entries {
+		total += e.Bytes
+		if p.MaxAge > 0 && !e.Active && now.Sub(e.LastUsed) > p.MaxAge {
+			stale += e.Bytes
+			staleCount++
+		}
+	}
+	var problems []string
+	if total > p.Keep {
+		problems = append(problems, fmt.Sprintf("%s cached, over the %s limit", formatBytes(total), formatBytes(p.Keep)))
+	}
+	if staleCount > 0 {
+		problems = append(problems, fmt.Sprintf("%d entries (%s) idle for over %s", staleCount, formatBytes(stale), p.MaxAge))
+	}
+	return problems
+}
+
+// engineCacheEntries lists the engine's local cache entries.
+func engineCacheEntries(ctx context.Context, client *dagger.Client) ([]cacheEntry, error) {
+	list, err := client.Engine().LocalCache().EntrySet().Entries(ctx)
+	if err != nil {
+		return nil, &InfraError{Op: "list engine cache", Err: err}
+	}
+	entries := make([]cacheEntry, 0, len(list))
+	for i := range list {
+		size, err := list[i].DiskSpaceBytes(ctx)
+		if err != nil {
+			return nil, &InfraError{Op: "read engine cache entry", Err: err}
+		}
+		used, err := list[i].MostRecentUseTimeUnixNano(ctx)
+		if err != nil {
+			return nil, &InfraError{Op: "read engine cache entry", Err: err}
+		}
+		active, err := list[i].ActivelyUsed(ctx)
+		if err != nil {
+			return nil, &InfraError{Op: "read engine cache entry", Err: err}
+		}
+		entries = append(entries, cacheEntry{Bytes: int64(size), LastUsed: time.Unix(0, int64(used)), Active: active})
+	}
+	return entries, nil
+}
+
+func cacheBytes(entries []cacheEntry) int64 {
+	var total int64
+	for _, e := range entries {
+		total += e.Bytes
+	}
+	return total
+}
+
+// pruneEngineCache brings the engine cache within policy. The engine cannot
+// prune chosen entries, only apply its own GC policy or release everything
+// not in use, so the default policy goes first and a full prune follows only
+// if the cache still breaks policy.
+func pruneEngineCache(ctx context.Context, client *dagger.Client, policy cachePolicy) error {
+	cache := client.Engine().LocalCache()
+	entries, err := engineCacheEntries(ctx, client)
+	if err != nil {
+		return err
+	}
+	before := cacheBytes(entries)
+	problems := policy.violations(entries, time.Now())
+	if len(problems) == 0 {
+		fmt.Printf("Engine cache: %s in %d entries, within policy\n", formatBytes(before), len(entries))
+		return nil
+	}
+	fmt.Printf("Engine cache: %s; pruning with the engine's default policy\n", strings.Join(problems, "; "))
+	for _, opts := range []dagger.EngineCachePruneOpts{{UseDefaultPolicy: true}, {}} {
+		if err := cache.Prune(ctx, opts); err != nil {
+			return &InfraError{Op: "prune engine cache", Err: err}
+		}
+		if entries, err = engineCacheEntries(ctx, client); err != nil {
+			return err
+		}
+		if problems = policy.violations(entries, time.Now()); len(problems) == 0 {
+			break
+		}
+		if opts.UseDefaultPolicy {
+			fmt.Printf("Engine cache: %s; releasing every entry not in use\n", strings.Join(problems, "; "))
+		}
+	}
+	after := cacheBytes(entries)
+	fmt.Printf("Engine cache: %s -> %s (%d entries)\n", formatBytes(before), formatBytes(after), len(entries))
+	if len(problems) > 0 {
+		return fmt.Errorf("engine cache still breaks policy after pruning, held by running builds: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// parseDfAvailable reads the available bytes from "df -Pk" output.
+func parseDfAvailable(out string) (int64, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("unexpected df output %q", out)
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 4 {
+		return 0, fmt.Errorf("unexpected df output %q", out)
+	}
+	kib, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected df output %q: %w", out, err)
+	}
+	return kib * 1024, nil
+}
+
+// engineFreeBytes is the free space on the engine's storage, measured from
+// inside a container, whose root filesystem lives there.
+func engineFreeBytes(ctx context.Context, c *dagger.Container) (int64, error) {
+	// The timestamp keeps the engine from answering with a cached result.
+	measured := c.WithEnvVariable("MYCO_CI_PREFLIGHT", time.Now().String()).
+		WithExec([]string{"df", "-Pk", "/"})
+	var out string
+	err := runBounded(ctx, "df", func(ctx context.Context) (err error) {
+		out, err = measured.Stdout(ctx)
+		return err
+	})
+	if err != nil {
+		return 0, &InfraError{Op: "measure engine disk", Err: err}
+	}
+	return parseDfAvailable(out)
+}
+
+// preflightDisk makes sure the engine has minFree bytes free before the
+// stages start, pruning its cache down to keep bytes if not, and fails fast
+// when that is still not enough rather than letting a build hit ENOSPC
+// halfway through.
+func preflightDisk(ctx context.Context, client *dagger.Client, c *dagger.Container, minFree, keep int64) error {
+	free, err := engineFreeBytes(ctx, c)
+	if err != nil {
+		return err
+	}
+	if free >= minFree {
+		fmt.Printf("Engine disk: %s free\n", formatBytes(free))
+		return nil
+	}
+	fmt.Printf("Engine disk: %s free, below the %s watermark; pruning the engine cache\n", formatBytes(free), formatBytes(minFree))
+	if err := pruneEngineCache(ctx, client, cachePolicy{Keep: keep}); err != nil {
+		fmt.Printf("warning: %v\n", err)
+	}
+	if free, err = engineFreeBytes(ctx, c); err != nil {
+		return err
+	}
+	if free < minFree {
+		return &InfraError{Op: "disk preflight", Err: fmt.Errorf("engine has %s free after pruning, need %s; free space on the runner or lower min_free in %s", formatBytes(free), formatBytes(minFree), DefaultConfigPath)}
+	}
+	fmt.Printf("Engine disk: %s free after pruning\n", formatBytes(free))
+	return nil
+}
+
+// runCachePrune implements "ci cache prune [-keep SIZE] [-max-age DURATION]".
+func runCachePrune(args []string) error {
+	fs := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+	keep := fs.String("keep", defaultCacheKeep, "largest engine cache to leave, e.g. 10GB or 512MiB")
+	maxAge := fs.Duration("max-age", defaultCacheMaxAge, "prune when entries have been idle this long; 0 disables")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	keepBytes, err := parseBytes(*keep)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	client, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stdout))
+	if err != nil {
+		return &InfraError{Op: "connect to dagger", Err: err}
+	}
+	defer client.Close()
+	return pruneEngineCache(ctx, client, cachePolicy{Keep: keepBytes, MaxAge: *maxAge})
+}
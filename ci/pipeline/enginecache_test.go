@@ -0,0 +1,57 @@
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBytes(t *testing.T) {
+	for in, want := range map[string]int64{
+		"10GB":   10e9,
+		"512MiB": 512 << 20,
+		"1.5gb":  1.5e9,
+		"2048":   2048,
+		" 3 KB ": 3000,
+	} {
+		if got, err := parseBytes(in); err != nil || got != want {
+			t.Errorf("parseBytes(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "GB", "ten GB", "-1GB"} {
+		if _, err := parseBytes(in); err == nil {
+			t.Errorf("parseBytes(%q) succeeded", in)
+		}
+	}
+}
+
+func TestCachePolicyViolations(t *testing.T) {
+	now := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	policy := cachePolicy{Keep: 10e9, MaxAge: 7 * 24 * time.Hour}
+	fresh := cacheEntry{Bytes: 4e9, LastUsed: now.Add(-time.Hour)}
+	stale := cacheEntry{Bytes: 2e9, LastUsed: now.Add(-30 * 24 * time.Hour)}
+	staleActive := cacheEntry{Bytes: 1e9, LastUsed: now.Add(-30 * 24 * time.Hour), Active: true}
+
+	if got := policy.violations([]cacheEntry{fresh, fresh, staleActive}, now); got != nil {
+		t.Errorf("within policy: %q", got)
+	}
+	got := policy.violations([]cacheEntry{fresh, fresh, stale, staleActive}, now)
+	want := []string{"11.0GB cached, over the 10.0GB limit", "1 entries (2.0GB) idle for over 168h0m0s"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("violations = %q, want %q", got, want)
+	}
+	if got := (cachePolicy{Keep: 10e9}).violations([]cacheEntry{stale}, now); got != nil {
+		t.Errorf("age check ran with MaxAge 0: %q", got)
+	}
+}
+
+func TestParseDfAvailable(t *testing.T) {
+	out := "Filesystem     1024-blocks      Used Available Capacity Mounted on\noverlay         102687672  81234567  16170385      84% /\n"
+	got, err := parseDfAvailable(out)
+	if err != nil || got != 16170385*1024 {
+		t.Errorf("parseDfAvailable = %d, %v", got, err)
+	}
+	if _, err := parseDfAvailable("df: /: No such file or directory"); err == nil {
+		t.Error("garbage parsed")
+	}
+}
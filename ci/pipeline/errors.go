@@ -0,0 +1,257 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// Exit codes for the ci command, most severe failure first when a run fails
+// in several ways.
+const (
+	ExitOK       = 0
+	ExitStage    = 1 // a check failed: the code under test is at fault
+	ExitUsage    = 2 // the command line was wrong
+	ExitArtifact = 3 // outputs could not be written or read back
+	ExitTimeout  = 4 // a deadline expired
+	ExitInfra    = 5 // the engine or network failed; rerunning may help
+	// ExitInterrupted is 128+SIGINT, as shells report a run stopped by
+	// Ctrl+C.
+	ExitInterrupted = 130
+)
+
+// StageError is a stage whose command ran and failed. Command and ExitCode
+// are empty when the failure was not a process exit, e.g. a Verify check.
+// Stage is empty until the error leaves the stage.
+type StageError struct {
+	Stage    string
+	Command  string
+	ExitCode int
+	Output   string
+	Err      error
+}
+
+func (e *StageError) Error() string {
+	var parts []string
+	if e.Stage != "" {
+		parts = append(parts, fmt.Sprintf("[%s] failed", e.Stage))
+	}
+	if e.Command != "" {
+		parts = append(parts, fmt.Sprintf("%s exited with code %d", e.Command, e.ExitCode))
+	}
+	if e.Err != nil {
+		parts = append(parts, e.Err.Error())
+	}
+	msg := strings.Join(parts, ": ")
+	if e.Output != "" {
+		msg += ":\n" + e.Output
+	}
+	return msg
+}
+
+func (e *StageError) Unwrap() error { return e.Err }
+
+// InfraError is a failure to run anything at all: the engine, an image pull
+// or a package mirror.
+type InfraError struct {
+	Stage string
+	Op    string
+	Err   error
+}
+
+func (e *InfraError) Error() string {
+	if e.Stage == "" {
+		return fmt.Sprintf("infrastructure: %s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("[%s] infrastructure: %s: %v", e.Stage, e.Op, e.Err)
+}
+
+func (e *InfraError) Unwrap() error { return e.Err }
+
+// TimeoutError is a stage cut off by the pipeline deadline, or a command of
+// it that ran past the stage's timeout.
+type TimeoutError struct {
+	Stage string
+	After time.Duration
+	Err   error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("[%s] timed out after %s: %v", e.Stage, e.After.Round(time.Second), e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error { return e.Err }
+
+// ArtifactError is a build output that could not be exported, hashed or
+// recorded.
+type ArtifactError struct {
+	Path string
+	Err  error
+}
+
+func (e *ArtifactError) Error() string {
+	return fmt.Sprintf("artifact %s: %v", e.Path, e.Err)
+}
+
+func (e *ArtifactError) Unwrap() error { return e.Err }
+
+// WarningError is a stage that found something worth a look but not worth
+// failing the run over, such as a benchmark regression. runStages records the
+// stage as warned, lists the warnings after the run and carries on.
+type WarningError struct {
+	Stage    string
+	Warnings []string
+}
+
+func (e *WarningError) Error() string {
+	return fmt.Sprintf("[%s] warning: %s", e.Stage, strings.Join(e.Warnings, "\n  "))
+}
+
+// UsageError is a command given arguments it does not take.
+type UsageError struct {
+	Err error
+}
+
+func (e *UsageError) Error() string { return e.Err.Error() }
+
+func (e *UsageError) Unwrap() error { return e.Err }
+
+// parseFlags parses args into fs, made with flag.ContinueOnError, which
+// has printed what was wrong along with the usage by the time this returns.
+// -h returns flag.ErrHelp, for the caller to exit quietly.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return &UsageError{Err: err}
+	}
+	return nil
+}
+
+// classify turns whatever a stage returned into one of the typed errors,
+// filling in the stage name. Anything that is not already typed is a
+// StageError, with the command and output when Dagger reports a failed exec.
+// Typed errors nested deeper are kept in the chain for ExitCode.
+func classify(ctx context.Context, stage string, elapsed time.Duration, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		if _, ok := err.(*TimeoutError); !ok {
+			return &TimeoutError{Stage: stage, After: elapsed, Err: err}
+		}
+	}
+	switch e := err.(type) {
+	case *StageError:
+		if e.Stage == "" {
+			e.Stage = stage
+		}
+		return e
+	case *InfraError:
+		if e.Stage == "" {
+			e.Stage = stage
+		}
+		return e
+	case *WarningError:
+		if e.Stage == "" {
+			e.Stage = stage
+		}
+		return e
+	case *TimeoutError:
+		if e.Stage == "" {
+			e.Stage = stage
+		}
+		return e
+	case *ArtifactError:
+		return err
+	}
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		return &StageError{
+			Stage:    stage,
+			Command:  strings.Join(execErr.Cmd, " "),
+			ExitCode: execErr.ExitCode,
+			Output:   strings.TrimSpace(execErr.Stdout + "\n" + execErr.Stderr),
+		}
+	}
+	return &StageError{Stage: stage, Err: err}
+}
+
+var stageLabel = regexp.MustCompile(`^\[([^\]]+)\] `)
+
+// failures is the joined errors of stages that ran in parallel. Stages that
+// failed with the same message, e.g. every build shard hitting one compile
+// error, are reported once with the stages that hit it. Unwrap keeps every
+// error for ExitCode.
+type failures []error
+
+func joinFailures(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return failures(errs)
+}
+
+func (f failures) Error() string {
+	type group struct {
+		stages []string
+		body   string
+	}
+	var groups []*group
+	byBody := map[string]*group{}
+	for _, err := range f {
+		msg := err.Error()
+		stage := ""
+		if m := stageLabel.FindStringSubmatch(msg); m != nil {
+			stage, msg = m[1], msg[len(m[0]):]
+		}
+		g := byBody[msg]
+		if g == nil {
+			g = &group{body: msg}
+			byBody[msg] = g
+			groups = append(groups, g)
+		}
+		if stage != "" {
+			g.stages = append(g.stages, stage)
+		}
+	}
+	lines := make([]string, 0, len(groups))
+	for _, g := range groups {
+		switch len(g.stages) {
+		case 0:
+			lines = append(lines, g.body)
+		case 1:
+			lines = append(lines, fmt.Sprintf("[%s] %s", g.stages[0], g.body))
+		default:
+			lines = append(lines, fmt.Sprintf("[%s] (%d stages) %s", strings.Join(g.stages, ", "), len(g.stages), g.body))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (f failures) Unwrap() []error { return f }
+
+// ExitCode maps a pipeline error to the ci command's exit status, taking the
+// most severe kind when errors were joined.
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, ErrInterrupted):
+		return ExitInterrupted
+	case errors.As(err, new(*UsageError)):
+		return ExitUsage
+	case errors.As(err, new(*InfraError)):
+		return ExitInfra
+	case errors.As(err, new(*TimeoutError)):
+		return ExitTimeout
+	case errors.As(err, new(*ArtifactError)):
+		return ExitArtifact
+	default:
+		return ExitStage
+	}
+}
@@ -0,0 +1,127 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	live := context.Background()
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	infra := &InfraError{Op: "exec zig", Err: errors.New("connection reset")}
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		code int
+		msg  string
+	}{
+		{"plain error", live, errors.New("verify: exposure 9.1 > 8.3"), ExitStage, "[Unit Tests] failed: verify: exposure 9.1 > 8.3"},
+		{"command exit", live, Result{ExitCode: 2, Stderr: "bad"}.check("zig test"), ExitStage, "[Unit Tests] failed: zig test exited with code 2:\nbad"},
+		{"infra", live, infra, ExitInfra, "[Unit Tests] infrastructure: exec zig: connection reset"},
+		{"infra nested in a stage error", live, &StageError{Err: fmt.Errorf("cli.zig: %w", &InfraError{Op: "exec zig", Err: errors.New("eof")})}, ExitInfra, "[Unit Tests] failed: cli.zig"},
+		{"deadline", expired, errors.New("context canceled"), ExitTimeout, "[Unit Tests] timed out after 1m0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classify(tt.ctx, "Unit Tests", time.Minute, tt.err)
+			if got := ExitCode(err); got != tt.code {
+				t.Errorf("ExitCode = %d, want %d", got, tt.code)
+			}
+			if !strings.HasPrefix(err.Error(), tt.msg) {
+				t.Errorf("message = %q, want prefix %q", err, tt.msg)
+			}
+		})
+	}
+}
+
+func TestExitCodeTakesMostSevere(t *testing.T) {
+	err := errors.Join(
+		&StageError{Stage: "Format", Err: errors.New("unformatted")},
+		&ArtifactError{Path: "build/x", Err: errors.New("disk full")},
+		&TimeoutError{Stage: "Cluster Smoke", After: time.Minute, Err: context.DeadlineExceeded},
+	)
+	if got := ExitCode(err); got != ExitTimeout {
+		t.Fatalf("ExitCode = %d, want %d", got, ExitTimeout)
+	}
+	if got := ExitCode(nil); got != ExitOK {
+		t.Fatalf("ExitCode(nil) = %d", got)
+	}
+}
+
+func TestFailuresCollapseIdenticalErrors(t *testing.T) {
+	compile := func(stage string) error {
+		return &StageError{Stage: stage, Command: "zig build", ExitCode: 1, Output: "src/main.zig:3:1: error: expected ';'"}
+	}
+	err := joinFailures([]error{
+		compile("Build linux/amd64"),
+		&StageError{Stage: "Format", Err: errors.New("unformatted")},
+		compile("Build linux/arm64"),
+		&ArtifactError{Path: "build/x", Err: errors.New("disk full")},
+	})
+	want := "[Build linux/amd64, Build linux/arm64] (2 stages) failed: zig build exited with code 1:\nsrc/main.zig:3:1: error: expected ';'\n" +
+		"[Format] failed: unformatted\n" +
+		"artifact build/x: disk full"
+	if err.Error() != want {
+		t.Errorf("message =\n%s\nwant\n%s", err, want)
+	}
+	if got := ExitCode(fmt.Errorf("builds failed: %w", err)); got != ExitArtifact {
+		t.Errorf("ExitCode = %d, want %d", got, ExitArtifact)
+	}
+}
+
+func TestCommandsReturnUsageErrors(t *testing.T) {
+	runFlags := func(args []string) error {
+		_, err := ParseRunFlags(PhaseAll, args)
+		return err
+	}
+	tests := []struct {
+		name string
+		run  func([]string) error
+		args []string
+	}{
+		{"cache without a bundle", RunCacheCommand, []string{"export"}},
+		{"cache unknown command", RunCacheCommand, []string{"copy", "b.tar"}},
+		{"cache prune unknown flag", RunCacheCommand, []string{"prune", "-bogus"}},
+		{"report unknown flag", RunReportCommand, []string{"-bogus"}},
+		{"bisect without good", RunBisectCommand, nil},
+		{"release without a command", RunReleaseCommand, nil},
+		{"release unknown flag", RunReleaseCommand, []string{"verify", "-bogus"}},
+		{"run unknown flag", runFlags, []string{"-bogus"}},
+		{"run fail-fast with keep-going", runFlags, []string{"-fail-fast", "-keep-going"}},
+		{"run local with offline", runFlags, []string{"-local", "-offline"}},
+		{"run negative jobs", runFlags, []string{"-j", "-1"}},
+		{"run unknown only stage", func(args []string) error { return New(Options{}).Select(args, nil) }, []string{"Nope"}},
+		{"run unknown skip stage", func(args []string) error { return New(Options{}).Select(nil, args) }, []string{"Nope"}},
+		{"run malformed stage timeout", func(args []string) error { return (&Config{}).SetStageTimeouts(args[0]) }, []string{"Cluster Smoke=soon"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExitCode(tt.run(tt.args)); got != ExitUsage {
+				t.Errorf("ExitCode = %d, want %d", got, ExitUsage)
+			}
+		})
+	}
+	if err := RunCacheCommand([]string{"-h"}); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("cache -h = %v, want flag.ErrHelp", err)
+	}
+	if err := runFlags([]string{"-h"}); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("run -h = %v, want flag.ErrHelp", err)
+	}
+
+	t.Setenv("MYCO_CI_JOBS", "many")
+	if got := ExitCode(runFlags(nil)); got != ExitUsage {
+		t.Errorf("MYCO_CI_JOBS=many: ExitCode = %d, want %d", got, ExitUsage)
+	}
+	t.Setenv("MYCO_CI_JOBS", "3")
+	if f, err := ParseRunFlags(PhaseAll, nil); err != nil || f.Jobs != 3 {
+		t.Errorf("MYCO_CI_JOBS=3: Jobs = %d, err %v", f.Jobs, err)
+	}
+}
@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// Executor runs one command in the stage runner container. Stages that only
+// need a command's result go through it rather than Dagger directly, so the
+// pipeline logic can be exercised with a fake.
+type Executor interface {
+	Exec(ctx context.Context, cmd Command) (Result, error)
+}
+
+// Command is a process to run with extra environment. Mounts are files,
+// usually stage outputs, placed at their paths before it runs, and
+// WriteFiles are written there from their contents, e.g. generated
+// fixtures. ReadFiles are
+// read back from the container once it exits; missing ones are left out of
+// Result.Files. ExportFiles are handed back as files in Result.Exported
+// without being read.
+type Command struct {
+	Args        []string                `json:"args"`
+	Env         map[string]string       `json:"env,omitempty"`
+	Mounts      map[string]*dagger.File `json:"-"`
+	WriteFiles  map[string]string       `json:"write_files,omitempty"`
+	ReadFiles   []string                `json:"read_files,omitempty"`
+	ExportFiles []string                `json:"export_files,omitempty"`
+}
+
+// Result is how a command ended. A non-zero ExitCode is not an error from
+// Exec; errors are for the engine failing to run the command at all.
+type Result struct {
+	ExitCode int               `json:"exit_code"`
+	Stdout   string            `json:"stdout,omitempty"`
+	Stderr   string            `json:"stderr,omitempty"`
+	Files    map[string]string `json:"files,omitempty"`
+	// Exported is nil under executors without a container to export from.
+	Exported map[string]*dagger.File `json:"-"`
+}
+
+// check turns a non-zero exit into a StageError carrying the command's
+// output.
+func (r Result) check(what string) error {
+	if r.ExitCode == 0 {
+		return nil
+	}
+	return &StageError{Command: what, ExitCode: r.ExitCode, Output: strings.TrimSpace(r.Stdout + "\n" + r.Stderr)}
+}
+
+// daggerExecutor runs commands on top of container, each bounded by the
+// running stage's command timeout.
+type daggerExecutor struct {
+	container *dagger.Container
+}
+
+func (e daggerExecutor) Exec(ctx context.Context, cmd Command) (Result, error) {
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+	res, err := e.exec(cmdCtx, cmd)
+	return res, commandTimedOut(ctx, cmdCtx, cmd.Args[0], err)
+}
+
+func (e daggerExecutor) exec(ctx context.Context, cmd Command) (Result, error) {
+	c := e.container
+	names := make([]string, 0, len(cmd.Env))
+	for name := range cmd.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c = c.WithEnvVariable(name, cmd.Env[name])
+	}
+	paths := make([]string, 0, len(cmd.Mounts))
+	for path := range cmd.Mounts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		c = c.WithMountedFile(path, cmd.Mounts[path])
+	}
+	paths = paths[:0]
+	for path := range cmd.WriteFiles {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		c = c.WithNewFile(path, cmd.WriteFiles[path])
+	}
+	ran := c.WithExec(cmd.Args, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+
+	// With ReturnTypeAny a failing command is a result, so any error here is
+	// the engine's.
+	var res Result
+	var err error
+	if res.ExitCode, err = ran.ExitCode(ctx); err != nil {
+		return Result{}, &InfraError{Op: "exec " + cmd.Args[0], Err: err}
+	}
+	if res.Stdout, err = ran.Stdout(ctx); err != nil {
+		return Result{}, &InfraError{Op: "read stdout", Err: err}
+	}
+	if res.Stderr, err = ran.Stderr(ctx); err != nil {
+		return Result{}, &InfraError{Op: "read stderr", Err: err}
+	}
+	for _, path := range cmd.ReadFiles {
+		contents, err := ran.File(path).Contents(ctx)
+		if err != nil {
+			continue
+		}
+		if res.Files == nil {
+			res.Files = map[string]string{}
+		}
+		res.Files[path] = contents
+	}
+	for _, path := range cmd.ExportFiles {
+		if res.Exported == nil {
+			res.Exported = map[string]*dagger.File{}
+		}
+		res.Exported[path] = ran.File(path)
+	}
+	return res, nil
+}
+
+// zigCacheEnv points zig's caches at the mounted cache volume.
+var zigCacheEnv = map[string]string{
+	"ZIG_GLOBAL_CACHE_DIR": "/src/zig-cache",
+	"ZIG_LOCAL_CACHE_DIR":  "/src/zig-cache",
+}
@@ -0,0 +1,29 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+)
+
+// fakeExecutor answers commands from handle and keeps every command it saw.
+type fakeExecutor struct {
+	mu     sync.Mutex
+	calls  []Command
+	handle func(Command) (Result, error)
+}
+
+func (f *fakeExecutor) Exec(_ context.Context, cmd Command) (Result, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, cmd)
+	f.mu.Unlock()
+	if f.handle == nil {
+		return Result{}, nil
+	}
+	return f.handle(cmd)
+}
+
+func (f *fakeExecutor) commands() []Command {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Command(nil), f.calls...)
+}
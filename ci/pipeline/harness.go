@@ -0,0 +1,473 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"dagger.io/dagger"
+	"orchestrator-ci/ci/fixtures"
+)
+
+// scenario is a self-contained multi-node check. Script is appended to
+// scenarioPrelude and runs in its own container, so ports and state dirs
+// never collide with the other stages.
+type scenario struct {
+	Name   string
+	Script string
+	// Pending marks scenarios that exercise daemon behavior which has not
+	// landed yet. They only run when MYCO_CI_RUN_PENDING=1.
+	Pending string
+	// Packages are extra apk packages the script needs.
+	Packages []string
+	// OptIn names a host variable that must be "1" for the scenario to run,
+	// for stages too slow or noisy to run on every push.
+	OptIn string
+	// Privileged grants root capabilities, e.g. for iptables.
+	Privileged bool
+	// Env lists host variables passed through to the script when set.
+	Env []string
+	// NeedsNetwork marks scenarios that pull extra images, so --offline can
+	// skip them. Scenarios with Packages always need the network.
+	NeedsNetwork bool
+	// Resources is the CPU and memory the scenario needs; zero means
+	// defaultStageResources. MemoryMB is enforced by memoryGuard.
+	Resources Resources
+	// Verify runs Go-side assertions against the finished container once
+	// the script has succeeded. The client is there for follow-up containers.
+	Verify func(ctx context.Context, client *dagger.Client, ran *dagger.Container) error
+}
+
+// scenarios lists every scenario stage in the order they are started.
+var scenarios = []scenario{
+	plaintextRejectionScenario,
+	keyHygieneScenario,
+	replayAttackScenario,
+	replayDetectionScenario,
+	handshakeFuzzScenario,
+	peerEvictionScenario,
+	peerConnectivityScenario,
+	asymmetricReachabilityScenario,
+	dnsPeerAddressScenario,
+	serviceRemovalScenario,
+	crdtOrderingScenario,
+	walCompactionScenario,
+	killDurabilityScenario,
+	stateMigrationScenario,
+	mycoJSONCompatScenario,
+	cliHelpScenario,
+	exitCodeScenario,
+	streamSeparationScenario,
+	unusualNamesScenario,
+	readOnlyFSScenario,
+	nonRootScenario,
+	resourceLimitsScenario,
+	unitHardeningScenario,
+	cliLatencyScenario,
+	flamegraphScenario,
+	offlineBuildScenario,
+	docsDriftScenario,
+	examplesScenario,
+	duplicateServiceScenario,
+	dependencyOrderScenario,
+	teardownScenario,
+	restartStormScenario,
+	slowConsumerScenario,
+	duplicateNodeIDScenario,
+	duplicateNodeIDDetectionScenario,
+	socketPermissionsScenario,
+	staleSocketScenario,
+	privilegeModelScenario,
+}
+
+// scenarioTools are the Go commands built for the scenario containers and
+// the cluster smoke: the hostile peer, the myco.json generator and the
+// convergence waiter.
+var scenarioTools = []struct{ Name, Package string }{
+	{"myco-evil-peer", "./ci/evilpeer"},
+	{"myco-fixture", "./ci/fixturegen"},
+	{"myco-wait-converge", "./ci/waitconverge"},
+}
+
+// scenarioToolsDir builds scenarioTools as static binaries, in one directory
+// the scenario containers put on their PATH.
+func scenarioToolsDir(client *dagger.Client, run runDir, src *dagger.Directory) *dagger.Directory {
+	c := goContainer(client, run, src).WithEnvVariable("CGO_ENABLED", "0")
+	for _, tool := range scenarioTools {
+		c = c.WithExec([]string{"go", "build", "-o", "/out/" + tool.Name, tool.Package})
+	}
+	return c.Directory("/out")
+}
+
+// tool is one of scenarioTools, or nil where none were built, as in a dry
+// run.
+func (e *Env) tool(name string) *dagger.File {
+	if e.tools == nil {
+		return nil
+	}
+	return e.tools.File(name)
+}
+
+// skipReason says why s is gated off for this run, or "" when it runs.
+func (s scenario) skipReason(offline bool) string {
+	switch {
+	case s.Pending != "" && os.Getenv("MYCO_CI_RUN_PENDING") != "1":
+		return "pending: " + s.Pending
+	case s.OptIn != "" && os.Getenv(s.OptIn) != "1":
+		return fmt.Sprintf("set %s=1 to enable", s.OptIn)
+	case offline && (s.NeedsNetwork || len(s.Packages) > 0):
+		return "needs network; running --offline"
+	}
+	return ""
+}
+
+func runScenario(ctx context.Context, env *Env, runner *dagger.Container, s scenario) error {
+	if reason := s.skipReason(env.Offline); reason != "" {
+		logf(ctx, "skipped (%s)", reason)
+		return nil
+	}
+	// Failures are inspected rather than propagated by Sync so anything the
+	// script left in $ARTIFACTS (logs, reproducers) can still be exported.
+	if len(s.Packages) > 0 {
+		runner = runner.WithExec(append([]string{"apk", "add", "--no-cache"}, s.Packages...))
+	}
+	for _, name := range s.Env {
+		if value := os.Getenv(name); value != "" {
+			runner = runner.WithEnvVariable(name, value)
+		}
+	}
+	args := []string{"bash", "-c", scenarioPrelude + memoryGuard(s.Resources.MemoryMB) + s.Script}
+	ran := runner.
+		WithEnvVariable("ZIG_LOCAL_CACHE_DIR", "/src/zig-cache").
+		WithEnvVariable("ZIG_GLOBAL_CACHE_DIR", "/src/zig-cache").
+		WithExec(args, dagger.ContainerWithExecOpts{
+			Expect:                   dagger.ReturnTypeAny,
+			InsecureRootCapabilities: s.Privileged,
+		})
+	var code int
+	err := runBounded(ctx, "scenario script", func(ctx context.Context) (err error) {
+		code, err = ran.ExitCode(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	logExec(ctx, args, ran, code)
+	if err := exportScenarioArtifacts(ctx, env.run, ran, s); err != nil {
+		logf(ctx, "warning: artifact export failed: %v", err)
+	}
+	// Scenarios that never call deploy_services leave no samples.
+	if raw, err := ran.File(propagationFile).Contents(ctx); err == nil {
+		env.perf.propagation(s.Name, parsePropagation(raw))
+	}
+	if code != 0 {
+		return &StageError{Command: "scenario script", ExitCode: code}
+	}
+	if s.Verify != nil {
+		return s.Verify(ctx, env.Client, ran)
+	}
+	return nil
+}
+
+// scenarioArtifactsDir is where scripts drop files worth keeping.
+const scenarioArtifactsDir = "/tmp/myco-artifacts"
+
+// exportScenarioArtifacts copies a non-empty $ARTIFACTS directory to
+// artifacts/<scenario> in the run directory on the host.
+func exportScenarioArtifacts(ctx context.Context, run runDir, ran *dagger.Container, s scenario) error {
+	dir := ran.Directory(scenarioArtifactsDir)
+	entries, err := dir.Entries(ctx)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	slug := stageSlug(s.Name)
+	path := run.path("artifacts", slug)
+	if _, err := dir.Export(ctx, path); err != nil {
+		return err
+	}
+	logf(ctx, "artifacts exported to %s", path)
+	return nil
+}
+
+// scenarioPrelude holds the bash helpers shared by all scenarios. Nodes are
+// addressed by zero-based index: node 0 is "n1", listens on PORT_BASE and
+// runs with MYCO_NODE_ID=1. The layout and each node's environment come from
+// fixtures.NodeConfig, so start_node and myco_cli cannot drift apart.
+var scenarioPrelude = `
+set -euo pipefail
+
+# Mock nix/systemctl so deploys don't require real system services.
+echo '#!/bin/sh' > /usr/bin/nix
+echo 'echo /nix/store/mock-output-path' >> /usr/bin/nix
+chmod +x /usr/bin/nix
+echo '#!/bin/sh' > /usr/bin/systemctl
+echo 'exit 0' >> /usr/bin/systemctl
+chmod +x /usr/bin/systemctl
+
+# Secure transport is the default; scenarios opt into plaintext per node.
+unset MYCO_PACKET_PLAINTEXT MYCO_PACKET_ALLOW_PLAINTEXT
+
+BIN=/src/zig-out/bin/myco
+STATE=` + fixtures.ScenarioStateRoot + `
+ARTIFACTS=/tmp/myco-artifacts
+PORT_BASE=` + strconv.Itoa(fixtures.ScenarioPortBase) + `
+# bounded stops a CLI call after STATUS_TIMEOUT_SEC, so one hung call fails
+# the scenario in seconds and by name instead of at the stage timeout.
+STATUS_TIMEOUT_SEC="${MYCO_SMOKE_STATUS_TIMEOUT_SEC:-5}"
+TIMED_OUT=124
+TIMEOUTS_FILE=/tmp/myco-timeouts.txt
+rm -f "${TIMEOUTS_FILE}"
+PIDS=()
+HELPER_PIDS=()
+EVIL_PEER=/usr/local/bin/myco-evil-peer
+FIXTURE=/usr/local/bin/myco-fixture
+WAIT_CONVERGE=/usr/local/bin/myco-wait-converge
+# deploy_services records propagation latency here for the perf report.
+PROPAGATION_FILE=/tmp/myco-propagation.txt
+PROPAGATION_TIMEOUT_SEC="${MYCO_PROPAGATION_TIMEOUT_SEC:-120}"
+
+node_name() { echo "n$(($1 + 1))"; }
+node_dir() { echo "${STATE}/$(node_name "$1")"; }
+node_sock() { echo "$(node_dir "$1")/myco.sock"; }
+node_port() { echo $((PORT_BASE + $1)); }
+node_addr() { echo "127.0.0.1:$(node_port "$1")"; }
+
+# node_vars IDX [ROLE [PLAINTEXT]] loads NAME=VALUE lines for env(1) into
+# NODE_ENV: what IDX's daemon runs with, with PLAINTEXT (allow or force) if
+# given, or for ROLE cli or pubkey the subset those need.
+node_vars() {
+  local out
+  out=$("${FIXTURE}" node-env -role "${2:-daemon}" -plaintext "${3:-}" "$1") || fail "no environment for $(node_name "$1")"
+  mapfile -t NODE_ENV <<<"$out"
+}
+
+# now_ms is the time in milliseconds, from bash itself: busybox date has no
+# %N.
+now_ms() { local us=${EPOCHREALTIME/[.,]/}; echo $((us / 1000)); }
+
+# bounded SECS WHAT CMD... runs CMD and stops it after SECS seconds, when it
+# returns TIMED_OUT and reports WHAT on stderr and in TIMEOUTS_FILE. CMD must
+# be a program, not a function, for the kill to reach it. This stays in bash
+# because coreutils and busybox timeout(1) report a timeout differently.
+bounded() {
+  local secs="$1" what="$2" pid watchdog code=0
+  local mark="${TIMEOUTS_FILE}.$$.${RANDOM}"
+  shift 2
+  "$@" &
+  pid=$!
+  (
+    trap 'kill "$sleeper" 2>/dev/null; exit 0' TERM
+    sleep "$secs" &
+    sleeper=$!
+    wait "$sleeper"
+    kill -TERM "$pid" 2>/dev/null && : >"$mark"
+  ) &
+  watchdog=$!
+  wait "$pid" || code=$?
+  kill "$watchdog" 2>/dev/null || true
+  wait "$watchdog" 2>/dev/null || true
+  if [ -e "$mark" ]; then
+    rm -f "$mark"
+    echo "${what} timed out after ${secs}s" | tee -a "${TIMEOUTS_FILE}" >&2
+    return "${TIMED_OUT}"
+  fi
+  return "$code"
+}
+
+ok() { echo "[OK] $*"; }
+fail() {
+  echo "[FAIL] $*"
+  exit 1
+}
+
+cleanup() {
+  for p in "${PIDS[@]}" "${HELPER_PIDS[@]}"; do
+    kill "$p" >/dev/null 2>&1 || true
+  done
+}
+
+# start_helper CMD... runs a non-daemon helper in the background until exit.
+start_helper() {
+  "$@" &
+  HELPER_PIDS+=("$!")
+}
+dump_logs() {
+  echo "==> Log tails (myco.log)"
+  for idx in "${!PIDS[@]}"; do
+    echo "--- $(node_name "$idx") ---"
+    tail -n 200 "$(node_dir "$idx")/myco.log" || true
+    echo ""
+  done
+}
+on_exit() {
+  status=$?
+  trap - EXIT
+  cleanup
+  if [ "$status" -ne 0 ]; then
+    if [ -s "${TIMEOUTS_FILE}" ]; then
+      echo "==> Timed out calls"
+      cat "${TIMEOUTS_FILE}"
+    fi
+    dump_logs
+  fi
+  exit "$status"
+}
+trap on_exit EXIT
+
+build_myco() {
+  echo "==> Building binary..."
+  zig build -Doptimize="${MYCO_SMOKE_OPTIMIZE:-ReleaseFast}"
+}
+
+# start_node IDX [-plaintext MODE] [VAR=VALUE...] starts a daemon with extra
+# environment, accepting (allow) or sending (force) plaintext packets.
+start_node() {
+  local idx="$1" plaintext=""
+  shift
+  if [ "${1:-}" = "-plaintext" ]; then
+    plaintext="$2"
+    shift 2
+  fi
+  local dir
+  dir=$(node_dir "$idx")
+  mkdir -p "$dir"
+  node_vars "$idx" daemon "$plaintext"
+  env "${NODE_ENV[@]}" MYCO_SMOKE_SKIP_EXEC=1 "$@" "${BIN}" daemon >>"${dir}/myco.log" 2>&1 &
+  PIDS[$idx]=$!
+}
+
+stop_node() {
+  local pid="${PIDS[$1]}"
+  kill "$pid" >/dev/null 2>&1 || true
+  wait "$pid" 2>/dev/null || true
+}
+
+# stop_all stops every daemon and forgets their pids so nodes can restart fresh.
+stop_all() {
+  for idx in "${!PIDS[@]}"; do
+    stop_node "$idx"
+  done
+  PIDS=()
+}
+
+node_alive() {
+  kill -0 "${PIDS[$1]}" 2>/dev/null
+}
+
+check_daemons() {
+  for idx in "${!PIDS[@]}"; do
+    node_alive "$idx" || fail "daemon for $(node_name "$idx") (pid ${PIDS[$idx]}) died"
+  done
+}
+
+# myco_cli IDX ARGS... runs the CLI against a node's state dir and socket.
+myco_cli() {
+  local idx="$1"
+  shift
+  (
+    node_vars "$idx" cli
+    cd "$(node_dir "$idx")" &&
+      bounded "${STATUS_TIMEOUT_SEC}" "myco $* on $(node_name "$idx")" env "${NODE_ENV[@]}" "${BIN}" "$@"
+  )
+}
+
+node_pubkey() {
+  (
+    node_vars "$1" pubkey
+    bounded "${STATUS_TIMEOUT_SEC}" "myco pubkey of $(node_name "$1")" env "${NODE_ENV[@]}" "${BIN}" pubkey
+  )
+}
+
+# peer_add IDX PEER_IDX [ADDR] points IDX at PEER_IDX (loopback address by default).
+peer_add() {
+  local addr="${3:-$(node_addr "$2")}"
+  myco_cli "$1" peer add "$(node_pubkey "$2")" "$addr" >/dev/null 2>&1
+}
+
+wire_full_mesh() {
+  for i in "$@"; do
+    for j in "$@"; do
+      [ "$i" -eq "$j" ] && continue
+      peer_add "$i" "$j"
+    done
+  done
+}
+
+node_status() {
+  myco_cli "$1" status 2>&1 || true
+}
+
+# status_field IDX FIELD prints a single metric from 'myco status'.
+status_field() {
+  awk -v f="$2" '$1 == f {print $2; exit}' <<<"$(node_status "$1")"
+}
+
+# write_services FILE FIRST_ID COUNT PREFIX writes a myco.json service array.
+write_services() {
+  "${FIXTURE}" services "$2" "$3" "$4" >"$1"
+}
+
+# deploy_services IDX FIRST_ID COUNT PREFIX deploys generated services via IDX
+# and times how long the deploy takes to reach every other running node.
+deploy_services() {
+  write_services "$(node_dir "$1")/myco.json" "$2" "$3" "$4"
+  local t0
+  t0=$(now_ms)
+  myco_cli "$1" deploy >/dev/null 2>&1 || true
+  track_propagation "$1" "$t0"
+}
+
+# track_propagation IDX T0_MS watches the other running nodes in the
+# background until they know as many services as IDX does now.
+track_propagation() {
+  local want other
+  want=$(status_field "$1" services_known)
+  [ -n "$want" ] || return 0
+  for other in "${!PIDS[@]}"; do
+    [ "$other" -ne "$1" ] && node_alive "$other" || continue
+    start_helper propagation_watch "$1" "$other" "$want" "$2"
+  done
+}
+
+# propagation_watch FROM TO WANT T0_MS appends "FROM TO MS" to
+# PROPAGATION_FILE once TO reports WANT services; nodes that never get there
+# within PROPAGATION_TIMEOUT_SEC record nothing.
+propagation_watch() {
+  local deadline known
+  deadline=$(( $(date +%s) + PROPAGATION_TIMEOUT_SEC ))
+  while [ "$(date +%s)" -lt "$deadline" ]; do
+    known=$(status_field "$2" services_known)
+    if [ -n "$known" ] && [ "$known" -ge "$3" ]; then
+      echo "$(node_name "$1") $(node_name "$2") $(( $(now_ms) - $4 ))" >>"${PROPAGATION_FILE}"
+      return 0
+    fi
+    sleep 0.2
+  done
+}
+
+services_known_at_least() {
+  local known
+  known=$(status_field "$1" services_known)
+  [ -n "$known" ] && [ "$known" -ge "$2" ]
+}
+
+# wait_until SECONDS DESCRIPTION CMD... polls CMD once per second.
+wait_until() {
+  local limit="$1" desc="$2"
+  shift 2
+  local i
+  for i in $(seq 1 "$limit"); do
+    check_daemons
+    if "$@"; then
+      ok "${desc} (after ${i}s)"
+      return 0
+    fi
+    sleep 1
+  done
+  fail "${desc}: not reached within ${limit}s"
+}
+
+rm -rf "${STATE}" "${ARTIFACTS}"
+mkdir -p "${STATE}" "${ARTIFACTS}"
+`
@@ -0,0 +1,115 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Hook is a command ci.yaml runs before or after a stage, e.g. to warm a
+// mirror or post custom metrics: a bash snippet in the stage runner, with
+// the source tree at /src, or a command in a container of its own.
+//
+// Hooks see MYCO_CI_RUN_ID and MYCO_CI_STAGE, and after hooks also
+// MYCO_CI_STAGE_RESULT (passed or failed), on top of Env.
+type Hook struct {
+	// Run is the bash snippet.
+	Run string `yaml:"run"`
+	// Image and Args run Args in a container from Image instead, with the
+	// source tree mounted at /src.
+	Image string            `yaml:"image"`
+	Args  []string          `yaml:"args"`
+	Env   map[string]string `yaml:"env"`
+}
+
+func (h Hook) validate() error {
+	switch {
+	case h.Run != "" && h.Image != "":
+		return errors.New("hook sets both run and image")
+	case h.Run == "" && h.Image == "":
+		return errors.New("hook sets neither run nor image")
+	case h.Image != "" && len(h.Args) == 0:
+		return fmt.Errorf("hook image %s has no args", h.Image)
+	case h.Run != "" && len(h.Args) > 0:
+		return errors.New("hook args need an image; put them in run")
+	}
+	return nil
+}
+
+// command is the hook as run for stage, with env added to its own. Both
+// kinds are bounded by the stage's timeout, which the executor enforces.
+func (h Hook) command(env map[string]string) Command {
+	merged := map[string]string{}
+	for name, value := range h.Env {
+		merged[name] = value
+	}
+	for name, value := range env {
+		merged[name] = value
+	}
+	if h.Image != "" {
+		return Command{Args: h.Args, Env: merged}
+	}
+	return Command{Args: []string{"bash", "-c", h.Run}, Env: merged}
+}
+
+// runStage runs s between its hooks. A failing before hook fails the stage
+// without running it. After hooks run whatever the stage did; their
+// failures are warnings, so a broken metrics endpoint never fails a build
+// that passed.
+func runStage(ctx context.Context, s Stage, env *Env) error {
+	if err := runHooks(ctx, env, "before", s.Before, map[string]string{"MYCO_CI_RUN_ID": env.run.ID, "MYCO_CI_STAGE": s.Name}); err != nil {
+		return err
+	}
+	err := s.Run(ctx, env)
+	if len(s.After) == 0 {
+		return err
+	}
+	result := "passed"
+	var warning *WarningError
+	if err != nil && !errors.As(err, &warning) {
+		result = "failed"
+	}
+	hookErr := runHooks(ctx, env, "after", s.After, map[string]string{"MYCO_CI_RUN_ID": env.run.ID, "MYCO_CI_STAGE": s.Name, "MYCO_CI_STAGE_RESULT": result})
+	if hookErr == nil {
+		return err
+	}
+	if result == "failed" {
+		logf(ctx, "%v", hookErr)
+		return err
+	}
+	if warning == nil {
+		warning = &WarningError{}
+	}
+	warning.Warnings = append(warning.Warnings, hookErr.Error())
+	return warning
+}
+
+// runHooks runs hooks in order, stopping at the first that fails.
+func runHooks(ctx context.Context, env *Env, when string, hooks []Hook, vars map[string]string) error {
+	for i, h := range hooks {
+		exec := env.Exec
+		if h.Image != "" {
+			if env.image == nil {
+				return fmt.Errorf("%s hook %d: image hooks need the engine", when, i+1)
+			}
+			exec = env.image(h.Image)
+		}
+		res, err := exec.Exec(ctx, h.command(vars))
+		if err != nil {
+			return fmt.Errorf("%s hook %d: %w", when, i+1, err)
+		}
+		if err := res.check(fmt.Sprintf("%s hook %d", when, i+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hookLine describes a hook in a dry-run plan.
+func hookLine(h Hook) string {
+	if h.Image != "" {
+		return "[" + h.Image + "] " + planCommand(Command{Args: h.Args, Env: h.Env})
+	}
+	return planCommand(Command{Args: []string{"bash", "-c", strings.TrimSpace(h.Run)}, Env: h.Env})
+}
@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigHooks(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, `
+stages:
+  Cluster Smoke:
+    before:
+      - run: curl -fsS "$MIRROR/warm"
+        env: {MIRROR: http://mirror.local}
+    after:
+      - image: curlimages/curl:8.10.1
+        args: [curl, -fsS, -X, POST, http://metrics.local]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(Options{})
+	if err := p.Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range p.Stages {
+		if s.Name == "Cluster Smoke" && (len(s.Before) != 1 || len(s.After) != 1 || s.After[0].Image != "curlimages/curl:8.10.1") {
+			t.Errorf("Cluster Smoke hooks = %+v, %+v", s.Before, s.After)
+		}
+	}
+
+	for contents, want := range map[string]string{
+		"stages:\n  Format:\n    after:\n      - {run: x, image: alpine}\n": `stage "Format" after hook 1: hook sets both run and image`,
+		"stages:\n  Format:\n    before:\n      - {env: {A: b}}\n":          `stage "Format" before hook 1: hook sets neither run nor image`,
+		"stages:\n  Format:\n    before:\n      - {image: alpine}\n":        "hook image alpine has no args",
+		"stages:\n  Format:\n    before:\n      - {run: x, args: [y]}\n":    "hook args need an image",
+	} {
+		if _, err := LoadConfig(writeConfig(t, contents)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: err = %v, want %q", contents, err, want)
+		}
+	}
+}
+
+func TestRunStageHooks(t *testing.T) {
+	hooks := func(when string) []Hook { return []Hook{{Run: "echo " + when, Env: map[string]string{"HOOK": when}}} }
+	body := func(err error) func(context.Context, *Env) error {
+		return func(ctx context.Context, env *Env) error {
+			if _, execErr := env.Exec.Exec(ctx, Command{Args: []string{"body"}}); execErr != nil {
+				return execErr
+			}
+			return err
+		}
+	}
+	failing := func(cmd Command) (Result, error) {
+		if cmd.Env["HOOK"] == "" {
+			return Result{}, nil
+		}
+		return Result{ExitCode: 7, Stderr: "hook broke"}, nil
+	}
+
+	for _, tc := range []struct {
+		name          string
+		stageErr      error
+		handle        func(Command) (Result, error)
+		before, after []Hook
+		wantRan       []string
+		wantErr       string
+		wantWarn      bool
+		wantResult    string
+	}{
+		{name: "passes", before: hooks("before"), after: hooks("after"), wantRan: []string{"before", "body", "after"}, wantResult: "passed"},
+		{name: "stage fails", stageErr: errors.New("boom"), after: hooks("after"), wantRan: []string{"body", "after"}, wantErr: "boom", wantResult: "failed"},
+		{name: "stage warns", stageErr: &WarningError{Warnings: []string{"slow"}}, after: hooks("after"), wantRan: []string{"body", "after"}, wantWarn: true, wantResult: "passed"},
+		{name: "after hook fails", handle: failing, after: hooks("after"), wantRan: []string{"body", "after"}, wantErr: "after hook 1 exited with code 7", wantWarn: true, wantResult: "passed"},
+		{name: "before hook fails", handle: failing, before: hooks("before"), after: hooks("after"), wantRan: []string{"before"}, wantErr: "before hook 1 exited with code 7"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			exec := &fakeExecutor{handle: tc.handle}
+			s := Stage{Name: "Smoke", Run: body(tc.stageErr), Before: tc.before, After: tc.after}
+			err := runStage(context.Background(), s, &Env{Exec: exec, run: runDir{ID: "r1"}})
+
+			var ran []string
+			for _, cmd := range exec.commands() {
+				if cmd.Env["HOOK"] == "" {
+					ran = append(ran, cmd.Args[0])
+					continue
+				}
+				ran = append(ran, cmd.Env["HOOK"])
+				if cmd.Env["MYCO_CI_STAGE"] != "Smoke" || cmd.Env["MYCO_CI_RUN_ID"] != "r1" {
+					t.Errorf("hook env = %v", cmd.Env)
+				}
+				if cmd.Env["HOOK"] == "after" && cmd.Env["MYCO_CI_STAGE_RESULT"] != tc.wantResult {
+					t.Errorf("MYCO_CI_STAGE_RESULT = %q, want %q", cmd.Env["MYCO_CI_STAGE_RESULT"], tc.wantResult)
+				}
+			}
+			if strings.Join(ran, ",") != strings.Join(tc.wantRan, ",") {
+				t.Errorf("ran %v, want %v", ran, tc.wantRan)
+			}
+			var warning *WarningError
+			if isWarn := errors.As(err, &warning); isWarn != tc.wantWarn {
+				t.Errorf("err = %v, want warning %v", err, tc.wantWarn)
+			}
+			if tc.wantErr == "" && err != nil && !tc.wantWarn {
+				t.Errorf("err = %v, want nil", err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("err = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestImageHooksNeedTheEngine(t *testing.T) {
+	s := Stage{Name: "Smoke", Before: []Hook{{Image: "alpine", Args: []string{"true"}}}, Run: func(context.Context, *Env) error { return nil }}
+	if err := runStage(context.Background(), s, &Env{Exec: &fakeExecutor{}}); err == nil || !strings.Contains(err.Error(), "need the engine") {
+		t.Errorf("err = %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// The ci tool itself runs on Linux, macOS and Windows. Off Linux the engine
+// lives in Docker Desktop's Linux VM, so this machine's CPUs and memory say
+// nothing about where the stages run; stage commands and their /tmp paths
+// are always the runner's, never the host's.
+
+// engineInVM says whether the engine runs in a VM rather than on this
+// machine's own kernel.
+func engineInVM() bool {
+	return runtime.GOOS != "linux"
+}
+
+// hostDescription names this machine's platform and where the engine runs
+// relative to it.
+func hostDescription(native string) string {
+	host := runtime.GOOS + "/" + runtime.GOARCH
+	if engineInVM() {
+		return fmt.Sprintf("Host %s; the engine runs in a %s VM.", host, native)
+	}
+	return fmt.Sprintf("Host %s; the engine shares its kernel.", host)
+}
+
+// runnerCapacityScript prints the runner's CPUs and then its MemTotal in
+// KiB.
+const runnerCapacityScript = `nproc; awk '/^MemTotal:/ {print $2}' /proc/meminfo`
+
+// runnerCapacity asks the runner for its CPUs and memory, which the
+// scheduler sizes its pool from when the engine is in a VM.
+func runnerCapacity(ctx context.Context, exec Executor) (Resources, error) {
+	res, err := exec.Exec(ctx, Command{Args: []string{"sh", "-c", runnerCapacityScript}})
+	if err != nil {
+		return Resources{}, err
+	}
+	if err := res.check("runner capacity"); err != nil {
+		return Resources{}, err
+	}
+	fields := strings.Fields(res.Stdout)
+	if len(fields) != 2 {
+		return Resources{}, fmt.Errorf("runner capacity: unexpected output %q", res.Stdout)
+	}
+	cpus, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return Resources{}, fmt.Errorf("runner capacity: CPUs %q: %w", fields[0], err)
+	}
+	kb, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return Resources{}, fmt.Errorf("runner capacity: memory %q: %w", fields[1], err)
+	}
+	return Resources{CPUs: float64(cpus), MemoryMB: kb / 1024}, nil
+}
@@ -0,0 +1,170 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// imageDockerfile describes the published runtime image. It carries the
+// HEALTHCHECK, and the pipeline reads the check command back from it so the
+// two cannot drift.
+const imageDockerfile = "ci/image/Dockerfile"
+
+// imageHealthyWithin bounds how long a fresh container may take to pass its
+// healthcheck before the image is rejected.
+const imageHealthyWithin = 30 * time.Second
+
+var healthcheckCmd = regexp.MustCompile(`(?m)^HEALTHCHECK\s.*?\bCMD\s+(.+)$`)
+
+// imageHealthcheck returns the shell command of the Dockerfile's
+// HEALTHCHECK.
+func imageHealthcheck(dockerfile string) (string, error) {
+	m := healthcheckCmd.FindStringSubmatch(dockerfile)
+	if m == nil {
+		return "", errors.New("no HEALTHCHECK ... CMD instruction")
+	}
+	return strings.TrimSpace(m[1]), nil
+}
+
+// zigTargetPlatform is the inverse of platformToZigTarget.
+func zigTargetPlatform(target string) (dagger.Platform, bool) {
+	for _, platform := range []dagger.Platform{"linux/amd64", "linux/arm64"} {
+		if t, _ := platformToZigTarget(platform); t == target {
+			return platform, true
+		}
+	}
+	return "", false
+}
+
+// imageVariants picks the manifest binaries the image is built from, by
+// name. The Dockerfile's RUN step executes in each variant, so a foreign
+// platform's variant is skipped, with the reason, on an engine that cannot
+// emulate it. verify is the native binary, the one the health check starts.
+func imageVariants(manifest artifactManifest, native dagger.Platform) (names []string, verify string, skipped []string) {
+	var all []string
+	for name := range manifest {
+		all = append(all, name)
+	}
+	sort.Strings(all)
+	for _, name := range all {
+		platform, ok := zigTargetPlatform(manifest[name].Target)
+		switch {
+		case !ok:
+			continue
+		case platform == native:
+			verify = name
+		case !emulates(native):
+			skipped = append(skipped, fmt.Sprintf("%s: building its image needs qemu, which a %s engine lacks", platform, native))
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, verify, skipped
+}
+
+// publishImage builds the runtime image for every binary in the artifact
+// manifest the engine can, checks the native variant turns healthy, and
+// only then pushes the multi-platform image under each of tags.
+func publishImage(ctx context.Context, client *dagger.Client, run runDir, manifest artifactManifest, tags []string, version, commit string, native dagger.Platform) error {
+	dockerfile, err := os.ReadFile(imageDockerfile)
+	if err != nil {
+		return &ArtifactError{Path: imageDockerfile, Err: err}
+	}
+	check, err := imageHealthcheck(string(dockerfile))
+	if err != nil {
+		return &ArtifactError{Path: imageDockerfile, Err: err}
+	}
+
+	names, verifyName, skipped := imageVariants(manifest, native)
+	if verifyName == "" {
+		target, _ := platformToZigTarget(native)
+		return &ArtifactError{Path: run.path(artifactManifestName), Err: fmt.Errorf("no %s binary to build the image from", target)}
+	}
+	for _, reason := range skipped {
+		fmt.Printf("[Image] warning: skipping %s\n", reason)
+	}
+	var variants []*dagger.Container
+	var verify *dagger.Container
+	for _, name := range names {
+		platform, _ := zigTargetPlatform(manifest[name].Target)
+		image := client.Directory().
+			WithFile("Dockerfile", client.Host().File(imageDockerfile)).
+			WithFile("myco", client.Host().File(run.path(name))).
+			DockerBuild(dagger.DirectoryDockerBuildOpts{Platform: platform}).
+			WithLabel("org.opencontainers.image.revision", commit).
+			WithLabel("org.opencontainers.image.version", version)
+		variants = append(variants, image)
+		if name == verifyName {
+			verify = image
+		}
+	}
+
+	fmt.Printf("[Image] waiting up to %s for the healthcheck to pass...\n", imageHealthyWithin)
+	if err := verifyImageHealth(ctx, verify, check); err != nil {
+		return err
+	}
+	fmt.Println("[Image] healthy")
+
+	for _, tag := range tags {
+		if err := pushImage(ctx, client, variants, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushImage publishes variants as one multi-platform image under tag, with
+// registry credentials from MYCO_CI_REGISTRY_USER and
+// MYCO_CI_REGISTRY_PASSWORD when set.
+func pushImage(ctx context.Context, client *dagger.Client, variants []*dagger.Container, tag string) error {
+	image := variants[0]
+	if password := os.Getenv("MYCO_CI_REGISTRY_PASSWORD"); password != "" {
+		registry, _, _ := strings.Cut(tag, "/")
+		image = image.WithRegistryAuth(registry, os.Getenv("MYCO_CI_REGISTRY_USER"), client.SetSecret("registry-password", password))
+	}
+	digest, err := image.Publish(ctx, tag, dagger.ContainerPublishOpts{PlatformVariants: variants[1:]})
+	if err != nil {
+		return &InfraError{Stage: "Image", Op: "publish " + tag, Err: err}
+	}
+	fmt.Printf("[Image] published %s\n", digest)
+	return nil
+}
+
+// verifyImageHealth starts the image's own entrypoint inside it and polls the
+// HEALTHCHECK command until it passes. The check talks to the daemon over its
+// unix socket, so it has to run in the same container rather than from a
+// separate service binding.
+func verifyImageHealth(ctx context.Context, image *dagger.Container, check string) error {
+	script := fmt.Sprintf(`
+myco daemon >/tmp/daemon.log 2>&1 &
+for _ in $(seq 1 %d); do
+  if sh -c "$HEALTHCHECK"; then
+    exit 0
+  fi
+  sleep 1
+done
+cat /tmp/daemon.log
+exit 1
+`, int(imageHealthyWithin.Seconds()))
+	res, err := daggerExecutor{image}.Exec(ctx, Command{
+		Args: []string{"sh", "-c", script},
+		Env:  map[string]string{"HEALTHCHECK": check},
+	})
+	if err != nil {
+		return err
+	}
+	if res.ExitCode != 0 {
+		err := res.check("image healthcheck").(*StageError)
+		err.Stage = "Image"
+		return err
+	}
+	return nil
+}
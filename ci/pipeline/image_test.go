@@ -0,0 +1,59 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+func TestImageDockerfileHasHealthcheck(t *testing.T) {
+	dockerfile, err := os.ReadFile(filepath.Join("..", "..", imageDockerfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check, err := imageHealthcheck(string(dockerfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "myco status >/dev/null || exit 1"; check != want {
+		t.Errorf("healthcheck = %q, want %q", check, want)
+	}
+}
+
+func TestImageHealthcheckMissing(t *testing.T) {
+	if _, err := imageHealthcheck("FROM alpine\nCMD [\"myco\"]\n"); err == nil {
+		t.Error("accepted a Dockerfile without HEALTHCHECK")
+	}
+}
+
+func TestZigTargetPlatformRoundTrip(t *testing.T) {
+	for _, platform := range []string{"linux/amd64", "linux/arm64"} {
+		target, err := platformToZigTarget(dagger.Platform(platform))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := zigTargetPlatform(target); !ok || string(got) != platform {
+			t.Errorf("zigTargetPlatform(%q) = %q, %v; want %q", target, got, ok, platform)
+		}
+	}
+	if _, ok := zigTargetPlatform("riscv64-linux-musl"); ok {
+		t.Error("mapped an unsupported target")
+	}
+}
+
+func TestImageVariantsFollowEnginePlatform(t *testing.T) {
+	manifest := artifactManifest{
+		"myco-0.4.0-aarch64-linux-musl": {Target: "aarch64-linux-musl"},
+		"myco-0.4.0-x86_64-linux-musl":  {Target: "x86_64-linux-musl"},
+	}
+	names, verify, skipped := imageVariants(manifest, "linux/amd64")
+	if len(names) != 2 || verify != "myco-0.4.0-x86_64-linux-musl" || len(skipped) != 0 {
+		t.Errorf("amd64 engine: names %v, verify %q, skipped %v", names, verify, skipped)
+	}
+	names, verify, skipped = imageVariants(manifest, "linux/arm64")
+	if len(names) != 1 || verify != "myco-0.4.0-aarch64-linux-musl" || len(skipped) != 1 {
+		t.Errorf("arm64 engine: names %v, verify %q, skipped %v; want the native variant only", names, verify, skipped)
+	}
+}
@@ -0,0 +1,99 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrInterrupted is why a run stopped after SIGINT or SIGTERM.
+var ErrInterrupted = errors.New("interrupted")
+
+// WithInterrupt cancels ctx with ErrInterrupted on the first SIGINT or
+// SIGTERM, so running execs are cancelled and the caller still closes the
+// engine client. A second signal is sent on abandon, an ErrInterrupted for
+// the caller to exit with at once. stop releases the signals.
+func WithInterrupt(ctx context.Context) (_ context.Context, abandon <-chan error, stop func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	abandoned := make(chan error, 1)
+	go func() {
+		select {
+		case sig := <-signals:
+			fmt.Printf("\n%s: stopping the run; send it again to exit without cleaning up\n", sig)
+			cancel(ErrInterrupted)
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-signals:
+			abandoned <- fmt.Errorf("%w again by %s: exiting without cleaning up", ErrInterrupted, sig)
+		case <-done:
+		}
+	}()
+	return ctx, abandoned, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel(nil)
+	}
+}
+
+// interrupted says whether ctx ended because of WithInterrupt.
+func interrupted(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrInterrupted)
+}
+
+// markInterrupted marks err, from a run that ctx's interrupt cut short, as
+// failing because of it.
+func markInterrupted(ctx context.Context, err error) error {
+	if err != nil && interrupted(ctx) && !errors.Is(err, ErrInterrupted) {
+		return fmt.Errorf("%w: %w", ErrInterrupted, err)
+	}
+	return err
+}
+
+// inFlight tracks the stages running now, to say what an interrupt stopped.
+type inFlight struct {
+	mu      sync.Mutex
+	started map[string]time.Time
+}
+
+func (f *inFlight) start(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.started == nil {
+		f.started = map[string]time.Time{}
+	}
+	f.started[name] = time.Now()
+}
+
+func (f *inFlight) finish(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.started, name)
+}
+
+// String lists the running stages and how long each has run, by name, or
+// is empty when none is.
+func (f *inFlight) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := make([]string, 0, len(f.started))
+	for name := range f.started {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%s (%s)", name, time.Since(f.started[name]).Round(time.Second))
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,68 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunStagesInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	p := &Pipeline{Stages: []Stage{
+		{Name: "Long", Run: func(ctx context.Context, _ *Env) error {
+			cancel(ErrInterrupted)
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+		{Name: "Later", Deps: []string{"Long"}, Run: func(context.Context, *Env) error {
+			t.Error("stage ran after the interrupt")
+			return nil
+		}},
+	}}
+	perf := newPerfRecorder("abc")
+	err := p.runStages(ctx, &Env{perf: perf})
+	if !errors.Is(err, ErrInterrupted) || !strings.HasSuffix(err.Error(), "while running Long") {
+		t.Fatalf("runStages = %v, want an interrupt naming Long", err)
+	}
+	if got := ExitCode(err); got != ExitInterrupted {
+		t.Errorf("ExitCode = %d, want %d", got, ExitInterrupted)
+	}
+	for _, o := range perf.stageOutcomes() {
+		if o.Outcome != outcomeSkipped {
+			t.Errorf("%s recorded as %s, want skipped", o.Stage, o.Outcome)
+		}
+	}
+}
+
+func TestSecondInterruptAbandonsTheRun(t *testing.T) {
+	ctx, abandon, stop := WithInterrupt(context.Background())
+	defer stop()
+	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("first SIGINT did not cancel the run")
+	}
+	if !interrupted(ctx) {
+		t.Errorf("cause = %v, want ErrInterrupted", context.Cause(ctx))
+	}
+	select {
+	case err := <-abandon:
+		t.Fatalf("abandoned after one signal: %v", err)
+	default:
+	}
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	select {
+	case err := <-abandon:
+		if got := ExitCode(err); got != ExitInterrupted {
+			t.Errorf("ExitCode(%v) = %d, want %d", err, got, ExitInterrupted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second signal did not abandon the run")
+	}
+}
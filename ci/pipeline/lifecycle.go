@@ -0,0 +1,259 @@
+package pipeline
+
+// serviceRemovalScenario follows the Integration Test flow, then deletes one
+// of the two service definitions and re-runs 'myco up'. The removed service
+// must lose both its /etc/hosts line inside the MYCO block and its unit file,
+// while the surviving service keeps both.
+var serviceRemovalScenario = scenario{
+	Name:    "Service Removal",
+	Pending: "the CLI has no 'up' command and does not manage /etc/hosts (src/main.zig)",
+	Script: `
+build_myco
+
+WORK="${STATE}/up"
+UNIT_DIR=/run/systemd/system
+mkdir -p "${WORK}/services" "${UNIT_DIR}" /var/lib/myco
+cd "${WORK}"
+
+echo '{"name":"keep-service","package":"nixpkgs#hello","port":8080}' > services/keep.json
+echo '{"name":"drop-service","package":"nixpkgs#hello","port":8081}' > services/drop.json
+
+run_up() {
+  bounded 10 "myco up" env WATCHDOG_USEC=5000000 "${BIN}" up || true
+}
+
+# myco_block prints the managed section of /etc/hosts.
+myco_block() {
+  sed -n '/# --- MYCO START ---/,/# --- MYCO END ---/p' /etc/hosts
+}
+
+echo "==> Bringing up both services..."
+run_up
+for svc in keep-service drop-service; do
+  [ -f "${UNIT_DIR}/myco-${svc}.service" ] || fail "unit file for ${svc} missing"
+  myco_block | grep -q "127.0.0.1.*${svc}" || fail "hosts entry for ${svc} missing"
+done
+ok "both services present"
+
+echo "==> Removing drop-service and re-running up..."
+rm services/drop.json
+run_up
+cat /etc/hosts
+
+[ -f "${UNIT_DIR}/myco-keep-service.service" ] || fail "unit file for keep-service removed"
+myco_block | grep -q "127.0.0.1.*keep-service" || fail "hosts entry for keep-service removed"
+[ ! -f "${UNIT_DIR}/myco-drop-service.service" ] || fail "unit file for drop-service left behind"
+if myco_block | grep -q "drop-service"; then
+  fail "hosts entry for drop-service left in MYCO block"
+fi
+ok "drop-service cleaned up; keep-service untouched"
+`,
+}
+
+// teardownScenario brings two services up, then runs 'myco down'. The MYCO
+// block must leave /etc/hosts, every myco unit file must be removed, and the
+// daemon must drop its per-service configs from MYCO_STATE_DIR/services.
+// Lines outside the MYCO block are left as they were.
+var teardownScenario = scenario{
+	Name:    "Teardown",
+	Pending: "the CLI has no 'up' or 'down' command and does not manage /etc/hosts (src/main.zig)",
+	Script: `
+build_myco
+
+WORK="${STATE}/up"
+UP_STATE="${STATE}/up-state"
+UNIT_DIR=/run/systemd/system
+mkdir -p "${WORK}/services" "${UNIT_DIR}" /var/lib/myco
+cd "${WORK}"
+export MYCO_STATE_DIR="${UP_STATE}"
+
+echo '{"name":"alpha-service","package":"nixpkgs#hello","port":8080}' > services/alpha.json
+echo '{"name":"beta-service","package":"nixpkgs#hello","port":8081}' > services/beta.json
+echo "10.9.8.7 outside-myco" >> /etc/hosts
+
+echo "==> Bringing up both services..."
+bounded 10 "myco up" env WATCHDOG_USEC=5000000 "${BIN}" up || true
+for svc in alpha-service beta-service; do
+  [ -f "${UNIT_DIR}/myco-${svc}.service" ] || fail "unit file for ${svc} missing after up"
+  [ -f "${UP_STATE}/services/${svc}.json" ] || fail "state for ${svc} missing after up"
+done
+grep -q "# --- MYCO START ---" /etc/hosts || fail "MYCO block missing after up"
+ok "services up"
+
+echo "==> Tearing down..."
+bounded "${STATUS_TIMEOUT_SEC}" "myco down" "${BIN}" down || fail "'myco down' exited with $?"
+cat /etc/hosts
+
+if grep -q "# --- MYCO" /etc/hosts; then
+  fail "MYCO block left in /etc/hosts"
+fi
+grep -q "10.9.8.7 outside-myco" /etc/hosts || fail "teardown removed a line outside the MYCO block"
+leftover=$(find "${UNIT_DIR}" -name 'myco-*.service')
+[ -z "$leftover" ] || fail "unit files left behind: ${leftover}"
+leftover=$(find "${UP_STATE}/services" -name '*.json' 2>/dev/null)
+[ -z "$leftover" ] || fail "service state left behind: ${leftover}"
+ok "hosts block, unit files and service state removed"
+`,
+}
+
+// readOnlyFSScenario remounts /run read-only and deploys to a daemon running
+// the real executor, whose unit writes then fail. The daemon must keep the
+// deploys and keep answering, write no unit and run the executor once per
+// service rather than retrying in a loop.
+var readOnlyFSScenario = scenario{
+	Name:       "Read-only Filesystem",
+	Privileged: true,
+	Script: `
+build_myco
+
+mkdir -p /run/systemd/system /var/lib/myco
+
+echo "==> Remounting /run read-only..."
+mount --bind /run /run
+mount -o remount,ro,bind /run
+if touch /run/systemd/system/.myco-rw-probe 2>/dev/null; then
+  fail "/run is still writable; cannot run the degradation test"
+fi
+
+dir=$(node_dir 0)
+mkdir -p "$dir"
+node_vars 0
+env "${NODE_ENV[@]}" "${BIN}" daemon >>"${dir}/myco.log" 2>&1 &
+PIDS[0]=$!
+wait_until 10 "n1 answers status" services_known_at_least 0 0
+
+write_services "${dir}/myco.json" 1 2 readonly
+myco_cli 0 deploy >/dev/null 2>&1 || fail "deploy was refused while /run is read-only"
+wait_until 20 "n1 keeps the deployed services" services_known_at_least 0 2
+sleep 5
+check_daemons
+services_known_at_least 0 2 || fail "status stopped answering"
+
+cat "${dir}/myco.log"
+[ -z "$(find /run/systemd/system -name 'myco-*.service')" ] || fail "a unit file was written to a read-only /run"
+runs=$(grep -c "Deploying Service" "${dir}/myco.log" || true)
+[ "$runs" -le 2 ] || fail "${runs} executor runs for 2 services; the daemon retries the failed writes"
+ok "n1 keeps serving with /run read-only (${runs} executor runs)"
+`,
+}
+
+// nonRootScenario runs two daemons and the CLI as an unprivileged user. Gossip,
+// deploy metadata, status and peer management must work; n1 also runs the
+// real executor, whose writes to /run/systemd must fail without taking the
+// daemon down. The daemon discards executor errors, so the failure is only
+// seen as the missing unit file.
+var nonRootScenario = scenario{
+	Name: "Non-root Execution",
+	Script: `
+build_myco
+
+RUN_AS=myco-user
+adduser -D -H "${RUN_AS}"
+mkdir -p /var/lib/myco /run/systemd/system
+chmod 755 /var/lib/myco /run/systemd/system
+
+# as_user CMD runs a shell snippet as the unprivileged user.
+as_user() {
+  su -s /bin/sh "${RUN_AS}" -c "$1"
+}
+
+# start_user_node IDX [VAR=VALUE...] starts a daemon as the unprivileged user.
+start_user_node() {
+  local idx="$1"
+  shift
+  local dir
+  dir=$(node_dir "$idx")
+  mkdir -p "$dir"
+  chown "${RUN_AS}" "$dir"
+  node_vars "$idx"
+  su -s /bin/sh "${RUN_AS}" -c "exec env ${NODE_ENV[*]} $* '${BIN}' daemon" >>"${dir}/myco.log" 2>&1 &
+  PIDS[$idx]=$!
+}
+
+# user_cli IDX ARGS... is myco_cli run as the unprivileged user.
+user_cli() {
+  local idx="$1"
+  shift
+  node_vars "$idx" cli
+  as_user "cd '$(node_dir "$idx")' && env ${NODE_ENV[*]} '${BIN}' $*"
+}
+
+start_user_node 0
+start_user_node 1 MYCO_SMOKE_SKIP_EXEC=1
+sleep 2
+check_daemons
+for idx in 0 1; do
+  owner=$(stat -c '%U' /proc/"${PIDS[$idx]}")
+  [ "$owner" = "${RUN_AS}" ] || fail "$(node_name "$idx") runs as ${owner}, want ${RUN_AS}"
+done
+ok "daemons run as ${RUN_AS}"
+
+user_cli 0 peer add "$(node_pubkey 1)" "$(node_addr 1)"
+user_cli 1 peer add "$(node_pubkey 0)" "$(node_addr 0)"
+ok "peer add works without root"
+
+write_services "$(node_dir 0)/myco.json" 1 2 rootless
+chown "${RUN_AS}" "$(node_dir 0)/myco.json"
+user_cli 0 deploy >/dev/null 2>&1 || true
+user_status_ok() {
+  user_cli "$1" status 2>&1 | awk '$1 == "services_known" {exit !($2 >= 2)}'
+}
+wait_until 60 "n1 keeps deploy metadata without root" user_status_ok 0
+wait_until 60 "n2 syncs from n1 without root" user_status_ok 1
+
+echo "==> n1 log:"
+cat "$(node_dir 0)/myco.log"
+check_daemons
+[ -z "$(ls -A /run/systemd/system)" ] || fail "a unit file was written without root"
+ok "privileged executor writes fail without root"
+`,
+}
+
+// duplicateServiceScenario deploys one myco.json holding two services that
+// claim the same id. Service definitions carry no port, so a shared id is
+// the conflict myco can have. Deploy applies the entries in order and the
+// last one wins: the scenario holds the daemon to one service and one unit,
+// for the second entry, rather than two units fighting over one id.
+var duplicateServiceScenario = scenario{
+	Name: "Duplicate Service",
+	Script: `
+build_myco
+
+UNIT_DIR=/run/systemd/system
+mkdir -p "${UNIT_DIR}" /var/lib/myco
+
+dir=$(node_dir 0)
+mkdir -p "$dir"
+node_vars 0
+env "${NODE_ENV[@]}" "${BIN}" daemon >>"${dir}/myco.log" 2>&1 &
+PIDS[0]=$!
+sleep 2
+check_daemons
+
+{
+  echo "["
+  "${FIXTURE}" service -id 7 -name first-service
+  echo ","
+  "${FIXTURE}" service -id 7 -name second-service
+  echo "]"
+} >"${dir}/myco.json"
+
+echo "==> Deploying two services with id 7..."
+out=$(myco_cli 0 deploy 2>&1) || fail "deploy of duplicate ids failed: ${out}"
+echo "$out"
+
+unit="${UNIT_DIR}/myco-7.service"
+second_wins() {
+  grep -qxF "Description=Myco Managed Service: second-service" "$unit" 2>/dev/null
+}
+wait_until 10 "unit for id 7 names second-service" second_wins
+cat "$unit"
+check_daemons
+
+known=$(status_field 0 services_known)
+[ "$known" = "1" ] || fail "services_known is ${known:-missing} after deploying one id twice, want 1"
+units=$(find "${UNIT_DIR}" -maxdepth 1 -name 'myco-*.service' | wc -l)
+[ "$units" -eq 1 ] || fail "${units} unit files written for one id, want 1"
+ok "duplicate id resolved last-wins with a single unit"
+`,
+}
@@ -0,0 +1,239 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// Why --local skips a stage: it needs what only the engine provides.
+const (
+	localEngineSkip    = "needs the Dagger engine; running --local"
+	localSandboxedSkip = "changes the system outside the source tree; running --local"
+)
+
+// hostExecutor runs commands directly on the host, for --local. The source
+// tree at root stands in for /src; any other path is the host's own, except
+// mount paths, which are linked under scratch and reach the command through
+// the Env values and arguments that name them.
+//
+// There are no engine files on the host, so an exported file is handed back
+// as a bare *dagger.File that only this executor can resolve, as a mount of
+// a later command. Stages that hand such files to the engine are Engine
+// stages, which --local skips.
+type hostExecutor struct {
+	root    string
+	scratch string
+
+	mu    sync.Mutex
+	files map[*dagger.File]string
+}
+
+func newHostExecutor(root, scratch string) *hostExecutor {
+	return &hostExecutor{root: root, scratch: scratch, files: map[*dagger.File]string{}}
+}
+
+// hostPath maps a runner path to the host.
+func (e *hostExecutor) hostPath(path string) string {
+	if path == "/src" {
+		return e.root
+	}
+	if rest, ok := strings.CutPrefix(path, "/src/"); ok {
+		return filepath.Join(e.root, filepath.FromSlash(rest))
+	}
+	return path
+}
+
+func (e *hostExecutor) Exec(ctx context.Context, cmd Command) (Result, error) {
+	if len(cmd.Args) == 0 {
+		return Result{}, errors.New("exec: no command")
+	}
+	mounts := map[string]string{}
+	for path, f := range cmd.Mounts {
+		e.mu.Lock()
+		src, ok := e.files[f]
+		e.mu.Unlock()
+		if !ok {
+			return Result{}, &InfraError{Op: "mount " + path, Err: errors.New("not a file exported on this host")}
+		}
+		dst := filepath.Join(e.scratch, "mounts", filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return Result{}, &InfraError{Op: "mount " + path, Err: err}
+		}
+		os.Remove(dst)
+		// Windows outside developer mode cannot link; copy instead.
+		if err := os.Symlink(src, dst); err != nil {
+			if err := copyHostFile(src, dst); err != nil {
+				return Result{}, &InfraError{Op: "mount " + path, Err: err}
+			}
+		}
+		mounts[path] = dst
+	}
+	translate := func(value string) string {
+		if dst, ok := mounts[value]; ok {
+			return dst
+		}
+		return e.hostPath(value)
+	}
+	for path, contents := range cmd.WriteFiles {
+		dst := e.hostPath(path)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return Result{}, &InfraError{Op: "write " + path, Err: err}
+		}
+		if err := os.WriteFile(dst, []byte(contents), 0o644); err != nil {
+			return Result{}, &InfraError{Op: "write " + path, Err: err}
+		}
+	}
+
+	args := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		args[i] = translate(arg)
+	}
+	cmdCtx, cancel := commandContext(ctx)
+	defer cancel()
+	c := exec.CommandContext(cmdCtx, args[0], args[1:]...)
+	c.Dir = e.root
+	c.Env = os.Environ()
+	for name, value := range runnerEnv() {
+		c.Env = append(c.Env, name+"="+value)
+	}
+	for name, value := range cmd.Env {
+		c.Env = append(c.Env, name+"="+translate(value))
+	}
+	var stdout, stderr bytes.Buffer
+	c.Stdout, c.Stderr = &stdout, &stderr
+
+	var res Result
+	var exitErr *exec.ExitError
+	err := c.Run()
+	if timeout, ok := commandTimedOut(ctx, cmdCtx, cmd.Args[0], err).(*TimeoutError); ok {
+		return Result{}, timeout
+	}
+	switch {
+	case errors.As(err, &exitErr):
+		res.ExitCode = exitErr.ExitCode()
+	case err != nil:
+		return Result{}, &InfraError{Op: "exec " + cmd.Args[0], Err: err}
+	}
+	res.Stdout, res.Stderr = stdout.String(), stderr.String()
+	for _, path := range cmd.ReadFiles {
+		data, err := os.ReadFile(translate(path))
+		if err != nil {
+			continue
+		}
+		if res.Files == nil {
+			res.Files = map[string]string{}
+		}
+		res.Files[path] = string(data)
+	}
+	for _, path := range cmd.ExportFiles {
+		f, err := e.export(translate(path))
+		if err != nil {
+			continue
+		}
+		if res.Exported == nil {
+			res.Exported = map[string]*dagger.File{}
+		}
+		res.Exported[path] = f
+	}
+	return res, nil
+}
+
+// export copies path into scratch, so a later command rebuilding it does
+// not change what was exported, and returns its handle.
+func (e *hostExecutor) export(path string) (*dagger.File, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	dst := filepath.Join(e.scratch, "exports", strconv.Itoa(len(e.files)), filepath.Base(path))
+	if err := copyHostFile(path, dst); err != nil {
+		return nil, err
+	}
+	f := new(dagger.File)
+	e.files[f] = dst
+	return f, nil
+}
+
+func copyHostFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// localSkip says why --local cannot run s, or "" when it can.
+func localSkip(s Stage) string {
+	switch {
+	case s.Engine:
+		return localEngineSkip
+	case s.Sandboxed:
+		return localSandboxedSkip
+	}
+	return ""
+}
+
+// RunLocal runs the stages that need no engine directly on this host, with
+// the host's zig and bash, for contributors without Docker. The release
+// build and every stage localSkip rules out are skipped.
+func (p *Pipeline) RunLocal(ctx context.Context) (runErr error) {
+	defer func() { runErr = markInterrupted(ctx, runErr) }()
+	for _, tool := range []string{"zig", "bash"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return &InfraError{Op: "find " + tool, Err: fmt.Errorf("--local runs the stages with the host's %s: %w", tool, err)}
+		}
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		return &InfraError{Op: "find the source tree", Err: err}
+	}
+
+	commit := currentCommit()
+	perf := newPerfRecorder(commit)
+	run := p.startRun()
+	fmt.Printf("Run %s on this host: outputs in %s (linked from build/latest)\n", run.ID, run.path())
+	if err := run.linkLatest(); err != nil {
+		fmt.Printf("warning: build/latest not updated: %v\n", err)
+	}
+	scratch, err := filepath.Abs(run.path("local"))
+	if err != nil {
+		return &InfraError{Op: "find the run directory", Err: err}
+	}
+	env := &Env{Exec: newHostExecutor(root, scratch), Native: hostPlatform(), run: run, perf: perf}
+	if err := p.runChecks(ctx, env, perf); err != nil {
+		return err
+	}
+	if p.Options.Build {
+		fmt.Println("Skipping multi-platform build stage: it needs the Dagger engine.")
+	}
+	if err := perf.write(run); err != nil {
+		fmt.Printf("warning: performance report not written: %v\n", err)
+	}
+	fmt.Println(completionMessage(perf))
+	return nil
+}
@@ -0,0 +1,89 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+func TestHostExecutorMapsSrcAndMounts(t *testing.T) {
+	exec := newHostExecutor(t.TempDir(), t.TempDir())
+	ctx := context.Background()
+	res, err := exec.Exec(ctx, Command{
+		Args:        []string{"sh", "-c", `mkdir -p out && echo "$GREETING" >out/tool && chmod +x out/tool`},
+		Env:         map[string]string{"GREETING": "#!/bin/sh\necho mounted"},
+		ExportFiles: []string{"/src/out/tool"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tool := res.Exported["/src/out/tool"]
+	if res.ExitCode != 0 || tool == nil {
+		t.Fatalf("exit %d, exported %v", res.ExitCode, res.Exported)
+	}
+
+	res, err = exec.Exec(ctx, Command{
+		Args:      []string{"sh", "-c", `"$TOOL" >out/log && rm out/tool && cat out/log`},
+		Env:       map[string]string{"TOOL": "/usr/local/bin/tool"},
+		Mounts:    map[string]*dagger.File{"/usr/local/bin/tool": tool},
+		ReadFiles: []string{"/src/out/log", "/src/missing"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ExitCode != 0 || strings.TrimSpace(res.Stdout) != "mounted" {
+		t.Fatalf("exit %d, stdout %q, stderr %q", res.ExitCode, res.Stdout, res.Stderr)
+	}
+	if got := res.Files["/src/out/log"]; strings.TrimSpace(got) != "mounted" {
+		t.Errorf("read back %q", got)
+	}
+	if _, ok := res.Files["/src/missing"]; ok {
+		t.Error("missing file read back")
+	}
+}
+
+func TestHostExecutorRejectsEngineFiles(t *testing.T) {
+	exec := newHostExecutor(t.TempDir(), t.TempDir())
+	_, err := exec.Exec(context.Background(), Command{Args: []string{"true"}, Mounts: map[string]*dagger.File{"/usr/local/bin/myco": nil}})
+	if ExitCode(err) != ExitInfra {
+		t.Errorf("err = %v, want an infrastructure error", err)
+	}
+}
+
+func TestHostExecutorEnforcesTheCommandTimeout(t *testing.T) {
+	exec := newHostExecutor(t.TempDir(), t.TempDir())
+	ctx := withStageTimeout(context.Background(), 100*time.Millisecond)
+	start := time.Now()
+	_, err := exec.Exec(ctx, Command{Args: []string{"sleep", "5"}})
+	if _, ok := err.(*TimeoutError); !ok {
+		t.Fatalf("err = %v, want a TimeoutError", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("sleep ran %s past its timeout", elapsed)
+	}
+	if err := classify(context.Background(), "Unit Tests", time.Second, err); ExitCode(err) != ExitTimeout || !strings.HasPrefix(err.Error(), "[Unit Tests] timed out") {
+		t.Errorf("classified as %v (exit %d)", err, ExitCode(err))
+	}
+}
+
+func TestLocalSkipsStagesTheHostCannotRun(t *testing.T) {
+	p := New(Options{Local: true, Coverage: true})
+	for _, s := range p.Stages {
+		want := ""
+		switch s.Name {
+		case "Coverage", "License Headers":
+			want = localEngineSkip
+		case "Integration Test", "Cluster Smoke":
+			want = localSandboxedSkip
+		case "Format", "Build Check", "Unit Tests", "Myco Binary":
+		default:
+			continue
+		}
+		if s.Skip != want {
+			t.Errorf("%s: skip %q, want %q", s.Name, s.Skip, want)
+		}
+	}
+}
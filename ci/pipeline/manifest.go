@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// environmentStamp pins down what the stages ran on, so a local run can be
+// diffed against CI when results disagree.
+type environmentStamp struct {
+	BaseImage       string            `json:"base_image"`
+	BaseImageDigest string            `json:"base_image_digest"`
+	ZigVersion      string            `json:"zig_version"`
+	Kernel          string            `json:"kernel"`
+	Platform        string            `json:"platform"`
+	APKPackages     map[string]string `json:"apk_packages"`
+}
+
+// runManifest describes the run that produced the files in its run
+// directory.
+type runManifest struct {
+	RunID       string           `json:"run_id"`
+	Commit      string           `json:"commit"`
+	StartedAt   time.Time        `json:"started_at"`
+	Environment environmentStamp `json:"environment"`
+}
+
+// stampEnvironment inspects the base container. The kernel is the engine
+// host's, which is what the daemons under test actually run on. Offline,
+// the base image came from the bundle and has no registry digest.
+func stampEnvironment(ctx context.Context, client *dagger.Client, base *dagger.Container, offline bool) (environmentStamp, error) {
+	stamp := environmentStamp{BaseImage: baseImage, APKPackages: map[string]string{}}
+	if offline {
+		stamp.BaseImageDigest = "offline bundle"
+	} else {
+		ref, err := client.Container().From(baseImage).ImageRef(ctx)
+		if err != nil {
+			return stamp, err
+		}
+		stamp.BaseImageDigest = ref
+	}
+	platform, err := client.DefaultPlatform(ctx)
+	if err != nil {
+		return stamp, err
+	}
+	stamp.Platform = string(platform)
+
+	out, err := base.
+		WithExec([]string{"sh", "-c", "zig version; uname -r; apk list --installed"}).
+		Stdout(ctx)
+	if err != nil {
+		return stamp, err
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 2 {
+		return stamp, fmt.Errorf("unexpected environment probe output: %q", out)
+	}
+	stamp.ZigVersion, stamp.Kernel = lines[0], lines[1]
+	for _, line := range lines[2:] {
+		// "bash-5.2.37-r0 x86_64 {bash} (GPL-3.0-or-later) [installed]"
+		if pkg, origin, ok := strings.Cut(line, " "); ok {
+			name := apkOriginName(origin)
+			if name != "" {
+				stamp.APKPackages[name] = strings.TrimPrefix(pkg, name+"-")
+			}
+		}
+	}
+	return stamp, nil
+}
+
+// apkOriginName pulls the package name out of "x86_64 {origin} (...)"; the
+// name is needed because versions can't be split off "name-ver-rN" reliably.
+func apkOriginName(rest string) string {
+	_, after, ok := strings.Cut(rest, "{")
+	if !ok {
+		return ""
+	}
+	name, _, _ := strings.Cut(after, "}")
+	return name
+}
+
+// writeRunManifest stores the manifest and adds the environment to the
+// GitHub job summary when there is one.
+func writeRunManifest(run runDir, m runManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := run.path("run-manifest.json")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+
+	env := m.Environment
+	summary := fmt.Sprintf("## Environment\n\n| | |\n|---|---|\n| run | `%s` |\n| commit | `%s` |\n| base image | `%s` |\n| zig | `%s` |\n| kernel | `%s` |\n| platform | `%s` |\n| apk packages | %d (see %s) |\n",
+		m.RunID, m.Commit, env.BaseImageDigest, env.ZigVersion, env.Kernel, env.Platform, len(env.APKPackages), path)
+	fmt.Print(summary)
+	return appendStepSummary(summary)
+}
@@ -0,0 +1,191 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// zigOptimizeModes are the values zig build accepts for -Doptimize.
+var zigOptimizeModes = []string{"Debug", "ReleaseSafe", "ReleaseFast", "ReleaseSmall"}
+
+// matrixBuildResources matches the Build Check stage.
+var matrixBuildResources = Resources{CPUs: 2, MemoryMB: 1536}
+
+// Matrix is the matrix section of ci.yaml. The cross product of its axes,
+// minus Exclude, plus Include, becomes one Matrix Build stage per cell. An
+// empty axis takes a single default: the native platform, Debug and the
+// pipeline's zig version.
+type Matrix struct {
+	Platform []string `yaml:"platform"`
+	Optimize []string `yaml:"optimize"`
+	Zig      []string `yaml:"zig"`
+	// Exclude drops every cell matching all fields a rule sets.
+	Exclude []MatrixCell `yaml:"exclude"`
+	// Include adds cells; fields a rule leaves out take the axis default.
+	Include []MatrixCell `yaml:"include"`
+}
+
+// MatrixCell is one combination of the matrix axes.
+type MatrixCell struct {
+	Platform string `yaml:"platform"`
+	Optimize string `yaml:"optimize"`
+	Zig      string `yaml:"zig"`
+}
+
+// empty reports whether the matrix declares nothing.
+func (m Matrix) empty() bool {
+	return len(m.Platform)+len(m.Optimize)+len(m.Zig)+len(m.Include) == 0
+}
+
+// matches reports whether every field rule sets equals c's.
+func (rule MatrixCell) matches(c MatrixCell) bool {
+	return (rule.Platform == "" || rule.Platform == c.Platform) &&
+		(rule.Optimize == "" || rule.Optimize == c.Optimize) &&
+		(rule.Zig == "" || rule.Zig == c.Zig)
+}
+
+// stageName is the generated stage name for the cell.
+func (c MatrixCell) stageName() string {
+	return fmt.Sprintf("Matrix Build (%s, %s, zig %s)", c.Platform, c.Optimize, c.Zig)
+}
+
+// cells expands the matrix in axis order, without duplicates, with native as
+// the platform default.
+func (m Matrix) cells(native dagger.Platform) []MatrixCell {
+	if m.empty() {
+		return nil
+	}
+	axis := func(values []string, fallback string) []string {
+		if len(values) == 0 {
+			return []string{fallback}
+		}
+		return values
+	}
+	platforms := axis(m.Platform, string(native))
+	modes := axis(m.Optimize, "Debug")
+	versions := axis(m.Zig, zigVersion())
+
+	var cells []MatrixCell
+	seen := map[MatrixCell]bool{}
+	add := func(c MatrixCell) {
+		if !seen[c] {
+			seen[c] = true
+			cells = append(cells, c)
+		}
+	}
+	if len(m.Platform)+len(m.Optimize)+len(m.Zig) > 0 {
+		for _, platform := range platforms {
+			for _, mode := range modes {
+				for _, version := range versions {
+					c := MatrixCell{Platform: platform, Optimize: mode, Zig: version}
+					excluded := false
+					for _, rule := range m.Exclude {
+						excluded = excluded || rule.matches(c)
+					}
+					if !excluded {
+						add(c)
+					}
+				}
+			}
+		}
+	}
+	for _, c := range m.Include {
+		if c.Platform == "" {
+			c.Platform = platforms[0]
+		}
+		if c.Optimize == "" {
+			c.Optimize = modes[0]
+		}
+		if c.Zig == "" {
+			c.Zig = versions[0]
+		}
+		add(c)
+	}
+	return cells
+}
+
+// validate checks every value the matrix names is one the stages can build.
+func (m Matrix) validate() error {
+	check := func(c MatrixCell) error {
+		if c.Platform != "" {
+			if _, err := platformToZigTarget(dagger.Platform(c.Platform)); err != nil {
+				return err
+			}
+		}
+		if c.Optimize != "" && !containsString(zigOptimizeModes, c.Optimize) {
+			return fmt.Errorf("optimize %q: want one of %s", c.Optimize, strings.Join(zigOptimizeModes, ", "))
+		}
+		return nil
+	}
+	for _, p := range m.Platform {
+		if err := check(MatrixCell{Platform: p}); err != nil {
+			return fmt.Errorf("matrix: %w", err)
+		}
+	}
+	for _, o := range m.Optimize {
+		if err := check(MatrixCell{Optimize: o}); err != nil {
+			return fmt.Errorf("matrix: %w", err)
+		}
+	}
+	for _, rules := range [][]MatrixCell{m.Exclude, m.Include} {
+		for _, c := range rules {
+			if err := check(c); err != nil {
+				return fmt.Errorf("matrix: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matrixStages are the Matrix Build stages for m. Cells on another zig than
+// the pipeline's need its toolchain downloaded, so they are skipped offline.
+func matrixStages(m Matrix, native dagger.Platform, offline bool) []Stage {
+	var stages []Stage
+	for _, c := range m.cells(native) {
+		stage := Stage{Name: c.stageName(), Resources: matrixBuildResources, Run: func(ctx context.Context, env *Env) error {
+			return runMatrixBuild(ctx, env, c)
+		}}
+		if c.Zig != zigVersion() {
+			stage.Engine = true
+			if offline {
+				stage.Skip = fmt.Sprintf("zig %s is not in the cache bundle; running --offline", c.Zig)
+			}
+		}
+		stages = append(stages, stage)
+	}
+	return stages
+}
+
+// runMatrixBuild compiles one cell: zig build for the cell's target and
+// optimize mode, with the cell's zig.
+func runMatrixBuild(ctx context.Context, env *Env, c MatrixCell) error {
+	target, err := platformToZigTarget(dagger.Platform(c.Platform))
+	if err != nil {
+		return err
+	}
+	exec := env.Exec
+	if c.Zig != zigVersion() {
+		runner, err := env.toolchain(ctx, c.Zig)
+		if err != nil {
+			return &InfraError{Op: "provision zig " + c.Zig, Err: err}
+		}
+		exec = daggerExecutor{runner}
+	}
+	res, err := exec.Exec(ctx, Command{Args: []string{"zig", "build", "-Dtarget=" + target, "-Doptimize=" + c.Optimize}, Env: zigCacheEnv})
+	if err != nil {
+		return err
+	}
+	return res.check("zig build")
+}
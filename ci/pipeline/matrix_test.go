@@ -0,0 +1,86 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatrixCells(t *testing.T) {
+	t.Setenv("MYCO_ZIG_VERSION", "")
+	m := Matrix{
+		Platform: []string{"linux/amd64", "linux/arm64"},
+		Optimize: []string{"Debug", "ReleaseSafe"},
+		Zig:      []string{defaultZigVersion, "0.16.0"},
+		Exclude: []MatrixCell{
+			{Platform: "linux/arm64", Zig: "0.16.0"},
+			{Optimize: "Debug", Zig: "0.16.0"},
+		},
+		Include: []MatrixCell{
+			{Platform: "linux/arm64", Optimize: "ReleaseSmall"},
+			{Platform: "linux/amd64", Optimize: "Debug"},
+		},
+	}
+	var got []string
+	for _, c := range m.cells("linux/amd64") {
+		got = append(got, c.stageName())
+	}
+	v := defaultZigVersion
+	want := []string{
+		"Matrix Build (linux/amd64, Debug, zig " + v + ")",
+		"Matrix Build (linux/amd64, ReleaseSafe, zig " + v + ")",
+		"Matrix Build (linux/amd64, ReleaseSafe, zig 0.16.0)",
+		"Matrix Build (linux/arm64, Debug, zig " + v + ")",
+		"Matrix Build (linux/arm64, ReleaseSafe, zig " + v + ")",
+		"Matrix Build (linux/arm64, ReleaseSmall, zig " + v + ")",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("cells:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if cells := (Matrix{}).cells("linux/amd64"); cells != nil {
+		t.Errorf("empty matrix expands to %v", cells)
+	}
+	arm := Matrix{Optimize: []string{"ReleaseSafe"}}.cells("linux/arm64")
+	if len(arm) != 1 || arm[0].Platform != "linux/arm64" {
+		t.Errorf("arm64 engine: cells = %v, want the native linux/arm64", arm)
+	}
+}
+
+func TestMatrixConfig(t *testing.T) {
+	t.Setenv("MYCO_ZIG_VERSION", "")
+	cfg, err := LoadConfig(writeConfig(t, `
+matrix:
+  platform: [linux/amd64, linux/arm64]
+  optimize: [ReleaseFast]
+  zig: [0.16.0]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(Options{Matrix: cfg.Matrix, Offline: true})
+	var matrix []Stage
+	for _, s := range p.Stages {
+		if strings.HasPrefix(s.Name, "Matrix Build") {
+			matrix = append(matrix, s)
+		}
+	}
+	if len(matrix) != 2 {
+		t.Fatalf("got %d matrix stages, want 2", len(matrix))
+	}
+	for _, s := range matrix {
+		if !strings.Contains(s.Skip, "--offline") {
+			t.Errorf("%s on a non-default zig offline: Skip = %q", s.Name, s.Skip)
+		}
+	}
+
+	for _, bad := range []string{
+		"matrix:\n  optimize: [Fast]\n",
+		"matrix:\n  platform: [windows/amd64]\n",
+		"matrix:\n  exclude: [{optimize: Small}]\n",
+		"matrix:\n  os: [linux]\n",
+	} {
+		if _, err := LoadConfig(writeConfig(t, bad)); err == nil {
+			t.Errorf("LoadConfig accepted %q", bad)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package pipeline
+
+// peerEvictionScenario pauses n3 with SIGSTOP and expects n1 and n2 to report
+// it unreachable within MYCO_PEER_TIMEOUT_SEC, back off instead of hammering
+// it, and report it reachable again soon after SIGCONT. Traffic towards n3 is
+// routed through a counting proxy so the retry rate can be measured.
+var peerEvictionScenario = scenario{
+	Name:    "Peer Eviction",
+	Pending: "the daemon has no peer timeout and status does not report per-peer reachability",
+	Script: `
+build_myco
+
+PEER_TIMEOUT_SEC="${MYCO_PEER_TIMEOUT_SEC:-30}"
+RESUME_SEC=15
+METER="${STATE}/to-n3.count"
+METER_ADDR=127.0.0.1:19998
+
+for idx in 0 1 2; do
+  start_node "$idx" MYCO_PEER_TIMEOUT_SEC="${PEER_TIMEOUT_SEC}"
+done
+sleep 2
+check_daemons
+
+start_helper "${EVIL_PEER}" proxy -listen "${METER_ADDR}" -to "$(node_addr 2)" -out "" -count-file "${METER}"
+peer_add 0 1
+peer_add 1 0
+peer_add 0 2 "${METER_ADDR}"
+peer_add 1 2 "${METER_ADDR}"
+peer_add 2 0
+peer_add 2 1
+
+deploy_services 0 1 3 evict
+for idx in 0 1 2; do
+  wait_until 60 "$(node_name "$idx") converged" services_known_at_least "$idx" 3
+done
+
+# peer_state IDX PEER_IDX prints the reachability IDX reports for PEER_IDX.
+peer_state() {
+  local pub
+  pub=$(node_pubkey "$2")
+  awk -v p="$pub" '$1 == "peer" && $2 == p {print $3; exit}' <<<"$(node_status "$1")"
+}
+peer_is() {
+  [ "$(peer_state "$1" "$2")" = "$3" ]
+}
+forwarded() {
+  cat "${METER}" 2>/dev/null || echo 0
+}
+
+for idx in 0 1; do
+  peer_is "$idx" 2 reachable || fail "$(node_name "$idx") does not report n3 reachable before the pause"
+done
+
+echo "==> Pausing n3..."
+kill -STOP "${PIDS[2]}"
+paused_at=$(date +%s)
+# check_daemons only needs the pid to exist; a stopped process still does.
+for idx in 0 1; do
+  wait_until $((PEER_TIMEOUT_SEC + 10)) "$(node_name "$idx") marks n3 unreachable" peer_is "$idx" 2 unreachable
+done
+echo "==> n3 marked unreachable $(( $(date +%s) - paused_at ))s after pause (timeout ${PEER_TIMEOUT_SEC}s)"
+
+echo "==> Measuring retry rate towards paused n3..."
+before=$(forwarded)
+sleep 10
+after=$(forwarded)
+rate=$(( (after - before) / 10 ))
+echo "==> ${rate} frames/s sent to unreachable n3"
+[ "$rate" -le 5 ] || fail "peers keep sending ${rate} frames/s to an unreachable node"
+
+echo "==> Resuming n3..."
+kill -CONT "${PIDS[2]}"
+for idx in 0 1; do
+  wait_until "${RESUME_SEC}" "$(node_name "$idx") re-establishes n3" peer_is "$idx" 2 reachable
+done
+`,
+}
+
+// peerConnectivityScenario wires a full three-node mesh and runs the
+// convergence waiter with per-peer health required, so every node must
+// report both of its peers connected. The Cluster Smoke waits with the
+// check off until this one passes.
+var peerConnectivityScenario = scenario{
+	Name:    "Peer Connectivity",
+	Pending: "'myco status' has no per-peer health lines (src/api/server.zig)",
+	Script: `
+build_myco
+
+for idx in 0 1 2; do
+  start_node "$idx"
+done
+sleep 2
+check_daemons
+wire_full_mesh 0 1 2
+deploy_services 0 1 3 connected
+
+nodes=()
+for idx in 0 1 2; do
+  nodes+=("$(node_name "$idx")=${PIDS[$idx]}")
+done
+"${WAIT_CONVERGE}" -bin "${BIN}" -state "${STATE}" -services 3 -peer-health \
+  -deadline 120s -report "${ARTIFACTS}/converge.json" "${nodes[@]}" ||
+  fail "nodes did not all report both peers connected"
+ok "every node reports its two peers connected"
+`,
+}
+
+// asymmetricReachabilityScenario models a node behind NAT: n3 can dial n1
+// and n2, but unsolicited inbound packets to its port are dropped. Replies on
+// flows n3 opened are still allowed, just like a home router's conntrack.
+var asymmetricReachabilityScenario = scenario{
+	Name:       "Asymmetric Reachability",
+	Packages:   []string{"iptables"},
+	Privileged: true,
+	Script: `
+build_myco
+
+for idx in 0 1 2; do
+  start_node "$idx"
+done
+sleep 2
+check_daemons
+
+echo "==> Blocking unsolicited inbound traffic to n3..."
+N3_PORT=$(node_port 2)
+iptables -A INPUT -p udp --dport "${N3_PORT}" -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+iptables -A INPUT -p udp --dport "${N3_PORT}" -j DROP
+iptables -L INPUT -n -v
+
+wire_full_mesh 0 1 2
+
+deploy_services 0 1 2 nat-a
+deploy_services 2 101 2 nat-c
+for idx in 0 1 2; do
+  wait_until 120 "$(node_name "$idx") converged on 4 services" services_known_at_least "$idx" 4
+done
+
+dropped=$(iptables -L INPUT -n -v -x | awk '$3 == "DROP" {print $1; exit}')
+echo "==> ${dropped:-0} unsolicited packets to n3 were dropped"
+ok "cluster converged with n3 reachable only via outbound flows"
+`,
+}
+
+// dnsPeerAddressScenario adds peers by hostname instead of IP literal. Names
+// come from /etc/hosts so the test controls resolution: it checks the first
+// lookup, that the daemon follows an address change, and that an unknown
+// name is rejected by 'peer add'. An iptables rule with no target is used as
+// a packet counter for the n1 -> n2 flow.
+var dnsPeerAddressScenario = scenario{
+	Name:       "DNS Peer Address",
+	Pending:    "peer addresses are parsed as IP literals only (src/p2p/peers.zig)",
+	Packages:   []string{"iptables"},
+	Privileged: true,
+	Script: `
+build_myco
+
+HOSTNAME_N2=myco-n2.test
+RESOLVE_SEC="${MYCO_PEER_RESOLVE_SEC:-30}"
+
+# set_host NAME IP rewrites /etc/hosts in place (it may be a bind mount).
+set_host() {
+  grep -v " $1\$" /etc/hosts >"${STATE}/hosts" || true
+  echo "$2 $1" >>"${STATE}/hosts"
+  cat "${STATE}/hosts" >/etc/hosts
+}
+
+set_host "${HOSTNAME_N2}" 127.0.0.1
+getent hosts "${HOSTNAME_N2}" || fail "test resolver entry for ${HOSTNAME_N2} missing"
+
+start_node 0
+start_node 1
+sleep 2
+check_daemons
+
+echo "==> Adding n2 to n1 by hostname..."
+myco_cli 0 peer add "$(node_pubkey 1)" "${HOSTNAME_N2}:$(node_port 1)" || fail "peer add by hostname failed"
+peer_add 1 0
+
+iptables -A INPUT -p udp --sport "$(node_port 0)" --dport "$(node_port 1)"
+n1_to_n2() {
+  iptables -L INPUT -n -v -x | awk -v d="dpt:$(node_port 1)" '$0 ~ d {print $1; exit}'
+}
+flowing() {
+  local before
+  before=$(n1_to_n2)
+  sleep 2
+  [ "$(n1_to_n2)" -gt "$before" ]
+}
+stalled() {
+  local before
+  before=$(n1_to_n2)
+  sleep 3
+  [ "$(n1_to_n2)" -eq "$before" ]
+}
+
+deploy_services 0 1 2 dns
+wait_until 60 "n2 converged via hostname peer" services_known_at_least 1 2
+wait_until 10 "n1 sends to n2 at the resolved address" flowing
+
+echo "==> Moving ${HOSTNAME_N2} to a black-hole address..."
+set_host "${HOSTNAME_N2}" 192.0.2.1
+wait_until $((RESOLVE_SEC + 10)) "n1 re-resolved ${HOSTNAME_N2} away from loopback" stalled
+
+echo "==> Moving ${HOSTNAME_N2} back to loopback..."
+set_host "${HOSTNAME_N2}" 127.0.0.1
+wait_until $((RESOLVE_SEC + 10)) "n1 re-resolved ${HOSTNAME_N2} back to loopback" flowing
+
+echo "==> Adding a peer with an unresolvable name..."
+cp "$(node_dir 0)/peers.list" "${STATE}/peers.before"
+if out=$(myco_cli 0 peer add "$(node_pubkey 1)" "does-not-exist.invalid:$(node_port 1)" 2>&1); then
+  echo "$out"
+  fail "peer add accepted an NXDOMAIN hostname"
+fi
+echo "$out"
+cmp -s "${STATE}/peers.before" "$(node_dir 0)/peers.list" || fail "failed peer add modified peers.list"
+ok "NXDOMAIN peer rejected without touching peers.list"
+`,
+}
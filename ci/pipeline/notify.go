@@ -0,0 +1,219 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultArtifactLinkTTL is how long the links in a failure notification
+// work. maxArtifactLinkTTL is the longest S3 and GCS will sign a URL for.
+const (
+	defaultArtifactLinkTTL = 72 * time.Hour
+	maxArtifactLinkTTL     = 7 * 24 * time.Hour
+)
+
+// stageFailure is a stage that failed and the files in the run directory a
+// responder needs: its failure log, and a debug bundle of whatever the stage
+// exported under artifacts/ if it exported anything.
+type stageFailure struct {
+	Stage   string
+	Message string
+	Log     string
+	Bundle  string
+}
+
+// failedStages splits a run's error into the stages it names. Errors not
+// attributed to a stage, like a failed disk preflight, are the "Pipeline"'s.
+func failedStages(err error) []stageFailure {
+	if err == nil {
+		return nil
+	}
+	var errs []error
+	var joined failures
+	if errors.As(err, &joined) {
+		errs = joined
+	} else {
+		errs = []error{err}
+	}
+	var failed []stageFailure
+	index := map[string]int{}
+	for _, e := range errs {
+		msg, stage := e.Error(), "Pipeline"
+		if m := stageLabel.FindStringSubmatch(msg); m != nil {
+			stage = m[1]
+		}
+		if i, ok := index[stage]; ok {
+			failed[i].Message += "\n" + msg
+			continue
+		}
+		index[stage] = len(failed)
+		failed = append(failed, stageFailure{Stage: stage, Message: msg})
+	}
+	return failed
+}
+
+// failureSlug is stageSlug made safe for a file name; matrix stage names
+// hold slashes and parentheses.
+func failureSlug(stage string) string {
+	return strings.NewReplacer("/", "-", "(", "", ")", "", ",", "").Replace(stageSlug(stage))
+}
+
+// write puts the failure log, and the debug bundle when the stage left
+// artifacts, under failures/ in run's directory.
+func (f *stageFailure) write(run runDir) error {
+	slug := failureSlug(f.Stage)
+	if err := os.MkdirAll(run.path("failures"), 0o755); err != nil {
+		return err
+	}
+	f.Log = path.Join("failures", slug+".log")
+	if err := os.WriteFile(run.path(filepath.FromSlash(f.Log)), []byte(f.Message+"\n"), 0o644); err != nil {
+		return err
+	}
+	artifacts := run.path("artifacts", stageSlug(f.Stage))
+	if info, err := os.Stat(artifacts); err != nil || !info.IsDir() {
+		return nil
+	}
+	f.Bundle = path.Join("failures", slug+"-debug.tar")
+	return writeTar(run.path(filepath.FromSlash(f.Bundle)), artifacts)
+}
+
+// failureLink is one expiring link in a failure notification.
+type failureLink struct {
+	Label, URL string
+}
+
+// signFailureLinks presigns the uploaded log and debug bundle of each
+// failure of run, keyed by stage. Files that did not upload or sign are
+// left out.
+func signFailureLinks(ctx context.Context, store artifactStore, run runDir, failed []stageFailure, ttl time.Duration, uploaded []uploadedArtifact) map[string][]failureLink {
+	present := map[string]bool{}
+	for _, a := range uploaded {
+		present[a.Name] = true
+	}
+	links := map[string][]failureLink{}
+	for _, f := range failed {
+		for _, file := range []failureLink{{"log", f.Log}, {"debug bundle", f.Bundle}} {
+			if file.URL == "" || !present[file.URL] {
+				continue
+			}
+			signed, err := store.Presign(ctx, path.Join(run.ID, file.URL), ttl)
+			if err != nil {
+				fmt.Printf("warning: no link for %s %s: %v\n", f.Stage, file.Label, err)
+				continue
+			}
+			links[f.Stage] = append(links[f.Stage], failureLink{file.Label, signed})
+		}
+	}
+	return links
+}
+
+// runURL links the CI job when running under GitHub Actions.
+func runURL() string {
+	server, repo, id := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID")
+	if server == "" || repo == "" || id == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s/actions/runs/%s", server, repo, id)
+}
+
+// failureMarkdown is the notification for the job summary and PR comment.
+func failureMarkdown(run runDir, failed []stageFailure, links map[string][]failureLink, expires time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "## ❌ Failed stages\n\nRun %s", run.ID)
+	if u := runURL(); u != "" {
+		fmt.Fprintf(&b, " ([job](%s))", u)
+	}
+	fmt.Fprintf(&b, ". Links expire %s.\n\n", expires.UTC().Format(time.RFC3339))
+	for _, f := range failed {
+		fmt.Fprintf(&b, "- **%s**", f.Stage)
+		for i, l := range links[f.Stage] {
+			sep := ", "
+			if i == 0 {
+				sep = ": "
+			}
+			fmt.Fprintf(&b, "%s[%s](%s)", sep, l.Label, l.URL)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// failureSlackText is the same notification in Slack's mrkdwn.
+func failureSlackText(run runDir, failed []stageFailure, links map[string][]failureLink, expires time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, ":x: myco CI run %s failed", run.ID)
+	if u := runURL(); u != "" {
+		fmt.Fprintf(&b, " (<%s|job>)", u)
+	}
+	b.WriteString("\n")
+	for _, f := range failed {
+		fmt.Fprintf(&b, "• *%s*", f.Stage)
+		for i, l := range links[f.Stage] {
+			sep := " · "
+			if i == 0 {
+				sep = ": "
+			}
+			fmt.Fprintf(&b, "%s<%s|%s>", sep, l.URL, l.Label)
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "Links expire %s.", expires.UTC().Format(time.RFC3339))
+	return b.String()
+}
+
+// postSlack sends text to a Slack incoming webhook.
+func postSlack(ctx context.Context, hc *http.Client, webhook, text string) error {
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Slack webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// notifyFailure links the failed stages' logs and debug bundles, through
+// URLs that expire after ttl, from the job summary, the pull request when
+// MYCO_CI_PR_COMMENT=1 and Slack when MYCO_CI_SLACK_WEBHOOK is set, so
+// responders need no access to the store. The posts go through hc.
+func notifyFailure(ctx context.Context, hc *http.Client, run runDir, store artifactStore, failed []stageFailure, ttl time.Duration, uploaded []uploadedArtifact) {
+	if ttl <= 0 {
+		ttl = defaultArtifactLinkTTL
+	}
+	links := signFailureLinks(ctx, store, run, failed, ttl, uploaded)
+	expires := time.Now().Add(ttl)
+	markdown := failureMarkdown(run, failed, links, expires)
+	if err := appendStepSummary(markdown); err != nil {
+		fmt.Printf("warning: job summary not updated: %v\n", err)
+	}
+	if os.Getenv("MYCO_CI_PR_COMMENT") == "1" {
+		if err := commentOnPullRequest(ctx, hc, markdown); err != nil {
+			fmt.Printf("warning: failure not posted to the pull request: %v\n", err)
+		}
+	}
+	if webhook := os.Getenv("MYCO_CI_SLACK_WEBHOOK"); webhook != "" {
+		if err := postSlack(ctx, hc, webhook, failureSlackText(run, failed, links, expires)); err != nil {
+			fmt.Printf("warning: failure not posted to Slack: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFailedStagesSplitsJoinedErrors(t *testing.T) {
+	err := fmt.Errorf("checks failed: %w", joinFailures([]error{
+		&StageError{Stage: "Format", Command: "zig fmt", Err: errors.New("src/main.zig")},
+		&StageError{Stage: "Cluster Smoke", Err: errors.New("convergence timed out")},
+	}))
+	failed := failedStages(err)
+	if len(failed) != 2 || failed[0].Stage != "Format" || failed[1].Stage != "Cluster Smoke" {
+		t.Fatalf("failedStages = %+v", failed)
+	}
+	if !strings.Contains(failed[1].Message, "convergence timed out") {
+		t.Errorf("Cluster Smoke message = %q", failed[1].Message)
+	}
+	if got := failedStages(&InfraError{Op: "disk preflight", Err: errors.New("full")}); len(got) != 1 || got[0].Stage != "Pipeline" {
+		t.Errorf("unattributed error = %+v", got)
+	}
+	if failedStages(nil) != nil {
+		t.Error("a passing run has failed stages")
+	}
+}
+
+func TestNotifyFailureLinksLogsAndDebugBundles(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("GITHUB_SERVER_URL", "")
+	summary := filepath.Join(t.TempDir(), "summary.md")
+	t.Setenv("GITHUB_STEP_SUMMARY", summary)
+	run := runDir{ID: "r1"}
+	if err := os.MkdirAll(run.path("artifacts", "cluster-smoke"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(run.path("artifacts", "cluster-smoke", "n1.log"), []byte("panic"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := []stageFailure{
+		{Stage: "Cluster Smoke", Message: "[Cluster Smoke] failed: convergence timed out"},
+		{Stage: "Matrix Build (linux/arm64, Debug, zig 0.15.2)", Message: "[Matrix Build] failed"},
+	}
+	for i := range failed {
+		if err := failed[i].write(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if failed[0].Bundle != "failures/cluster-smoke-debug.tar" || failed[1].Bundle != "" {
+		t.Errorf("bundles = %q, %q", failed[0].Bundle, failed[1].Bundle)
+	}
+	if failed[1].Log != "failures/matrix-build-linux-arm64-debug-zig-0.15.2.log" {
+		t.Errorf("matrix log = %q", failed[1].Log)
+	}
+
+	store := localStore{Dir: t.TempDir()}
+	uploaded, err := mirrorRun(context.Background(), store, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifyFailure(context.Background(), Options{}.httpClient(), run, store, failed, time.Hour, uploaded)
+	data, err := os.ReadFile(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	for _, want := range []string{
+		"- **Cluster Smoke**: [log](file://",
+		"cluster-smoke.log), [debug bundle](file://",
+		"- **Matrix Build (linux/arm64, Debug, zig 0.15.2)**: [log](",
+		"Links expire ",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("summary lacks %q:\n%s", want, got)
+		}
+	}
+}
+
+// TestOfflineRunPostsNothing sends a failure to a Slack webhook with an
+// offline run's client and an online one, checking only the online post
+// arrives and that going offline left the process's default client alone.
+func TestOfflineRunPostsNothing(t *testing.T) {
+	t.Setenv("GITHUB_STEP_SUMMARY", filepath.Join(t.TempDir(), "summary.md"))
+	var posts atomic.Int32
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+	}))
+	defer webhook.Close()
+	t.Setenv("MYCO_CI_SLACK_WEBHOOK", webhook.URL)
+	failed := []stageFailure{{Stage: "Format", Message: "[Format] failed"}}
+	store := localStore{Dir: t.TempDir()}
+
+	notifyFailure(context.Background(), Options{Offline: true}.httpClient(), runDir{ID: "r1"}, store, failed, time.Hour, nil)
+	if n := posts.Load(); n != 0 {
+		t.Fatalf("offline run posted %d time(s)", n)
+	}
+	resp, err := http.Get(webhook.URL)
+	if err != nil {
+		t.Fatalf("default client refused after an offline run: %v", err)
+	}
+	resp.Body.Close()
+	notifyFailure(context.Background(), Options{}.httpClient(), runDir{ID: "r1"}, store, failed, time.Hour, nil)
+	if n := posts.Load(); n != 2 {
+		t.Errorf("posts = %d, want the GET and the online post", n)
+	}
+}
+
+func TestPresignCommands(t *testing.T) {
+	s3 := s3Store{Bucket: "myco-ci", Prefix: "runs"}
+	if got := strings.Join(s3.presignCommand("r1/failures/format.log", 72*time.Hour), " "); got != "aws s3 presign s3://myco-ci/runs/r1/failures/format.log --expires-in 259200" {
+		t.Errorf("s3 presign = %q", got)
+	}
+	gcs := gcsStore{Bucket: "myco-ci"}
+	if got := strings.Join(gcs.presignCommand("r1/failures/format.log", time.Hour), " "); got != "gcloud storage sign-url gs://myco-ci/r1/failures/format.log --duration=3600s --format=value(signed_url)" {
+		t.Errorf("gcs presign = %q", got)
+	}
+}
+
+func TestFailureSlackText(t *testing.T) {
+	t.Setenv("GITHUB_SERVER_URL", "https://github.com")
+	t.Setenv("GITHUB_REPOSITORY", "LBjerke/myco")
+	t.Setenv("GITHUB_RUN_ID", "42")
+	failed := []stageFailure{{Stage: "Format"}}
+	links := map[string][]failureLink{"Format": {{"log", "https://s/log"}, {"debug bundle", "https://s/tar"}}}
+	got := failureSlackText(runDir{ID: "r1"}, failed, links, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	for _, want := range []string{"(<https://github.com/LBjerke/myco/actions/runs/42|job>)", "• *Format*: <https://s/log|log> · <https://s/tar|debug bundle>", "Links expire 2026-01-02T03:04:05Z."} {
+		if !strings.Contains(got, want) {
+			t.Errorf("slack text lacks %q:\n%s", want, got)
+		}
+	}
+}
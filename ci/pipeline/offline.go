@@ -0,0 +1,32 @@
+package pipeline
+
+// offlineBuildScenario fetches every dependency in build.zig.zon into an
+// empty vendor cache, then rebuilds inside a network namespace with no
+// interfaces using only that cache. It fails if build.zig.zon is missing a
+// dependency or a pin, protecting air-gapped deployers.
+var offlineBuildScenario = scenario{
+	Name:       "Offline Build",
+	Packages:   []string{"util-linux"},
+	Privileged: true,
+	Resources:  Resources{CPUs: 2, MemoryMB: 1536},
+	Script: `
+VENDOR="${STATE}/vendor"
+mkdir -p "${VENDOR}"
+
+echo "==> Fetching dependencies into ${VENDOR}..."
+ZIG_GLOBAL_CACHE_DIR="${VENDOR}" zig build --fetch
+ls "${VENDOR}/p" 2>/dev/null || echo "(no package dependencies)"
+
+offline() { unshare --net -- "$@"; }
+if offline wget -q -T 3 -O /dev/null https://ziglang.org/ 2>/dev/null; then
+  fail "network is still reachable inside the offline namespace"
+fi
+ok "network namespace is isolated"
+
+echo "==> Rebuilding offline from the vendor cache..."
+offline env ZIG_GLOBAL_CACHE_DIR="${VENDOR}" ZIG_LOCAL_CACHE_DIR="${STATE}/local-cache" \
+  zig build --prefix "${STATE}/out" || fail "offline build failed; build.zig.zon is incomplete or unpinned"
+test -x "${STATE}/out/bin/myco" || fail "offline build produced no binary"
+ok "offline build succeeded from the vendored dependency set"
+`,
+}
@@ -0,0 +1,213 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// OutputKind is what a stage output holds.
+type OutputKind string
+
+const (
+	OutputFile      OutputKind = "file"
+	OutputDirectory OutputKind = "directory"
+	OutputJSON      OutputKind = "json"
+)
+
+// Output declares a named value a stage publishes for later stages, which
+// list the name in their Inputs instead of reaching into the producer's
+// container by path.
+type Output struct {
+	Name string
+	Kind OutputKind
+}
+
+// stageOutput is a published value; only the field matching Kind is set.
+type stageOutput struct {
+	Kind      OutputKind
+	File      *dagger.File
+	Directory *dagger.Directory
+	JSON      json.RawMessage
+}
+
+// outputSlot is one declared output. ready is closed once the producer has
+// published it or err says why it never will.
+type outputSlot struct {
+	producer string
+	kind     OutputKind
+	ready    chan struct{}
+	value    stageOutput
+	err      error
+}
+
+// outputRegistry holds the outputs of one run's stages.
+type outputRegistry struct {
+	mu    sync.Mutex
+	slots map[string]*outputSlot
+}
+
+// newOutputRegistry declares every stage's outputs and checks each input
+// names an output some stage declares. The stage graph orders producers
+// before their consumers.
+func newOutputRegistry(stages []Stage) (*outputRegistry, error) {
+	r := &outputRegistry{slots: map[string]*outputSlot{}}
+	for _, s := range stages {
+		for _, o := range s.Outputs {
+			if prev, ok := r.slots[o.Name]; ok {
+				return nil, fmt.Errorf("output %q declared by both %s and %s", o.Name, prev.producer, s.Name)
+			}
+			r.slots[o.Name] = &outputSlot{producer: s.Name, kind: o.Kind, ready: make(chan struct{})}
+		}
+	}
+	for _, s := range stages {
+		for _, name := range s.Inputs {
+			if _, ok := r.slots[name]; !ok {
+				return nil, fmt.Errorf("%s needs output %q, which no stage declares", s.Name, name)
+			}
+		}
+	}
+	return r, nil
+}
+
+func (r *outputRegistry) publish(name string, value stageOutput) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	slot, ok := r.slots[name]
+	switch {
+	case !ok:
+		return fmt.Errorf("output %q is not declared by any stage", name)
+	case slot.kind != value.Kind:
+		return fmt.Errorf("output %q is a %s, not a %s", name, slot.kind, value.Kind)
+	}
+	select {
+	case <-slot.ready:
+		return fmt.Errorf("output %q published twice", name)
+	default:
+	}
+	slot.value = value
+	close(slot.ready)
+	return nil
+}
+
+// finish settles the outputs of a stage that ended: anything it did not
+// publish becomes unavailable, with reason when the stage failed or was
+// skipped.
+func (r *outputRegistry) finish(stage, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, slot := range r.slots {
+		if slot.producer != stage {
+			continue
+		}
+		select {
+		case <-slot.ready:
+			continue
+		default:
+		}
+		if reason == "" {
+			reason = "finished without publishing it"
+		}
+		slot.err = fmt.Errorf("output %q unavailable: %s %s", name, stage, reason)
+		close(slot.ready)
+	}
+}
+
+// published says whether stage has published any of its outputs yet.
+func (r *outputRegistry) published(stage string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, slot := range r.slots {
+		if slot.producer != stage {
+			continue
+		}
+		select {
+		case <-slot.ready:
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// available returns why the first of the named outputs is unavailable, if
+// one is. Their producers must have finished.
+func (r *outputRegistry) available(names []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range names {
+		if slot := r.slots[name]; slot.err != nil {
+			return slot.err
+		}
+	}
+	return nil
+}
+
+func (r *outputRegistry) get(name string, kind OutputKind) (stageOutput, error) {
+	if r == nil {
+		return stageOutput{}, fmt.Errorf("output %q: no output registry", name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	slot, ok := r.slots[name]
+	if !ok {
+		return stageOutput{}, fmt.Errorf("output %q is not declared by any stage", name)
+	}
+	select {
+	case <-slot.ready:
+	default:
+		return stageOutput{}, fmt.Errorf("output %q is not published yet; list it in the stage's Inputs", name)
+	}
+	if slot.err != nil {
+		return stageOutput{}, slot.err
+	}
+	if slot.kind != kind {
+		return stageOutput{}, fmt.Errorf("output %q is a %s, not a %s", name, slot.kind, kind)
+	}
+	return slot.value, nil
+}
+
+// PublishFile publishes a declared file output.
+func (e *Env) PublishFile(name string, f *dagger.File) error {
+	return e.outputs.publish(name, stageOutput{Kind: OutputFile, File: f})
+}
+
+// PublishDirectory publishes a declared directory output.
+func (e *Env) PublishDirectory(name string, d *dagger.Directory) error {
+	return e.outputs.publish(name, stageOutput{Kind: OutputDirectory, Directory: d})
+}
+
+// PublishJSON publishes v, marshalled, as a declared JSON output.
+func (e *Env) PublishJSON(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("output %q: %w", name, err)
+	}
+	return e.outputs.publish(name, stageOutput{Kind: OutputJSON, JSON: data})
+}
+
+// File returns a file output named in the stage's Inputs.
+func (e *Env) File(name string) (*dagger.File, error) {
+	out, err := e.outputs.get(name, OutputFile)
+	return out.File, err
+}
+
+// Directory returns a directory output named in the stage's Inputs.
+func (e *Env) Directory(name string) (*dagger.Directory, error) {
+	out, err := e.outputs.get(name, OutputDirectory)
+	return out.Directory, err
+}
+
+// JSON unmarshals a JSON output named in the stage's Inputs into v.
+func (e *Env) JSON(name string, v any) error {
+	out, err := e.outputs.get(name, OutputJSON)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(out.JSON, v); err != nil {
+		return fmt.Errorf("output %q: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestOutputRegistryRejectsBadDeclarations(t *testing.T) {
+	stage := func(name string, outputs []Output, inputs ...string) Stage {
+		return Stage{Name: name, Outputs: outputs, Inputs: inputs}
+	}
+	tests := []struct {
+		name   string
+		stages []Stage
+		want   string
+	}{
+		{"undeclared input", []Stage{stage("Smoke", nil, "binary")}, `Smoke needs output "binary", which no stage declares`},
+		{"duplicate output", []Stage{stage("A", []Output{{"x", OutputJSON}}), stage("B", []Output{{"x", OutputJSON}})}, `output "x" declared by both A and B`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newOutputRegistry(tt.stages)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunStagesPassesOutputs(t *testing.T) {
+	type sizes struct{ Bytes int64 }
+	var got sizes
+	p := &Pipeline{Stages: []Stage{
+		{Name: "Consumer", Inputs: []string{"sizes"}, Run: func(_ context.Context, env *Env) error {
+			if _, err := env.File("sizes"); err == nil {
+				t.Error("JSON output returned as a file")
+			}
+			return env.JSON("sizes", &got)
+		}},
+		{Name: "Producer", Outputs: []Output{{"sizes", OutputJSON}}, Run: func(_ context.Context, env *Env) error {
+			return env.PublishJSON("sizes", sizes{Bytes: 42})
+		}},
+	}}
+	if err := p.runStages(context.Background(), &Env{perf: newPerfRecorder("abc")}); err != nil {
+		t.Fatal(err)
+	}
+	if got.Bytes != 42 {
+		t.Errorf("consumer read %+v, want Bytes 42", got)
+	}
+}
+
+func TestRunStagesSkipsConsumersOfFailedStages(t *testing.T) {
+	p := &Pipeline{Stages: []Stage{
+		{Name: "Myco Binary", Outputs: []Output{{"binary", OutputFile}}, Run: func(context.Context, *Env) error {
+			return errors.New("compile error")
+		}},
+		{Name: "Cluster Smoke", Inputs: []string{"binary"}, Run: func(context.Context, *Env) error {
+			t.Error("consumer ran without its input")
+			return nil
+		}},
+	}}
+	perf := newPerfRecorder("abc")
+	err := p.runStages(context.Background(), &Env{perf: perf})
+	if err == nil || !strings.Contains(err.Error(), "compile error") {
+		t.Fatalf("err = %v, want the producer's failure", err)
+	}
+	for _, o := range perf.stageOutcomes() {
+		if o.Stage == "Cluster Smoke" && o.Outcome != outcomeSkipped {
+			t.Errorf("Cluster Smoke outcome = %q, want skipped", o.Outcome)
+		}
+	}
+}
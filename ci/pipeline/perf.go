@@ -0,0 +1,214 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// perfSchemaVersion is bumped whenever a field of perfReport changes meaning
+// or is removed. Adding fields does not bump it.
+const perfSchemaVersion = 1
+
+// perfReport is the per-commit document written to perf/<commit>.json.
+// Every field is always present; metrics a run did not measure are null so
+// consumers can tell "not measured" from zero.
+type perfReport struct {
+	SchemaVersion int                `json:"schema_version"`
+	Commit        string             `json:"commit"`
+	GeneratedAt   time.Time          `json:"generated_at"`
+	StageSeconds  map[string]float64 `json:"stage_seconds"`
+	// Cluster smoke measurements.
+	ConvergenceSeconds *float64 `json:"convergence_seconds"`
+	StartupMillis      *float64 `json:"startup_ms"`
+	MaxRSSKiB          *int64   `json:"max_rss_kib"`
+	GossipBytes        *int64   `json:"gossip_bytes"`
+	// BinaryBytes maps zig target to release binary size.
+	BinaryBytes map[string]int64 `json:"binary_bytes"`
+	// PropagationMillis maps scenario name to how long its deploys took to
+	// reach every other node.
+	PropagationMillis map[string]propagationStats `json:"propagation_ms"`
+}
+
+// perfRecorder collects measurements from concurrently running stages.
+type perfRecorder struct {
+	mu       sync.Mutex
+	report   perfReport
+	outcomes []stageRecord
+}
+
+func newPerfRecorder(commit string) *perfRecorder {
+	return &perfRecorder{report: perfReport{
+		SchemaVersion:     perfSchemaVersion,
+		Commit:            commit,
+		StageSeconds:      map[string]float64{},
+		BinaryBytes:       map[string]int64{},
+		PropagationMillis: map[string]propagationStats{},
+	}}
+}
+
+// stage records how long a stage ran and whether it passed, warned or failed.
+func (p *perfRecorder) stage(name string, d time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report.StageSeconds[name] = d.Seconds()
+	outcome := outcomePassed
+	if _, ok := err.(*WarningError); ok {
+		outcome = outcomeWarned
+	} else if err != nil {
+		outcome = outcomeFailed
+	}
+	p.outcomes = append(p.outcomes, stageRecord{Commit: p.report.Commit, Stage: name, Outcome: outcome, Seconds: d.Seconds()})
+}
+
+// stageSkipped records a stage that was gated off for this run.
+func (p *perfRecorder) stageSkipped(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.outcomes = append(p.outcomes, stageRecord{Commit: p.report.Commit, Stage: name, Outcome: outcomeSkipped})
+}
+
+// stageOutcomes returns a copy of the outcomes recorded so far.
+func (p *perfRecorder) stageOutcomes() []stageRecord {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]stageRecord(nil), p.outcomes...)
+}
+
+// warnedStages lists the stages recorded as warned, in recording order.
+func (p *perfRecorder) warnedStages() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var stages []string
+	for _, o := range p.outcomes {
+		if o.Outcome == outcomeWarned {
+			stages = append(stages, o.Stage)
+		}
+	}
+	return stages
+}
+
+// stageAttempts records that a stage took more than one attempt.
+func (p *perfRecorder) stageAttempts(name string, attempts int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := len(p.outcomes) - 1; i >= 0; i-- {
+		if p.outcomes[i].Stage == name {
+			p.outcomes[i].Attempts = attempts
+			return
+		}
+	}
+}
+
+// retriedStages lists the stages that passed, or warned, only after a
+// retry, with their attempts, in recording order.
+func (p *perfRecorder) retriedStages() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var stages []string
+	for _, o := range p.outcomes {
+		if o.Attempts > 1 && o.Outcome != outcomeFailed {
+			stages = append(stages, fmt.Sprintf("%s (attempt %d)", o.Stage, o.Attempts))
+		}
+	}
+	return stages
+}
+
+func (p *perfRecorder) binarySize(target string, bytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report.BinaryBytes[target] = bytes
+}
+
+// propagation records a scenario's deploy propagation samples.
+func (p *perfRecorder) propagation(scenario string, samples []float64) {
+	if len(samples) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report.PropagationMillis[scenario] = newPropagationStats(samples)
+}
+
+// propagationStats returns a copy of the propagation stats recorded so far.
+func (p *perfRecorder) propagationStats() map[string]propagationStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make(map[string]propagationStats, len(p.report.PropagationMillis))
+	for name, s := range p.report.PropagationMillis {
+		stats[name] = s
+	}
+	return stats
+}
+
+// smokeMetrics takes the key=value lines the cluster smoke script writes to
+// its perf file. Unknown keys are ignored and missing ones stay null.
+func (p *perfRecorder) smokeMetrics(raw string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	scanner := bufio.NewScanner(strings.NewReader(raw))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || value == "" {
+			continue
+		}
+		var err error
+		switch key {
+		case "convergence_sec":
+			p.report.ConvergenceSeconds, err = parseFloatPtr(value)
+		case "startup_ms":
+			p.report.StartupMillis, err = parseFloatPtr(value)
+		case "max_rss_kib":
+			p.report.MaxRSSKiB, err = parseIntPtr(value)
+		case "gossip_bytes":
+			p.report.GossipBytes, err = parseIntPtr(value)
+		}
+		if err != nil {
+			return fmt.Errorf("smoke metric %s: %w", key, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// write stores the report as perf/<commit>.json in the run directory.
+func (p *perfRecorder) write(run runDir) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report.GeneratedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(p.report, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := run.path("perf")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, p.report.Commit+".json")
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Performance report written to %s\n", path)
+	return nil
+}
+
+func parseFloatPtr(s string) (*float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func parseIntPtr(s string) (*int64, error) {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
@@ -0,0 +1,1069 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dagger.io/dagger"
+	"orchestrator-ci/ci/fixtures"
+)
+
+// Options selects what a pipeline run does beyond the default checks.
+type Options struct {
+	// Offline runs from the cache bundle in BundleDir and refuses network
+	// access; stages that need the network are skipped.
+	Offline   bool
+	BundleDir string
+	// Coverage adds the kcov Coverage stage.
+	Coverage bool
+	// CompareRelease adds the Release Comparison stage.
+	CompareRelease bool
+	// Build runs the multi-platform release build once every check passed.
+	Build     bool
+	Platforms []dagger.Platform
+	// Native is the engine's own platform; the others are cross-compiled
+	// only. New guesses it from the ci binary's architecture and Run asks
+	// the engine.
+	Native dagger.Platform
+	// Image, when set with Build, is the repository the runtime image is
+	// pushed to once it passes its healthcheck.
+	Image string
+	// Channel is the release channel (edge, nightly or stable) the build
+	// publishes to; see ReleaseChannel.
+	Channel string
+	// MinFree and CacheKeep drive the disk preflight; zero means
+	// defaultMinFree and defaultCacheKeep.
+	MinFree   int64
+	CacheKeep int64
+	// Matrix adds a Matrix Build stage per cell.
+	Matrix Matrix
+	// ArtifactStore, when set, is where the run directory is mirrored once
+	// the run ends; see parseArtifactStore. ArtifactLinkTTL is how long the
+	// links to a failed stage's files work; zero is defaultArtifactLinkTTL.
+	ArtifactStore   string
+	ArtifactLinkTTL time.Duration
+	// FailFast cancels the stages still running and skips those not yet
+	// started once one stage fails, instead of running every stage and
+	// reporting all failures together.
+	FailFast bool
+	// Jobs caps how many stages, and release builds, run at once; zero
+	// leaves it to the runner's CPUs and memory.
+	Jobs int
+	// Local runs the stages on this host through RunLocal instead of in
+	// the engine; stages that cannot are skipped.
+	Local bool
+	// StageLogs also writes each stage's messages, and the commands it ran
+	// with their output, to logs/<stage>.log in the run directory.
+	StageLogs bool
+}
+
+// Env is what stages run against: the engine, the source tree and the shared
+// runner container with src and the zig cache mounted. Exec runs commands in
+// Runner; stages that use only Exec can run without an engine.
+type Env struct {
+	Client *dagger.Client
+	Src    *dagger.Directory
+	Runner *dagger.Container
+	Exec   Executor
+	// Native is the engine's platform, the one its binaries run on.
+	Native dagger.Platform
+	// Offline is set by --offline: stages are served from the cache bundle.
+	Offline bool
+	// HTTP is what stages fetch and post with; offline it refuses every
+	// request.
+	HTTP *http.Client
+
+	// run is where this Run writes its logs, reports and artifacts.
+	run     runDir
+	perf    *perfRecorder
+	tools   *dagger.Directory
+	outputs *outputRegistry
+	// image returns an executor for a container from ref with the source
+	// tree at /src, for hooks that bring their own image.
+	image func(ref string) Executor
+	// toolchain returns a runner like Runner with another zig version.
+	toolchain func(ctx context.Context, version string) (*dagger.Container, error)
+}
+
+// Stage is one check of the pipeline. Checks run concurrently, each once
+// its Inputs are published, its Deps have passed and the scheduler has room
+// for its Resources. New checks are added to New, or from their own file
+// with RegisterStages.
+type Stage struct {
+	Name      string
+	Resources Resources
+	// Skip, when set, says why the stage is gated off for this run.
+	Skip string
+	// Outputs are published by Run through the Env; Inputs name outputs of
+	// other stages that Run reads. A stage whose input never arrives is
+	// skipped.
+	Outputs []Output
+	Inputs  []string
+	// Deps names stages that must pass before this one starts, for
+	// ordering that passes no output. A stage whose dependency fails or is
+	// skipped is skipped.
+	Deps []string
+	// Timeout bounds each command the stage runs; zero is
+	// defaultStageTimeout and negative is none.
+	Timeout time.Duration
+	// Phase is the 'ci' subcommand that runs the stage on its own; New
+	// assigns it when left empty.
+	Phase string
+	// Before and After are ci.yaml's hooks, run around Run; see runStage.
+	Before []Hook
+	After  []Hook
+	// Engine marks stages that use the engine through Client, Runner or Src
+	// rather than only Exec, so a dry run cannot list their commands.
+	Engine bool
+	// Sandboxed marks stages whose commands change the runner outside /src
+	// and /tmp, such as mocking nix in /usr/bin, which --local will not do
+	// to the host.
+	Sandboxed bool
+	// Plugin is the executable that runs the stage, for stages added by
+	// LoadPlugins; a dry run does not start it.
+	Plugin string
+	// Retry reruns the stage when it fails; see RetryPolicy.
+	Retry RetryPolicy
+	Run   func(ctx context.Context, env *Env) error
+}
+
+// Pipeline is the check stages followed by the optional release build.
+type Pipeline struct {
+	Options Options
+	Stages  []Stage
+
+	// progress, once StartProgress is called, is told how each stage goes.
+	progress *progressView
+	// machine is what the stages share, when the engine reports it rather
+	// than it being this machine; see engineInVM.
+	machine Resources
+	// next is the run directory StartProgress opened before Run, so the
+	// console log and the run's other output land together.
+	next *runDir
+}
+
+// DefaultBundleDir is where --offline looks for the cache bundle.
+var DefaultBundleDir = defaultBundleDir
+
+// New assembles the standard stages for opts.
+func New(opts Options) *Pipeline {
+	if opts.BundleDir == "" {
+		opts.BundleDir = defaultBundleDir
+	}
+	if len(opts.Platforms) == 0 {
+		opts.Platforms = []dagger.Platform{"linux/amd64", "linux/arm64"}
+	}
+	if opts.Native == "" {
+		opts.Native = hostPlatform()
+	}
+	if opts.MinFree == 0 {
+		opts.MinFree = defaultMinFree
+	}
+	if opts.CacheKeep == 0 {
+		opts.CacheKeep, _ = parseBytes(defaultCacheKeep)
+	}
+
+	stages := append([]Stage(nil), checkStages...)
+	stages = append(stages, Stage{Name: "Integration Test", Resources: defaultStageResources, Sandboxed: true, Inputs: []string{mycoBinaryOutput}, Run: func(ctx context.Context, env *Env) error {
+		bin, err := env.File(mycoBinaryOutput)
+		if err != nil {
+			return err
+		}
+		cmd, err := integrationCommand(bin)
+		if err != nil {
+			return err
+		}
+		res, err := env.Exec.Exec(ctx, cmd)
+		if err != nil {
+			return err
+		}
+		return res.check("integration script")
+	}})
+	if opts.Coverage && !opts.Offline {
+		stages = append(stages, Stage{Name: "Coverage", Resources: Resources{CPUs: 2, MemoryMB: 2048}, Engine: true, Run: func(ctx context.Context, env *Env) error {
+			return runCoverage(ctx, env.run, env.Runner)
+		}})
+	}
+	stages = append(stages, Stage{Name: "License Headers", Engine: true, Run: func(ctx context.Context, env *Env) error {
+		return runLicenseCheck(ctx, env.Src)
+	}})
+	if !opts.Offline {
+		stages = append(stages,
+			Stage{Name: "Dependency Report", Engine: true, Run: func(ctx context.Context, env *Env) error {
+				return runDependencyReport(ctx, env.run, env.Client, env.HTTP)
+			}},
+			Stage{Name: "Secrets Scan", Engine: true, Run: func(ctx context.Context, env *Env) error {
+				return runSecretsScan(ctx, env.run, env.Client, env.Src)
+			}},
+			Stage{Name: "CI Self-Test", Resources: selfTestResources, Engine: true, Run: func(ctx context.Context, env *Env) error {
+				return runSelfTest(ctx, env.Client, env.run, env.Src)
+			}},
+		)
+	}
+	if opts.CompareRelease && !opts.Offline {
+		stages = append(stages, Stage{Name: "Release Comparison", Resources: releaseComparisonResources, Engine: true, Run: func(ctx context.Context, env *Env) error {
+			return runReleaseComparison(ctx, env.Runner.WithDirectory("/usr/local/bin", env.tools), env.Native)
+		}})
+	}
+	stages = append(stages,
+		Stage{Name: "Unit Tests", Resources: unitTestResources, Run: func(ctx context.Context, env *Env) error {
+			return runUnitTests(ctx, env.Exec, env.perf)
+		}},
+		Stage{Name: "Myco Binary", Resources: mycoBinaryResources, Outputs: []Output{{Name: mycoBinaryOutput, Kind: OutputFile}}, Run: func(ctx context.Context, env *Env) error {
+			bin, err := buildMycoBinary(ctx, env.Exec)
+			if err != nil {
+				return err
+			}
+			return env.PublishFile(mycoBinaryOutput, bin)
+		}},
+		Stage{Name: "Cluster Smoke", Resources: clusterSmokeResources, Sandboxed: true, Inputs: []string{mycoBinaryOutput}, Run: func(ctx context.Context, env *Env) error {
+			bin, err := env.File(mycoBinaryOutput)
+			if err != nil {
+				return err
+			}
+			return runClusterSmoke(ctx, env.Exec, bin, env.tool("myco-wait-converge"), env.perf)
+		}},
+	)
+	stages = append(stages, matrixStages(opts.Matrix, opts.Native, opts.Offline)...)
+	for _, s := range scenarios {
+		stages = append(stages, Stage{Name: s.Name, Resources: s.Resources, Skip: s.skipReason(opts.Offline), Engine: true, Run: func(ctx context.Context, env *Env) error {
+			return runScenario(ctx, env, env.Runner.WithDirectory("/usr/local/bin", env.tools), s)
+		}})
+	}
+	stages = append(stages, registeredStages(opts)...)
+	for i := range stages {
+		if stages[i].Phase == "" {
+			stages[i].Phase = stagePhase(stages[i].Name)
+		}
+		if reason := localSkip(stages[i]); opts.Local && reason != "" && stages[i].Skip == "" {
+			stages[i].Skip = reason
+		}
+	}
+	return &Pipeline{Options: opts, Stages: stages}
+}
+
+// Phases are the parts of the pipeline 'ci <phase>' runs on its own, so
+// separate CI jobs can run them. "all" runs every stage and then the build,
+// as plain 'ci' does.
+const (
+	PhaseCheck       = "check"
+	PhaseIntegration = "integration"
+	PhaseSmoke       = "smoke"
+	PhaseBuild       = "build"
+	PhaseAll         = "all"
+)
+
+// Phases lists the phases in the order a full run covers them.
+var Phases = []string{PhaseCheck, PhaseIntegration, PhaseSmoke, PhaseBuild}
+
+// stagePhase assigns a stage to a phase: the integration script, the binary
+// it shares with the cluster smoke, and the scenarios are integration, the
+// cluster smoke is smoke, and everything else is a check.
+func stagePhase(name string) string {
+	switch name {
+	case "Cluster Smoke":
+		return PhaseSmoke
+	case "Integration Test", "Myco Binary":
+		return PhaseIntegration
+	}
+	for _, s := range scenarios {
+		if s.Name == name {
+			return PhaseIntegration
+		}
+	}
+	return PhaseCheck
+}
+
+// Phase narrows the pipeline to one phase. The build phase runs no stages,
+// only the release build; the others drop every stage outside the phase,
+// except those producing outputs the phase's stages take, and leave the
+// build to the build phase.
+func (p *Pipeline) Phase(name string) error {
+	switch name {
+	case PhaseAll:
+		return nil
+	case PhaseBuild:
+		p.Stages = nil
+		p.Options.Build = true
+		return nil
+	case PhaseCheck, PhaseIntegration, PhaseSmoke:
+	default:
+		return &UsageError{Err: fmt.Errorf("no phase %q; phases are: %s, %s", name, strings.Join(Phases, ", "), PhaseAll)}
+	}
+	producers := map[string]string{}
+	for _, s := range p.Stages {
+		for _, o := range s.Outputs {
+			producers[o.Name] = s.Name
+		}
+	}
+	inPhase := map[string]bool{}
+	var need func(s Stage)
+	need = func(s Stage) {
+		inPhase[s.Name] = true
+		for _, input := range s.Inputs {
+			for _, producer := range p.Stages {
+				if producer.Name == producers[input] && !inPhase[producer.Name] {
+					need(producer)
+				}
+			}
+		}
+	}
+	for _, s := range p.Stages {
+		if s.Phase == name {
+			need(s)
+		}
+	}
+	var kept []Stage
+	for _, s := range p.Stages {
+		if inPhase[s.Name] {
+			kept = append(kept, s)
+		}
+	}
+	// Dependencies in other phases ran, and passed, in their own job.
+	for i := range kept {
+		var deps []string
+		for _, dep := range kept[i].Deps {
+			if inPhase[dep] {
+				deps = append(deps, dep)
+			}
+		}
+		kept[i].Deps = deps
+	}
+	p.Stages = kept
+	p.Options.Build = false
+	return nil
+}
+
+// Select narrows the run to the stages named in only, plus the stages whose
+// outputs they need or that they depend on, minus those named in skip. Either list may be empty.
+// Names match case-insensitively; an unknown name is a UsageError. Stages left
+// out stay in the pipeline, marked skipped, so the run still reports them.
+func (p *Pipeline) Select(only, skip []string) error {
+	byName := map[string]int{}
+	producers := map[string]int{}
+	for i, s := range p.Stages {
+		byName[strings.ToLower(s.Name)] = i
+		for _, o := range s.Outputs {
+			producers[o.Name] = i
+		}
+	}
+	lookup := func(flag string, names []string) ([]int, error) {
+		var found []int
+		for _, name := range names {
+			i, ok := byName[strings.ToLower(name)]
+			if !ok {
+				return nil, &UsageError{Err: fmt.Errorf("--%s: no stage %q; stages are: %s", flag, name, p.stageNames())}
+			}
+			found = append(found, i)
+		}
+		return found, nil
+	}
+	onlyIdx, err := lookup("only", only)
+	if err != nil {
+		return err
+	}
+	skipIdx, err := lookup("skip", skip)
+	if err != nil {
+		return err
+	}
+
+	if len(onlyIdx) > 0 {
+		keep := map[int]bool{}
+		var add func(i int)
+		add = func(i int) {
+			if keep[i] {
+				return
+			}
+			keep[i] = true
+			for _, input := range p.Stages[i].Inputs {
+				if producer, ok := producers[input]; ok {
+					add(producer)
+				}
+			}
+			for _, dep := range p.Stages[i].Deps {
+				if j, ok := byName[strings.ToLower(dep)]; ok {
+					add(j)
+				}
+			}
+		}
+		for _, i := range onlyIdx {
+			add(i)
+		}
+		for i := range p.Stages {
+			if !keep[i] && p.Stages[i].Skip == "" {
+				p.Stages[i].Skip = "not selected by --only"
+			}
+		}
+	}
+	for _, i := range skipIdx {
+		if p.Stages[i].Skip == "" {
+			p.Stages[i].Skip = "deselected by --skip"
+		}
+	}
+	return nil
+}
+
+// Run executes the pipeline on client, writing outputs under the run
+// directory. It returns an error if any stage or build fails.
+func (p *Pipeline) Run(ctx context.Context, client *dagger.Client) (runErr error) {
+	defer func() { runErr = markInterrupted(ctx, runErr) }()
+	run := p.startRun()
+	src := client.Host().Directory(".", dagger.HostDirectoryOpts{
+		Exclude: []string{
+			".git/",
+			".zig-cache/",
+			"zig-cache/",
+			"zig-out/",
+			"tmp/",
+			"build/",
+		},
+		Gitignore: true,
+	})
+
+	fmt.Println("Creating Alpine build environment...")
+
+	var bundle *cacheBundle
+	if p.Options.Offline {
+		fmt.Printf("Offline mode: using cache bundle %s\n", p.Options.BundleDir)
+		bundle = &cacheBundle{Dir: p.Options.BundleDir}
+	}
+	hc := p.Options.httpClient()
+	base, err := buildEnvironment(ctx, client, hc, run, bundle)
+	if err != nil {
+		return &InfraError{Op: "build environment", Err: err}
+	}
+	if err := preflightDisk(ctx, client, base, p.Options.MinFree, p.Options.CacheKeep); err != nil {
+		return err
+	}
+
+	cacheName := zigCacheKey("build.zig.zon")
+	zigCache := client.CacheVolume(run.cacheKey(cacheName))
+	runner := stageRunner(base, src, zigCache)
+	if bundle != nil {
+		runner = runner.
+			WithMountedDirectory("/src/zig-cache/p", client.Host().Directory(bundle.zigDepsDir())).
+			WithEnvVariable("http_proxy", offlineProxy).
+			WithEnvVariable("https_proxy", offlineProxy).
+			WithEnvVariable("HTTP_PROXY", offlineProxy).
+			WithEnvVariable("HTTPS_PROXY", offlineProxy)
+	}
+
+	commit := currentCommit()
+	perf := newPerfRecorder(commit)
+	fmt.Printf("Run %s: outputs in %s (linked from build/latest)\n", run.ID, run.path())
+	if err := run.linkLatest(); err != nil {
+		fmt.Printf("warning: build/latest not updated: %v\n", err)
+	}
+
+	stamp, err := stampEnvironment(ctx, client, base, p.Options.Offline)
+	if err != nil {
+		fmt.Printf("warning: environment stamp incomplete: %v\n", err)
+	}
+	if err := writeRunManifest(run, runManifest{RunID: run.ID, Commit: commit, StartedAt: time.Now().UTC(), Environment: stamp}); err != nil {
+		fmt.Printf("warning: run manifest not written: %v\n", err)
+	}
+	defer func() { p.uploadArtifacts(run, runErr) }()
+
+	native, err := enginePlatform(ctx, client)
+	if err != nil {
+		return &InfraError{Op: "query engine platform", Err: err}
+	}
+	p.Options.Native = native
+	fmt.Println(hostDescription(string(native)))
+	if cross := crossPlatforms(p.Options.Platforms, native); len(cross) > 0 {
+		fmt.Printf("Engine platform %s; %s cross-compiled only.\n", native, strings.Join(cross, ", "))
+	}
+
+	tools := scenarioToolsDir(client, run, src)
+	if p.Options.Offline {
+		dir, err := hostScenarioTools(run, strings.TrimPrefix(string(native), "linux/"))
+		if err != nil {
+			return &StageError{Stage: "Scenario Tools", Err: err}
+		}
+		tools = client.Host().Directory(dir)
+	}
+
+	env := &Env{Client: client, Src: src, Runner: runner, Exec: daggerExecutor{runner}, Native: native, Offline: p.Options.Offline, HTTP: hc, run: run, perf: perf, tools: tools}
+	env.image = func(ref string) Executor {
+		return daggerExecutor{client.Container().From(ref).WithMountedDirectory("/src", src).WithWorkdir("/src")}
+	}
+	env.toolchain = func(ctx context.Context, version string) (*dagger.Container, error) {
+		base, err := zigEnvironment(ctx, client, hc, run, bundle, version)
+		if err != nil {
+			return nil, err
+		}
+		return stageRunner(base, src, client.CacheVolume(run.cacheKey(cacheName+"-zig-"+version))), nil
+	}
+	if engineInVM() {
+		if machine, err := runnerCapacity(ctx, env.Exec); err != nil {
+			fmt.Printf("warning: engine VM capacity unknown, sizing the stages to this machine: %v\n", err)
+		} else {
+			p.machine = machine
+		}
+	}
+	if err := p.runChecks(ctx, env, perf); err != nil {
+		return err
+	}
+
+	fmt.Println("All checks passed. Starting build stage...")
+
+	if !p.Options.Build {
+		fmt.Println("Skipping multi-platform build stage (set RUN_PLATFORM_BUILD=1 to enable).")
+		if err := perf.write(run); err != nil {
+			fmt.Printf("warning: performance report not written: %v\n", err)
+		}
+		fmt.Println(completionMessage(perf))
+		return nil
+	}
+
+	rel, err := newRelease(p.Options.Channel, "build.zig.zon", commit, time.Now())
+	if err != nil {
+		return err
+	}
+	if rel.Channel != "" {
+		fmt.Printf("Building %s on the %s channel\n", rel.Version, rel.Channel)
+	}
+	if err := p.build(ctx, run, base, src, zigCache, commit, rel, perf); err != nil {
+		return err
+	}
+	if p.Options.Image != "" {
+		if err := p.image(ctx, run, client, commit, rel); err != nil {
+			return err
+		}
+	}
+	if rel.Channel == channelStable {
+		if err := draftRelease(run, rel); err != nil {
+			return err
+		}
+		if err := p.verifyRelease(run, rel); err != nil {
+			return err
+		}
+	}
+
+	if err := perf.write(run); err != nil {
+		fmt.Printf("warning: performance report not written: %v\n", err)
+	}
+
+	fmt.Println(completionMessage(perf))
+	return nil
+}
+
+// runChecks runs the stages against env, recording their commands when
+// MYCO_CI_RECORD is set, and adds the outcome to the stage history.
+func (p *Pipeline) runChecks(ctx context.Context, env *Env, perf *perfRecorder) error {
+	var recorder *recordingExecutor
+	if path := os.Getenv("MYCO_CI_RECORD"); path != "" {
+		recorder = &recordingExecutor{inner: env.Exec}
+		env.Exec = recorder
+	}
+	err := p.runStages(ctx, env)
+	if recorder != nil {
+		path := os.Getenv("MYCO_CI_RECORD")
+		if recErr := recorder.save(path); recErr != nil {
+			fmt.Printf("warning: exec recording not written: %v\n", recErr)
+		} else {
+			fmt.Printf("Exec recording written to %s\n", path)
+		}
+	}
+	if recErr := recordStageHistory(env.run, perf); recErr != nil {
+		fmt.Printf("warning: stage history not updated: %v\n", recErr)
+	}
+	if recErr := recordPropagation(env.run, perf); recErr != nil {
+		fmt.Printf("warning: propagation history not updated: %v\n", recErr)
+	}
+	return err
+}
+
+// completionMessage is the last line of a successful run, naming any stages
+// that passed with warnings or only on a retry.
+func completionMessage(perf *perfRecorder) string {
+	msg := "🚀 Pipeline completed successfully!"
+	if warned := perf.warnedStages(); len(warned) > 0 {
+		msg = fmt.Sprintf("🚀 Pipeline completed with warnings from %s", strings.Join(warned, ", "))
+	}
+	if retried := perf.retriedStages(); len(retried) > 0 {
+		msg += fmt.Sprintf(" (passed on retry: %s)", strings.Join(retried, ", "))
+	}
+	return msg
+}
+
+// runStages runs the stages in dependency order under the resource
+// scheduler and joins their failures into one error. With FailFast the
+// first failure cancels the rest.
+func (p *Pipeline) runStages(ctx context.Context, env *Env) error {
+	graph, err := newStageGraph(p.Stages)
+	if err != nil {
+		return err
+	}
+	outputs, err := newOutputRegistry(p.Stages)
+	if err != nil {
+		return err
+	}
+	env.outputs = outputs
+	sched := newStageScheduler(p.Options.Jobs, p.machine)
+	errChan := make(chan error, len(p.Stages))
+	warnChan := make(chan error, len(p.Stages))
+	stageCtx, cancelStages := context.WithCancelCause(ctx)
+	defer cancelStages(nil)
+	// cancelled says why fail-fast or an interrupt stopped the run, if one
+	// did; the run's own deadline is a timeout, not a cancellation.
+	cancelled := func() string {
+		if interrupted(ctx) || (ctx.Err() == nil && stageCtx.Err() != nil) {
+			return context.Cause(stageCtx).Error()
+		}
+		return ""
+	}
+	// An interrupt is reported as it arrives with the stages it cancels;
+	// those that then end cut short go to cutChan.
+	running := &inFlight{}
+	cutChan := make(chan string, len(p.Stages))
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if inflight := running.String(); interrupted(ctx) && inflight != "" {
+				fmt.Printf("Cancelling %s\n", inflight)
+			}
+		case <-finished:
+		}
+	}()
+	logs := newStageLogs(env.run, p.Options.StageLogs)
+	defer logs.close()
+	if logs.files {
+		fmt.Printf("Stage logs in %s\n", env.run.path(stageLogDir))
+	}
+	skip := func(s Stage, reason string) stageStatus {
+		logs.stage(s.Name).Printf("skipped (%s)", reason)
+		p.report(s.Name, progressSkipped)
+		env.perf.stageSkipped(s.Name)
+		outputs.finish(s.Name, "was skipped")
+		return stageSkipped
+	}
+
+	fmt.Printf("Starting %d stages as their dependencies and resources allow...\n", len(p.Stages))
+
+	graph.run(func(s Stage, blocked string) stageStatus {
+		reason := s.Skip
+		if reason == "" {
+			reason = blocked
+		}
+		if reason == "" {
+			if err := outputs.available(s.Inputs); err != nil {
+				reason = err.Error()
+			}
+		}
+		if reason == "" {
+			reason = cancelled()
+		}
+		if reason != "" {
+			return skip(s, reason)
+		}
+		release := sched.acquire(s.Name, s.Resources)
+		defer release()
+		if reason := cancelled(); reason != "" {
+			return skip(s, reason)
+		}
+		log := logs.stage(s.Name)
+		log.Printf("starting")
+		running.start(s.Name)
+		defer running.finish(s.Name)
+		start := time.Now()
+		stageEnv := &Env{}
+		*stageEnv = *env
+		stageEnv.Exec = logExecutor{inner: env.Exec, log: log}
+		if p.progress != nil {
+			p.progress.started(s.Name)
+			stageEnv.Exec = progressExecutor{inner: stageEnv.Exec, view: p.progress, stage: s.Name}
+		}
+		logCtx := withStageLog(stageCtx, log)
+		published := func() bool { return outputs.published(s.Name) }
+		attempts, err := runWithRetry(logCtx, s, published, func() error {
+			begin := time.Now()
+			err := runStage(withStageTimeout(logCtx, s.Timeout), s, stageEnv)
+			return classify(logCtx, s.Name, time.Since(begin), err)
+		})
+		if reason := cancelled(); err != nil && reason != "" {
+			if interrupted(ctx) {
+				cutChan <- s.Name
+			}
+			return skip(s, "cancelled, "+reason)
+		}
+		env.perf.stage(s.Name, time.Since(start), err)
+		if attempts > 1 {
+			env.perf.stageAttempts(s.Name, attempts)
+		}
+		if _, ok := err.(*WarningError); ok {
+			outputs.finish(s.Name, "")
+			log.Printf("passed with warnings")
+			p.report(s.Name, progressWarned)
+			warnChan <- err
+			return stagePassed
+		}
+		if err != nil {
+			outputs.finish(s.Name, "failed")
+			p.report(s.Name, progressFailed)
+			errChan <- err
+			if p.Options.FailFast {
+				cancelStages(fmt.Errorf("--fail-fast after %s failed", s.Name))
+			}
+			return stageFailed
+		}
+		outputs.finish(s.Name, "")
+		p.report(s.Name, progressPassed)
+		if attempts > 1 {
+			log.Printf("passed on attempt %d!", attempts)
+		} else {
+			log.Printf("passed!")
+		}
+		return stagePassed
+	})
+	close(errChan)
+	close(warnChan)
+	close(cutChan)
+
+	var warnings []error
+	for w := range warnChan {
+		warnings = append(warnings, w)
+	}
+	if len(warnings) > 0 {
+		report := joinFailures(warnings).Error()
+		fmt.Println("\n--- Check Stage Warnings ---")
+		fmt.Println(report)
+		if err := appendStepSummary("## Warnings\n\n```\n" + report + "\n```\n"); err != nil {
+			fmt.Printf("warning: job summary not updated: %v\n", err)
+		}
+	}
+
+	var collectedErrors []error
+	for e := range errChan {
+		collectedErrors = append(collectedErrors, e)
+	}
+	if interrupted(ctx) {
+		var cut []string
+		for name := range cutChan {
+			cut = append(cut, name)
+		}
+		if len(collectedErrors) > 0 {
+			fmt.Println("\n--- Check Stage Failures ---")
+			fmt.Println(joinFailures(collectedErrors))
+		}
+		if len(cut) == 0 {
+			return ErrInterrupted
+		}
+		sort.Strings(cut)
+		return fmt.Errorf("%w while running %s", ErrInterrupted, strings.Join(cut, ", "))
+	}
+
+	if len(collectedErrors) > 0 {
+		failed := joinFailures(collectedErrors)
+		fmt.Println("\n--- Check Stage Failures ---")
+		fmt.Println(failed)
+		return fmt.Errorf("checks failed: %w", failed)
+	}
+	return nil
+}
+
+// build compiles a ReleaseSmall binary per platform, exports it as
+// myco-<release version>-<target> and writes the artifact manifest.
+func (p *Pipeline) build(ctx context.Context, run runDir, base *dagger.Container, src *dagger.Directory, zigCache *dagger.CacheVolume, commit string, rel release, perf *perfRecorder) error {
+	var buildWg sync.WaitGroup
+	buildErrChan := make(chan error, len(p.Options.Platforms))
+	artifacts := make(chan artifact, len(p.Options.Platforms))
+
+	// With Jobs set, builds beyond it wait for a slot.
+	var slots chan struct{}
+	if p.Options.Jobs > 0 {
+		slots = make(chan struct{}, p.Options.Jobs)
+	}
+
+	for _, platform := range p.Options.Platforms {
+		buildWg.Add(1)
+		go func(p dagger.Platform) {
+			defer buildWg.Done()
+			if slots != nil {
+				slots <- struct{}{}
+				defer func() { <-slots }()
+			}
+
+			stage := "Build " + string(p)
+			target, err := platformToZigTarget(p)
+			if err != nil {
+				buildErrChan <- &StageError{Stage: stage, Err: err}
+				return
+			}
+			start := time.Now()
+
+			fmt.Printf("Starting Build for %s (%s)...\n", p, target)
+
+			buildCmd := base.
+				WithMountedDirectory("/src", src).
+				WithMountedCache("/src/zig-cache", zigCache).
+				WithWorkdir("/src").
+				WithEnvVariable("ZIG_LOCAL_CACHE_DIR", "/src/zig-cache").
+				WithEnvVariable("ZIG_GLOBAL_CACHE_DIR", "/src/zig-cache").
+				WithExec([]string{"zig", "build", "-Dtarget=" + target, "-Doptimize=ReleaseSmall"})
+
+			outputBinary := buildCmd.File("/src/zig-out/bin/myco")
+			outputPath := run.path(artifactName(rel.Version, target))
+
+			// The export is what runs the build, so a failed zig build
+			// surfaces here as an exec error.
+			_, err = outputBinary.Export(ctx, outputPath)
+			if errors.As(err, new(*dagger.ExecError)) || ctx.Err() != nil {
+				buildErrChan <- classify(ctx, stage, time.Since(start), err)
+				return
+			}
+			if err != nil {
+				buildErrChan <- &ArtifactError{Path: outputPath, Err: err}
+				return
+			}
+
+			built, err := describeArtifact(outputPath, target, commit)
+			if err != nil {
+				buildErrChan <- &ArtifactError{Path: outputPath, Err: err}
+				return
+			}
+			built.Channel = rel.Channel
+			artifacts <- built
+			perf.binarySize(target, built.Size)
+
+			fmt.Printf("Built %s (%d bytes)\n", outputPath, built.Size)
+		}(platform)
+	}
+
+	buildWg.Wait()
+	close(buildErrChan)
+	close(artifacts)
+
+	var buildErrors []error
+	for e := range buildErrChan {
+		buildErrors = append(buildErrors, e)
+	}
+
+	if len(buildErrors) > 0 {
+		failed := joinFailures(buildErrors)
+		fmt.Println("\n--- Build Stage Failures ---")
+		fmt.Println(failed)
+		return fmt.Errorf("builds failed: %w", failed)
+	}
+
+	var built []artifact
+	for a := range artifacts {
+		built = append(built, a)
+	}
+	manifestPath := run.path(artifactManifestName)
+	if err := writeArtifactManifest(run, built); err != nil {
+		return &ArtifactError{Path: manifestPath, Err: err}
+	}
+	manifest, err := readArtifactManifest(manifestPath)
+	if err != nil {
+		return &ArtifactError{Path: manifestPath, Err: err}
+	}
+	if err := recordBinarySizes(run, manifest.sizeRecords()); err != nil {
+		fmt.Printf("warning: size history not updated: %v\n", err)
+	}
+	return nil
+}
+
+// image publishes the runtime image built from this run's release binaries.
+func (p *Pipeline) image(ctx context.Context, run runDir, client *dagger.Client, commit string, rel release) error {
+	manifestPath := run.path(artifactManifestName)
+	manifest, err := readArtifactManifest(manifestPath)
+	if err != nil {
+		return &ArtifactError{Path: manifestPath, Err: err}
+	}
+	return publishImage(ctx, client, run, manifest, rel.imageTags(p.Options.Image, commit), rel.Version, commit, p.Options.Native)
+}
+
+// verifyRelease checks the draft's assets against this run's manifest.
+func (p *Pipeline) verifyRelease(run runDir, rel release) error {
+	manifestPath := run.path(artifactManifestName)
+	manifest, err := readArtifactManifest(manifestPath)
+	if err != nil {
+		return &ArtifactError{Path: manifestPath, Err: err}
+	}
+	return verifyRelease(releaseTag(rel.Project), manifest)
+}
+
+// checkStages are the quick checks that run next to the scenario stages.
+var checkStages = []Stage{
+	ExecStage("Format", Resources{}, "zig", "fmt", ".", "--check", "--exclude", ".zig-cache", "--exclude", "zig-cache", "--exclude", "zig-out"),
+	ExecStage("Build Check", Resources{CPUs: 2, MemoryMB: 1536}, "zig", "build"),
+}
+
+// integrationNode is the daemon the integration script deploys to.
+var integrationNode = fixtures.NodeConfig{StateDir: "/tmp/myco-integration", Port: 7777, NodeID: 1, UDSPath: "/tmp/myco-integration/myco.sock"}
+
+// integrationProject is the directory the integration script runs 'myco
+// deploy' from.
+const integrationProject = "/tmp/myco-integration/project"
+
+// integrationServices are the services the integration script deploys.
+var integrationServices = fixtures.Services(1, 3, "integration")
+
+// integrationCommand runs integrationScript with the myco binary at
+// MYCO_BIN, integrationServices written to its project's myco.json and
+// listed in SERVICES as ID:NAME.
+func integrationCommand(bin *dagger.File) (Command, error) {
+	env, err := integrationNode.Env()
+	if err != nil {
+		return Command{}, err
+	}
+	data, err := fixtures.Marshal(integrationServices)
+	if err != nil {
+		return Command{}, err
+	}
+	entries := make([]string, 0, len(integrationServices))
+	for _, svc := range integrationServices {
+		entries = append(entries, fmt.Sprintf("%d:%s", svc.ID, svc.Name))
+	}
+	env["MYCO_BIN"] = mycoBinaryMount
+	env["PROJECT"] = integrationProject
+	env["SERVICES"] = strings.Join(entries, " ")
+	return Command{
+		Args:       []string{"bash", "-c", integrationScript},
+		Env:        env,
+		Mounts:     map[string]*dagger.File{mycoBinaryMount: bin},
+		WriteFiles: map[string]string{integrationProject + "/myco.json": string(data)},
+	}, nil
+}
+
+// integrationChecks defines check_units DIR, which fails unless DIR holds
+// exactly one unit per SERVICES entry, naming its service and starting what
+// the executor built for it.
+const integrationChecks = `
+check_units() {
+    local dir="$1" entry id name unit units want
+    for entry in $SERVICES; do
+        id=${entry%%:*}
+        name=${entry#*:}
+        unit="${dir}/myco-${id}.service"
+        if [ ! -f "$unit" ]; then
+            echo "[FAIL] Unit file for ${name} (id ${id}) missing."
+            return 1
+        fi
+        if ! grep -qxF "Description=Myco Managed Service: ${name}" "$unit"; then
+            echo "[FAIL] Unit file for id ${id} does not name ${name}:"
+            sed 's/^/    /' "$unit"
+            return 1
+        fi
+        if ! grep -qxF "ExecStart=/var/lib/myco/bin/${id}/result/bin/run" "$unit"; then
+            echo "[FAIL] Unit file for ${name} does not start its build:"
+            sed 's/^/    /' "$unit"
+            return 1
+        fi
+        echo "[OK] Unit file for ${name} exists."
+    done
+    units=$(find "$dir" -maxdepth 1 -name 'myco-*.service' | wc -l)
+    want=$(wc -w <<<"$SERVICES")
+    if [ "$units" -ne "$want" ]; then
+        echo "[FAIL] Expected ${want} unit files, found ${units}."
+        return 1
+    fi
+}
+`
+
+// integrationScript mocks nix and systemctl, starts a daemon from the
+// binary at MYCO_BIN, runs 'myco deploy' in PROJECT and waits for the
+// executor's units, which check_units holds to SERVICES. It checks no
+// /etc/hosts entries or ports: the daemon writes no hosts entries, and a
+// deployed service carries no port (src/schema/service.zig), so every
+// service gets the same unit shape.
+const integrationScript = integrationChecks + `
+            set -e
+
+            echo "--- [1] Environment Setup ---"
+            # Mock 'nix'
+            echo '#!/bin/bash' > /usr/bin/nix
+            echo 'echo /nix/store/mock-output-path' >> /usr/bin/nix
+            chmod +x /usr/bin/nix
+
+            # Mock 'systemctl'
+            echo '#!/bin/bash' > /usr/bin/systemctl
+            echo 'exit 0' >> /usr/bin/systemctl
+            chmod +x /usr/bin/systemctl
+
+            # Create Directories
+            mkdir -p /run/systemd/system
+            mkdir -p /var/lib/myco "${MYCO_STATE_DIR}"
+
+            echo "--- [2] Daemon ---"
+            [ -x "${MYCO_BIN}" ] || { echo "[FAIL] no myco binary at ${MYCO_BIN}"; exit 1; }
+            "${MYCO_BIN}" daemon >"${MYCO_STATE_DIR}/daemon.log" 2>&1 &
+            DAEMON=$!
+            trap 'kill "$DAEMON" 2>/dev/null || true' EXIT
+            for _ in $(seq 50); do
+                [ -S "${MYCO_UDS_PATH}" ] && break
+                sleep 0.1
+            done
+            if [ ! -S "${MYCO_UDS_PATH}" ]; then
+                echo "[FAIL] Daemon did not open ${MYCO_UDS_PATH}."
+                cat "${MYCO_STATE_DIR}/daemon.log"
+                exit 1
+            fi
+
+            echo "--- [3] Deploy ---"
+            (cd "${PROJECT}" && "${MYCO_BIN}" deploy)
+
+            echo "--- [4] Verification ---"
+            # The executor builds and writes units after deploy returns.
+            want=$(wc -w <<<"$SERVICES")
+            for _ in $(seq 100); do
+                [ "$(find /run/systemd/system -maxdepth 1 -name 'myco-*.service' | wc -l)" -ge "$want" ] && break
+                sleep 0.1
+            done
+            if ! check_units /run/systemd/system; then
+                cat "${MYCO_STATE_DIR}/daemon.log"
+                exit 1
+            fi
+        `
+
+// stageRunner mounts src and the zig cache into base with the timing knobs
+// every stage shares.
+func stageRunner(base *dagger.Container, src *dagger.Directory, zigCache *dagger.CacheVolume) *dagger.Container {
+	env := runnerEnv()
+	return base.
+		WithMountedDirectory("/src", src).
+		WithMountedCache("/src/zig-cache", zigCache).
+		WithWorkdir("/src").
+		WithEnvVariable("MYCO_POLL_MS", env["MYCO_POLL_MS"]).
+		WithEnvVariable("MYCO_SYNC_TICKS", env["MYCO_SYNC_TICKS"])
+}
+
+// runnerEnv is the daemon tuning every stage command runs with.
+func runnerEnv() map[string]string {
+	pollMs := os.Getenv("MYCO_POLL_MS")
+	if pollMs == "" {
+		pollMs = "100"
+	}
+	syncTicks := os.Getenv("MYCO_SYNC_TICKS")
+	if syncTicks == "" {
+		syncTicks = "5"
+	}
+	return map[string]string{"MYCO_POLL_MS": pollMs, "MYCO_SYNC_TICKS": syncTicks}
+}
+
+func platformToZigTarget(platform dagger.Platform) (string, error) {
+	switch platform {
+	case "linux/amd64":
+		return "x86_64-linux-musl", nil
+	case "linux/arm64":
+		return "aarch64-linux-musl", nil
+	default:
+		return "", fmt.Errorf("unsupported platform: %s", platform)
+	}
+}
+
+// Timeout is the overall deadline without a configuration file,
+// MYCO_CI_TIMEOUT_MIN minutes or 7; zero means none.
+func Timeout() time.Duration {
+	return Config{}.Deadline()
+}
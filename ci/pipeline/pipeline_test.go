@@ -0,0 +1,307 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestRunStagesJoinsFailuresAndRecordsSkips(t *testing.T) {
+	t.Setenv("MYCO_CI_RUNNER_CPUS", "2")
+	t.Setenv("MYCO_CI_RUNNER_MEMORY_MB", "2048")
+	ran := make(chan string, 4)
+	stage := func(name string, err error) Stage {
+		return Stage{Name: name, Run: func(context.Context, *Env) error {
+			ran <- name
+			return err
+		}}
+	}
+	p := &Pipeline{Stages: []Stage{
+		stage("Good", nil),
+		stage("Bad One", errors.New("boom")),
+		stage("Bad Two", errors.New("bang")),
+		stage("Soft", &WarningError{Warnings: []string{"3% slower"}}),
+		{Name: "Gated", Skip: "set X=1 to enable", Run: func(context.Context, *Env) error {
+			t.Error("skipped stage ran")
+			return nil
+		}},
+	}}
+	perf := newPerfRecorder("abc")
+	err := p.runStages(context.Background(), &Env{perf: perf})
+	close(ran)
+
+	if err == nil {
+		t.Fatal("runStages succeeded with failing stages")
+	}
+	for _, want := range []string{"[Bad One] failed: boom", "[Bad Two] failed: bang"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q is missing %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "3% slower") {
+		t.Errorf("error %q includes a warning", err)
+	}
+	if n := len(ran); n != 4 {
+		t.Errorf("%d stages ran, want 4", n)
+	}
+
+	outcomes := map[string]string{}
+	for _, o := range perf.stageOutcomes() {
+		outcomes[o.Stage] = o.Outcome
+	}
+	want := map[string]string{"Good": outcomePassed, "Bad One": outcomeFailed, "Bad Two": outcomeFailed, "Soft": outcomeWarned, "Gated": outcomeSkipped}
+	for name, outcome := range want {
+		if outcomes[name] != outcome {
+			t.Errorf("outcome for %s = %q, want %q", name, outcomes[name], outcome)
+		}
+	}
+}
+
+func TestRunStagesFailFast(t *testing.T) {
+	t.Setenv("MYCO_CI_RUNNER_CPUS", "2")
+	t.Setenv("MYCO_CI_RUNNER_MEMORY_MB", "2048")
+	started := make(chan struct{})
+	p := &Pipeline{Options: Options{FailFast: true}, Stages: []Stage{
+		{Name: "Slow", Run: func(ctx context.Context, _ *Env) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+		{Name: "Bad", Run: func(context.Context, *Env) error {
+			<-started
+			return errors.New("boom")
+		}},
+		{Name: "Later", Deps: []string{"Slow"}, Run: func(context.Context, *Env) error {
+			t.Error("stage after the failure ran")
+			return nil
+		}},
+	}}
+	perf := newPerfRecorder("abc")
+	err := p.runStages(context.Background(), &Env{perf: perf})
+	if err == nil || !strings.Contains(err.Error(), "[Bad] failed: boom") {
+		t.Fatalf("runStages = %v, want Bad's failure", err)
+	}
+	if strings.Contains(err.Error(), "Slow") {
+		t.Errorf("cancelled stage reported as a failure: %v", err)
+	}
+	outcomes := map[string]string{}
+	for _, o := range perf.stageOutcomes() {
+		outcomes[o.Stage] = o.Outcome
+	}
+	want := map[string]string{"Slow": outcomeSkipped, "Bad": outcomeFailed, "Later": outcomeSkipped}
+	for name, outcome := range want {
+		if outcomes[name] != outcome {
+			t.Errorf("outcome for %s = %q, want %q", name, outcomes[name], outcome)
+		}
+	}
+}
+
+func TestRunStagesPassesWithWarnings(t *testing.T) {
+	p := &Pipeline{Stages: []Stage{{Name: "Release Comparison", Run: func(context.Context, *Env) error {
+		return &WarningError{Warnings: []string{"cli_status regressed more than 10%"}}
+	}}}}
+	perf := newPerfRecorder("abc")
+	if err := p.runStages(context.Background(), &Env{perf: perf}); err != nil {
+		t.Fatalf("runStages failed on a warning: %v", err)
+	}
+	if got, want := completionMessage(perf), "🚀 Pipeline completed with warnings from Release Comparison"; got != want {
+		t.Errorf("completionMessage = %q, want %q", got, want)
+	}
+}
+
+func TestExecStagesUseExecutor(t *testing.T) {
+	exec := &fakeExecutor{handle: func(cmd Command) (Result, error) {
+		if cmd.Args[1] == "fmt" {
+			return Result{ExitCode: 1, Stdout: "src/main.zig"}, nil
+		}
+		return Result{}, nil
+	}}
+	stages := map[string]Stage{}
+	for _, s := range New(Options{}).Stages {
+		stages[s.Name] = s
+	}
+	env := &Env{Exec: exec}
+	if err := stages["Format"].Run(context.Background(), env); err == nil || !strings.Contains(err.Error(), "src/main.zig") {
+		t.Errorf("Format err = %v, want the unformatted file", err)
+	}
+	if err := stages["Build Check"].Run(context.Background(), env); err != nil {
+		t.Errorf("Build Check err = %v", err)
+	}
+}
+
+func TestNewGatesNetworkStagesOffline(t *testing.T) {
+	names := func(p *Pipeline) map[string]Stage {
+		m := map[string]Stage{}
+		for _, s := range p.Stages {
+			m[s.Name] = s
+		}
+		return m
+	}
+	online := names(New(Options{Coverage: true}))
+	offline := names(New(Options{Coverage: true, Offline: true}))
+	for _, name := range []string{"Coverage", "Dependency Report", "Secrets Scan", "CI Self-Test"} {
+		if _, ok := online[name]; !ok {
+			t.Errorf("%s missing online", name)
+		}
+		if _, ok := offline[name]; ok {
+			t.Errorf("%s present offline", name)
+		}
+	}
+	for _, s := range scenarios {
+		if s.NeedsNetwork && s.Pending == "" && s.OptIn == "" && offline[s.Name].Skip == "" {
+			t.Errorf("network scenario %s not skipped offline", s.Name)
+		}
+	}
+}
+
+func TestSelectKeepsProducersOfSelectedStages(t *testing.T) {
+	p := New(Options{})
+	if err := p.Select([]string{"cluster smoke", "Format"}, []string{"format"}); err != nil {
+		t.Fatal(err)
+	}
+	skip := map[string]string{}
+	for _, s := range p.Stages {
+		skip[s.Name] = s.Skip
+	}
+	want := map[string]string{
+		"Cluster Smoke":    "",
+		"Myco Binary":      "",
+		"Format":           "deselected by --skip",
+		"Integration Test": "not selected by --only",
+	}
+	for name, reason := range want {
+		if skip[name] != reason {
+			t.Errorf("%s skip = %q, want %q", name, skip[name], reason)
+		}
+	}
+
+	if err := New(Options{}).Select(nil, []string{"Nope"}); err == nil || !strings.Contains(err.Error(), `--skip: no stage "Nope"`) {
+		t.Errorf("unknown stage err = %v", err)
+	}
+}
+
+func TestPhasesPartitionStages(t *testing.T) {
+	all := New(Options{Coverage: true, CompareRelease: true})
+	covered := map[string]string{}
+	for _, phase := range []string{PhaseCheck, PhaseIntegration, PhaseSmoke} {
+		p := New(Options{Coverage: true, CompareRelease: true, Build: true})
+		if err := p.Phase(phase); err != nil {
+			t.Fatal(err)
+		}
+		if p.Options.Build {
+			t.Errorf("%s phase runs the release build", phase)
+		}
+		if _, err := newStageGraph(p.Stages); err != nil {
+			t.Errorf("%s phase: %v", phase, err)
+		}
+		if _, err := newOutputRegistry(p.Stages); err != nil {
+			t.Errorf("%s phase: %v", phase, err)
+		}
+		for _, s := range p.Stages {
+			if s.Phase != phase {
+				if len(s.Outputs) == 0 {
+					t.Errorf("%s phase runs %s from the %s phase, which has no outputs", phase, s.Name, s.Phase)
+				}
+				continue
+			}
+			if prev, ok := covered[s.Name]; ok {
+				t.Errorf("%s is in both %s and %s", s.Name, prev, phase)
+			}
+			covered[s.Name] = phase
+		}
+	}
+	for _, s := range all.Stages {
+		if _, ok := covered[s.Name]; !ok {
+			t.Errorf("%s is in no phase", s.Name)
+		}
+	}
+	if covered["Cluster Smoke"] != PhaseSmoke || covered["Integration Test"] != PhaseIntegration || covered["Format"] != PhaseCheck {
+		t.Errorf("unexpected phases: %v", covered)
+	}
+
+	smoke := New(Options{})
+	if err := smoke.Phase(PhaseSmoke); err != nil || smoke.stageNames() != "Myco Binary, Cluster Smoke" {
+		t.Errorf("smoke phase runs %s (err %v), want the cluster smoke and the binary it takes", smoke.stageNames(), err)
+	}
+
+	build := New(Options{})
+	if err := build.Phase(PhaseBuild); err != nil || len(build.Stages) != 0 || !build.Options.Build {
+		t.Errorf("build phase: %d stages, Build %v, err %v", len(build.Stages), build.Options.Build, err)
+	}
+	if err := New(Options{}).Phase("deploy"); err == nil {
+		t.Error("unknown phase accepted")
+	}
+}
+
+func TestIntegrationChecksCatchBrokenUnits(t *testing.T) {
+	unit := func(id int, name string) string {
+		return fmt.Sprintf("[Unit]\nDescription=Myco Managed Service: %s\n\n[Service]\nExecStart=/var/lib/myco/bin/%d/result/bin/run\n", name, id)
+	}
+	good := map[string]string{
+		"/src/myco-1.service": unit(1, "integration-1"),
+		"/src/myco-2.service": unit(2, "integration-2"),
+		"/src/myco-3.service": unit(3, "integration-3"),
+	}
+	with := func(path, contents string) map[string]string {
+		units := maps.Clone(good)
+		if contents == "" {
+			delete(units, path)
+		} else {
+			units[path] = contents
+		}
+		return units
+	}
+	for _, tc := range []struct {
+		name  string
+		units map[string]string
+		fail  string
+	}{
+		{"every unit", good, ""},
+		{"missing unit", with("/src/myco-2.service", ""), "Unit file for integration-2 (id 2) missing"},
+		{"wrong name", with("/src/myco-2.service", unit(2, "integration-3")), "does not name integration-2"},
+		{"wrong build", with("/src/myco-3.service", unit(1, "integration-3")), "does not start its build"},
+		{"extra unit", with("/src/myco-4.service", unit(4, "stray")), "Expected 3 unit files, found 4"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			exec := newHostExecutor(t.TempDir(), t.TempDir())
+			res, err := exec.Exec(context.Background(), Command{
+				Args:       []string{"bash", "-c", integrationChecks + `check_units "$PWD"`},
+				Env:        map[string]string{"SERVICES": "1:integration-1 2:integration-2 3:integration-3"},
+				WriteFiles: tc.units,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.fail == "" {
+				if res.ExitCode != 0 {
+					t.Fatalf("exit %d:\n%s", res.ExitCode, res.Stdout)
+				}
+				return
+			}
+			if res.ExitCode == 0 || !strings.Contains(res.Stdout, tc.fail) {
+				t.Errorf("exit %d, want a failure with %q:\n%s", res.ExitCode, tc.fail, res.Stdout)
+			}
+		})
+	}
+}
+
+func TestEachRunGetsItsOwnDirectory(t *testing.T) {
+	t.Setenv("MYCO_CI_RUN_ID", "")
+	p := New(Options{})
+	first, second := p.startRun(), p.startRun()
+	if first.ID == "" || first.ID == second.ID {
+		t.Errorf("run IDs %q and %q, want two distinct IDs", first.ID, second.ID)
+	}
+
+	opened := newRunDir()
+	p.next = &opened
+	if got := p.startRun(); got != opened {
+		t.Errorf("run after StartProgress = %q, want its directory %q", got.ID, opened.ID)
+	}
+	if got := p.startRun(); got == opened {
+		t.Error("StartProgress's directory was reused by a second run")
+	}
+}
@@ -0,0 +1,224 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dryRunExecutor stands in for the runner during a dry run: every command
+// succeeds without running, so a stage goes on to the commands after it.
+type dryRunExecutor struct{}
+
+func (dryRunExecutor) Exec(context.Context, Command) (Result, error) {
+	return Result{}, nil
+}
+
+// Plan writes what Run would do without connecting to the engine: the
+// stages in an order they can start in, what each waits for, where it runs
+// and the commands it runs, then the release build. Stages that drive the
+// engine themselves are listed without commands, which exist only once they
+// run. Commands a stage runs concurrently may be listed in any order.
+func (p *Pipeline) Plan(w io.Writer, deadline time.Duration) error {
+	graph, err := newStageGraph(p.Stages)
+	if err != nil {
+		return err
+	}
+	outputs, err := newOutputRegistry(p.Stages)
+	if err != nil {
+		return err
+	}
+	// Consumers get empty placeholders for the outputs their producers did
+	// not publish; publishing over what a producer did publish fails, and
+	// that is fine.
+	placeholders := func(s Stage) {
+		for _, o := range s.Outputs {
+			outputs.publish(o.Name, stageOutput{Kind: o.Kind})
+		}
+	}
+
+	limit := "none"
+	if deadline > 0 {
+		limit = deadline.String()
+	}
+	fmt.Fprintf(w, "Dry run: %d stages, overall deadline %s. Nothing is executed.\n", len(p.Stages), limit)
+	if p.Options.Local {
+		fmt.Fprintln(w, "Local: commands run on this host with its zig and bash; /src is the working tree.")
+	} else {
+		fmt.Fprintf(w, "Runner: %s with zig %s, the source tree at /src and the zig cache at /src/zig-cache.\n", baseImage, zigVersion())
+	}
+	if p.Options.FailFast {
+		fmt.Fprintln(w, "Fail-fast: the first failing stage cancels the rest.")
+	}
+	if p.Options.Jobs > 0 {
+		fmt.Fprintf(w, "Parallelism: at most %d stages at a time.\n", p.Options.Jobs)
+	}
+	if cross := crossPlatforms(p.Options.Platforms, p.Options.Native); p.Options.Build && len(cross) > 0 {
+		fmt.Fprintf(w, "Platforms: %s native (assumed from this host until the engine is asked), %s cross-compiled only.\n", p.Options.Native, strings.Join(cross, ", "))
+	}
+	if p.Options.Offline {
+		fmt.Fprintf(w, "Offline: served from the cache bundle in %s.\n", p.Options.BundleDir)
+	}
+
+	skipped := map[int]string{}
+	for n, i := range graph.order() {
+		s := p.Stages[i]
+		fmt.Fprintf(w, "\n%2d. %s [%s] %s\n", n+1, s.Name, s.Phase, planLimits(s))
+		var after []string
+		for _, j := range graph.deps[i] {
+			after = append(after, p.Stages[j].Name)
+			if _, ok := skipped[j]; ok && s.Skip == "" {
+				s.Skip = p.Stages[j].Name + " is skipped"
+			}
+		}
+		if len(after) > 0 {
+			fmt.Fprintf(w, "    after: %s\n", strings.Join(after, ", "))
+		}
+		if s.Skip != "" {
+			skipped[i] = s.Skip
+			fmt.Fprintf(w, "    skipped: %s\n", s.Skip)
+			placeholders(s)
+			continue
+		}
+		if s.Retry.Count > 0 {
+			fmt.Fprintf(w, "    %s\n", retryLine(s.Retry))
+		}
+		for _, h := range s.Before {
+			fmt.Fprintf(w, "    before hook: %s\n", hookLine(h))
+		}
+		switch {
+		case s.Plugin != "":
+			fmt.Fprintf(w, "    runs plugin %s, which sends its commands once it runs\n", s.Plugin)
+		case s.Engine:
+			fmt.Fprintln(w, "    runs its own containers on the engine")
+		default:
+			commands, err := planCommands(s, outputs)
+			for _, cmd := range commands {
+				fmt.Fprintf(w, "    $ %s\n", planCommand(cmd))
+			}
+			if err != nil {
+				fmt.Fprintf(w, "    commands after this are known only once it runs: %v\n", err)
+			}
+		}
+		for _, h := range s.After {
+			fmt.Fprintf(w, "    after hook: %s\n", hookLine(h))
+		}
+		placeholders(s)
+	}
+
+	fmt.Fprintln(w)
+	if !p.Options.Build {
+		fmt.Fprintln(w, "Release build: off (set RUN_PLATFORM_BUILD=1 to enable).")
+	} else {
+		for _, platform := range p.Options.Platforms {
+			target, err := platformToZigTarget(platform)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "Release build %s, once every stage passes:\n    $ zig build -Dtarget=%s -Doptimize=ReleaseSmall\n", platform, target)
+		}
+		if p.Options.Channel != "" {
+			fmt.Fprintf(w, "Publishes to the %s channel.\n", p.Options.Channel)
+		}
+		if p.Options.Image != "" {
+			fmt.Fprintf(w, "Pushes the runtime image to %s.\n", p.Options.Image)
+		}
+	}
+	if p.Options.ArtifactStore != "" {
+		fmt.Fprintf(w, "Artifacts mirrored to %s.\n", p.Options.ArtifactStore)
+	}
+	return nil
+}
+
+// planLimits describes a stage's resource request and command timeout.
+func planLimits(s Stage) string {
+	r := s.Resources
+	if r == (Resources{}) {
+		r = defaultStageResources
+	}
+	timeout := "timeout " + defaultStageTimeout.String()
+	switch {
+	case s.Timeout < 0:
+		timeout = "no timeout"
+	case s.Timeout > 0:
+		timeout = "timeout " + s.Timeout.String()
+	}
+	return fmt.Sprintf("%.1f CPUs, %d MiB, %s", r.CPUs, r.MemoryMB, timeout)
+}
+
+// planCommands runs s against an executor that only records, returning the
+// commands it ran and why it stopped early, if it did: because it reached
+// for the engine anyway, or it needed a real result. The stage's own output
+// is discarded.
+func planCommands(s Stage, outputs *outputRegistry) (commands []Command, err error) {
+	recorder := &recordingExecutor{inner: dryRunExecutor{}}
+	env := &Env{Exec: recorder, perf: newPerfRecorder(""), outputs: outputs}
+	stdout := os.Stdout
+	if devNull, openErr := os.OpenFile(os.DevNull, os.O_WRONLY, 0); openErr == nil {
+		os.Stdout = devNull
+		defer devNull.Close()
+	}
+	defer func() {
+		os.Stdout = stdout
+		if r := recover(); r != nil {
+			err = fmt.Errorf("it uses the engine (%v)", r)
+		}
+		for _, rec := range recorder.interactions {
+			commands = append(commands, rec.Command)
+		}
+	}()
+	err = s.Run(withStageTimeout(context.Background(), s.Timeout), env)
+	return nil, err
+}
+
+// planCommand renders cmd as a shell line. Scripts passed to bash -c are
+// summarised by their length rather than printed.
+func planCommand(cmd Command) string {
+	var parts []string
+	names := make([]string, 0, len(cmd.Env))
+	for name := range cmd.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, name+"="+planArg(cmd.Env[name]))
+	}
+	for _, arg := range cmd.Args {
+		if strings.Contains(strings.TrimSpace(arg), "\n") {
+			parts = append(parts, fmt.Sprintf("<%d-line script>", strings.Count(strings.TrimSpace(arg), "\n")+1))
+			continue
+		}
+		parts = append(parts, planArg(arg))
+	}
+	line := strings.Join(parts, " ")
+	if len(cmd.Mounts) > 0 {
+		paths := make([]string, 0, len(cmd.Mounts))
+		for path := range cmd.Mounts {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		line += "  (mounts " + strings.Join(paths, ", ") + ")"
+	}
+	if len(cmd.WriteFiles) > 0 {
+		paths := make([]string, 0, len(cmd.WriteFiles))
+		for path := range cmd.WriteFiles {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		line += "  (writes " + strings.Join(paths, ", ") + ")"
+	}
+	return line
+}
+
+// planArg quotes arg when the shell would split or expand it.
+func planArg(arg string) string {
+	if arg == "" || strings.ContainsAny(arg, " \t'\"$`\\|&;<>()*?[]{}~#") {
+		return strconv.Quote(arg)
+	}
+	return arg
+}
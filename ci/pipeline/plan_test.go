@@ -0,0 +1,98 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanListsStagesInStartOrder(t *testing.T) {
+	p := &Pipeline{Stages: []Stage{
+		{Name: "Smoke", Inputs: []string{"bin"}, Timeout: -1, Run: func(ctx context.Context, env *Env) error {
+			if _, err := env.File("bin"); err != nil {
+				return err
+			}
+			_, err := env.Exec.Exec(ctx, Command{Args: []string{"bash", "-c", "set -e\nrun smoke\n"}, Env: map[string]string{"NODES": "3"}})
+			return err
+		}},
+		ExecStage("Binary", Resources{CPUs: 2, MemoryMB: 1024}, "zig", "build"),
+		{Name: "Scan", Engine: true},
+		{Name: "Pending", Skip: "not yet", Outputs: []Output{{Name: "report", Kind: OutputJSON}}},
+		{Name: "Report", Inputs: []string{"report"}},
+		{Name: "Deploy", Plugin: "/opt/ci/deploy", Run: func(context.Context, *Env) error {
+			t.Error("dry run started a plugin")
+			return nil
+		}},
+	}}
+	p.Stages[1].Outputs = []Output{{Name: "bin", Kind: OutputFile}}
+	p.Stages[1].Before = []Hook{{Run: "warm-mirror"}}
+	p.Stages[1].After = []Hook{{Image: "curlimages/curl", Args: []string{"curl", "http://metrics.local"}}}
+	binary := p.Stages[1].Run
+	p.Stages[1].Run = func(ctx context.Context, env *Env) error {
+		if err := binary(ctx, env); err != nil {
+			return err
+		}
+		return env.PublishFile("bin", nil)
+	}
+
+	var out strings.Builder
+	if err := p.Plan(&out, 7*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	plan := out.String()
+	for _, want := range []string{
+		"Dry run: 6 stages, overall deadline 7m0s.",
+		" 1. Binary [] 2.0 CPUs, 1024 MiB, timeout 15m0s\n    before hook: bash -c warm-mirror\n    $ zig build\n    after hook: [curlimages/curl] curl http://metrics.local\n",
+		" 2. Smoke [] 1.0 CPUs, 512 MiB, no timeout\n    after: Binary\n    $ NODES=3 bash -c <2-line script>\n",
+		"Scan [] 1.0 CPUs, 512 MiB, timeout 15m0s\n    runs its own containers on the engine\n",
+		"Pending [] 1.0 CPUs, 512 MiB, timeout 15m0s\n    skipped: not yet\n",
+		"    after: Pending\n    skipped: Pending is skipped\n",
+		"Deploy [] 1.0 CPUs, 512 MiB, timeout 15m0s\n    runs plugin /opt/ci/deploy, which sends its commands once it runs\n",
+		"Release build: off",
+	} {
+		if !strings.Contains(plan, want) {
+			t.Errorf("plan missing %q:\n%s", want, plan)
+		}
+	}
+}
+
+func TestPlanReportsStagesThatNeedTheEngine(t *testing.T) {
+	p := &Pipeline{Stages: []Stage{{Name: "Sneaky", Run: func(ctx context.Context, env *Env) error {
+		env.Exec.Exec(ctx, Command{Args: []string{"true"}})
+		env.Runner.WithExec([]string{"false"})
+		return nil
+	}}}}
+	var out strings.Builder
+	if err := p.Plan(&out, 0); err != nil {
+		t.Fatal(err)
+	}
+	if plan := out.String(); !strings.Contains(plan, "$ true\n    commands after this are known only once it runs: it uses the engine") {
+		t.Errorf("plan does not say where the stage reached for the engine:\n%s", plan)
+	}
+}
+
+func TestPlanRejectsCycles(t *testing.T) {
+	p := &Pipeline{Stages: []Stage{{Name: "A", Deps: []string{"B"}}, {Name: "B", Deps: []string{"A"}}}}
+	if err := p.Plan(&strings.Builder{}, 0); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Plan = %v, want a cycle error", err)
+	}
+}
+
+// TestPlanCoversExecStages keeps the Engine markers honest: every stage New
+// builds without one must plan its commands through Exec alone.
+func TestPlanCoversExecStages(t *testing.T) {
+	p := New(Options{Build: true})
+	var out strings.Builder
+	if err := p.Plan(&out, 0); err != nil {
+		t.Fatal(err)
+	}
+	if plan := out.String(); strings.Contains(plan, "known only once it runs") {
+		t.Errorf("a stage without Engine set reached for the engine:\n%s", plan)
+	}
+	for _, s := range commandStages(t) {
+		if s.Engine {
+			t.Errorf("%s only talks to the Executor but is marked Engine", s.Name)
+		}
+	}
+}
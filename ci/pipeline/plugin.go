@@ -0,0 +1,221 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A plugin is an executable that adds stages without forking this package,
+// for checks a team cannot publish, like an internal deploy. It speaks JSON
+// on stdio:
+//
+//   - "PLUGIN describe" prints {"protocol": 1, "stages": [...]}, each stage
+//     a pluginStage.
+//   - "PLUGIN run STAGE" runs one stage. It writes one JSON message per line
+//     to stdout: {"exec": COMMAND} runs a command in the stage runner and
+//     answers with one line holding the Result, plus "error" when the
+//     engine could not run it; {"log": "..."} prints a line; and
+//     {"done": {"error": "...", "warnings": [...]}} ends the stage, failed
+//     when error is set. Stderr goes to the pipeline's.
+//
+// Plugins run on the host with MYCO_CI_RUN_ID, MYCO_CI_RUN_DIR (where to put
+// artifacts) and, when running a stage, MYCO_CI_STAGE set.
+
+// pluginProtocol is the protocol version this pipeline speaks.
+const pluginProtocol = 1
+
+// pluginDescribeTimeout bounds "PLUGIN describe", which runs before the
+// pipeline starts and should only print.
+const pluginDescribeTimeout = 30 * time.Second
+
+// pluginStage is a stage as a plugin describes it.
+type pluginStage struct {
+	Name     string   `json:"name"`
+	CPUs     float64  `json:"cpus,omitempty"`
+	MemoryMB int      `json:"memory_mb,omitempty"`
+	Deps     []string `json:"deps,omitempty"`
+	// Phase defaults as for built-in stages, to check.
+	Phase string `json:"phase,omitempty"`
+	// Network stages are skipped under --offline.
+	Network bool `json:"network,omitempty"`
+}
+
+type pluginDescription struct {
+	Protocol int           `json:"protocol"`
+	Stages   []pluginStage `json:"stages"`
+}
+
+// pluginMessage is one line a running plugin writes; one field is set.
+type pluginMessage struct {
+	Exec *Command      `json:"exec,omitempty"`
+	Log  string        `json:"log,omitempty"`
+	Done *pluginResult `json:"done,omitempty"`
+}
+
+type pluginResult struct {
+	Error    string   `json:"error,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// pluginReply answers an exec message.
+type pluginReply struct {
+	Result
+	Error string `json:"error,omitempty"`
+}
+
+// LoadPlugins asks each plugin for its stages and registers them, so every
+// pipeline New assembles from here on includes them.
+func LoadPlugins(paths []string) error {
+	for _, path := range paths {
+		stages, err := describePlugin(path)
+		if err != nil {
+			return err
+		}
+		RegisterStages(func(opts Options) []Stage {
+			var built []Stage
+			for _, d := range stages {
+				built = append(built, pluginStageFor(path, d, opts.Offline))
+			}
+			return built
+		})
+	}
+	return nil
+}
+
+// describePlugin runs "PLUGIN describe" and checks what it says.
+func describePlugin(path string) ([]pluginStage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginDescribeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, "describe")
+	cmd.Env = os.Environ()
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: describe: %w", path, err)
+	}
+	var desc pluginDescription
+	if err := json.Unmarshal(out, &desc); err != nil {
+		return nil, fmt.Errorf("plugin %s: describe: %w", path, err)
+	}
+	if desc.Protocol != pluginProtocol {
+		return nil, fmt.Errorf("plugin %s speaks protocol %d; this pipeline speaks %d", path, desc.Protocol, pluginProtocol)
+	}
+	for _, s := range desc.Stages {
+		if strings.TrimSpace(s.Name) == "" {
+			return nil, fmt.Errorf("plugin %s: a stage has no name", path)
+		}
+		switch s.Phase {
+		case "", PhaseCheck, PhaseIntegration, PhaseSmoke:
+		default:
+			return nil, fmt.Errorf("plugin %s: stage %q: no phase %q", path, s.Name, s.Phase)
+		}
+	}
+	return desc.Stages, nil
+}
+
+// pluginStageFor is the Stage that runs d through the plugin at path.
+func pluginStageFor(path string, d pluginStage, offline bool) Stage {
+	s := Stage{
+		Name:      d.Name,
+		Resources: Resources{CPUs: d.CPUs, MemoryMB: d.MemoryMB},
+		Deps:      d.Deps,
+		Phase:     d.Phase,
+		Plugin:    path,
+		Run: func(ctx context.Context, env *Env) error {
+			return runPlugin(ctx, env.run, path, d.Name, env.Exec)
+		},
+	}
+	if offline && d.Network {
+		s.Skip = "needs network; running --offline"
+	}
+	return s
+}
+
+// pluginEnv is the environment plugins run stage with.
+func pluginEnv(run runDir, stage string) []string {
+	dir, err := filepath.Abs(run.path())
+	if err != nil {
+		dir = run.path()
+	}
+	return append(os.Environ(), "MYCO_CI_RUN_ID="+run.ID, "MYCO_CI_RUN_DIR="+dir, "MYCO_CI_STAGE="+stage)
+}
+
+// runPlugin runs "PLUGIN run STAGE", answering its exec messages through
+// runner. Commands get the stage's timeout; the plugin itself is killed
+// when ctx ends.
+func runPlugin(ctx context.Context, run runDir, path, stage string, runner Executor) error {
+	cmd := exec.CommandContext(ctx, path, "run", stage)
+	cmd.Env = pluginEnv(run, stage)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return &StageError{Command: path + " run", Err: err}
+	}
+	done, err := pluginSession(ctx, json.NewDecoder(stdout), json.NewEncoder(stdin), runner)
+	stdin.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return &StageError{Command: path + " run", Err: err}
+	}
+	waitErr := cmd.Wait()
+	switch {
+	case done == nil && waitErr != nil:
+		return &StageError{Command: path + " run", Err: waitErr}
+	case done == nil:
+		return &StageError{Command: path + " run", Err: errors.New("plugin exited without reporting a result")}
+	case done.Error != "":
+		return &StageError{Command: path + " run", Err: errors.New(done.Error)}
+	case waitErr != nil:
+		return &StageError{Command: path + " run", Err: waitErr}
+	case len(done.Warnings) > 0:
+		return &WarningError{Warnings: done.Warnings}
+	}
+	return nil
+}
+
+// pluginSession reads a running plugin's messages until it reports a result
+// or closes stdout. An unreadable message is a protocol error.
+func pluginSession(ctx context.Context, dec *json.Decoder, enc *json.Encoder, runner Executor) (*pluginResult, error) {
+	for {
+		var msg pluginMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("plugin protocol: %w", err)
+		}
+		switch {
+		case msg.Done != nil:
+			return msg.Done, nil
+		case msg.Exec != nil:
+			if len(msg.Exec.Args) == 0 {
+				return nil, errors.New("plugin protocol: exec without args")
+			}
+			res, err := runner.Exec(ctx, Command{Args: msg.Exec.Args, Env: msg.Exec.Env, ReadFiles: msg.Exec.ReadFiles})
+			reply := pluginReply{Result: res}
+			if err != nil {
+				reply.Error = err.Error()
+			}
+			if err := enc.Encode(reply); err != nil {
+				return nil, fmt.Errorf("plugin protocol: %w", err)
+			}
+		case msg.Log != "":
+			logf(ctx, "%s", msg.Log)
+		}
+	}
+}
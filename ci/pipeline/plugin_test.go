@@ -0,0 +1,101 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writePlugin writes a plugin that adds Compliance, which runs one command
+// and warns when it passes, and Deploy, which needs the network.
+func writePlugin(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "plugin")
+	script := `#!/bin/sh
+case "$1" in
+describe)
+  echo '{"protocol": 1, "stages": [{"name": "Compliance", "cpus": 0.5, "memory_mb": 256, "deps": ["Format"]}, {"name": "Deploy", "network": true, "phase": "smoke"}]}'
+  ;;
+run)
+  [ "$2" = "$MYCO_CI_STAGE" ] || { echo '{"done": {"error": "stage not in env"}}'; exit 0; }
+  echo '{"exec": {"args": ["zig", "build", "audit"], "env": {"RUN": "'"$MYCO_CI_RUN_ID"'"}}}'
+  read reply
+  case "$reply" in
+  *'"exit_code":0'*) echo '{"log": "audit clean"}'; echo '{"done": {"warnings": ["a waiver expires soon"]}}' ;;
+  *) echo '{"done": {"error": "audit failed"}}' ;;
+  esac
+  ;;
+esac
+`
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPluginsRegistersStages(t *testing.T) {
+	saved := stageRegistry.funcs
+	t.Cleanup(func() { stageRegistry.funcs = saved })
+	path := writePlugin(t)
+	if err := LoadPlugins([]string{path}); err != nil {
+		t.Fatal(err)
+	}
+
+	stages := map[string]Stage{}
+	for _, s := range New(Options{Offline: true}).Stages {
+		stages[s.Name] = s
+	}
+	compliance, deploy := stages["Compliance"], stages["Deploy"]
+	if compliance.Plugin != path || compliance.Resources != (Resources{CPUs: 0.5, MemoryMB: 256}) || compliance.Phase != PhaseCheck || len(compliance.Deps) != 1 {
+		t.Errorf("Compliance = %+v", compliance)
+	}
+	if deploy.Phase != PhaseSmoke || deploy.Skip == "" {
+		t.Errorf("Deploy = phase %q, skip %q; want smoke, skipped offline", deploy.Phase, deploy.Skip)
+	}
+}
+
+func TestRunPlugin(t *testing.T) {
+	path := writePlugin(t)
+	exec := &fakeExecutor{}
+	err := runPlugin(context.Background(), runDir{ID: "r1"}, path, "Compliance", exec)
+	if w, ok := err.(*WarningError); !ok || w.Warnings[0] != "a waiver expires soon" {
+		t.Errorf("runPlugin = %v, want the plugin's warning", err)
+	}
+	calls := exec.commands()
+	if len(calls) != 1 || !strings.HasSuffix(strings.Join(calls[0].Args, " "), "zig build audit") || calls[0].Env["RUN"] != "r1" {
+		t.Errorf("commands = %+v", calls)
+	}
+
+	failing := &fakeExecutor{handle: func(Command) (Result, error) { return Result{ExitCode: 2}, nil }}
+	if err := runPlugin(context.Background(), runDir{ID: "r1"}, path, "Compliance", failing); err == nil || !strings.Contains(err.Error(), "audit failed") {
+		t.Errorf("runPlugin with a failing command = %v, want the plugin's error", err)
+	}
+}
+
+func TestPluginProtocolErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, script := range map[string]string{
+		"old protocol":  `echo '{"protocol": 0, "stages": []}'`,
+		"unnamed stage": `echo '{"protocol": 1, "stages": [{"cpus": 1}]}'`,
+		"bad phase":     `echo '{"protocol": 1, "stages": [{"name": "X", "phase": "build"}]}'`,
+		"not json":      `echo hello`,
+	} {
+		path := filepath.Join(dir, strings.ReplaceAll(name, " ", "-"))
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := describePlugin(path); err == nil {
+			t.Errorf("%s: describe succeeded", name)
+		}
+	}
+
+	silent := filepath.Join(dir, "silent")
+	if err := os.WriteFile(silent, []byte("#!/bin/sh\nexit 0\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := runPlugin(context.Background(), runDir{ID: "r1"}, silent, "X", &fakeExecutor{}); err == nil || !strings.Contains(err.Error(), "without reporting a result") {
+		t.Errorf("silent plugin = %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package pipeline
+
+// flamegraphScenario samples n2 with perf while a deploy burst converges
+// across three nodes, then exports the folded stacks and a flamegraph SVG.
+// The binary is built ReleaseSafe so Zig frames keep their symbols.
+var flamegraphScenario = scenario{
+	Name:       "Flamegraph Profile",
+	OptIn:      "MYCO_CI_PROFILE",
+	Packages:   []string{"perf", "perl", "flamegraph"},
+	Privileged: true,
+	Resources:  Resources{CPUs: 2, MemoryMB: 1024},
+	Env:        []string{"MYCO_PROFILE_SEC"},
+	Script: `
+MYCO_SMOKE_OPTIMIZE=ReleaseSafe build_myco
+
+PROFILE_SEC="${MYCO_PROFILE_SEC:-20}"
+
+start_node 0
+start_node 1
+start_node 2
+sleep 2
+check_daemons
+wire_full_mesh 0 1 2
+
+echo "==> Recording n2 for ${PROFILE_SEC}s during a deploy burst..."
+perf record -F 999 -g -p "${PIDS[1]}" -o "${STATE}/perf.data" -- sleep "${PROFILE_SEC}" &
+perf_pid=$!
+sleep 1
+deploy_services 0 1 20 burst-a
+deploy_services 2 100 20 burst-c
+wait_until 120 "cluster converged while profiling" services_known_at_least 1 40
+wait "${perf_pid}" || fail "perf record failed"
+check_daemons
+
+perf script -i "${STATE}/perf.data" >"${STATE}/perf.txt"
+stackcollapse-perf.pl "${STATE}/perf.txt" >"${ARTIFACTS}/n2.folded"
+[ -s "${ARTIFACTS}/n2.folded" ] || fail "perf captured no samples"
+flamegraph.pl --title "myco daemon (n2) during deploy burst" "${ARTIFACTS}/n2.folded" >"${ARTIFACTS}/n2-flamegraph.svg"
+echo "==> Hottest frames:"
+awk '{print $NF "\t" $0}' "${ARTIFACTS}/n2.folded" | sort -nr | head -n 10 | cut -f2-
+ok "flamegraph written to ${ARTIFACTS}/n2-flamegraph.svg"
+`,
+}
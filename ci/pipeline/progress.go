@@ -0,0 +1,243 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often the --tui table is redrawn.
+const progressInterval = 500 * time.Millisecond
+
+// consoleLogName is the run-directory file that takes the run's output
+// while the table has the terminal.
+const consoleLogName = "console.log"
+
+// Stage states shown in the table.
+const (
+	progressWaiting = "waiting"
+	progressRunning = "running"
+	progressPassed  = "passed"
+	progressWarned  = "warnings"
+	progressFailed  = "FAILED"
+	progressSkipped = "skipped"
+)
+
+// progressView is the live stage table of --tui: a row per stage with its
+// state, elapsed time and the last line it logged, redrawn in place. The
+// concurrent stages' own output goes to the console log instead, where it
+// can be read whole.
+type progressView struct {
+	mu    sync.Mutex
+	out   io.Writer
+	width int
+	start time.Time
+	names []string
+	rows  map[string]*progressRow
+	// drawn is how many lines the last draw left, for the next to replace.
+	drawn int
+}
+
+type progressRow struct {
+	state      string
+	start, end time.Time
+	last       string
+}
+
+func newProgressView(out io.Writer, width int, stages []Stage) *progressView {
+	v := &progressView{out: out, width: width, start: time.Now(), rows: map[string]*progressRow{}}
+	for _, s := range stages {
+		v.names = append(v.names, s.Name)
+		v.rows[s.Name] = &progressRow{state: progressWaiting}
+	}
+	return v
+}
+
+func (v *progressView) started(name string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if r, ok := v.rows[name]; ok {
+		r.state, r.start, r.end = progressRunning, time.Now(), time.Time{}
+	}
+}
+
+func (v *progressView) finished(name, state string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if r, ok := v.rows[name]; ok {
+		r.state, r.end = state, time.Now()
+	}
+}
+
+func (v *progressView) logged(name, line string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if r, ok := v.rows[name]; ok && line != "" {
+		r.last = line
+	}
+}
+
+// render lays the table out as of now. Stages skipped before they started
+// are counted in the footer rather than given rows.
+func (v *progressView) render(now time.Time) []string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	nameWidth := len("Stage")
+	for _, name := range v.names {
+		if r := v.rows[name]; r.state != progressSkipped || !r.start.IsZero() {
+			nameWidth = max(nameWidth, len(name))
+		}
+	}
+	line := func(name, state, elapsed, last string) string {
+		row := fmt.Sprintf("%-*s  %-8s  %7s  %s", nameWidth, name, state, elapsed, last)
+		return strings.TrimRight(truncate(row, v.width), " ")
+	}
+	lines := []string{line("Stage", "State", "Elapsed", "Last output")}
+	counts := map[string]int{}
+	for _, name := range v.names {
+		r := v.rows[name]
+		counts[r.state]++
+		if r.state == progressSkipped && r.start.IsZero() {
+			continue
+		}
+		elapsed := ""
+		switch {
+		case r.start.IsZero():
+		case r.end.IsZero():
+			elapsed = now.Sub(r.start).Round(time.Second).String()
+		default:
+			elapsed = r.end.Sub(r.start).Round(time.Second).String()
+		}
+		lines = append(lines, line(name, r.state, elapsed, r.last))
+	}
+	var parts []string
+	for _, state := range []string{progressRunning, progressWaiting, progressPassed, progressWarned, progressFailed, progressSkipped} {
+		if counts[state] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[state], strings.ToLower(state)))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("%s — %s", now.Sub(v.start).Round(time.Second), strings.Join(parts, ", ")))
+	return lines
+}
+
+// draw replaces the previous table with the current one.
+func (v *progressView) draw() {
+	lines := v.render(time.Now())
+	var b strings.Builder
+	if v.drawn > 0 {
+		fmt.Fprintf(&b, "\x1b[%dF", v.drawn)
+	}
+	b.WriteString("\x1b[J")
+	for _, l := range lines {
+		b.WriteString(l + "\n")
+	}
+	io.WriteString(v.out, b.String())
+	v.drawn = len(lines)
+}
+
+// truncate shortens s to width runes, marking the cut.
+func truncate(s string, width int) string {
+	r := []rune(s)
+	if width <= 0 || len(r) <= width {
+		return s
+	}
+	return string(r[:width-1]) + "…"
+}
+
+// lastLine is the last non-blank line of out.
+func lastLine(out string) string {
+	out = strings.TrimRight(out, " \t\r\n")
+	if i := strings.LastIndexByte(out, '\n'); i >= 0 {
+		out = out[i+1:]
+	}
+	return strings.TrimSpace(out)
+}
+
+// progressExecutor reports each command a stage runs, and then the last
+// line it printed, as the stage's last output.
+type progressExecutor struct {
+	inner Executor
+	view  *progressView
+	stage string
+}
+
+func (e progressExecutor) Exec(ctx context.Context, cmd Command) (Result, error) {
+	e.view.logged(e.stage, "$ "+planCommand(Command{Args: cmd.Args}))
+	res, err := e.inner.Exec(ctx, cmd)
+	switch {
+	case err != nil:
+		e.view.logged(e.stage, err.Error())
+	case lastLine(res.Stderr) != "" && res.ExitCode != 0:
+		e.view.logged(e.stage, lastLine(res.Stderr))
+	default:
+		e.view.logged(e.stage, lastLine(res.Stdout+"\n"+res.Stderr))
+	}
+	return res, err
+}
+
+// StartProgress gives the terminal to the live stage table until stop is
+// called: meanwhile what the run prints, the engine's log included when it
+// is connected after, goes to console.log in the run directory. It needs
+// stdout to be a terminal.
+func (p *Pipeline) StartProgress() (stop func(), err error) {
+	term := os.Stdout
+	if info, err := term.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil, errors.New("--tui needs a terminal; its output is not one")
+	}
+	run := newRunDir()
+	if err := os.MkdirAll(run.path(), 0o755); err != nil {
+		return nil, err
+	}
+	p.next = &run
+	logPath := run.path(consoleLogName)
+	console, err := os.Create(logPath)
+	if err != nil {
+		return nil, err
+	}
+	width := 120
+	if cols, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && cols > 0 {
+		width = cols
+	}
+	enableANSI(term)
+	view := newProgressView(term, width, p.Stages)
+	p.progress = view
+	os.Stdout = console
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			view.draw()
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+		view.draw()
+		os.Stdout = term
+		console.Close()
+		fmt.Printf("Full output: %s\n", logPath)
+	}, nil
+}
+
+// report records how a stage ended in the table, when there is one.
+func (p *Pipeline) report(name, state string) {
+	if p.progress != nil {
+		p.progress.finished(name, state)
+	}
+}
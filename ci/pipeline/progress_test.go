@@ -0,0 +1,50 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressTable(t *testing.T) {
+	stages := []Stage{{Name: "Format"}, {Name: "Unit Tests"}, {Name: "Cluster Smoke"}, {Name: "Coverage"}}
+	v := newProgressView(nil, 60, stages)
+	exec := progressExecutor{inner: &fakeExecutor{handle: func(Command) (Result, error) {
+		return Result{Stdout: "All 12 tests passed.\n\n"}, nil
+	}}, view: v, stage: "Unit Tests"}
+
+	v.started("Format")
+	v.finished("Format", progressPassed)
+	v.started("Unit Tests")
+	if _, err := exec.Exec(context.Background(), Command{Args: []string{"zig", "build", "test"}}); err != nil {
+		t.Fatal(err)
+	}
+	v.finished("Coverage", progressSkipped)
+
+	got := strings.Join(v.render(v.start.Add(90*time.Second)), "\n")
+	for _, want := range []string{
+		"Stage          State     Elapsed  Last output",
+		"Unit Tests     running     1m30s  All 12 tests passed.",
+		"Cluster Smoke  waiting",
+		"1m30s — 1 running, 1 waiting, 1 passed, 1 skipped",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("table lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "Coverage") {
+		t.Errorf("stage skipped before it started has a row:\n%s", got)
+	}
+}
+
+func TestProgressTruncatesToWidth(t *testing.T) {
+	v := newProgressView(nil, 30, []Stage{{Name: "Build Check"}})
+	v.started("Build Check")
+	v.logged("Build Check", "$ zig build -Doptimize=ReleaseFast --summary all")
+	for _, l := range v.render(time.Now()) {
+		if n := len([]rune(l)); n > 30 {
+			t.Errorf("line of %d runes: %q", n, l)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// propagationFile is where deploy_services leaves one line per node that saw
+// a deploy: "<deploying node> <receiving node> <milliseconds>".
+const propagationFile = "/tmp/myco-propagation.txt"
+
+// propagationHistoryPath is the JSON-lines history of per-scenario deploy
+// propagation latency. Like the stage history it is carried between CI jobs
+// by the workflow cache; MYCO_PROPAGATION_HISTORY points at a copy to start
+// from when it does not exist yet.
+var propagationHistoryPath = filepath.Join("build", "propagation-history.jsonl")
+
+// propagationTrendRows is how many recent runs the trend shows per scenario.
+const propagationTrendRows = 10
+
+// propagationBuckets are the histogram upper bounds in milliseconds; samples
+// above the last bound land in a final overflow bucket.
+var propagationBuckets = []float64{100, 250, 500, 1000, 2500, 5000, 10000}
+
+// propagationStats summarizes one scenario's samples for the perf report.
+type propagationStats struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50_ms"`
+	P90     float64 `json:"p90_ms"`
+	Max     float64 `json:"max_ms"`
+	// Buckets counts samples per propagationBuckets bound plus overflow.
+	Buckets []int `json:"buckets"`
+}
+
+type propagationRecord struct {
+	RunID    string    `json:"run_id"`
+	Commit   string    `json:"commit"`
+	At       time.Time `json:"at"`
+	Scenario string    `json:"scenario"`
+	propagationStats
+}
+
+// parsePropagation reads the samples a scenario script wrote to
+// propagationFile. Malformed lines are skipped.
+func parsePropagation(raw string) []float64 {
+	var samples []float64
+	scanner := bufio.NewScanner(strings.NewReader(raw))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		ms, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || ms < 0 {
+			continue
+		}
+		samples = append(samples, ms)
+	}
+	return samples
+}
+
+func newPropagationStats(samples []float64) propagationStats {
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	stats := propagationStats{
+		Samples: len(sorted),
+		Buckets: make([]int, len(propagationBuckets)+1),
+	}
+	if len(sorted) == 0 {
+		return stats
+	}
+	stats.P50 = percentile(sorted, 0.5)
+	stats.P90 = percentile(sorted, 0.9)
+	stats.Max = sorted[len(sorted)-1]
+	for _, ms := range sorted {
+		stats.Buckets[sort.SearchFloat64s(propagationBuckets, ms)]++
+	}
+	return stats
+}
+
+// percentile picks the nearest-rank value from sorted samples.
+func percentile(sorted []float64, q float64) float64 {
+	rank := int(q*float64(len(sorted))+0.999999) - 1
+	return sorted[min(max(rank, 0), len(sorted)-1)]
+}
+
+// bucketLabel names histogram bucket i.
+func bucketLabel(i int) string {
+	if i == len(propagationBuckets) {
+		return fmt.Sprintf("> %s", formatMillis(propagationBuckets[i-1]))
+	}
+	return fmt.Sprintf("≤ %s", formatMillis(propagationBuckets[i]))
+}
+
+func formatMillis(ms float64) string {
+	if ms >= 1000 {
+		return strconv.FormatFloat(ms/1000, 'f', -1, 64) + "s"
+	}
+	return strconv.FormatFloat(ms, 'f', 0, 64) + "ms"
+}
+
+// recordPropagation appends this run's per-scenario latency to the history
+// and writes histograms plus the recent trend to the run directory and the
+// GitHub job summary.
+func recordPropagation(run runDir, p *perfRecorder) error {
+	current := p.propagationStats()
+	if len(current) == 0 {
+		return nil
+	}
+	var names []string
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := time.Now().UTC()
+	var records []propagationRecord
+	for _, name := range names {
+		records = append(records, propagationRecord{
+			RunID:            run.ID,
+			Commit:           p.report.Commit,
+			At:               now,
+			Scenario:         name,
+			propagationStats: current[name],
+		})
+	}
+
+	if err := appendHistory(propagationHistoryPath, os.Getenv("MYCO_PROPAGATION_HISTORY"), records); err != nil {
+		return err
+	}
+	history, err := readPropagationHistory(propagationHistoryPath)
+	if err != nil {
+		return err
+	}
+
+	report := renderPropagation(current, history)
+	path := run.path("propagation.md")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(report), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Propagation latency: %d scenario(s) in %s\n", len(current), path)
+	return appendStepSummary(report)
+}
+
+// readPropagationHistory loads a history file; a missing file is an empty
+// history.
+func readPropagationHistory(path string) ([]propagationRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var history []propagationRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var r propagationRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		history = append(history, r)
+	}
+	return history, scanner.Err()
+}
+
+// renderPropagation draws a histogram per scenario for this run followed by
+// the p50/p90 of its last propagationTrendRows runs.
+func renderPropagation(current map[string]propagationStats, history []propagationRecord) string {
+	var names []string
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("## Deploy propagation latency\n")
+	for _, name := range names {
+		stats := current[name]
+		fmt.Fprintf(&b, "\n### %s\n\n%d samples, p50 %s, p90 %s, max %s\n\n| latency | count | |\n|---|---:|---|\n",
+			name, stats.Samples, formatMillis(stats.P50), formatMillis(stats.P90), formatMillis(stats.Max))
+		largest := 0
+		for _, n := range stats.Buckets {
+			largest = max(largest, n)
+		}
+		for i, n := range stats.Buckets {
+			bar := ""
+			if n > 0 {
+				bar = strings.Repeat("█", 1+19*n/max(largest, 1))
+			}
+			fmt.Fprintf(&b, "| %s | %d | %s |\n", bucketLabel(i), n, bar)
+		}
+
+		var runs []propagationRecord
+		for _, r := range history {
+			if r.Scenario == name {
+				runs = append(runs, r)
+			}
+		}
+		if len(runs) > propagationTrendRows {
+			runs = runs[len(runs)-propagationTrendRows:]
+		}
+		if len(runs) < 2 {
+			continue
+		}
+		b.WriteString("\n| commit | samples | p50 | p90 |\n|---|---:|---:|---:|\n")
+		for _, r := range runs {
+			fmt.Fprintf(&b, "| `%s` | %d | %s | %s |\n", shortCommit(r.Commit), r.Samples, formatMillis(r.P50), formatMillis(r.P90))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,56 @@
+package pipeline
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePropagationSkipsMalformedLines(t *testing.T) {
+	raw := "n1 n2 120\nn1 n3 480\ngarbage\nn2 n1 -5\nn2 n3 x\n\nn2 n1 12000\n"
+	if got, want := parsePropagation(raw), []float64{120, 480, 12000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parsePropagation = %v, want %v", got, want)
+	}
+}
+
+func TestPropagationStats(t *testing.T) {
+	stats := newPropagationStats([]float64{900, 80, 100, 300, 12000, 450, 2000, 700, 600, 150})
+	if stats.Samples != 10 || stats.P50 != 450 || stats.P90 != 2000 || stats.Max != 12000 {
+		t.Errorf("stats = %+v", stats)
+	}
+	// ≤100ms, ≤250ms, ≤500ms, ≤1s, ≤2.5s, ≤5s, ≤10s, >10s
+	if want := []int{2, 1, 2, 3, 1, 0, 0, 1}; !reflect.DeepEqual(stats.Buckets, want) {
+		t.Errorf("buckets = %v, want %v", stats.Buckets, want)
+	}
+}
+
+func TestRenderPropagationTrend(t *testing.T) {
+	current := map[string]propagationStats{
+		"Peer Eviction": newPropagationStats([]float64{200, 400}),
+		"Network Chaos": newPropagationStats([]float64{3000}),
+	}
+	history := []propagationRecord{
+		{Commit: "aaaaaaaaaa", Scenario: "Peer Eviction", propagationStats: propagationStats{Samples: 4, P50: 150, P90: 300}},
+		{Commit: "bbbbbbbbbb", Scenario: "Peer Eviction", propagationStats: current["Peer Eviction"]},
+		{Commit: "bbbbbbbbbb", Scenario: "Network Chaos", propagationStats: current["Network Chaos"]},
+	}
+	report := renderPropagation(current, history)
+	for _, want := range []string{
+		"### Network Chaos\n\n1 samples, p50 3s, p90 3s, max 3s",
+		"| ≤ 250ms | 1 | ████████████████████ |",
+		"| > 10s | 0 |  |",
+		"| `aaaaaaa` | 4 | 150ms | 300ms |",
+		"| `bbbbbbb` | 2 | 200ms | 400ms |",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report is missing %q:\n%s", want, report)
+		}
+	}
+	if strings.Index(report, "Network Chaos") > strings.Index(report, "Peer Eviction") {
+		t.Errorf("scenarios are not sorted:\n%s", report)
+	}
+	// A single run has no trend to show.
+	if chaos := report[strings.Index(report, "### Network Chaos"):strings.Index(report, "### Peer Eviction")]; strings.Contains(chaos, "| commit |") {
+		t.Errorf("trend shown for a scenario with one run:\n%s", chaos)
+	}
+}
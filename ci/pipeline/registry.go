@@ -0,0 +1,47 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+)
+
+// stageRegistry holds the stage constructors added with RegisterStages.
+var stageRegistry struct {
+	mu    sync.Mutex
+	funcs []func(opts Options) []Stage
+}
+
+// RegisterStages adds stages to every pipeline New assembles, after the
+// built-in ones, so a check can live in its own file without touching New or
+// the runner. stages is called with the run's options and may return nothing
+// to leave its checks out, the way New gates network stages when offline.
+// Call it from an init function.
+func RegisterStages(stages func(opts Options) []Stage) {
+	stageRegistry.mu.Lock()
+	defer stageRegistry.mu.Unlock()
+	stageRegistry.funcs = append(stageRegistry.funcs, stages)
+}
+
+// registeredStages builds the registered stages for opts, in registration
+// order.
+func registeredStages(opts Options) []Stage {
+	stageRegistry.mu.Lock()
+	defer stageRegistry.mu.Unlock()
+	var stages []Stage
+	for _, f := range stageRegistry.funcs {
+		stages = append(stages, f(opts)...)
+	}
+	return stages
+}
+
+// ExecStage is a stage that runs one command in the shared runner and fails
+// if it exits non-zero.
+func ExecStage(name string, resources Resources, args ...string) Stage {
+	return Stage{Name: name, Resources: resources, Run: func(ctx context.Context, env *Env) error {
+		res, err := env.Exec.Exec(ctx, Command{Args: args})
+		if err != nil {
+			return err
+		}
+		return res.check(args[0])
+	}}
+}
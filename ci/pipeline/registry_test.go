@@ -0,0 +1,89 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestRegisterStagesAddsToNew(t *testing.T) {
+	saved := stageRegistry.funcs
+	t.Cleanup(func() { stageRegistry.funcs = saved })
+
+	RegisterStages(func(opts Options) []Stage {
+		if opts.Offline {
+			return nil
+		}
+		lint := ExecStage("Lint", Resources{}, "zig", "build", "lint")
+		lint.Deps = []string{"Format"}
+		return []Stage{lint}
+	})
+	find := func(p *Pipeline) *Stage {
+		for i := range p.Stages {
+			if p.Stages[i].Name == "Lint" {
+				return &p.Stages[i]
+			}
+		}
+		return nil
+	}
+	lint := find(New(Options{}))
+	if lint == nil {
+		t.Fatal("registered stage missing from New")
+	}
+	if lint.Phase != PhaseCheck {
+		t.Errorf("Lint phase = %q, want %q", lint.Phase, PhaseCheck)
+	}
+	if find(New(Options{Offline: true})) != nil {
+		t.Error("registered stage kept when its constructor gated it off")
+	}
+
+	p := New(Options{})
+	if err := p.Select([]string{"lint"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range p.Stages {
+		if s.Name == "Format" && s.Skip != "" {
+			t.Errorf("--only Lint skipped its dependency Format: %q", s.Skip)
+		}
+	}
+}
+
+func TestRunStagesOrdersByDeps(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	ran := func(name string, err error) func(context.Context, *Env) error {
+		return func(context.Context, *Env) error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return err
+		}
+	}
+	p := &Pipeline{Stages: []Stage{
+		{Name: "Publish", Deps: []string{"Build", "Test"}, Run: ran("Publish", nil)},
+		{Name: "Report", Deps: []string{"Broken"}, Run: ran("Report", nil)},
+		{Name: "Build", Run: ran("Build", nil)},
+		{Name: "Test", Deps: []string{"Build"}, Run: ran("Test", nil)},
+		{Name: "Broken", Run: ran("Broken", errors.New("boom"))},
+	}}
+	perf := newPerfRecorder("abc")
+	if err := p.runStages(context.Background(), &Env{perf: perf}); err == nil {
+		t.Fatal("runStages passed with a failing stage")
+	}
+	pos := map[string]int{}
+	for i, name := range order {
+		pos[name] = i
+	}
+	if _, ok := pos["Report"]; ok {
+		t.Error("Report ran although its dependency failed")
+	}
+	if !(pos["Build"] < pos["Test"] && pos["Test"] < pos["Publish"]) {
+		t.Errorf("ran in order %v, want Build before Test before Publish", order)
+	}
+	for _, o := range perf.stageOutcomes() {
+		if o.Stage == "Report" && o.Outcome != outcomeSkipped {
+			t.Errorf("Report outcome = %q, want skipped", o.Outcome)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// Release channels. Pushes to main publish edge pre-releases, the scheduled
+// run publishes nightly, and version tags publish stable. Runs outside those
+// (pull requests, local runs) have no channel and publish nothing by default.
+const (
+	channelEdge    = "edge"
+	channelNightly = "nightly"
+	channelStable  = "stable"
+)
+
+// ReleaseChannel is the channel for this run: MYCO_CI_CHANNEL when set,
+// otherwise derived from the GitHub Actions event and ref.
+func ReleaseChannel() (string, error) {
+	if value := os.Getenv("MYCO_CI_CHANNEL"); value != "" {
+		switch value {
+		case channelEdge, channelNightly, channelStable:
+			return value, nil
+		}
+		return "", fmt.Errorf("MYCO_CI_CHANNEL=%q: want %s, %s or %s", value, channelEdge, channelNightly, channelStable)
+	}
+	return channelFor(os.Getenv("GITHUB_EVENT_NAME"), os.Getenv("GITHUB_REF")), nil
+}
+
+// channelFor maps a GitHub event and ref to a channel, or "" for none.
+func channelFor(event, ref string) string {
+	switch {
+	case event == "schedule":
+		return channelNightly
+	case event == "push" && strings.HasPrefix(ref, "refs/tags/v"):
+		return channelStable
+	case event == "push" && ref == "refs/heads/main":
+		return channelEdge
+	}
+	return ""
+}
+
+// release is what one build publishes as. Version is the full release
+// version, which names artifacts and image tags: the project version on
+// stable and for runs without a channel, with a semver pre-release suffix
+// on edge and nightly.
+type release struct {
+	Channel string
+	Project string
+	Version string
+}
+
+// newRelease reads the project version from zonPath and derives the release
+// version for channel. A stable build must come from the tag matching the
+// project version, so a mistagged commit cannot publish.
+func newRelease(channel, zonPath, commit string, at time.Time) (release, error) {
+	project, err := projectVersion(zonPath)
+	if err != nil {
+		return release{}, &ArtifactError{Path: zonPath, Err: err}
+	}
+	r := release{Channel: channel, Project: project, Version: project}
+	switch channel {
+	case channelEdge:
+		r.Version = project + "-edge." + shortCommit(commit)
+	case channelNightly:
+		r.Version = project + "-nightly." + at.UTC().Format("20060102")
+	case channelStable:
+		if tag := os.Getenv("GITHUB_REF_NAME"); tag != "" && tag != "v"+project {
+			return release{}, &ArtifactError{Path: zonPath, Err: fmt.Errorf("tag %s does not match version %s", tag, project)}
+		}
+	}
+	return r, nil
+}
+
+// prerelease reports whether the build is not a stable release.
+func (r release) prerelease() bool {
+	return r.Channel != channelStable
+}
+
+// imageTags are the tags the runtime image is pushed under in repo: the
+// release version and the moving channel tag, or the version and commit
+// when the run has no channel. Stable builds only push the version; the
+// stable tag moves when the release is promoted.
+func (r release) imageTags(repo, commit string) []string {
+	switch r.Channel {
+	case "":
+		return []string{repo + ":" + r.Version, repo + ":" + shortCommit(commit)}
+	case channelStable:
+		return []string{repo + ":" + r.Version}
+	}
+	return []string{repo + ":" + r.Version, repo + ":" + r.Channel}
+}
+
+// releaseTag is the git tag, and GitHub release name, of a stable release.
+func releaseTag(project string) string {
+	return "v" + project
+}
+
+// draftRelease creates the GitHub release for a stable build as a draft with
+// every artifact in the manifest attached, or refreshes the assets of a
+// draft left by an earlier attempt. Drafts stay private until
+// 'ci release promote'. The artifacts are read from run's directory.
+func draftRelease(run runDir, rel release) error {
+	manifestPath := run.path(artifactManifestName)
+	manifest, err := readArtifactManifest(manifestPath)
+	if err != nil {
+		return &ArtifactError{Path: manifestPath, Err: err}
+	}
+	var files []string
+	for name := range manifest {
+		files = append(files, run.path(name))
+	}
+	sort.Strings(files)
+	files = append(files, manifestPath)
+
+	tag := releaseTag(rel.Project)
+	if out, err := gh("release", "view", tag, "--json", "isDraft", "--jq", ".isDraft"); err == nil {
+		if out != "true" {
+			return &ArtifactError{Path: tag, Err: errors.New("release is already published; bump the version to release again")}
+		}
+		if _, err := gh(append([]string{"release", "upload", tag, "--clobber"}, files...)...); err != nil {
+			return &InfraError{Stage: "Release", Op: "upload assets to draft " + tag, Err: err}
+		}
+	} else {
+		args := []string{"release", "create", tag, "--draft", "--verify-tag", "--title", tag, "--generate-notes"}
+		if _, err := gh(append(args, files...)...); err != nil {
+			return &InfraError{Stage: "Release", Op: "create draft " + tag, Err: err}
+		}
+	}
+	fmt.Printf("Draft release %s has %d assets; run 'ci release promote -tag %s' to publish it\n", tag, len(files), tag)
+	return nil
+}
+
+// RunReleaseCommand implements
+// "ci release verify|promote [-tag vX.Y.Z] [-image REPO]".
+//
+// verify downloads the release's assets and checks them against its
+// manifest. promote publishes a draft created by a tag build once it has
+// been checked by hand: it verifies the assets the same way, moves the
+// image's stable tag to the release version, and only then makes the
+// release public.
+func RunReleaseCommand(args []string) error {
+	const usage = "usage: ci release verify|promote [-tag vX.Y.Z] [-image REPO]"
+	if len(args) == 0 || (args[0] != "verify" && args[0] != "promote") {
+		return &UsageError{Err: errors.New(usage)}
+	}
+	fs := flag.NewFlagSet("release "+args[0], flag.ContinueOnError)
+	tag := fs.String("tag", "", "release tag (default: v<version> from build.zig.zon)")
+	image := fs.String("image", os.Getenv("MYCO_CI_IMAGE"), "image repository whose stable tag promote moves; empty skips it")
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+	if *tag == "" {
+		project, err := projectVersion("build.zig.zon")
+		if err != nil {
+			return err
+		}
+		*tag = releaseTag(project)
+	}
+	if args[0] == "verify" {
+		return verifyRelease(*tag, nil)
+	}
+
+	isDraft, err := gh("release", "view", *tag, "--json", "isDraft", "--jq", ".isDraft")
+	if err != nil {
+		return err
+	}
+	if isDraft != "true" {
+		return fmt.Errorf("release %s is not a draft; nothing to promote", *tag)
+	}
+	if err := verifyRelease(*tag, nil); err != nil {
+		return err
+	}
+	if *image != "" {
+		out, err := gh("release", "download", *tag, "--pattern", artifactManifestName, "--output", "-")
+		if err != nil {
+			return err
+		}
+		var manifest artifactManifest
+		if err := json.Unmarshal([]byte(out), &manifest); err != nil {
+			return fmt.Errorf("%s in %s: %w", artifactManifestName, *tag, err)
+		}
+		if err := promoteImage(manifest, *image, strings.TrimPrefix(*tag, "v")); err != nil {
+			return err
+		}
+	}
+	if _, err := gh("release", "edit", *tag, "--draft=false", "--latest"); err != nil {
+		return err
+	}
+	fmt.Printf("Release %s published\n", *tag)
+	return nil
+}
+
+// promoteImage points repo:stable at the image pushed as repo:version by the
+// tag build, keeping every platform the release was built for.
+func promoteImage(manifest artifactManifest, repo, version string) error {
+	ctx := context.Background()
+	client, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stdout))
+	if err != nil {
+		return &InfraError{Op: "connect to dagger", Err: err}
+	}
+	defer client.Close()
+
+	var platforms []string
+	for _, a := range manifest {
+		if platform, ok := zigTargetPlatform(a.Target); ok {
+			platforms = append(platforms, string(platform))
+		}
+	}
+	sort.Strings(platforms)
+	if len(platforms) == 0 {
+		return fmt.Errorf("manifest has no image platforms")
+	}
+	var variants []*dagger.Container
+	for _, platform := range platforms {
+		variants = append(variants, client.Container(dagger.ContainerOpts{Platform: dagger.Platform(platform)}).From(repo+":"+version))
+	}
+	return pushImage(ctx, client, variants, repo+":"+channelStable)
+}
+
+// gh runs a GitHub CLI command and returns its trimmed stdout; stderr is
+// kept out of it so JSON output parses, and reported on failure.
+func gh(args ...string) (string, error) {
+	out, err := exec.Command("gh", args...).Output()
+	if err != nil {
+		var stderr []byte
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = exitErr.Stderr
+		}
+		return "", fmt.Errorf("gh %s: %w\n%s", strings.Join(args, " "), err, stderr)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,90 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChannelFor(t *testing.T) {
+	for _, tc := range []struct {
+		event, ref, want string
+	}{
+		{"push", "refs/heads/main", channelEdge},
+		{"push", "refs/tags/v0.4.0", channelStable},
+		{"schedule", "refs/heads/main", channelNightly},
+		{"pull_request", "refs/pull/7/merge", ""},
+		{"push", "refs/heads/feature", ""},
+		{"push", "refs/tags/experiment", ""},
+		{"", "", ""},
+	} {
+		if got := channelFor(tc.event, tc.ref); got != tc.want {
+			t.Errorf("channelFor(%q, %q) = %q, want %q", tc.event, tc.ref, got, tc.want)
+		}
+	}
+}
+
+func TestReleaseChannelOverride(t *testing.T) {
+	t.Setenv("GITHUB_EVENT_NAME", "push")
+	t.Setenv("GITHUB_REF", "refs/heads/main")
+	t.Setenv("MYCO_CI_CHANNEL", channelNightly)
+	if got, err := ReleaseChannel(); err != nil || got != channelNightly {
+		t.Errorf("ReleaseChannel() = %q, %v; want %q", got, err, channelNightly)
+	}
+	t.Setenv("MYCO_CI_CHANNEL", "beta")
+	if _, err := ReleaseChannel(); err == nil {
+		t.Error("accepted an unknown channel")
+	}
+}
+
+func TestNewRelease(t *testing.T) {
+	zon := filepath.Join(t.TempDir(), "build.zig.zon")
+	if err := os.WriteFile(zon, []byte(`.{ .name = .myco, .version = "0.4.0" }`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 3, 9, 23, 30, 0, 0, time.UTC)
+	commit := "0123456789abcdef"
+	t.Setenv("GITHUB_REF_NAME", "")
+
+	for _, tc := range []struct {
+		channel, version string
+		tags             []string
+	}{
+		{"", "0.4.0", []string{"r:0.4.0", "r:0123456"}},
+		{channelEdge, "0.4.0-edge.0123456", []string{"r:0.4.0-edge.0123456", "r:edge"}},
+		{channelNightly, "0.4.0-nightly.20260309", []string{"r:0.4.0-nightly.20260309", "r:nightly"}},
+		// The stable tag only moves on promotion.
+		{channelStable, "0.4.0", []string{"r:0.4.0"}},
+	} {
+		rel, err := newRelease(tc.channel, zon, commit, at)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.channel, err)
+		}
+		if rel.Version != tc.version {
+			t.Errorf("%q: version %q, want %q", tc.channel, rel.Version, tc.version)
+		}
+		if got := rel.imageTags("r", commit); !reflect.DeepEqual(got, tc.tags) {
+			t.Errorf("%q: tags %v, want %v", tc.channel, got, tc.tags)
+		}
+		if got := artifactName(rel.Version, "x86_64-linux-musl"); got != "myco-"+tc.version+"-x86_64-linux-musl" {
+			t.Errorf("%q: artifact name %q", tc.channel, got)
+		}
+	}
+}
+
+func TestNewReleaseRejectsMismatchedTag(t *testing.T) {
+	zon := filepath.Join(t.TempDir(), "build.zig.zon")
+	if err := os.WriteFile(zon, []byte(`.{ .version = "0.4.0" }`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GITHUB_REF_NAME", "v0.3.9")
+	if _, err := newRelease(channelStable, zon, "abc", time.Now()); err == nil {
+		t.Error("stable release built from a tag that does not match the version")
+	}
+	t.Setenv("GITHUB_REF_NAME", "v0.4.0")
+	if _, err := newRelease(channelStable, zon, "abc", time.Now()); err != nil {
+		t.Errorf("matching tag rejected: %v", err)
+	}
+}
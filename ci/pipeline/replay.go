@@ -0,0 +1,137 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// interaction is one exec as stored in a fixture.
+type interaction struct {
+	Command Command `json:"command"`
+	Result  Result  `json:"result"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// fixture is the file format shared by recording and replay.
+type fixture struct {
+	Interactions []interaction `json:"interactions"`
+}
+
+// commandKey identifies a command for replay: its arguments and environment.
+func commandKey(cmd Command) string {
+	var b strings.Builder
+	for _, arg := range cmd.Args {
+		b.WriteString(arg)
+		b.WriteByte(0)
+	}
+	names := make([]string, 0, len(cmd.Env))
+	for name := range cmd.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "\x01%s=%s", name, cmd.Env[name])
+	}
+	return b.String()
+}
+
+// recordingExecutor passes commands to inner and keeps each command with
+// what came back, for saving as a fixture. With MYCO_CI_RECORD=<file> the
+// pipeline records every Executor call of a run.
+type recordingExecutor struct {
+	inner Executor
+
+	mu           sync.Mutex
+	interactions []interaction
+}
+
+func (r *recordingExecutor) Exec(ctx context.Context, cmd Command) (Result, error) {
+	res, err := r.inner.Exec(ctx, cmd)
+	rec := interaction{Command: cmd, Result: res}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	r.mu.Lock()
+	r.interactions = append(r.interactions, rec)
+	r.mu.Unlock()
+	return res, err
+}
+
+// save writes the recorded interactions to path. Stages run concurrently, so
+// interactions are ordered by command to keep fixtures stable; replay only
+// depends on order among identical commands, which is preserved.
+func (r *recordingExecutor) save(path string) error {
+	r.mu.Lock()
+	recorded := append([]interaction(nil), r.interactions...)
+	r.mu.Unlock()
+	sort.SliceStable(recorded, func(i, j int) bool {
+		return commandKey(recorded[i].Command) < commandKey(recorded[j].Command)
+	})
+	data, err := json.MarshalIndent(fixture{Interactions: recorded}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// replayExecutor answers commands from a fixture without an engine. Each
+// recorded interaction is served once; a command with no interaction left
+// is an error.
+type replayExecutor struct {
+	mu      sync.Mutex
+	pending map[string][]interaction
+}
+
+func loadReplay(path string) (*replayExecutor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f fixture
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	r := &replayExecutor{pending: map[string][]interaction{}}
+	for _, rec := range f.Interactions {
+		key := commandKey(rec.Command)
+		r.pending[key] = append(r.pending[key], rec)
+	}
+	return r, nil
+}
+
+func (r *replayExecutor) Exec(_ context.Context, cmd Command) (Result, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := commandKey(cmd)
+	queue := r.pending[key]
+	if len(queue) == 0 {
+		return Result{}, fmt.Errorf("no recorded interaction for %q", strings.Join(cmd.Args, " "))
+	}
+	rec := queue[0]
+	r.pending[key] = queue[1:]
+	if rec.Error != "" {
+		return rec.Result, errors.New(rec.Error)
+	}
+	return rec.Result, nil
+}
+
+// unused reports interactions that were never replayed.
+func (r *replayExecutor) unused() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, queue := range r.pending {
+		n += len(queue)
+	}
+	return n
+}
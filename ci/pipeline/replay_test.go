@@ -0,0 +1,115 @@
+package pipeline
+
+import (
+	"context"
+	"flag"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata fixtures from the synthesized executor")
+
+// commandStages are the standard stages that only talk to the Executor.
+func commandStages(t *testing.T) []Stage {
+	t.Helper()
+	byName := map[string]Stage{}
+	for _, s := range New(Options{}).Stages {
+		byName[s.Name] = s
+	}
+	var stages []Stage
+	for _, name := range []string{"Format", "Build Check", "Integration Test", "Unit Tests", "Myco Binary", "Cluster Smoke"} {
+		s, ok := byName[name]
+		if !ok {
+			t.Fatalf("stage %q not in the pipeline", name)
+		}
+		stages = append(stages, s)
+	}
+	return stages
+}
+
+// synthesizedRun fails Format and tests/cli.zig and passes everything else.
+func synthesizedRun(cmd Command) (Result, error) {
+	args := strings.Join(cmd.Args, " ")
+	switch {
+	case strings.Contains(args, "zig fmt"):
+		return Result{ExitCode: 1, Stdout: "src/cli.zig\n"}, nil
+	case strings.Contains(args, "-Mroot=tests/cli.zig") && !strings.Contains(args, "-fno-emit-bin"):
+		return Result{ExitCode: 1, Stderr: "test.deploy rejects empty flake... FAIL\n1 passed; 1 failed.\n"}, nil
+	case len(cmd.ReadFiles) > 0:
+		return Result{Files: map[string]string{smokePerfFile: "startup_ms=85\nconvergence_sec=6\n"}}, nil
+	}
+	return Result{}, nil
+}
+
+// clearStageEnv pins the environment commands are built from so recorded
+// commands match on replay.
+func clearStageEnv(t *testing.T) {
+	for _, name := range []string{"MYCO_SMOKE_PRESET", "MYCO_SMOKE_NODES", "MYCO_SMOKE_JOBS_PER_NODE", "MYCO_SMOKE_MAX_WAIT_SEC", "MYCO_SMOKE_OPTIMIZE"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("MYCO_CI_RUNNER_CPUS", "4")
+	t.Setenv("MYCO_CI_RUNNER_MEMORY_MB", "8192")
+}
+
+func TestReplayPipelineRun(t *testing.T) {
+	clearStageEnv(t)
+	path := filepath.Join("testdata", "pipeline-run.json")
+	p := &Pipeline{Stages: commandStages(t)}
+
+	if *update {
+		recorder := &recordingExecutor{inner: &fakeExecutor{handle: synthesizedRun}}
+		p.runStages(context.Background(), &Env{Exec: recorder, perf: newPerfRecorder("fixture")})
+		if err := recorder.save(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replay, err := loadReplay(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	perf := newPerfRecorder("replay")
+	err = p.runStages(context.Background(), &Env{Exec: replay, perf: perf})
+	if err == nil {
+		t.Fatal("replayed run passed; the fixture has failures")
+	}
+	for _, want := range []string{"[Format] failed", "src/cli.zig", "[Unit Tests] failed", "1 of 5 test files failed", "tests/cli.zig"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error is missing %q:\n%v", want, err)
+		}
+	}
+	if n := replay.unused(); n != 0 {
+		t.Errorf("%d recorded interactions were not replayed; the stages changed, rerun with -update", n)
+	}
+
+	outcomes := map[string]string{}
+	for _, o := range perf.stageOutcomes() {
+		outcomes[o.Stage] = o.Outcome
+	}
+	want := map[string]string{
+		"Format":                       outcomeFailed,
+		"Build Check":                  outcomePassed,
+		"Integration Test":             outcomePassed,
+		"Unit Tests: compile check":    outcomePassed,
+		"Unit Tests: tests/cli.zig":    outcomeFailed,
+		"Unit Tests: tests/engine.zig": outcomePassed,
+		"Unit Tests":                   outcomeFailed,
+		"Cluster Smoke":                outcomePassed,
+	}
+	for stage, outcome := range want {
+		if outcomes[stage] != outcome {
+			t.Errorf("outcome for %s = %q, want %q", stage, outcomes[stage], outcome)
+		}
+	}
+	if c := perf.report.ConvergenceSeconds; c == nil || *c != 6 {
+		t.Errorf("convergence = %v, want 6 from the replayed smoke metrics", c)
+	}
+}
+
+func TestReplayRejectsUnrecordedCommands(t *testing.T) {
+	replay := &replayExecutor{pending: map[string][]interaction{}}
+	if _, err := replay.Exec(context.Background(), Command{Args: []string{"zig", "build"}}); err == nil {
+		t.Fatal("unrecorded command replayed")
+	}
+}
@@ -0,0 +1,148 @@
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Resources is what a stage expects to use while it runs. The
+// scheduler holds a stage back until its request fits next to the stages
+// already running, and MemoryMB is also enforced inside script stages.
+type Resources struct {
+	CPUs     float64
+	MemoryMB int
+}
+
+// defaultStageResources covers a single-node scenario or a plain zig build.
+var defaultStageResources = Resources{CPUs: 1, MemoryMB: 512}
+
+// stageScheduler admits stages while their combined requests fit the
+// runner's capacity and, when jobs is set, fewer than jobs are running.
+type stageScheduler struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	capacity Resources
+	used     Resources
+	jobs     int
+	running  int
+}
+
+// newStageScheduler sizes the pool from MYCO_CI_RUNNER_CPUS and
+// MYCO_CI_RUNNER_MEMORY_MB, defaulting to machine, or this machine when it
+// is zero, with a quarter of the memory left for the engine itself. jobs
+// caps how many stages run at once; zero leaves that to the resources.
+func newStageScheduler(jobs int, machine Resources) *stageScheduler {
+	if machine == (Resources{}) {
+		machine = Resources{CPUs: float64(runtime.NumCPU()), MemoryMB: hostMemoryMB()}
+	}
+	capacity := Resources{CPUs: machine.CPUs, MemoryMB: machine.MemoryMB * 3 / 4}
+	if value := os.Getenv("MYCO_CI_RUNNER_CPUS"); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil && parsed > 0 {
+			capacity.CPUs = parsed
+		}
+	}
+	if value := os.Getenv("MYCO_CI_RUNNER_MEMORY_MB"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			capacity.MemoryMB = parsed
+		}
+	}
+	if jobs > 0 {
+		fmt.Printf("Stage scheduler capacity: %.1f CPUs, %d MiB, %d stages at a time\n", capacity.CPUs, capacity.MemoryMB, jobs)
+	} else {
+		fmt.Printf("Stage scheduler capacity: %.1f CPUs, %d MiB\n", capacity.CPUs, capacity.MemoryMB)
+	}
+	s := &stageScheduler{capacity: capacity, jobs: jobs}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// acquire blocks until r fits and returns the matching release. A request
+// larger than the whole runner is clamped so the stage still runs, alone.
+func (s *stageScheduler) acquire(name string, r Resources) func() {
+	if r == (Resources{}) {
+		r = defaultStageResources
+	}
+	r.CPUs = min(r.CPUs, s.capacity.CPUs)
+	r.MemoryMB = min(r.MemoryMB, s.capacity.MemoryMB)
+
+	s.mu.Lock()
+	waited := false
+	for s.used.CPUs+r.CPUs > s.capacity.CPUs || s.used.MemoryMB+r.MemoryMB > s.capacity.MemoryMB || (s.jobs > 0 && s.running >= s.jobs) {
+		if !waited {
+			fmt.Printf("[%s] waiting for %.1f CPUs / %d MiB\n", name, r.CPUs, r.MemoryMB)
+			waited = true
+		}
+		s.cond.Wait()
+	}
+	s.used.CPUs += r.CPUs
+	s.used.MemoryMB += r.MemoryMB
+	s.running++
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		s.used.CPUs -= r.CPUs
+		s.used.MemoryMB -= r.MemoryMB
+		s.running--
+		s.mu.Unlock()
+		s.cond.Broadcast()
+	}
+}
+
+// hostMemoryMB reads this machine's memory: MemTotal on Linux, hw.memsize
+// on macOS, and 4 GiB where neither is available.
+func hostMemoryMB() int {
+	if runtime.GOOS == "darwin" {
+		out, err := exec.Command("sysctl", "-n", "hw.memsize").Output()
+		if bytes, err2 := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64); err == nil && err2 == nil {
+			return int(bytes >> 20)
+		}
+		return 4096
+	}
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 4096
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			if kb, err := strconv.Atoi(fields[1]); err == nil {
+				return kb / 1024
+			}
+		}
+	}
+	return 4096
+}
+
+// memoryGuard returns a bash snippet that kills every process in the stage
+// container once their combined RSS passes limitMB. Dagger has no memory
+// limit for execs, so without it a runaway stage can take the engine down
+// with it. The watchdog exits with the script that started it.
+func memoryGuard(limitMB int) string {
+	if limitMB <= 0 {
+		limitMB = defaultStageResources.MemoryMB
+	}
+	return fmt.Sprintf(`
+STAGE_MEMORY_MB=%d
+(
+  set +e
+  guarded=$$
+  while kill -0 "$guarded" 2>/dev/null; do
+    rss=$(cat /proc/[0-9]*/status 2>/dev/null | awk '/^VmRSS:/ {s += $2} END {print s + 0}')
+    if [ "$rss" -gt $((STAGE_MEMORY_MB * 1024)) ]; then
+      echo "[FAIL] stage RSS ${rss}KiB exceeds its ${STAGE_MEMORY_MB}MiB limit; killing it"
+      kill -9 -1
+    fi
+    sleep 1
+  done
+) &
+`, limitMB)
+}
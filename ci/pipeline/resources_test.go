@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testScheduler(capacity Resources) *stageScheduler {
+	s := &stageScheduler{capacity: capacity}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func TestSchedulerHoldsStagesThatDoNotFit(t *testing.T) {
+	s := testScheduler(Resources{CPUs: 2, MemoryMB: 1024})
+	release := s.acquire("first", Resources{CPUs: 2, MemoryMB: 512})
+
+	admitted := make(chan struct{})
+	go func() {
+		s.acquire("second", Resources{CPUs: 1, MemoryMB: 256})()
+		close(admitted)
+	}()
+	select {
+	case <-admitted:
+		t.Fatal("second stage admitted while the runner was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	select {
+	case <-admitted:
+	case <-time.After(time.Second):
+		t.Fatal("second stage not admitted after release")
+	}
+}
+
+func TestSchedulerClampsOversizeRequests(t *testing.T) {
+	s := testScheduler(Resources{CPUs: 2, MemoryMB: 1024})
+	release := s.acquire("huge", Resources{CPUs: 64, MemoryMB: 1 << 20})
+	if s.used != s.capacity {
+		t.Fatalf("used = %+v, want the whole runner %+v", s.used, s.capacity)
+	}
+	release()
+	if s.used != (Resources{}) {
+		t.Fatalf("used = %+v after release, want zero", s.used)
+	}
+}
+
+func TestSchedulerDefaultsEmptyRequests(t *testing.T) {
+	s := testScheduler(Resources{CPUs: 8, MemoryMB: 8192})
+	defer s.acquire("empty", Resources{})()
+	if s.used != defaultStageResources {
+		t.Fatalf("used = %+v, want %+v", s.used, defaultStageResources)
+	}
+}
+
+func TestSchedulerCapsConcurrentStages(t *testing.T) {
+	s := testScheduler(Resources{CPUs: 8, MemoryMB: 8192})
+	s.jobs = 1
+	release := s.acquire("first", Resources{CPUs: 1, MemoryMB: 256})
+
+	admitted := make(chan struct{})
+	go func() {
+		s.acquire("second", Resources{CPUs: 1, MemoryMB: 256})()
+		close(admitted)
+	}()
+	select {
+	case <-admitted:
+		t.Fatal("second stage admitted past -j 1")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	select {
+	case <-admitted:
+	case <-time.After(time.Second):
+		t.Fatal("second stage not admitted after release")
+	}
+}
+
+func TestSchedulerSizesFromTheEngineMachine(t *testing.T) {
+	t.Setenv("MYCO_CI_RUNNER_CPUS", "")
+	t.Setenv("MYCO_CI_RUNNER_MEMORY_MB", "")
+	exec := &fakeExecutor{handle: func(Command) (Result, error) {
+		return Result{Stdout: "6\n8152548\n"}, nil
+	}}
+	machine, err := runnerCapacity(context.Background(), exec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Resources{CPUs: 6, MemoryMB: 7961}); machine != want {
+		t.Fatalf("runnerCapacity = %+v, want %+v", machine, want)
+	}
+	s := newStageScheduler(0, machine)
+	if want := (Resources{CPUs: 6, MemoryMB: 5970}); s.capacity != want {
+		t.Fatalf("capacity = %+v, want %+v", s.capacity, want)
+	}
+}
+
+func TestRunnerCapacityRejectsUnexpectedOutput(t *testing.T) {
+	exec := &fakeExecutor{handle: func(Command) (Result, error) {
+		return Result{Stdout: "6\n"}, nil
+	}}
+	if _, err := runnerCapacity(context.Background(), exec); err == nil {
+		t.Fatal("runnerCapacity accepted output without the memory")
+	}
+}
@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RetryPolicy reruns a stage that failed for reasons that say nothing about
+// the code, such as an engine hiccup or a package mirror timing out.
+type RetryPolicy struct {
+	// Count is how many times the stage reruns after its first attempt.
+	Count int `yaml:"count"`
+	// Backoff is the wait before the first rerun, doubling before each
+	// one after; zero is defaultRetryBackoff.
+	Backoff Duration `yaml:"backoff"`
+	// AnyError reruns failed checks too, not only infrastructure errors,
+	// for a stage known to be flaky.
+	AnyError bool `yaml:"any_error"`
+}
+
+// defaultRetryBackoff is the wait before a stage's first rerun.
+const defaultRetryBackoff = 10 * time.Second
+
+func (r RetryPolicy) validate() error {
+	switch {
+	case r.Count < 0:
+		return fmt.Errorf("retry count %d is negative", r.Count)
+	case r.Backoff == noLimit:
+		return fmt.Errorf("retry backoff cannot be none")
+	}
+	return nil
+}
+
+// retries says whether err, from attempt (counting from 1), is worth
+// another one under r.
+func (r RetryPolicy) retries(attempt int, err error) bool {
+	if err == nil || attempt > r.Count {
+		return false
+	}
+	if _, ok := err.(*WarningError); ok {
+		return false
+	}
+	return r.AnyError || ExitCode(err) == ExitInfra
+}
+
+// backoff is the wait before rerun n, counting from 1.
+func (r RetryPolicy) backoff(n int) time.Duration {
+	d := time.Duration(r.Backoff)
+	if d <= 0 {
+		d = defaultRetryBackoff
+	}
+	return d << (n - 1)
+}
+
+// runWithRetry runs attempt until it passes or s.Retry gives up on it,
+// returning the last error and how many attempts ran. A stage that has
+// published outputs is not rerun, since it could not publish them again;
+// nor is one whose context ended.
+func runWithRetry(ctx context.Context, s Stage, published func() bool, attempt func() error) (int, error) {
+	for n := 1; ; n++ {
+		err := attempt()
+		if !s.Retry.retries(n, err) || ctx.Err() != nil || published() {
+			return n, err
+		}
+		wait := s.Retry.backoff(n)
+		logf(ctx, "attempt %d of %d failed, retrying in %s: %v", n, s.Retry.Count+1, wait, err)
+		select {
+		case <-ctx.Done():
+			return n, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retryLine describes a stage's retry policy in a dry-run plan.
+func retryLine(r RetryPolicy) string {
+	what := "infrastructure errors"
+	if r.AnyError {
+		what = "any failure"
+	}
+	return fmt.Sprintf("retries: up to %d on %s, backoff %s doubling", r.Count, what, r.backoff(1))
+}
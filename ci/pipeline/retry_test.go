@@ -0,0 +1,90 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunStagesRetriesInfraErrors(t *testing.T) {
+	retry := RetryPolicy{Count: 2, Backoff: Duration(time.Millisecond)}
+	var flaky, broken, published int
+	p := &Pipeline{Stages: []Stage{
+		{Name: "Flaky", Retry: retry, Run: func(context.Context, *Env) error {
+			if flaky++; flaky < 3 {
+				return &InfraError{Op: "apk add", Err: errors.New("mirror timed out")}
+			}
+			return nil
+		}},
+		{Name: "Broken", Retry: retry, Run: func(context.Context, *Env) error {
+			broken++
+			return errors.New("assertion failed")
+		}},
+		{Name: "Producer", Retry: retry, Outputs: []Output{{Name: "report", Kind: OutputJSON}}, Run: func(_ context.Context, env *Env) error {
+			published++
+			if err := env.PublishJSON("report", 1); err != nil {
+				return err
+			}
+			return &InfraError{Op: "upload", Err: errors.New("reset")}
+		}},
+	}}
+	perf := newPerfRecorder("abc")
+	err := p.runStages(context.Background(), &Env{perf: perf})
+	if err == nil || strings.Contains(err.Error(), "Flaky") {
+		t.Fatalf("runStages = %v, want only Broken and Producer to fail", err)
+	}
+	if flaky != 3 || broken != 1 || published != 1 {
+		t.Errorf("attempts: Flaky %d, Broken %d, Producer %d; want 3, 1 and 1", flaky, broken, published)
+	}
+	if got := perf.retriedStages(); len(got) != 1 || got[0] != "Flaky (attempt 3)" {
+		t.Errorf("retriedStages = %q", got)
+	}
+	if msg := completionMessage(perf); !strings.Contains(msg, "passed on retry: Flaky (attempt 3)") {
+		t.Errorf("completion message %q does not name the retried stage", msg)
+	}
+}
+
+func TestRetryPolicyAnyErrorAndBackoff(t *testing.T) {
+	r := RetryPolicy{Count: 1, AnyError: true}
+	if !r.retries(1, errors.New("flaky check")) {
+		t.Error("any_error did not retry a failed check")
+	}
+	if r.retries(2, errors.New("flaky check")) {
+		t.Error("retried past count")
+	}
+	if r.retries(1, &WarningError{}) {
+		t.Error("retried a warning")
+	}
+	if got := r.backoff(3); got != 4*defaultRetryBackoff {
+		t.Errorf("backoff(3) = %s, want %s", got, 4*defaultRetryBackoff)
+	}
+}
+
+func TestRunStagesTimeoutReportsHowLongTheAttemptRan(t *testing.T) {
+	const sleep = 300 * time.Millisecond
+	exec := &fakeExecutor{handle: func(Command) (Result, error) {
+		time.Sleep(sleep)
+		return Result{}, &InfraError{Op: "exec sleep", Err: errors.New("engine went away")}
+	}}
+	p := &Pipeline{Stages: []Stage{
+		{Name: "Slow", Retry: RetryPolicy{Count: 2, Backoff: Duration(time.Millisecond)}, Run: func(ctx context.Context, env *Env) error {
+			_, err := env.Exec.Exec(ctx, Command{Args: []string{"sleep", "1"}})
+			return err
+		}},
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := p.runStages(ctx, &Env{Exec: exec, perf: newPerfRecorder("abc")})
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("runStages = %v, want a TimeoutError", err)
+	}
+	if timeout.After < sleep || timeout.After > 2*sleep {
+		t.Errorf("After = %s, want about %s", timeout.After, sleep)
+	}
+	if n := len(exec.commands()); n != 1 {
+		t.Errorf("%d attempts after the deadline, want 1", n)
+	}
+}
@@ -0,0 +1,164 @@
+package pipeline
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// runDir is one Run's output directory, build/runs/<ID>. Every Run gets its
+// own, so concurrent runs on one machine, or an embedder calling Run twice,
+// never overwrite each other. MYCO_CI_RUN_ID pins the ID, e.g. to the CI
+// job id.
+//
+// Container-side paths such as /tmp/myco-smoke and the cluster ports need no
+// namespacing: every exec gets its own filesystem and network namespace.
+type runDir struct {
+	ID string
+}
+
+func newRunDir() runDir {
+	if id := os.Getenv("MYCO_CI_RUN_ID"); id != "" {
+		return runDir{ID: id}
+	}
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return runDir{ID: time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)}
+}
+
+// startRun returns the run directory for the next Run: the one
+// StartProgress opened for its console log, or a new one.
+func (p *Pipeline) startRun() runDir {
+	if p.next != nil {
+		run := *p.next
+		p.next = nil
+		return run
+	}
+	return newRunDir()
+}
+
+// path joins parts under the run's output directory.
+func (r runDir) path(parts ...string) string {
+	return filepath.Join(append([]string{"build", "runs", r.ID}, parts...)...)
+}
+
+// cacheKey scopes a cache volume name to the run when
+// MYCO_CI_ISOLATE_CACHES=1. Sharing is the default because zig's cache is
+// safe for concurrent use and a per-run cache is always cold.
+func (r runDir) cacheKey(name string) string {
+	if os.Getenv("MYCO_CI_ISOLATE_CACHES") == "1" {
+		return name + "-" + r.ID
+	}
+	return name
+}
+
+// linkLatest points build/latest at the run's directory. The link is
+// swapped with a rename so readers never see it missing, except on Windows,
+// which cannot rename over a directory link and, outside developer mode,
+// cannot make one: there build/latest.txt names the run instead.
+func (r runDir) linkLatest() error {
+	if err := os.MkdirAll(r.path(), 0o755); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		latest := filepath.Join("build", "latest")
+		os.Remove(latest)
+		if err := os.Symlink(filepath.Join("runs", r.ID), latest); err != nil {
+			return os.WriteFile(latest+".txt", []byte(r.path()+"\n"), 0o644)
+		}
+		return nil
+	}
+	tmp := filepath.Join("build", fmt.Sprintf(".latest-%s", r.ID))
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Join("runs", r.ID), tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join("build", "latest"))
+}
+
+// appendStepSummary adds markdown to the GitHub job summary when there is one.
+func appendStepSummary(markdown string) error {
+	summary := os.Getenv("GITHUB_STEP_SUMMARY")
+	if summary == "" {
+		return nil
+	}
+	f, err := os.OpenFile(summary, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(markdown)
+	return err
+}
+
+// appendHistory adds records to the JSON-lines history at path in one
+// O_APPEND write, so runs finishing at the same time each keep theirs. A
+// history that does not exist yet starts as a copy of seed, when set.
+func appendHistory[T any](path, seed string, records []T) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if seed != "" && seed != path {
+		if err := seedHistory(path, seed); err != nil {
+			return err
+		}
+	}
+	var lines []byte
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(lines); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// seedHistory copies seed to path unless path exists. The copy is written
+// aside and linked into place, so it never replaces records another run
+// appended meanwhile.
+func seedHistory(path, seed string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	data, err := os.ReadFile(seed)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".seed-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Link(tmp.Name(), path); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	return nil
+}
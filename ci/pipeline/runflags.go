@@ -0,0 +1,87 @@
+package pipeline
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// RunFlags is the command line of a pipeline run,
+// 'go run ./ci [PHASE] [flags]'.
+type RunFlags struct {
+	Offline       bool
+	BundleDir     string
+	Only, Skip    []string
+	ConfigPath    string
+	StageTimeouts string
+	FailFast      bool
+	DryRun        bool
+	Local         bool
+	TUI           bool
+	StageLogs     bool
+	// Jobs is -j, else MYCO_CI_JOBS; zero lets the runner decide.
+	Jobs int
+}
+
+// ParseRunFlags parses the flags of a run of phase. Flags that cannot be
+// combined and a bad -j or MYCO_CI_JOBS are UsageErrors, like a flag the
+// run does not take; -h returns flag.ErrHelp.
+func ParseRunFlags(phase string, args []string) (RunFlags, error) {
+	var f RunFlags
+	fs := flag.NewFlagSet("ci "+phase, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: go run ./ci [%s|%s] [flags]\n", strings.Join(Phases, "|"), PhaseAll)
+		fmt.Fprintln(os.Stderr, "       go run ./ci cache|report|bisect|release ...")
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&f.Offline, "offline", false, "run from a cache bundle and refuse network access")
+	fs.StringVar(&f.BundleDir, "bundle", DefaultBundleDir, "cache bundle directory used by --offline")
+	only := fs.String("only", "", "comma-separated stages to run, plus the stages they need outputs from")
+	skip := fs.String("skip", "", "comma-separated stages not to run")
+	fs.StringVar(&f.ConfigPath, "config", DefaultConfigPath, "pipeline configuration; a missing file keeps the defaults")
+	fs.StringVar(&f.StageTimeouts, "stage-timeout", "", `comma-separated NAME=DURATION stage timeouts, e.g. "Cluster Smoke=30m"; none disables one`)
+	fs.BoolVar(&f.FailFast, "fail-fast", false, "cancel the remaining stages once one fails")
+	keepGoing := fs.Bool("keep-going", false, "run every stage and report all failures together (the default)")
+	fs.BoolVar(&f.DryRun, "dry-run", false, "print the stages, their order and commands without running anything")
+	fs.BoolVar(&f.Local, "local", false, "run the stages on this host with its zig and bash, without a Dagger engine")
+	fs.BoolVar(&f.TUI, "tui", false, "show a live table of the stages instead of their interleaved output, which goes to console.log in the run directory")
+	fs.BoolVar(&f.StageLogs, "stage-logs", false, "also write each stage's messages and command output to logs/STAGE.log in the run directory")
+	fs.IntVar(&f.Jobs, "j", 0, "run at most N stages at once (default MYCO_CI_JOBS, else as many as the runner fits)")
+	if err := parseFlags(fs, args); err != nil {
+		return f, err
+	}
+	f.Only, f.Skip = stageList(*only), stageList(*skip)
+	if f.FailFast && *keepGoing {
+		return f, &UsageError{Err: errors.New("--fail-fast and --keep-going cannot be combined")}
+	}
+	if f.Local && f.Offline {
+		return f, &UsageError{Err: errors.New("--local and --offline cannot be combined; --local already uses only this host")}
+	}
+	if f.Jobs == 0 {
+		if value := os.Getenv("MYCO_CI_JOBS"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return f, &UsageError{Err: fmt.Errorf("MYCO_CI_JOBS=%q: want a number of stages", value)}
+			}
+			f.Jobs = n
+		}
+	}
+	if f.Jobs < 0 {
+		return f, &UsageError{Err: fmt.Errorf("-j %d: want a positive number of stages", f.Jobs)}
+	}
+	return f, nil
+}
+
+// stageList splits a comma-separated --only or --skip value.
+func stageList(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,122 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// gitleaksImage runs the Secrets Scan stage; MYCO_GITLEAKS_IMAGE overrides it.
+const gitleaksImage = "ghcr.io/gitleaks/gitleaks:v8.28.0"
+
+// gitleaksConfig extends the default rules with myco's key files.
+const gitleaksConfig = "ci/gitleaks.toml"
+
+// gitleaksFoundExit is the exit status gitleaks is told to use for findings,
+// kept apart from the 1 it exits with on its own errors.
+const gitleaksFoundExit = 99
+
+// defaultSecretsHistoryDepth is how many recent commits the history scan
+// covers unless MYCO_SECRETS_HISTORY_DEPTH says otherwise.
+const defaultSecretsHistoryDepth = 50
+
+// gitleaksFinding is the subset of a gitleaks JSON report entry we print.
+type gitleaksFinding struct {
+	RuleID    string `json:"RuleID"`
+	File      string `json:"File"`
+	StartLine int    `json:"StartLine"`
+	Commit    string `json:"Commit"`
+}
+
+// runSecretsScan runs gitleaks over the working tree and, when the checkout
+// has one, the most recent commits of its git history. Findings are
+// redacted; the JSON reports go to secrets/ in the run directory.
+func runSecretsScan(ctx context.Context, run runDir, client *dagger.Client, src *dagger.Directory) error {
+	image := gitleaksImage
+	if value := os.Getenv("MYCO_GITLEAKS_IMAGE"); value != "" {
+		image = value
+	}
+	depth := defaultSecretsHistoryDepth
+	if value := os.Getenv("MYCO_SECRETS_HISTORY_DEPTH"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			depth = parsed
+		}
+	}
+
+	repo := src
+	scans := []struct {
+		name string
+		args []string
+	}{
+		{"tree", []string{"gitleaks", "dir", "."}},
+	}
+	if info, err := os.Stat(".git"); err == nil && info.IsDir() {
+		repo = src.WithDirectory(".git", client.Host().Directory(".git"))
+		scans = append(scans, struct {
+			name string
+			args []string
+		}{"history", []string{"gitleaks", "git", fmt.Sprintf("--log-opts=-n %d", depth), "."}})
+	} else {
+		logf(ctx, "no .git directory; scanning the working tree only")
+	}
+
+	scanner := client.Container().From(image).
+		WithMountedDirectory("/repo", repo).
+		WithWorkdir("/repo").
+		WithExec([]string{"git", "config", "--global", "--add", "safe.directory", "/repo"})
+
+	var findings []string
+	for _, scan := range scans {
+		report := "/tmp/gitleaks-" + scan.name + ".json"
+		args := append(scan.args, "--config", gitleaksConfig, "--redact", "--no-banner",
+			"--exit-code", strconv.Itoa(gitleaksFoundExit), "--report-format", "json", "--report-path", report)
+		ran := scanner.WithExec(args, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+		var code int
+		err := runBounded(ctx, "gitleaks "+scan.name, func(ctx context.Context) (err error) {
+			code, err = ran.ExitCode(ctx)
+			return err
+		})
+		if errors.As(err, new(*TimeoutError)) {
+			return err
+		}
+		if err != nil {
+			return &InfraError{Op: "gitleaks " + scan.name, Err: err}
+		}
+		if _, err := ran.File(report).Export(ctx, run.path("secrets", scan.name+".json")); err != nil {
+			logf(ctx, "warning: %s report not exported: %v", scan.name, err)
+		}
+		switch code {
+		case 0:
+			logf(ctx, "%s: no findings", scan.name)
+		case gitleaksFoundExit:
+			raw, err := ran.File(report).Contents(ctx)
+			if err != nil {
+				return err
+			}
+			var entries []gitleaksFinding
+			if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+				return fmt.Errorf("parse gitleaks %s report: %w", scan.name, err)
+			}
+			for _, f := range entries {
+				where := fmt.Sprintf("%s:%d", f.File, f.StartLine)
+				if f.Commit != "" {
+					where += " in " + shortCommit(f.Commit)
+				}
+				findings = append(findings, fmt.Sprintf("%s: %s (%s)", scan.name, where, f.RuleID))
+			}
+		default:
+			stderr, _ := ran.Stderr(ctx)
+			return &StageError{Command: "gitleaks " + scan.name, ExitCode: code, Output: strings.TrimSpace(stderr)}
+		}
+	}
+	if len(findings) > 0 {
+		return fmt.Errorf("%d possible secrets committed; rotate them and rewrite history:\n%s", len(findings), strings.Join(findings, "\n"))
+	}
+	return nil
+}
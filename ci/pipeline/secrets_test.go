@@ -0,0 +1,90 @@
+package pipeline
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// gitleaksPathRules reads the path rules and the allowlisted paths out of
+// ci/gitleaks.toml. Content rules come from gitleaks' defaults and only the
+// Secrets Scan stage can run them.
+func gitleaksPathRules(t *testing.T) (rules map[string]*regexp.Regexp, allowed []*regexp.Regexp) {
+	t.Helper()
+	f, err := os.Open("../../" + gitleaksConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	literal := regexp.MustCompile(`'''(.*?)'''`)
+	rules = map[string]*regexp.Regexp{}
+	var section, id string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		key, value, _ := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch {
+		case strings.HasPrefix(line, "["):
+			section, id = line, ""
+		case key == "id":
+			id = strings.Trim(value, `"`)
+		case section == "[[rules]]" && key == "path":
+			rules[id] = regexp.MustCompile(literal.FindStringSubmatch(value)[1])
+		case section == "[allowlist]" && key == "paths":
+			for _, m := range literal.FindAllStringSubmatch(value, -1) {
+				allowed = append(allowed, regexp.MustCompile(m[1]))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) == 0 {
+		t.Fatalf("no path rules in %s", gitleaksConfig)
+	}
+	return rules, allowed
+}
+
+func TestGitleaksPathRulesPassTree(t *testing.T) {
+	rules, allowed := gitleaksPathRules(t)
+	out, err := exec.Command("git", "-C", "../..", "ls-files").Output()
+	if err != nil {
+		t.Skipf("git ls-files: %v", err)
+	}
+
+	matches := func(res []*regexp.Regexp, path string) bool {
+		for _, re := range res {
+			if re.MatchString(path) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, path := range strings.Fields(string(out)) {
+		if matches(allowed, path) {
+			continue
+		}
+		for id, re := range rules {
+			if re.MatchString(path) {
+				t.Errorf("%s: %s finding", path, id)
+			}
+		}
+	}
+
+	// The fixture key is what the allowlist is for; the rule itself must
+	// still catch it, or the allowlist hides nothing.
+	const fixtureKey = "ci/fixtures/state-0.0.0/state/node.key"
+	if !rules["myco-node-key"].MatchString(fixtureKey) {
+		t.Errorf("myco-node-key does not match %s", fixtureKey)
+	}
+	if !matches(allowed, fixtureKey) {
+		t.Errorf("%s is not allowlisted", fixtureKey)
+	}
+	if matches(allowed, "ci/fixtures/node.key") || matches(allowed, "state/node.key") {
+		t.Error("allowlist reaches past the state fixtures")
+	}
+}
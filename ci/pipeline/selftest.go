@@ -0,0 +1,36 @@
+package pipeline
+
+import (
+	"context"
+
+	"dagger.io/dagger"
+)
+
+// selfTestResources covers compiling and testing the ci module.
+var selfTestResources = Resources{CPUs: 2, MemoryMB: 1024}
+
+// goContainer is a Go toolchain with src at /src. Go modules and build
+// outputs live in cache volumes so builds of the ci module do not download
+// its dependencies again on every run.
+func goContainer(client *dagger.Client, run runDir, src *dagger.Directory) *dagger.Container {
+	return client.Container().
+		From("golang:1.25-alpine").
+		WithMountedCache("/go/pkg/mod", client.CacheVolume(run.cacheKey("myco-go-mod"))).
+		WithMountedCache("/root/.cache/go-build", client.CacheVolume(run.cacheKey("myco-go-build"))).
+		WithMountedDirectory("/src", src).
+		WithWorkdir("/src")
+}
+
+// runSelfTest builds, vets and unit tests the ci module itself, so a broken
+// pipeline change fails here rather than in the stages it drives. The tests
+// use the fake executor and need no engine.
+func runSelfTest(ctx context.Context, client *dagger.Client, run runDir, src *dagger.Directory) error {
+	tested := goContainer(client, run, src).
+		WithExec([]string{"go", "build", "./ci/..."}).
+		WithExec([]string{"go", "vet", "./ci/..."}).
+		WithExec([]string{"go", "test", "-count=1", "./ci/..."})
+	return runBounded(ctx, "go build, vet and test", func(ctx context.Context) error {
+		_, err := tested.Sync(ctx)
+		return err
+	})
+}
@@ -0,0 +1,136 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sizeHistoryPath is the JSON-lines history of release binary sizes. It is
+// shared by all runs and kept between them (e.g. via a cache) so the trend
+// spans many commits; MYCO_SIZE_HISTORY points at a copy to start from when
+// it does not exist yet.
+var sizeHistoryPath = filepath.Join("build", "size-history.jsonl")
+
+// sizeTrendRows is how many recent commits the trend table shows per target.
+const sizeTrendRows = 10
+
+type sizeRecord struct {
+	Commit string `json:"commit"`
+	Target string `json:"target"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// currentCommit identifies the build in size records: GITHUB_SHA in Actions,
+// otherwise the checked-out HEAD.
+func currentCommit() string {
+	if sha := os.Getenv("GITHUB_SHA"); sha != "" {
+		return sha
+	}
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// recordBinarySizes appends this build's sizes to the history, rewrites the
+// trend markdown and adds it to the GitHub job summary when there is one.
+func recordBinarySizes(run runDir, built []sizeRecord) error {
+	if len(built) == 0 {
+		return nil
+	}
+	sort.Slice(built, func(i, j int) bool { return built[i].Target < built[j].Target })
+	if err := appendHistory(sizeHistoryPath, os.Getenv("MYCO_SIZE_HISTORY"), built); err != nil {
+		return err
+	}
+	history, err := readSizeHistory(sizeHistoryPath)
+	if err != nil {
+		return err
+	}
+
+	trend := renderSizeTrend(history)
+	sizeTrendPath := run.path("size-trend.md")
+	if err := os.WriteFile(sizeTrendPath, []byte(trend), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Size history: %d records in %s, trend in %s\n", len(history), sizeHistoryPath, sizeTrendPath)
+	return appendStepSummary(trend)
+}
+
+// readSizeHistory loads a history file; a missing file is an empty history.
+func readSizeHistory(path string) ([]sizeRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var history []sizeRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var r sizeRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		history = append(history, r)
+	}
+	return history, scanner.Err()
+}
+
+// renderSizeTrend draws the last sizeTrendRows builds of each target as a
+// markdown table with deltas and a bar scaled to the target's largest size.
+func renderSizeTrend(history []sizeRecord) string {
+	byTarget := map[string][]sizeRecord{}
+	var targets []string
+	for _, r := range history {
+		if _, ok := byTarget[r.Target]; !ok {
+			targets = append(targets, r.Target)
+		}
+		byTarget[r.Target] = append(byTarget[r.Target], r)
+	}
+	sort.Strings(targets)
+
+	var b strings.Builder
+	b.WriteString("## Binary size trend\n")
+	for _, target := range targets {
+		records := byTarget[target]
+		if len(records) > sizeTrendRows {
+			records = records[len(records)-sizeTrendRows:]
+		}
+		var largest int64
+		for _, r := range records {
+			largest = max(largest, r.Bytes)
+		}
+
+		fmt.Fprintf(&b, "\n### %s\n\n| commit | bytes | delta | |\n|---|---:|---:|---|\n", target)
+		for i, r := range records {
+			delta := ""
+			if i > 0 {
+				delta = fmt.Sprintf("%+d", r.Bytes-records[i-1].Bytes)
+			}
+			bar := strings.Repeat("█", int(1+19*r.Bytes/max(largest, 1)))
+			fmt.Fprintf(&b, "| `%s` | %d | %s | %s |\n", shortCommit(r.Commit), r.Bytes, delta, bar)
+		}
+	}
+	return b.String()
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
@@ -0,0 +1,483 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"dagger.io/dagger"
+	"orchestrator-ci/ci/converge"
+	"orchestrator-ci/ci/fixtures"
+)
+
+// clusterSmokeResources covers the default five-node cluster.
+var clusterSmokeResources = Resources{CPUs: 2, MemoryMB: 1536}
+
+// smokePerfFile is where the cluster script leaves its key=value metrics.
+const smokePerfFile = "/tmp/myco-smoke-perf.env"
+
+// convergeReportFile is where myco-wait-converge leaves its last poll.
+const convergeReportFile = "/tmp/myco-converge.json"
+
+// waitConvergeMount is where the cluster smoke finds myco-wait-converge.
+const waitConvergeMount = "/usr/local/bin/myco-wait-converge"
+
+// smokeConfig is the cluster size and convergence deadline for one run.
+type smokeConfig struct {
+	Preset  string
+	Nodes   int
+	Jobs    int
+	MaxWait string
+}
+
+// smokeSettings reads MYCO_SMOKE_PRESET, MYCO_SMOKE_NODES,
+// MYCO_SMOKE_JOBS_PER_NODE and MYCO_SMOKE_MAX_WAIT_SEC. Explicit counts win
+// over the preset, and the deadline scales with the total job count unless
+// set.
+func smokeSettings() smokeConfig {
+	preset := strings.ToLower(os.Getenv("MYCO_SMOKE_PRESET"))
+	nodes := 5
+	jobs := 2
+	nodesFromEnv := false
+	jobsFromEnv := false
+	if value := os.Getenv("MYCO_SMOKE_NODES"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			nodes = parsed
+			nodesFromEnv = true
+		}
+	}
+	if value := os.Getenv("MYCO_SMOKE_JOBS_PER_NODE"); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 {
+			jobs = parsed
+			jobsFromEnv = true
+		}
+	}
+	switch preset {
+	case "stress":
+		if !nodesFromEnv {
+			nodes = 10
+		}
+		if !jobsFromEnv {
+			jobs = 40
+		}
+	case "max":
+		if !nodesFromEnv {
+			nodes = 16
+		}
+		if !jobsFromEnv {
+			jobs = 32
+		}
+	case "", "default":
+	default:
+		fmt.Printf("Unknown MYCO_SMOKE_PRESET=%q; using explicit/default values.\n", preset)
+	}
+
+	maxWait := os.Getenv("MYCO_SMOKE_MAX_WAIT_SEC")
+	if maxWait == "" {
+		total := nodes * jobs
+		switch {
+		case total >= 400:
+			maxWait = "900"
+		case total >= 300:
+			maxWait = "720"
+		case total >= 200:
+			maxWait = "600"
+		case total >= 150:
+			maxWait = "600"
+		case total >= 100:
+			maxWait = "480"
+		case total >= 50:
+			maxWait = "360"
+		default:
+			maxWait = "240"
+		}
+	}
+	return smokeConfig{Preset: preset, Nodes: nodes, Jobs: jobs, MaxWait: maxWait}
+}
+
+// smokeServiceFiles is the myco.json each smoke node deploys, by path:
+// Jobs services hello-nN-1 … per node nN, numbered across the cluster.
+func smokeServiceFiles(cfg smokeConfig) (map[string]string, error) {
+	files := map[string]string{}
+	for n := 1; n <= cfg.Nodes; n++ {
+		first := uint64((n-1)*cfg.Jobs + 1)
+		data, err := fixtures.Marshal(fixtures.Services(first, cfg.Jobs, fmt.Sprintf("hello-n%d", n)))
+		if err != nil {
+			return nil, err
+		}
+		files[fmt.Sprintf("/tmp/myco-svc-n%d.json", n)] = string(data)
+	}
+	return files, nil
+}
+
+// smokeStateRoot and smokePortBase place smoke node nN in smokeStateRoot/nN,
+// listening on smokePortBase+N-1.
+const (
+	smokeStateRoot = "/tmp/myco-smoke"
+	smokePortBase  = 17777
+)
+
+// smokeNodeFiles is each smoke node's environment, by path: NAME=VALUE
+// lines for env(1) in /tmp/myco-env-nN-ROLE, for the daemon, the cli and
+// pubkey roles.
+func smokeNodeFiles(cfg smokeConfig) (map[string]string, error) {
+	files := map[string]string{}
+	for n := 1; n <= cfg.Nodes; n++ {
+		dir := path.Join(smokeStateRoot, fmt.Sprintf("n%d", n))
+		node := fixtures.NodeConfig{StateDir: dir, Port: smokePortBase + n - 1, NodeID: n, UDSPath: path.Join(dir, "myco.sock")}
+		for role, c := range map[string]fixtures.NodeConfig{"daemon": node, "cli": node.Client(), "pubkey": node.Identity()} {
+			env, err := c.Env()
+			if err != nil {
+				return nil, fmt.Errorf("smoke node n%d: %w", n, err)
+			}
+			files[fmt.Sprintf("/tmp/myco-env-n%d-%s", n, role)] = strings.Join(fixtures.EnvLines(env), "\n") + "\n"
+		}
+	}
+	return files, nil
+}
+
+// mycoBinaryOutput is the stage output holding the myco binary, built once
+// by the Myco Binary stage and run by both the integration test and the
+// cluster smoke.
+const mycoBinaryOutput = "myco-binary"
+
+// mycoBinaryMount is where the stages that take the binary find it.
+const mycoBinaryMount = "/usr/local/bin/myco"
+
+var mycoBinaryResources = Resources{CPUs: 2, MemoryMB: 1536}
+
+// buildMycoBinary builds myco with MYCO_SMOKE_OPTIMIZE (ReleaseFast by
+// default) and returns the binary.
+func buildMycoBinary(ctx context.Context, exec Executor) (*dagger.File, error) {
+	optimize := "ReleaseFast"
+	if value := os.Getenv("MYCO_SMOKE_OPTIMIZE"); value != "" {
+		optimize = value
+	}
+	res, err := exec.Exec(ctx, Command{
+		Args:        []string{"zig", "build", "-Doptimize="+optimize},
+		Env:         zigCacheEnv,
+		ExportFiles: []string{"/src/zig-out/bin/myco"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := res.check("zig build"); err != nil {
+		return nil, err
+	}
+	return res.Exported["/src/zig-out/bin/myco"], nil
+}
+
+// runClusterSmoke starts the cluster with bin and waits for it to converge
+// with waiter, the myco-wait-converge tool.
+func runClusterSmoke(ctx context.Context, exec Executor, bin, waiter *dagger.File, perf *perfRecorder) error {
+	cfg := smokeSettings()
+	if cfg.Preset == "" {
+		logf(ctx, "running cluster smoke (nodes=%d, jobs=%d)...", cfg.Nodes, cfg.Jobs)
+	} else {
+		logf(ctx, "running cluster smoke (preset=%s, nodes=%d, jobs=%d)...", cfg.Preset, cfg.Nodes, cfg.Jobs)
+	}
+
+clusterScript := `
+set -euo pipefail
+
+# Mock nix/systemctl so smoke deploys don't require real system services.
+echo '#!/bin/sh' > /usr/bin/nix
+echo 'echo /nix/store/mock-output-path' >> /usr/bin/nix
+chmod +x /usr/bin/nix
+echo '#!/bin/sh' > /usr/bin/systemctl
+echo 'exit 0' >> /usr/bin/systemctl
+chmod +x /usr/bin/systemctl
+
+BIN="${MYCO_SMOKE_BIN}"
+STATE=` + smokeStateRoot + `
+NODE_COUNT="${MYCO_SMOKE_NODES:-5}"
+SERVICES_PER_NODE="${MYCO_SMOKE_JOBS_PER_NODE:-2}"
+NODE_NAMES=()
+for i in $(seq 1 "${NODE_COUNT}"); do
+  NODE_NAMES+=("n${i}")
+done
+PORT_BASE=` + strconv.Itoa(smokePortBase) + `
+NODE_COUNT=${#NODE_NAMES[@]}
+TOTAL_SERVICES=$((NODE_COUNT * SERVICES_PER_NODE))
+MAX_WAIT_SEC="${MYCO_SMOKE_MAX_WAIT_SEC:-240}"
+WAIT_CONVERGE="${MYCO_SMOKE_WAIT_CONVERGE}"
+CONVERGE_REPORT=/tmp/myco-converge.json
+STATUS_TIMEOUT_SEC="${MYCO_SMOKE_STATUS_TIMEOUT_SEC:-5}"
+# key=value measurements picked up by the Go side for the perf report.
+PERF_FILE=/tmp/myco-smoke-perf.env
+: >"${PERF_FILE}"
+start_ts=$(date +%s)
+inject_start_ts=0
+inject_end_ts=0
+converged_ts=0
+phase="init"
+
+PIDS=()
+DEPLOY_PIDS=()
+# Milliseconds from bash itself: busybox date has no %N.
+now_ms() { local us=${EPOCHREALTIME/[.,]/}; echo $((us / 1000)); }
+cleanup() {
+  for p in "${PIDS[@]}"; do
+    kill "$p" >/dev/null 2>&1 || true
+  done
+}
+dump_logs() {
+  echo "==> Log tails (myco.log)"
+  for node in "${NODE_NAMES[@]}"; do
+    echo "--- ${node} ---"
+    tail -n 200 "${STATE}/${node}/myco.log" || true
+    echo ""
+  done
+}
+on_exit() {
+  status=$?
+  trap - EXIT
+  cleanup
+  end_ts=$(date +%s)
+  echo "==> Cluster smoke wall time: $((end_ts - start_ts))s"
+  if [ "$inject_start_ts" -gt 0 ] && [ "$converged_ts" -eq 0 ]; then
+    echo "==> Time since job injection started: $((end_ts - inject_start_ts))s"
+  fi
+  if [ "$inject_end_ts" -gt 0 ] && [ "$converged_ts" -eq 0 ]; then
+    echo "==> Time since job injection finished: $((end_ts - inject_end_ts))s"
+  fi
+  if [ "$status" -ne 0 ]; then
+    dump_logs
+  fi
+  exit "$status"
+}
+trap on_exit EXIT
+
+check_daemons() {
+  local dead=0
+  for idx in "${!PIDS[@]}"; do
+    local pid="${PIDS[$idx]}"
+    local node="${NODE_NAMES[$idx]}"
+    if ! kill -0 "$pid" 2>/dev/null; then
+      echo "[FAIL] daemon for ${node} (pid ${pid}) died during ${phase}"
+      dead=1
+    fi
+  done
+  if [ "$dead" -ne 0 ]; then
+    echo "==> Daemon process snapshot"
+    ps -o pid,stat,comm -p "${PIDS[@]}" 2>/dev/null || true
+    return 1
+  fi
+  return 0
+}
+
+rm -rf "${STATE}"
+mkdir -p "${STATE}"
+for node in "${NODE_NAMES[@]}"; do
+  mkdir -p "${STATE}/${node}"
+done
+
+[ -x "${BIN}" ] || { echo "[FAIL] no smoke binary at ${BIN}"; exit 1; }
+
+# node_env NODE ROLE loads NODE's environment for ROLE (daemon, cli or
+# pubkey), written by smokeNodeFiles, into NODE_ENV.
+node_env() {
+  mapfile -t NODE_ENV <"/tmp/myco-env-$1-$2"
+}
+
+# myco_cli NODE ARGS... runs the CLI from NODE's state dir against its socket.
+myco_cli() {
+  local node="$1"
+  shift
+  (
+    node_env "$node" cli
+    cd "${STATE}/${node}" && env "${NODE_ENV[@]}" "${BIN}" "$@"
+  )
+}
+
+start_node() {
+  node_env "$1" daemon
+  env "${NODE_ENV[@]}" MYCO_SMOKE_SKIP_EXEC=1 "${BIN}" daemon >"${STATE}/$1/myco.log" 2>&1 &
+  PIDS+=("$!")
+}
+
+echo "==> Starting nodes..."
+phase="start"
+for node in "${NODE_NAMES[@]}"; do
+  start_node "$node"
+done
+
+# Startup time: until every node's control socket is up.
+startup_begin_ms=$(now_ms)
+for _ in $(seq 1 100); do
+  up=1
+  for node in "${NODE_NAMES[@]}"; do
+    [ -S "${STATE}/${node}/myco.sock" ] || up=0
+  done
+  [ "$up" -eq 1 ] && break
+  sleep 0.1
+done
+if [ "$up" -eq 1 ]; then
+  echo "startup_ms=$(( $(now_ms) - startup_begin_ms ))" >>"${PERF_FILE}"
+fi
+
+sleep 2
+phase="post-start"
+check_daemons || exit 1
+
+echo "==> Fetching pubkeys..."
+PUBS=()
+for idx in "${!NODE_NAMES[@]}"; do
+  node_env "${NODE_NAMES[$idx]}" pubkey
+  PUBS[$idx]=$(env "${NODE_ENV[@]}" "${BIN}" pubkey)
+done
+
+echo "==> Wiring peers..."
+for i in "${!NODE_NAMES[@]}"; do
+  for j in "${!NODE_NAMES[@]}"; do
+    [ "$i" -eq "$j" ] && continue
+    myco_cli "${NODE_NAMES[$i]}" peer add "${PUBS[$j]}" "127.0.0.1:$((PORT_BASE + j))"
+  done
+done
+
+# /tmp/myco-svc-${node}.json, each node's services, come from smokeServiceFiles.
+echo "==> Deploying services to each node..."
+phase="deploy"
+inject_start_ts=$(date +%s)
+for node in "${NODE_NAMES[@]}"; do
+  (
+    cp "/tmp/myco-svc-${node}.json" "${STATE}/${node}/myco.json"
+    myco_cli "$node" deploy || true
+  ) &
+  DEPLOY_PIDS+=("$!")
+done
+for p in "${DEPLOY_PIDS[@]}"; do
+  wait "$p"
+done
+inject_end_ts=$(date +%s)
+phase="post-deploy"
+check_daemons || exit 1
+
+echo "==> Waiting for convergence (expect ${TOTAL_SERVICES} services per node, max ${MAX_WAIT_SEC}s)..."
+phase="converge"
+WAIT_NODES=()
+for idx in "${!NODE_NAMES[@]}"; do
+  WAIT_NODES+=("${NODE_NAMES[$idx]}=${PIDS[$idx]}")
+done
+# 'myco status' has no per-peer health yet, so connectivity is left to the
+# pending Peer Connectivity scenario and the Go side reports it as pending.
+if ! "${WAIT_CONVERGE}" -bin "${BIN}" -state "${STATE}" -services "${TOTAL_SERVICES}" -peer-health=false \
+  -deadline "${MAX_WAIT_SEC}s" -status-timeout "${STATUS_TIMEOUT_SEC}s" -report "${CONVERGE_REPORT}" "${WAIT_NODES[@]}"; then
+  check_daemons || true
+  exit 1
+fi
+converged_ts=$(date +%s)
+
+if [ "$inject_start_ts" -gt 0 ] && [ "$converged_ts" -gt 0 ]; then
+  echo "==> Converged in $((converged_ts - inject_start_ts))s after job injection started"
+  echo "convergence_sec=$((converged_ts - inject_start_ts))" >>"${PERF_FILE}"
+fi
+
+max_rss=0
+for pid in "${PIDS[@]}"; do
+  rss=$(awk '/^VmRSS:/ {print $2}' "/proc/${pid}/status" 2>/dev/null || true)
+  [ -n "$rss" ] && [ "$rss" -gt "$max_rss" ] && max_rss=$rss
+done
+[ "$max_rss" -gt 0 ] && echo "max_rss_kib=${max_rss}" >>"${PERF_FILE}"
+
+# Only reported once the daemon exposes a gossip byte counter in status.
+gossip_total=0
+for node in "${NODE_NAMES[@]}"; do
+  out=$(myco_cli "$node" status 2>&1 || true)
+  sent=$(awk '$1 == "gossip_bytes_sent" {print $2; exit}' <<<"$out")
+  [ -n "$sent" ] || { gossip_total=""; break; }
+  gossip_total=$((gossip_total + sent))
+done
+[ -n "$gossip_total" ] && echo "gossip_bytes=${gossip_total}" >>"${PERF_FILE}"
+if [ "$inject_end_ts" -gt 0 ] && [ "$converged_ts" -gt 0 ]; then
+  echo "==> Converged in $((converged_ts - inject_end_ts))s after job injection finished"
+fi
+
+echo "==> Metrics:"
+for node in "${NODE_NAMES[@]}"; do
+  echo "--- ${node} ---"
+  myco_cli "$node" status || true
+done
+
+echo "Cluster smoke completed."
+`
+	env := map[string]string{
+		"MYCO_SMOKE_NODES":         strconv.Itoa(cfg.Nodes),
+		"MYCO_SMOKE_JOBS_PER_NODE": strconv.Itoa(cfg.Jobs),
+		"MYCO_SMOKE_MAX_WAIT_SEC":  cfg.MaxWait,
+		"MYCO_SMOKE_BIN":           mycoBinaryMount,
+		"MYCO_SMOKE_WAIT_CONVERGE": waitConvergeMount,
+	}
+	services, err := smokeServiceFiles(cfg)
+	if err != nil {
+		return err
+	}
+	nodes, err := smokeNodeFiles(cfg)
+	if err != nil {
+		return err
+	}
+	maps.Copy(services, nodes)
+	res, err := exec.Exec(ctx, Command{
+		Args:       []string{"bash", "-c", memoryGuard(clusterSmokeResources.MemoryMB)+clusterScript},
+		Env:        env,
+		Mounts:     map[string]*dagger.File{mycoBinaryMount: bin, waitConvergeMount: waiter},
+		WriteFiles: services,
+		ReadFiles:  []string{smokePerfFile, convergeReportFile},
+	})
+	if err != nil {
+		return err
+	}
+	if err := res.check("cluster smoke"); err != nil {
+		return withConvergeReport(err, res.Files[convergeReportFile])
+	}
+
+	var report converge.Report
+	if json.Unmarshal([]byte(res.Files[convergeReportFile]), &report) == nil && !report.PeerHealth {
+		logf(ctx, "pending: peer connectivity not checked, 'myco status' does not report per-peer health; see the Peer Connectivity scenario")
+	}
+
+	metrics, ok := res.Files[smokePerfFile]
+	if !ok {
+		logf(ctx, "warning: cluster smoke metrics unavailable")
+		return nil
+	}
+	if err := perf.smokeMetrics(metrics); err != nil {
+		logf(ctx, "warning: %v", err)
+	}
+	return nil
+}
+
+// maxDivergenceLines caps the record differences a failed smoke's error
+// lists; the waiter's own output has them all.
+const maxDivergenceLines = 10
+
+// withConvergeReport adds the nodes that had not converged, and where their
+// service records differ, from the waiter's report to a failed cluster
+// smoke. A run that failed before the
+// wait, or converged and failed after, is returned as it is.
+func withConvergeReport(err error, raw string) error {
+	var report converge.Report
+	var stageErr *StageError
+	if raw == "" || json.Unmarshal([]byte(raw), &report) != nil || report.Converged || !errors.As(err, &stageErr) {
+		return err
+	}
+	msg := fmt.Sprintf("not converged after %d polls in %.0fs: %s", report.Polls, report.Seconds, report.Summary())
+	if n := len(report.Divergence); n > 0 {
+		msg += "\nservice records and peers that differ between nodes:"
+		for i, d := range report.Divergence {
+			if i == maxDivergenceLines {
+				msg += fmt.Sprintf("\n  ... and %d more", n-i)
+				break
+			}
+			msg += "\n  " + d.String()
+		}
+	}
+	stageErr.Err = errors.New(msg)
+	return err
+}
@@ -0,0 +1,168 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"orchestrator-ci/ci/fixtures"
+)
+
+func TestSmokeSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want smokeConfig
+	}{
+		{"defaults", nil, smokeConfig{Nodes: 5, Jobs: 2, MaxWait: "240"}},
+		{"stress preset", map[string]string{"MYCO_SMOKE_PRESET": "Stress"}, smokeConfig{Preset: "stress", Nodes: 10, Jobs: 40, MaxWait: "900"}},
+		{"explicit nodes beat preset", map[string]string{"MYCO_SMOKE_PRESET": "max", "MYCO_SMOKE_NODES": "3"}, smokeConfig{Preset: "max", Nodes: 3, Jobs: 32, MaxWait: "360"}},
+		{"invalid counts ignored", map[string]string{"MYCO_SMOKE_NODES": "-1", "MYCO_SMOKE_JOBS_PER_NODE": "x"}, smokeConfig{Nodes: 5, Jobs: 2, MaxWait: "240"}},
+		{"explicit deadline", map[string]string{"MYCO_SMOKE_MAX_WAIT_SEC": "30"}, smokeConfig{Nodes: 5, Jobs: 2, MaxWait: "30"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"MYCO_SMOKE_PRESET", "MYCO_SMOKE_NODES", "MYCO_SMOKE_JOBS_PER_NODE", "MYCO_SMOKE_MAX_WAIT_SEC"} {
+				t.Setenv(name, tt.env[name])
+			}
+			if got := smokeSettings(); got != tt.want {
+				t.Fatalf("smokeSettings() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterSmokeRecordsMetrics(t *testing.T) {
+	t.Setenv("MYCO_SMOKE_NODES", "3")
+	exec := &fakeExecutor{handle: func(cmd Command) (Result, error) {
+		return Result{Files: map[string]string{smokePerfFile: "startup_ms=120\nconvergence_sec=4\nmax_rss_kib=2048\n"}}, nil
+	}}
+	perf := newPerfRecorder("abc")
+	if err := runClusterSmoke(context.Background(), exec, nil, nil, perf); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := exec.commands()
+	if len(calls) != 1 {
+		t.Fatalf("got %d execs, want 1", len(calls))
+	}
+	if got := calls[0].Env["MYCO_SMOKE_NODES"]; got != "3" {
+		t.Errorf("MYCO_SMOKE_NODES = %q, want 3", got)
+	}
+	if got := calls[0].Env["MYCO_SMOKE_BIN"]; got != mycoBinaryMount {
+		t.Errorf("MYCO_SMOKE_BIN = %q, want %s", got, mycoBinaryMount)
+	}
+	if _, ok := calls[0].Mounts[mycoBinaryMount]; !ok {
+		t.Errorf("myco binary not mounted at %s", mycoBinaryMount)
+	}
+	var services []fixtures.ServiceDefinition
+	if err := json.Unmarshal([]byte(calls[0].WriteFiles["/tmp/myco-svc-n3.json"]), &services); err != nil {
+		t.Fatalf("n3 services: %v", err)
+	}
+	if len(services) != 2 || services[0].ID != 5 || services[1].Name != "hello-n3-2" || services[1].FlakeURI != "github:example/hello-n3-2" {
+		t.Errorf("n3 services = %+v, want ids 5 and 6 numbered across the cluster", services)
+	}
+	if len(calls[0].WriteFiles) != 3*4 {
+		t.Errorf("wrote %d files for 3 nodes, want a service file and three env files each", len(calls[0].WriteFiles))
+	}
+	wantEnv := "MYCO_NODE_ID=3\nMYCO_PORT=17779\nMYCO_STATE_DIR=/tmp/myco-smoke/n3\nMYCO_UDS_PATH=/tmp/myco-smoke/n3/myco.sock\n"
+	if got := calls[0].WriteFiles["/tmp/myco-env-n3-daemon"]; got != wantEnv {
+		t.Errorf("n3 daemon env = %q, want %q", got, wantEnv)
+	}
+	r := perf.report
+	if r.StartupMillis == nil || *r.StartupMillis != 120 || r.ConvergenceSeconds == nil || *r.ConvergenceSeconds != 4 {
+		t.Errorf("smoke metrics not recorded: startup %v, convergence %v", r.StartupMillis, r.ConvergenceSeconds)
+	}
+	if r.GossipBytes != nil {
+		t.Errorf("gossip bytes = %d, want unmeasured", *r.GossipBytes)
+	}
+}
+
+func TestClusterSmokeFailureCarriesOutput(t *testing.T) {
+	exec := &fakeExecutor{handle: func(Command) (Result, error) {
+		return Result{ExitCode: 1, Stdout: "[FAIL] daemon for n2 died during converge"}, nil
+	}}
+	err := runClusterSmoke(context.Background(), exec, nil, nil, newPerfRecorder("abc"))
+	if err == nil || !strings.Contains(err.Error(), "n2 died") {
+		t.Fatalf("err = %v, want the script output", err)
+	}
+}
+
+func TestClusterSmokeNamesLaggingNodes(t *testing.T) {
+	report := `{"converged": false, "polls": 31, "elapsed_sec": 240.2, "peer_health": true, "nodes": [
+		{"name": "n1", "services_known": 10, "services_expected": 10, "services_behind": 0, "peers_reachable": 2, "peers_expected": 2},
+		{"name": "n3", "services_known": 7, "services_expected": 10, "services_behind": 3, "peers_reachable": 1, "peers_expected": 2}]}`
+	exec := &fakeExecutor{handle: func(Command) (Result, error) {
+		return Result{ExitCode: 1, Files: map[string]string{convergeReportFile: report}}, nil
+	}}
+	err := runClusterSmoke(context.Background(), exec, nil, nil, newPerfRecorder("abc"))
+	want := "not converged after 31 polls in 240s: n3: 7/10 services (3 behind), 1/2 peers reachable"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("err = %v, want %q", err, want)
+	}
+	if strings.Contains(err.Error(), "n1:") {
+		t.Errorf("converged node reported as lagging: %v", err)
+	}
+}
+
+func TestClusterSmokeShowsDivergentRecords(t *testing.T) {
+	report := `{"converged": false, "polls": 31, "elapsed_sec": 240.2, "nodes": [
+		{"name": "n2", "services_known": 9, "services_expected": 10, "services_behind": 1, "peers_reachable": -1, "peers_expected": 2}],
+		"divergence": [
+		{"service": "web-3", "values": {"n1": "present", "n2": "(missing)", "n3": "present"}},
+		{"service": "web-4", "field": "version", "values": {"n1": "2", "n2": "1", "n3": "2"}}]}`
+	exec := &fakeExecutor{handle: func(Command) (Result, error) {
+		return Result{ExitCode: 1, Files: map[string]string{convergeReportFile: report}}, nil
+	}}
+	err := runClusterSmoke(context.Background(), exec, nil, nil, newPerfRecorder("abc"))
+	for _, want := range []string{"web-3: present on n1,n3; (missing) on n2", "web-4.version: 2 on n1,n3; 1 on n2"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestSmokeBinaryBuild(t *testing.T) {
+	t.Setenv("MYCO_SMOKE_OPTIMIZE", "Debug")
+	exec := &fakeExecutor{}
+	if _, err := buildMycoBinary(context.Background(), exec); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.commands()[0]
+	if got := strings.Join(cmd.Args, " "); got != "zig build -Doptimize=Debug" {
+		t.Errorf("args = %q", got)
+	}
+	if got := cmd.Env["ZIG_GLOBAL_CACHE_DIR"]; got != "/src/zig-cache" {
+		t.Errorf("ZIG_GLOBAL_CACHE_DIR = %q", got)
+	}
+
+	exec = &fakeExecutor{handle: func(Command) (Result, error) {
+		return Result{ExitCode: 1, Stderr: "src/main.zig:3:1: error: expected ';'"}, nil
+	}}
+	if _, err := buildMycoBinary(context.Background(), exec); err == nil || !strings.Contains(err.Error(), "expected ';'") {
+		t.Errorf("err = %v, want the compile error", err)
+	}
+}
+
+func TestClusterSmokeMarksUncheckedPeerHealthPending(t *testing.T) {
+	for _, tc := range []struct {
+		report  string
+		pending bool
+	}{
+		{`{"converged": true, "peer_health": false}`, true},
+		{`{"converged": true, "peer_health": true}`, false},
+	} {
+		exec := &fakeExecutor{handle: func(Command) (Result, error) {
+			return Result{Files: map[string]string{convergeReportFile: tc.report}}, nil
+		}}
+		out := captureStdout(t, func() {
+			if err := runClusterSmoke(context.Background(), exec, nil, nil, newPerfRecorder("abc")); err != nil {
+				t.Error(err)
+			}
+		})
+		if got := strings.Contains(out, "pending: peer connectivity not checked"); got != tc.pending {
+			t.Errorf("report %s: pending reported %v, want %v:\n%s", tc.report, got, tc.pending, out)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// stageLogDir is the run-directory subdirectory --stage-logs writes to.
+const stageLogDir = "logs"
+
+// stageColors are the ANSI colors stage tags cycle through; red is left
+// for failures.
+var stageColors = []string{"36", "35", "34", "33", "32", "96", "95", "94", "93", "92"}
+
+// stageLogs is where stages' messages go while they run concurrently. Each
+// message is formatted whole and written in one go with every line tagged
+// "[Stage] ", so stages never split each other's lines. With files set,
+// each stage's messages, and the commands it ran with their output, are
+// also kept untagged in logs/<stage>.log in the run directory.
+type stageLogs struct {
+	// mu serializes writes to stdout and guards stages.
+	mu     sync.Mutex
+	color  bool
+	files  bool
+	run    runDir
+	stages map[string]*stageLog
+}
+
+func newStageLogs(run runDir, files bool) *stageLogs {
+	return &stageLogs{color: colorOutput(), files: files, run: run, stages: map[string]*stageLog{}}
+}
+
+// colorOutput says whether stdout takes ANSI colors: a terminal or a GitHub
+// Actions log, unless NO_COLOR is set.
+func colorOutput() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	if os.Getenv("GITHUB_ACTIONS") == "true" {
+		return true
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// stage returns the log of the stage called name, which keeps its color
+// from run to run.
+func (l *stageLogs) stage(name string) *stageLog {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.stages[name]; ok {
+		return s
+	}
+	tag := "[" + name + "] "
+	if l.color {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		tag = "\x1b[" + stageColors[h.Sum32()%uint32(len(stageColors))] + "m[" + name + "]\x1b[0m "
+	}
+	s := &stageLog{logs: l, tag: tag}
+	if l.files {
+		s.path = l.run.path(stageLogDir, stageSlug(name)+".log")
+	}
+	l.stages[name] = s
+	return s
+}
+
+// close closes the stages' log files.
+func (l *stageLogs) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.stages {
+		s.mu.Lock()
+		if s.file != nil {
+			s.file.Close()
+			s.file = nil
+		}
+		s.mu.Unlock()
+	}
+}
+
+// stageLog is one stage's part of stageLogs.
+type stageLog struct {
+	logs *stageLogs
+	tag  string
+	// path is the stage's log file, "" without --stage-logs. It is opened
+	// on the first write, so stages that log nothing leave no file.
+	path string
+
+	mu     sync.Mutex
+	file   *os.File
+	failed bool
+}
+
+// Printf logs one message, tagging each of its lines.
+func (l *stageLog) Printf(format string, args ...any) {
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+	var b bytes.Buffer
+	for _, line := range strings.Split(msg, "\n") {
+		b.WriteString(l.tag + line + "\n")
+	}
+	l.logs.mu.Lock()
+	os.Stdout.Write(b.Bytes())
+	l.logs.mu.Unlock()
+	l.record(msg + "\n")
+}
+
+// command keeps a command the stage ran, and what it printed, in the
+// stage's log file only: on stdout it would drown the stages' messages.
+func (l *stageLog) command(cmd Command, res Result, err error) {
+	if l.path == "" {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "$ %s\n", planCommand(Command{Args: cmd.Args, Env: cmd.Env}))
+	for _, out := range []string{res.Stdout, res.Stderr} {
+		if out = strings.TrimRight(out, "\n"); out != "" {
+			b.WriteString(out + "\n")
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(&b, "error: %v\n", err)
+	} else if res.ExitCode != 0 {
+		fmt.Fprintf(&b, "exit %d\n", res.ExitCode)
+	}
+	l.record(b.String())
+}
+
+// record appends text to the stage's log file. A file that cannot be
+// written is reported once, and the stage's messages still reach stdout.
+func (l *stageLog) record(text string) {
+	if l.path == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failed {
+		return
+	}
+	if l.file == nil {
+		err := os.MkdirAll(filepath.Dir(l.path), 0o755)
+		if err == nil {
+			l.file, err = os.Create(l.path)
+		}
+		if err != nil {
+			l.failed = true
+			l.warn(err)
+			return
+		}
+	}
+	if _, err := l.file.WriteString(text); err != nil {
+		l.failed = true
+		l.warn(err)
+	}
+}
+
+func (l *stageLog) warn(err error) {
+	l.logs.mu.Lock()
+	defer l.logs.mu.Unlock()
+	fmt.Printf("%swarning: stage log not written: %v\n", l.tag, err)
+}
+
+type stageLogKey struct{}
+
+// withStageLog makes log where logf writes for the stage running under ctx.
+func withStageLog(ctx context.Context, log *stageLog) context.Context {
+	return context.WithValue(ctx, stageLogKey{}, log)
+}
+
+// logf logs a message of the stage running under ctx, or prints it as is
+// outside of one.
+func logf(ctx context.Context, format string, args ...any) {
+	if log, ok := ctx.Value(stageLogKey{}).(*stageLog); ok {
+		log.Printf(format, args...)
+		return
+	}
+	fmt.Println(strings.TrimRight(fmt.Sprintf(format, args...), "\n"))
+}
+
+// logExec keeps a command a stage ran on a container of its own, outside
+// its Executor, in the stage's log file.
+func logExec(ctx context.Context, args []string, ran *dagger.Container, code int) {
+	log, ok := ctx.Value(stageLogKey{}).(*stageLog)
+	if !ok || log.path == "" {
+		return
+	}
+	res := Result{ExitCode: code}
+	var err error
+	if res.Stdout, err = ran.Stdout(ctx); err == nil {
+		res.Stderr, err = ran.Stderr(ctx)
+	}
+	log.command(Command{Args: args}, res, err)
+}
+
+// logExecutor keeps each command a stage runs in the stage's log file.
+type logExecutor struct {
+	inner Executor
+	log   *stageLog
+}
+
+func (e logExecutor) Exec(ctx context.Context, cmd Command) (Result, error) {
+	res, err := e.inner.Exec(ctx, cmd)
+	e.log.command(cmd, res, err)
+	return res, err
+}
@@ -0,0 +1,98 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// captureStdout returns what fn printed.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "stdout")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = f
+	fn()
+	os.Stdout = stdout
+	f.Close()
+	out, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestStageLogTagsWholeLines(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+	logs := newStageLogs(runDir{ID: "r1"}, false)
+	out := captureStdout(t, func() {
+		var wg sync.WaitGroup
+		for _, name := range []string{"Unit Tests", "Cluster Smoke"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx := withStageLog(context.Background(), logs.stage(name))
+				for range 50 {
+					logf(ctx, "first line\nsecond line")
+				}
+			}()
+		}
+		wg.Wait()
+	})
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 200 {
+		t.Fatalf("%d lines, want 200:\n%s", len(lines), out)
+	}
+	for i := 0; i < len(lines); i += 2 {
+		tag, _, _ := strings.Cut(lines[i], "] ")
+		if lines[i] != tag+"] first line" || lines[i+1] != tag+"] second line" {
+			t.Fatalf("message split or untagged at line %d: %q, %q", i, lines[i], lines[i+1])
+		}
+	}
+}
+
+func TestStageLogFiles(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+	t.Chdir(t.TempDir())
+	run := runDir{ID: "r1"}
+	logs := newStageLogs(run, true)
+	log := logs.stage("Cluster Smoke")
+	exec := logExecutor{inner: &fakeExecutor{handle: func(Command) (Result, error) {
+		return Result{ExitCode: 1, Stdout: "n1 converged\n", Stderr: "n2 lagging\n"}, nil
+	}}, log: log}
+	captureStdout(t, func() {
+		ctx := withStageLog(context.Background(), log)
+		logf(ctx, "running cluster smoke")
+		if _, err := exec.Exec(ctx, Command{Args: []string{"bash", "-c", "wait_converge"}}); err != nil {
+			t.Error(err)
+		}
+	})
+	logs.close()
+
+	got, err := os.ReadFile(run.path(stageLogDir, "cluster-smoke.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "running cluster smoke\n$ bash -c wait_converge\nn1 converged\nn2 lagging\nexit 1\n"
+	if string(got) != want {
+		t.Errorf("stage log = %q, want %q", got, want)
+	}
+}
+
+func TestStageLogColors(t *testing.T) {
+	logs := &stageLogs{color: true, stages: map[string]*stageLog{}}
+	tag := logs.stage("Unit Tests").tag
+	if !strings.HasPrefix(tag, "\x1b[") || !strings.HasSuffix(tag, "[Unit Tests]\x1b[0m ") {
+		t.Errorf("tag = %q, want a colored [Unit Tests]", tag)
+	}
+	if again := (&stageLogs{color: true, stages: map[string]*stageLog{}}).stage("Unit Tests").tag; again != tag {
+		t.Errorf("color changed between runs: %q, then %q", tag, again)
+	}
+}
@@ -0,0 +1,249 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"dagger.io/dagger"
+	"golang.org/x/crypto/blake2b"
+)
+
+// baseImage is the pinned Alpine release every stage starts from. edge moved
+// weekly underneath us, so builds were not reproducible.
+const baseImage = "alpine:3.22"
+
+// defaultZigVersion matches .minimum_zig_version in build.zig.zon.
+// MYCO_ZIG_VERSION overrides it.
+const defaultZigVersion = "0.15.2"
+
+// basePackages pins the build environment's apk packages. "~" matches the
+// given version prefix, so security revisions within the release still
+// install while version bumps require editing this list.
+var basePackages = []string{
+	"build-base~0.5",
+	"bash~5.2",
+	"wget~1.25",
+	"xz~5.8",
+	"curl~8.14",
+}
+
+// zigInstallDir is where the toolchain cache volume is mounted.
+const zigInstallDir = "/opt/zig-toolchain"
+
+// buildEnvironment returns the base container: the pinned Alpine image and
+// packages plus a signature-verified zig release. zig is unpacked into a
+// cache volume keyed by version and arch, so later runs skip the extraction.
+// With a bundle, the provisioned image and tarball come from it instead;
+// hc downloads the tarball when neither has it.
+func buildEnvironment(ctx context.Context, client *dagger.Client, hc *http.Client, run runDir, bundle *cacheBundle) (*dagger.Container, error) {
+	return zigEnvironment(ctx, client, hc, run, bundle, zigVersion())
+}
+
+// zigVersion is the toolchain the pipeline builds with: MYCO_ZIG_VERSION or
+// defaultZigVersion.
+func zigVersion() string {
+	if version := os.Getenv("MYCO_ZIG_VERSION"); version != "" {
+		return version
+	}
+	return defaultZigVersion
+}
+
+// zigEnvironment is buildEnvironment for a given zig version.
+func zigEnvironment(ctx context.Context, client *dagger.Client, hc *http.Client, run runDir, bundle *cacheBundle, version string) (*dagger.Container, error) {
+	platform, err := client.DefaultPlatform(ctx)
+	if err != nil {
+		return nil, err
+	}
+	arch, err := zigArch(platform)
+	if err != nil {
+		return nil, err
+	}
+	toolchainDir := filepath.Join("build", "toolchain")
+	if bundle != nil {
+		if err := bundle.check(arch, version); err != nil {
+			return nil, err
+		}
+		toolchainDir = bundle.toolchainDir()
+	}
+	tarball, err := fetchZigToolchain(ctx, hc, toolchainDir, version, arch)
+	if err != nil {
+		return nil, fmt.Errorf("zig toolchain verification failed: %w", err)
+	}
+
+	dir := fmt.Sprintf("%s/%s", zigInstallDir, version)
+	install := fmt.Sprintf(`set -e
+if [ ! -x %[1]s/zig ]; then
+  rm -rf %[1]s.tmp && mkdir -p %[1]s.tmp
+  tar -xJf /tmp/zig.tar.xz -C %[1]s.tmp --strip-components=1
+  mv %[1]s.tmp %[1]s
+fi
+ln -sf %[1]s/zig /usr/local/bin/zig
+zig version`, dir)
+	fmt.Printf("Toolchain: %s, zig %s (%s)\n", baseImage, version, arch)
+	var provisioned *dagger.Container
+	if bundle != nil {
+		fmt.Printf("Loading base image from %s\n", bundle.imagePath())
+		provisioned = client.Container().Import(client.Host().File(bundle.imagePath()))
+	} else {
+		provisioned = provisionedBase(client)
+	}
+	return provisioned.
+		WithMountedCache(zigInstallDir, client.CacheVolume(run.cacheKey("myco-zig-toolchain-"+arch))).
+		WithFile("/tmp/zig.tar.xz", client.Host().File(tarball)).
+		WithExec([]string{"sh", "-c", install}), nil
+}
+
+// provisionedBase is the pinned image with basePackages installed; it is
+// what a cache bundle stores as images/base.tar.
+func provisionedBase(client *dagger.Client) *dagger.Container {
+	return client.Container().
+		From(baseImage).
+		WithExec(append([]string{"apk", "add", "--no-cache"}, basePackages...))
+}
+
+// zigMinisignKey is the release signing key published on
+// https://ziglang.org/download/.
+const zigMinisignKey = "RWSGOq2NVecA2UPNdBUZykf1CCb147pkmdtYxgb3Ti+JO/wCYvhbAb/U"
+
+// zigDownloadBase serves official tarballs with a .minisig next to each.
+const zigDownloadBase = "https://ziglang.org/download"
+
+// zigTarballName follows the arch-os-version naming used since zig 0.14.1.
+func zigTarballName(arch, version string) string {
+	return fmt.Sprintf("zig-%s-linux-%s.tar.xz", arch, version)
+}
+
+// zigArch maps the engine platform to zig's architecture naming.
+func zigArch(platform dagger.Platform) (string, error) {
+	switch {
+	case strings.HasSuffix(string(platform), "/amd64"):
+		return "x86_64", nil
+	case strings.HasSuffix(string(platform), "/arm64"):
+		return "aarch64", nil
+	default:
+		return "", fmt.Errorf("no zig toolchain for platform %s", platform)
+	}
+}
+
+// fetchZigToolchain downloads the pinned zig tarball and its signature with
+// hc, verifies it against zigMinisignKey and stores both in dir. A previously
+// downloaded pair is reused but verified again; nothing is written unless
+// the signature checks out.
+func fetchZigToolchain(ctx context.Context, hc *http.Client, dir, version, arch string) (string, error) {
+	name := zigTarballName(arch, version)
+	path := filepath.Join(dir, name)
+	url := fmt.Sprintf("%s/%s/%s", zigDownloadBase, version, name)
+
+	tarball, errTarball := os.ReadFile(path)
+	sig, errSig := os.ReadFile(path + ".minisig")
+	cached := errTarball == nil && errSig == nil
+	if !cached {
+		var err error
+		if tarball, err = httpGet(ctx, hc, url); err != nil {
+			return "", err
+		}
+		if sig, err = httpGet(ctx, hc, url+".minisig"); err != nil {
+			return "", err
+		}
+	}
+	trusted, err := verifyZigTarball(zigMinisignKey, name, tarball, sig)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Verified %s (%s)\n", name, trusted)
+	if cached {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path+".minisig", sig, 0o644); err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, tarball, 0o644)
+}
+
+// verifyZigTarball checks the tarball called name against its signature and
+// returns the trusted comment. The signed comment names the file, so a
+// validly signed tarball of another version or arch cannot be substituted.
+func verifyZigTarball(publicKey, name string, tarball, sig []byte) (string, error) {
+	trusted, err := verifyMinisign(publicKey, tarball, sig)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	if !strings.Contains(trusted, "file:"+name) {
+		return "", fmt.Errorf("%s: signature is for a different file (%q)", name, trusted)
+	}
+	return trusted, nil
+}
+
+func httpGet(ctx context.Context, hc *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// verifyMinisign checks a minisign signature and returns its trusted comment.
+// Both the legacy ("Ed") and prehashed ("ED") signature algorithms are
+// accepted; any malformed input fails closed.
+func verifyMinisign(publicKey string, data, minisig []byte) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != 42 || string(key[:2]) != "Ed" {
+		return "", errors.New("malformed minisign public key")
+	}
+	keyID, pub := key[2:10], ed25519.PublicKey(key[10:])
+
+	lines := strings.Split(strings.TrimRight(string(minisig), "\n"), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return "", errors.New("malformed minisign signature file")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sig) != 74 {
+		return "", errors.New("malformed minisign signature")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return "", errors.New("malformed minisign global signature")
+	}
+	if !bytes.Equal(sig[2:10], keyID) {
+		return "", errors.New("signed with an unexpected key")
+	}
+
+	message := data
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	default:
+		return "", fmt.Errorf("unsupported signature algorithm %q", sig[:2])
+	}
+	if !ed25519.Verify(pub, message, sig[10:]) {
+		return "", errors.New("signature mismatch")
+	}
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if !ed25519.Verify(pub, append(append([]byte(nil), sig[10:]...), trusted...), globalSig) {
+		return "", errors.New("trusted comment signature mismatch")
+	}
+	return trusted, nil
+}
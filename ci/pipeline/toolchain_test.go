@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignFixture is a signing key built from a fixed seed, standing in for
+// the zig release key.
+type minisignFixture struct {
+	id   [8]byte
+	priv ed25519.PrivateKey
+}
+
+func newMinisignFixture(seed byte, id string) minisignFixture {
+	f := minisignFixture{priv: ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))}
+	copy(f.id[:], id)
+	return f
+}
+
+// publicKey is the key as minisign prints it: "Ed", the key ID, the key.
+func (f minisignFixture) publicKey() string {
+	key := append([]byte("Ed"), f.id[:]...)
+	return base64.StdEncoding.EncodeToString(append(key, f.priv.Public().(ed25519.PublicKey)...))
+}
+
+// sign writes a .minisig for data with algorithm "Ed" (legacy) or "ED"
+// (prehashed).
+func (f minisignFixture) sign(alg string, data []byte, trusted string) []byte {
+	message := data
+	if alg == "ED" {
+		sum := blake2b.Sum512(data)
+		message = sum[:]
+	}
+	sig := ed25519.Sign(f.priv, message)
+	global := ed25519.Sign(f.priv, append(append([]byte(nil), sig...), trusted...))
+	blob := append(append([]byte(alg), f.id[:]...), sig...)
+	return fmt.Appendf(nil, "untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(blob), trusted, base64.StdEncoding.EncodeToString(global))
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	key := newMinisignFixture(1, "zigkey01")
+	other := newMinisignFixture(2, "otherkey")
+	tarball := []byte("zig-x86_64-linux-0.15.2.tar.xz contents")
+	trusted := "timestamp:1760000000\tfile:zig-x86_64-linux-0.15.2.tar.xz\thashed"
+	good := key.sign("ED", tarball, trusted)
+	goodLines := strings.Split(string(good), "\n")
+
+	tests := []struct {
+		name    string
+		pub     string
+		data    []byte
+		minisig []byte
+		wantErr string
+	}{
+		{"prehashed", key.publicKey(), tarball, good, ""},
+		{"legacy", key.publicKey(), tarball, key.sign("Ed", tarball, trusted), ""},
+		{"tampered payload", key.publicKey(), append([]byte("x"), tarball...), good, "signature mismatch"},
+		{"signed by another key", key.publicKey(), tarball, other.sign("ED", tarball, trusted), "signed with an unexpected key"},
+		{"another key with the same id", key.publicKey(), tarball,
+			newMinisignFixture(2, "zigkey01").sign("ED", tarball, trusted), "signature mismatch"},
+		{"tampered trusted comment", key.publicKey(), tarball,
+			[]byte(strings.Replace(string(good), "file:zig-x86_64", "file:zig-aarch64", 1)), "trusted comment signature mismatch"},
+		{"unknown algorithm", key.publicKey(), tarball, key.sign("EX", tarball, trusted), `unsupported signature algorithm "EX"`},
+		{"missing global signature", key.publicKey(), tarball,
+			[]byte(strings.Join(goodLines[:3], "\n")), "malformed minisign signature file"},
+		{"no trusted comment", key.publicKey(), tarball,
+			[]byte(strings.Join([]string{goodLines[0], goodLines[1], "comment", goodLines[3]}, "\n")), "malformed minisign signature file"},
+		{"signature not base64", key.publicKey(), tarball,
+			[]byte(strings.Join([]string{goodLines[0], "!!!", goodLines[2], goodLines[3]}, "\n")), "malformed minisign signature"},
+		{"signature truncated", key.publicKey(), tarball,
+			[]byte(strings.Join([]string{goodLines[0], goodLines[1][:40], goodLines[2], goodLines[3]}, "\n")), "malformed minisign signature"},
+		{"global signature truncated", key.publicKey(), tarball,
+			[]byte(strings.Join([]string{goodLines[0], goodLines[1], goodLines[2], goodLines[3][:40]}, "\n")), "malformed minisign global signature"},
+		{"empty signature file", key.publicKey(), tarball, nil, "malformed minisign signature file"},
+		{"malformed public key", key.publicKey()[:20], tarball, good, "malformed minisign public key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyMinisign(tt.pub, tt.data, tt.minisig)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyMinisign: %v", err)
+				}
+				if got != trusted {
+					t.Errorf("trusted comment = %q, want %q", got, trusted)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyZigTarballChecksTheSignedFileName(t *testing.T) {
+	key := newMinisignFixture(1, "zigkey01")
+	tarball := []byte("zig tarball")
+	name := zigTarballName("x86_64", "0.15.2")
+	tests := []struct {
+		name    string
+		trusted string
+		wantErr string
+	}{
+		{"names the tarball", "timestamp:1760000000\tfile:" + name + "\thashed", ""},
+		{"another arch", "timestamp:1760000000\tfile:" + zigTarballName("aarch64", "0.15.2") + "\thashed",
+			"signature is for a different file"},
+		{"another version", "timestamp:1760000000\tfile:" + zigTarballName("x86_64", "0.15.1") + "\thashed",
+			"signature is for a different file"},
+		{"no file name", "timestamp:1760000000", "signature is for a different file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := verifyZigTarball(key.publicKey(), name, tarball, key.sign("ED", tarball, tt.trusted))
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("verifyZigTarball: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
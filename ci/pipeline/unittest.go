@@ -0,0 +1,132 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unitTestFile is one zig test root. Plain roots aggregate file-level tests
+// with module path = /src; module roots import the myco module.
+type unitTestFile struct {
+	Root   string
+	Module bool
+}
+
+// unitTestFiles are the zig test roots shared by the Unit Tests and Coverage
+// stages.
+var unitTestFiles = []unitTestFile{
+	{Root: "src/plain_tests.zig"},
+	{Root: "tests/sync_crdt.zig", Module: true},
+	{Root: "tests/bench_packet_crypto.zig", Module: true},
+	{Root: "tests/cli.zig", Module: true},
+	{Root: "tests/engine.zig", Module: true},
+}
+
+// unitTestResources is the Unit Tests stage reservation. Its CPUs also bound
+// how many test files compile and run at once.
+var unitTestResources = Resources{CPUs: 4, MemoryMB: 3072}
+
+// zigTestArgs is the zig test command line for t, followed by extra flags.
+func (t unitTestFile) zigTestArgs(extra ...string) []string {
+	args := append([]string{"zig", "test", "-lc"}, extra...)
+	if t.Module {
+		return append(args, "--dep", "build_options", "--dep", "myco", "-Mroot="+t.Root,
+			"-Mbuild_options=src/build_options.zig", "--dep", "build_options", "-Mmyco=src/lib.zig")
+	}
+	return append(args, "--dep", "build_options", "-Mroot="+t.Root, "-Mbuild_options=src/build_options.zig")
+}
+
+// unitTestResult is the outcome of one test file.
+type unitTestResult struct {
+	Root     string
+	Duration time.Duration
+	Err      error
+}
+
+// unitTestTimeout bounds the compile check and each test file's exec, when
+// the stage's timeout is longer, so one hung file cannot use it all up.
+const unitTestTimeout = 300 * time.Second
+
+// runUnitTests runs each test file as its own exec, at most
+// unitTestResources.CPUs at a time, and records every file as a
+// "Unit Tests: <root>" stage so the perf report and stage history see them
+// individually. A compile check over all files runs first, so a compile
+// error fails once instead of in every file. It fails if any file fails.
+func runUnitTests(ctx context.Context, exec Executor, perf *perfRecorder) error {
+	start := time.Now()
+	err := compileCheckUnitTests(ctx, exec)
+	perf.stage("Unit Tests: compile check", time.Since(start), err)
+	if err != nil {
+		return err
+	}
+
+	results := make([]unitTestResult, len(unitTestFiles))
+	slots := make(chan struct{}, max(int(unitTestResources.CPUs), 1))
+	var wg sync.WaitGroup
+	for i, t := range unitTestFiles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			start := time.Now()
+			res, err := exec.Exec(capCommandTimeout(ctx, unitTestTimeout), Command{Args: t.zigTestArgs(), Env: zigCacheEnv})
+			if err == nil {
+				err = res.check("zig test")
+			}
+			results[i] = unitTestResult{Root: t.Root, Duration: time.Since(start), Err: err}
+			perf.stage("Unit Tests: "+t.Root, results[i].Duration, err)
+		}()
+	}
+	wg.Wait()
+
+	logf(ctx, "%s", renderUnitTestResults(results))
+	var failed []error
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, fmt.Errorf("%s: %w", r.Root, r.Err))
+		}
+	}
+	if len(failed) > 0 {
+		return &StageError{Err: fmt.Errorf("%d of %d test files failed:\n%w", len(failed), len(results), errors.Join(failed...))}
+	}
+	return nil
+}
+
+// compileCheckUnitTests type-checks every test file without code generation
+// (-fno-emit-bin), which takes seconds, and stops at the first file that
+// does not compile. Each file is its own exec, so the runner needs no shell.
+func compileCheckUnitTests(ctx context.Context, exec Executor) error {
+	for _, t := range unitTestFiles {
+		res, err := exec.Exec(capCommandTimeout(ctx, unitTestTimeout), Command{Args: t.zigTestArgs("-fno-emit-bin"), Env: zigCacheEnv})
+		if err != nil {
+			return err
+		}
+		if res.ExitCode != 0 {
+			return &StageError{Command: "compile check", ExitCode: res.ExitCode, Err: fmt.Errorf("test files do not compile: %s", t.Root), Output: strings.TrimSpace(res.Stderr)}
+		}
+	}
+	return nil
+}
+
+// renderUnitTestResults is a per-file table, slowest first.
+func renderUnitTestResults(results []unitTestResult) string {
+	sorted := append([]unitTestResult(nil), results...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Duration > sorted[j].Duration })
+	var b strings.Builder
+	b.WriteString("[Unit Tests] results:\n")
+	for _, r := range sorted {
+		state := "pass"
+		if r.Err != nil {
+			state = "FAIL"
+		}
+		fmt.Fprintf(&b, "  %-4s %7.1fs  %s\n", state, r.Duration.Seconds(), r.Root)
+	}
+	return b.String()
+}
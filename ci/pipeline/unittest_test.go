@@ -0,0 +1,76 @@
+package pipeline
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// isCompileCheck tells the compile-check exec apart from per-file test runs.
+func isCompileCheck(cmd Command) bool {
+	return strings.Contains(strings.Join(cmd.Args, " "), "-fno-emit-bin")
+}
+
+func TestUnitTestsStopAtCompileErrors(t *testing.T) {
+	exec := &fakeExecutor{handle: func(cmd Command) (Result, error) {
+		return Result{ExitCode: 1, Stderr: "src/lib.zig:1:1: error: expected type"}, nil
+	}}
+	err := runUnitTests(context.Background(), exec, newPerfRecorder("abc"))
+	if err == nil || !strings.Contains(err.Error(), "do not compile") {
+		t.Fatalf("err = %v, want a compile error", err)
+	}
+	if n := len(exec.commands()); n != 1 {
+		t.Fatalf("got %d execs, want only the compile check", n)
+	}
+}
+
+func TestUnitTestsNameTheFileThatDoesNotCompile(t *testing.T) {
+	broken := unitTestFiles[1].Root
+	exec := &fakeExecutor{handle: func(cmd Command) (Result, error) {
+		if strings.Contains(strings.Join(cmd.Args, " "), "-Mroot="+broken) {
+			return Result{ExitCode: 1, Stderr: broken + ":3:1: error: expected type"}, nil
+		}
+		return Result{}, nil
+	}}
+	err := runUnitTests(context.Background(), exec, newPerfRecorder("abc"))
+	if err == nil || !strings.Contains(err.Error(), "do not compile: "+broken) {
+		t.Fatalf("err = %v, want %s named", err, broken)
+	}
+	if n := len(exec.commands()); n != 2 {
+		t.Fatalf("got %d execs, want the compile check to stop at %s", n, broken)
+	}
+}
+
+func TestUnitTestsRunEveryFileAndReportFailures(t *testing.T) {
+	failing := unitTestFiles[len(unitTestFiles)-1].Root
+	exec := &fakeExecutor{handle: func(cmd Command) (Result, error) {
+		if !isCompileCheck(cmd) && strings.Contains(strings.Join(cmd.Args, " "), "-Mroot="+failing) {
+			return Result{ExitCode: 1, Stderr: "1 failed"}, nil
+		}
+		return Result{}, nil
+	}}
+	perf := newPerfRecorder("abc")
+	err := runUnitTests(context.Background(), exec, perf)
+	if err == nil || !strings.Contains(err.Error(), failing) || !strings.Contains(err.Error(), "1 of ") {
+		t.Fatalf("err = %v, want %s reported as the only failure", err, failing)
+	}
+	if n := len(exec.commands()); n != 2*len(unitTestFiles) {
+		t.Fatalf("got %d execs, want a compile check and a run per file", n)
+	}
+	for _, cmd := range exec.commands() {
+		if cmd.Args[0] != "zig" {
+			t.Errorf("exec %v goes through %s, want zig itself", cmd.Args, cmd.Args[0])
+		}
+	}
+
+	outcomes := map[string]string{}
+	for _, o := range perf.stageOutcomes() {
+		outcomes[o.Stage] = o.Outcome
+	}
+	if got := outcomes["Unit Tests: "+failing]; got != outcomeFailed {
+		t.Errorf("outcome for %s = %q, want failed", failing, got)
+	}
+	if got := outcomes["Unit Tests: "+unitTestFiles[0].Root]; got != outcomePassed {
+		t.Errorf("outcome for %s = %q, want passed", unitTestFiles[0].Root, got)
+	}
+}
@@ -0,0 +1,270 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadTimeout bounds mirroring a run's artifacts. It has its own deadline
+// because a run that hit the pipeline's is the one whose logs matter most.
+const uploadTimeout = 10 * time.Minute
+
+// artifactStore is durable storage the run directory is mirrored to.
+type artifactStore interface {
+	// Upload copies the local file at path to key and returns a URL for it.
+	Upload(ctx context.Context, path, key string) (string, error)
+	// Presign returns a URL for key that works without credentials until
+	// ttl has passed.
+	Presign(ctx context.Context, key string, ttl time.Duration) (string, error)
+	// String names the store in messages.
+	String() string
+}
+
+// parseArtifactStore reads a store location: s3://BUCKET/PREFIX,
+// gs://BUCKET/PREFIX, or a local directory as file:///DIR or a plain path.
+func parseArtifactStore(location string) (artifactStore, error) {
+	if !strings.Contains(location, "://") {
+		return localStore{Dir: location}, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("artifact store %q: %w", location, err)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "file":
+		return localStore{Dir: u.Path}, nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("artifact store %q: no bucket", location)
+		}
+		return s3Store{Bucket: u.Host, Prefix: prefix, Endpoint: os.Getenv("AWS_ENDPOINT_URL")}, nil
+	case "gs":
+		if u.Host == "" {
+			return nil, fmt.Errorf("artifact store %q: no bucket", location)
+		}
+		return gcsStore{Bucket: u.Host, Prefix: prefix}, nil
+	}
+	return nil, fmt.Errorf("artifact store %q: want s3://, gs://, file:// or a directory", location)
+}
+
+// localStore copies artifacts into a directory, e.g. a mounted NFS share.
+type localStore struct {
+	Dir string
+}
+
+func (s localStore) String() string { return s.Dir }
+
+func (s localStore) Upload(_ context.Context, from, key string) (string, error) {
+	to := filepath.Join(s.Dir, filepath.FromSlash(key))
+	if err := copyFile(from, to); err != nil {
+		return "", err
+	}
+	return s.url(key)
+}
+
+// Presign returns the file URL: a directory has no credentials to lend.
+func (s localStore) Presign(_ context.Context, key string, _ time.Duration) (string, error) {
+	return s.url(key)
+}
+
+func (s localStore) url(key string) (string, error) {
+	abs, err := filepath.Abs(filepath.Join(s.Dir, filepath.FromSlash(key)))
+	if err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String(), nil
+}
+
+// s3Store uploads with the aws CLI, which takes credentials from the usual
+// AWS_* variables. Endpoint, from AWS_ENDPOINT_URL, selects an S3-compatible
+// service such as MinIO.
+type s3Store struct {
+	Bucket, Prefix, Endpoint string
+}
+
+func (s s3Store) String() string { return "s3://" + path.Join(s.Bucket, s.Prefix) }
+
+func (s s3Store) command(from, key string) []string {
+	return []string{"aws", "s3", "cp", "--only-show-errors", from, "s3://" + path.Join(s.Bucket, s.Prefix, key)}
+}
+
+func (s s3Store) url(key string) string {
+	if s.Endpoint != "" {
+		return strings.TrimSuffix(s.Endpoint, "/") + "/" + path.Join(s.Bucket, s.Prefix, key)
+	}
+	return "https://" + s.Bucket + ".s3.amazonaws.com/" + path.Join(s.Prefix, key)
+}
+
+func (s s3Store) Upload(ctx context.Context, from, key string) (string, error) {
+	if _, err := runStoreCommand(ctx, s.command(from, key)); err != nil {
+		return "", err
+	}
+	return s.url(key), nil
+}
+
+func (s s3Store) presignCommand(key string, ttl time.Duration) []string {
+	return []string{"aws", "s3", "presign", "s3://" + path.Join(s.Bucket, s.Prefix, key), "--expires-in", strconv.Itoa(int(ttl.Seconds()))}
+}
+
+func (s s3Store) Presign(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return runStoreCommand(ctx, s.presignCommand(key, ttl))
+}
+
+// gcsStore uploads with the gcloud CLI and its active credentials.
+type gcsStore struct {
+	Bucket, Prefix string
+}
+
+func (s gcsStore) String() string { return "gs://" + path.Join(s.Bucket, s.Prefix) }
+
+func (s gcsStore) command(from, key string) []string {
+	return []string{"gcloud", "storage", "cp", "--no-user-output-enabled", from, "gs://" + path.Join(s.Bucket, s.Prefix, key)}
+}
+
+func (s gcsStore) url(key string) string {
+	return "https://storage.googleapis.com/" + path.Join(s.Bucket, s.Prefix, key)
+}
+
+func (s gcsStore) Upload(ctx context.Context, from, key string) (string, error) {
+	if _, err := runStoreCommand(ctx, s.command(from, key)); err != nil {
+		return "", err
+	}
+	return s.url(key), nil
+}
+
+// presignCommand signs with the active credentials, which must be a service
+// account: gcloud cannot sign URLs as a user.
+func (s gcsStore) presignCommand(key string, ttl time.Duration) []string {
+	return []string{"gcloud", "storage", "sign-url", "gs://" + path.Join(s.Bucket, s.Prefix, key), "--duration=" + strconv.Itoa(int(ttl.Seconds())) + "s", "--format=value(signed_url)"}
+}
+
+func (s gcsStore) Presign(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return runStoreCommand(ctx, s.presignCommand(key, ttl))
+}
+
+// runStoreCommand runs a storage CLI and returns its trimmed stdout.
+func runStoreCommand(ctx context.Context, args []string) (string, error) {
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if err != nil {
+		var stderr []byte
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = exitErr.Stderr
+		}
+		return "", fmt.Errorf("%s: %w\n%s", strings.Join(args, " "), err, stderr)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// uploadedArtifact is one mirrored file of the run directory.
+type uploadedArtifact struct {
+	Name string
+	Size int64
+	URL  string
+}
+
+// mirrorRun uploads every file in run's directory to store under
+// <run ID>/<path in the run directory>. It keeps going past failed uploads
+// and reports them together.
+func mirrorRun(ctx context.Context, store artifactStore, run runDir) ([]uploadedArtifact, error) {
+	dir := run.path()
+	var names []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	var uploaded []uploadedArtifact
+	var failed []string
+	for _, name := range names {
+		local := filepath.Join(dir, filepath.FromSlash(name))
+		info, err := os.Stat(local)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		link, err := store.Upload(ctx, local, path.Join(run.ID, name))
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		uploaded = append(uploaded, uploadedArtifact{Name: name, Size: info.Size(), URL: link})
+	}
+	if len(failed) > 0 {
+		return uploaded, fmt.Errorf("%d of %d artifacts not uploaded to %s: %s", len(failed), len(names), store, strings.Join(failed, "; "))
+	}
+	return uploaded, nil
+}
+
+// uploadSummary is the step summary section listing the mirrored artifacts.
+func uploadSummary(run runDir, store artifactStore, uploaded []uploadedArtifact) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "## Artifacts\n\nRun %s mirrored to `%s`.\n\n| artifact | size |\n| --- | --- |\n", run.ID, store)
+	for _, a := range uploaded {
+		fmt.Fprintf(&b, "| [%s](%s) | %s |\n", a.Name, a.URL, formatBytes(a.Size))
+	}
+	return b.String()
+}
+
+// uploadArtifacts mirrors run's directory to the configured store and
+// links every artifact from the step summary. When runErr says stages
+// failed, their logs and debug bundles get expiring links in the failure
+// notification. Upload problems are warnings: the run's own result stands
+// either way.
+func (p *Pipeline) uploadArtifacts(run runDir, runErr error) {
+	if p.Options.ArtifactStore == "" {
+		return
+	}
+	store, err := parseArtifactStore(p.Options.ArtifactStore)
+	if err != nil {
+		fmt.Printf("warning: artifacts not uploaded: %v\n", err)
+		return
+	}
+	if _, local := store.(localStore); p.Options.Offline && !local {
+		fmt.Printf("Offline mode: not uploading artifacts to %s\n", store)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancel()
+	failed := failedStages(runErr)
+	for i := range failed {
+		if err := failed[i].write(run); err != nil {
+			fmt.Printf("warning: %s failure files incomplete: %v\n", failed[i].Stage, err)
+		}
+	}
+	fmt.Printf("Uploading artifacts to %s...\n", store)
+	uploaded, err := mirrorRun(ctx, store, run)
+	if err != nil {
+		fmt.Printf("warning: %v\n", err)
+	}
+	if len(uploaded) == 0 {
+		return
+	}
+	fmt.Printf("Uploaded %d artifacts to %s\n", len(uploaded), store)
+	if err := appendStepSummary(uploadSummary(run, store, uploaded)); err != nil {
+		fmt.Printf("warning: job summary not updated: %v\n", err)
+	}
+	if len(failed) > 0 {
+		notifyFailure(ctx, p.Options.httpClient(), run, store, failed, p.Options.ArtifactLinkTTL, uploaded)
+	}
+}
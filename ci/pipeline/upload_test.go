@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseArtifactStore(t *testing.T) {
+	t.Setenv("AWS_ENDPOINT_URL", "")
+	tests := []struct {
+		location string
+		want     artifactStore
+	}{
+		{"build/mirror", localStore{Dir: "build/mirror"}},
+		{"file:///srv/ci", localStore{Dir: "/srv/ci"}},
+		{"s3://myco-ci/runs/", s3Store{Bucket: "myco-ci", Prefix: "runs"}},
+		{"gs://myco-ci", gcsStore{Bucket: "myco-ci"}},
+	}
+	for _, tt := range tests {
+		got, err := parseArtifactStore(tt.location)
+		if err != nil || got != tt.want {
+			t.Errorf("parseArtifactStore(%q) = %#v, %v; want %#v", tt.location, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"ftp://host/dir", "s3:///runs"} {
+		if _, err := parseArtifactStore(bad); err == nil {
+			t.Errorf("parseArtifactStore(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestCloudStoreCommandsAndURLs(t *testing.T) {
+	s3 := s3Store{Bucket: "myco-ci", Prefix: "runs"}
+	if got := strings.Join(s3.command("build/runs/r1/ci.log", "r1/ci.log"), " "); got != "aws s3 cp --only-show-errors build/runs/r1/ci.log s3://myco-ci/runs/r1/ci.log" {
+		t.Errorf("s3 command = %q", got)
+	}
+	if got := s3.url("r1/ci.log"); got != "https://myco-ci.s3.amazonaws.com/runs/r1/ci.log" {
+		t.Errorf("s3 url = %q", got)
+	}
+	s3.Endpoint = "http://minio:9000/"
+	if got := s3.url("r1/ci.log"); got != "http://minio:9000/myco-ci/runs/r1/ci.log" {
+		t.Errorf("s3 endpoint url = %q", got)
+	}
+	gcs := gcsStore{Bucket: "myco-ci"}
+	if got := gcs.command("a.pcap", "r1/a.pcap"); got[len(got)-1] != "gs://myco-ci/r1/a.pcap" {
+		t.Errorf("gcs command = %q", got)
+	}
+	if got := gcs.url("r1/a.pcap"); got != "https://storage.googleapis.com/myco-ci/r1/a.pcap" {
+		t.Errorf("gcs url = %q", got)
+	}
+}
+
+func TestMirrorRunToLocalStore(t *testing.T) {
+	t.Chdir(t.TempDir())
+	run := runDir{ID: "r1"}
+	for name, contents := range map[string]string{
+		"manifest.json":             "{}",
+		"bin/myco-0.1.0-x86_64":     "ELF",
+		"smoke/node-1/capture.pcap": "pcap",
+	} {
+		path := run.path(filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := localStore{Dir: t.TempDir()}
+	uploaded, err := mirrorRun(context.Background(), store, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploaded) != 3 || uploaded[0].Name != "bin/myco-0.1.0-x86_64" {
+		t.Fatalf("uploaded %+v", uploaded)
+	}
+	for _, a := range uploaded {
+		if !strings.HasPrefix(a.URL, "file:///") || !strings.Contains(a.URL, run.ID+"/"+a.Name) {
+			t.Errorf("%s: url %q", a.Name, a.URL)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(store.Dir, run.ID, "smoke", "node-1", "capture.pcap"))
+	if err != nil || string(data) != "pcap" {
+		t.Errorf("mirrored pcap = %q, %v", data, err)
+	}
+	summary := uploadSummary(run, store, uploaded)
+	if !strings.Contains(summary, "| [manifest.json](file://") || !strings.Contains(summary, "| 3B |") {
+		t.Errorf("summary:\n%s", summary)
+	}
+}
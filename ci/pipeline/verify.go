@@ -0,0 +1,125 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// verifyRelease downloads every asset of the GitHub release tag back over
+// HTTPS and checks it against want: each artifact must be attached with the
+// recorded size and SHA-256, and the binary for this machine must run. A nil
+// want checks the assets against the manifest attached to the release.
+//
+// Releases are not signed yet, so the manifest checksums are all there is to
+// verify; truncated or swapped uploads still fail here rather than for users.
+func verifyRelease(tag string, want artifactManifest) error {
+	dir, err := os.MkdirTemp("", "myco-release-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if _, err := gh("release", "download", tag, "--dir", dir); err != nil {
+		return &InfraError{Stage: "Release Verification", Op: "download " + tag, Err: err}
+	}
+
+	attached, err := readArtifactManifest(filepath.Join(dir, artifactManifestName))
+	if err != nil {
+		return &ArtifactError{Path: tag + "/" + artifactManifestName, Err: err}
+	}
+	if want == nil {
+		want = attached
+	}
+	problems := compareManifests(want, attached)
+	var names []string
+	for name := range want {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		expected := want[name]
+		got, err := describeArtifact(filepath.Join(dir, name), expected.Target, expected.Commit)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		case got.Size != expected.Size:
+			problems = append(problems, fmt.Sprintf("%s: %d bytes downloaded, %d built", name, got.Size, expected.Size))
+		case got.SHA256 != expected.SHA256:
+			problems = append(problems, fmt.Sprintf("%s: sha256 %s, built %s", name, got.SHA256, expected.SHA256))
+		default:
+			fmt.Printf("[Release Verification] %s: %d bytes, sha256 ok\n", name, got.Size)
+		}
+	}
+	if len(problems) > 0 {
+		return &ArtifactError{Path: tag, Err: fmt.Errorf("%s", strings.Join(problems, "; "))}
+	}
+
+	for _, name := range names {
+		if want[name].Target != nativeTarget() {
+			continue
+		}
+		if err := runVersion(filepath.Join(dir, name), releaseVersionOf(name, want[name].Target)); err != nil {
+			return &ArtifactError{Path: tag + "/" + name, Err: err}
+		}
+	}
+	return nil
+}
+
+// compareManifests reports differences between the manifest the build wrote
+// and the one attached to the release.
+func compareManifests(want, attached artifactManifest) []string {
+	var problems []string
+	for name, a := range want {
+		if b, ok := attached[name]; !ok {
+			problems = append(problems, name+": missing from the attached manifest")
+		} else if a != b {
+			problems = append(problems, name+": attached manifest entry differs from the build")
+		}
+	}
+	for name := range attached {
+		if _, ok := want[name]; !ok {
+			problems = append(problems, name+": attached but not built by this run")
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// nativeTarget is the zig target of binaries this machine can run.
+func nativeTarget() string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	target, _ := platformToZigTarget(dagger.Platform("linux/" + runtime.GOARCH))
+	return target
+}
+
+// releaseVersionOf recovers the release version from an artifact name.
+func releaseVersionOf(name, target string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(name, "myco-"), "-"+target)
+}
+
+// runVersion runs "BIN --version", which must succeed. The CLI has no
+// version command yet, so output without the version is reported but not
+// fatal.
+func runVersion(bin, version string) error {
+	if err := os.Chmod(bin, 0o755); err != nil {
+		return err
+	}
+	out, err := exec.Command(bin, "--version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s --version: %w\n%s", filepath.Base(bin), err, out)
+	}
+	if strings.Contains(string(out), version) {
+		fmt.Printf("[Release Verification] %s --version reports %s\n", filepath.Base(bin), version)
+	} else {
+		fmt.Printf("[Release Verification] %s --version ran but does not report %s\n", filepath.Base(bin), version)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareManifests(t *testing.T) {
+	bin := artifact{Name: "myco-0.4.0-x86_64-linux-musl", Target: "x86_64-linux-musl", Size: 10, SHA256: "aa", Commit: "abc"}
+	arm := artifact{Name: "myco-0.4.0-aarch64-linux-musl", Target: "aarch64-linux-musl", Size: 12, SHA256: "bb", Commit: "abc"}
+	swapped := bin
+	swapped.SHA256 = "cc"
+
+	want := artifactManifest{bin.Name: bin, arm.Name: arm}
+	if got := compareManifests(want, artifactManifest{bin.Name: bin, arm.Name: arm}); got != nil {
+		t.Errorf("identical manifests: %v", got)
+	}
+	got := compareManifests(want, artifactManifest{bin.Name: swapped, "extra": {Name: "extra"}})
+	expected := []string{
+		"extra: attached but not built by this run",
+		arm.Name + ": missing from the attached manifest",
+		bin.Name + ": attached manifest entry differs from the build",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("compareManifests = %q, want %q", got, expected)
+	}
+}
+
+func TestReleaseVersionOf(t *testing.T) {
+	for _, tc := range []struct{ name, target, want string }{
+		{"myco-0.4.0-x86_64-linux-musl", "x86_64-linux-musl", "0.4.0"},
+		{"myco-0.4.0-edge.abc1234-aarch64-linux-musl", "aarch64-linux-musl", "0.4.0-edge.abc1234"},
+	} {
+		if got := releaseVersionOf(tc.name, tc.target); got != tc.want {
+			t.Errorf("releaseVersionOf(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Command myco-wait-converge waits for the cluster smoke's nodes to
+// converge, polling 'myco status' with backoff until a deadline. On timeout
+// it names the nodes that lag, diffs the service records each node has
+// persisted to show where they disagree, and writes the last poll and the
+// diff as JSON for the pipeline to report.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"orchestrator-ci/ci/converge"
+)
+
+func main() {
+	fs := flag.NewFlagSet("myco-wait-converge", flag.ExitOnError)
+	bin := fs.String("bin", "myco", "myco binary to run status with")
+	state := fs.String("state", "", "directory holding one state dir per node")
+	services := fs.Int("services", 0, "services every node must know")
+	deadline := fs.Duration("deadline", 240*time.Second, "give up after this long")
+	statusTimeout := fs.Duration("status-timeout", 5*time.Second, "bound on each status call")
+	report := fs.String("report", "", "file the last poll is written to as JSON")
+	peerHealth := fs.Bool("peer-health", true, "require every node's status to report per-peer health")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: myco-wait-converge -state DIR -services N [flags] NAME[=PID]...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	if *state == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	nodes, err := parseNodes(*state, fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "myco-wait-converge: %v\n", err)
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *deadline)
+	defer cancel()
+	w := converge.Waiter{
+		Bin:               *bin,
+		Nodes:             nodes,
+		Services:          *services,
+		RequirePeerHealth: *peerHealth,
+		StatusTimeout:     *statusTimeout,
+		MinInterval:       250 * time.Millisecond,
+		MaxInterval:       5 * time.Second,
+		Log:               os.Stdout,
+	}
+	result, waitErr := w.Wait(ctx)
+	if waitErr != nil {
+		result.Divergence = diffState(nodes)
+	}
+	if *report != "" {
+		if err := writeReport(*report, result); err != nil {
+			fmt.Fprintf(os.Stderr, "myco-wait-converge: %v\n", err)
+		}
+	}
+	if waitErr != nil {
+		fmt.Printf("[FAIL] %v\n", waitErr)
+		for _, n := range result.Lagging() {
+			fmt.Printf("  %s\n", n)
+		}
+		if len(result.Divergence) > 0 {
+			fmt.Println("Service records and peers that differ between nodes:")
+			for _, d := range result.Divergence {
+				fmt.Printf("  %s\n", d)
+			}
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("Converged after %d polls in %.1fs.\n", result.Polls, result.Seconds)
+	if result.PeerHealth {
+		fmt.Printf("Every node reports %d reachable peers.\n", len(nodes)-1)
+	} else {
+		fmt.Println("Pending: status does not report per-peer health; peer connectivity not checked.")
+	}
+}
+
+// parseNodes reads NAME[=PID] arguments; each node's state dir is
+// STATE/NAME with its socket at myco.sock.
+func parseNodes(state string, args []string) ([]converge.Node, error) {
+	var nodes []converge.Node
+	for _, arg := range args {
+		name, pid, hasPID := strings.Cut(arg, "=")
+		if name == "" {
+			return nil, fmt.Errorf("node %q has no name", arg)
+		}
+		dir := filepath.Join(state, name)
+		n := converge.Node{Name: name, Dir: dir, Socket: filepath.Join(dir, "myco.sock")}
+		if hasPID {
+			parsed, err := strconv.Atoi(pid)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("node %q: PID %q is not a process id", name, pid)
+			}
+			n.PID = parsed
+		}
+		nodes = append(nodes, n)
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("no nodes")
+	}
+	return nodes, nil
+}
+
+// diffState snapshots every node's state dir and diffs the records,
+// printing the nodes whose state could not be read.
+func diffState(nodes []converge.Node) []converge.Divergence {
+	snaps := make([]converge.Snapshot, len(nodes))
+	for i, n := range nodes {
+		snaps[i] = converge.TakeSnapshot(n)
+		if snaps[i].Error != "" {
+			fmt.Printf("  %s: state not read: %s\n", n.Name, snaps[i].Error)
+		}
+	}
+	return converge.Diff(snaps)
+}
+
+func writeReport(path string, r converge.Report) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
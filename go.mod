@@ -2,7 +2,11 @@ module orchestrator-ci
 
 go 1.25.3
 
-require dagger.io/dagger v0.19.6
+require (
+	dagger.io/dagger v0.19.6
+	golang.org/x/crypto v0.42.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/99designs/gqlgen v0.17.81 // indirect